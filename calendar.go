@@ -99,6 +99,8 @@ func (tx *CalendarTx) Add(dates ...date.Date) error {
 	return nil
 }
 
+// Every night from start up to, but not including, stop must be listed. The
+// checkout day itself needn't be
 func (tx *CalendarTx) Available(start, stop date.Date) (bool, error) {
 	list, err := tx.List()
 	if err != nil {
@@ -114,10 +116,8 @@ func (tx *CalendarTx) Available(start, stop date.Date) (bool, error) {
 		return false
 	}
 
-	daysApart := start.DaysApart(stop)
-	for i := 0; i <= daysApart; i++ {
-		current := start.Add(i)
-		if !include(list, current) {
+	for _, night := range (stay{start, stop}).Nights() {
+		if !include(list, night) {
 			return false, unavailable
 		}
 	}
@@ -53,7 +53,9 @@ func TestCalendar(t *testing.T) {
 	}{
 		{date.New(2014, 1, 1), date.New(2014, 1, 1), true},
 		{date.New(2014, 1, 1), date.New(2014, 1, 2), true},
-		{date.New(2014, 1, 1), date.New(2014, 1, 3), false},
+		{date.New(2014, 1, 1), date.New(2014, 1, 3), true},
+		{date.New(2014, 1, 2), date.New(2014, 1, 3), true},
+		{date.New(2014, 1, 1), date.New(2014, 1, 4), false},
 		{date.New(2013, 12, 31), date.New(2014, 1, 2), false},
 	}
 	if err != nil {
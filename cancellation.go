@@ -0,0 +1,564 @@
+package booking
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Cancelling at least DaysBefore days ahead of checkin refunds Percent of
+// the price
+type refundTier struct {
+	DaysBefore int
+	Percent    int
+}
+
+// Terms for cancelling a rate. Tiers are ordered by DaysBefore, most notice
+// first, and the first one met applies. Each version of a rate plan keeps its
+// own copy, so bookings are cancelled on the terms they were made on, and
+// Version goes up when a plan changes the tiers of a policy it keeps the name
+// of, so cancellations say which terms they were under
+type cancellationPolicy struct {
+	Name    string
+	Version int
+	Tiers   refundTiers
+}
+
+var invalidPolicy = errors.New("invalid cancellation policy")
+
+func newCancellationPolicy(
+	name string,
+	version int,
+	tiers ...refundTier,
+) (cancellationPolicy, error) {
+	if name == "" || version < 1 {
+		return cancellationPolicy{}, invalidPolicy
+	}
+
+	for i, tier := range tiers {
+		if tier.DaysBefore < 0 || tier.Percent < 0 || tier.Percent > 100 {
+			return cancellationPolicy{}, invalidPolicy
+		}
+		if i > 0 && tier.DaysBefore >= tiers[i-1].DaysBefore {
+			return cancellationPolicy{}, invalidPolicy
+		}
+	}
+
+	return cancellationPolicy{Name: name, Version: version, Tiers: tiers}, nil
+}
+
+// Standard policies
+var (
+	flexible = cancellationPolicy{
+		Name:    "flexible",
+		Version: 1,
+		Tiers:   []refundTier{{1, 100}},
+	}
+	moderate = cancellationPolicy{
+		Name:    "moderate",
+		Version: 1,
+		Tiers:   []refundTier{{5, 100}, {0, 50}},
+	}
+	strict = cancellationPolicy{
+		Name:    "strict",
+		Version: 1,
+		Tiers:   []refundTier{{14, 100}, {7, 50}},
+	}
+	nonRefundable = cancellationPolicy{
+		Name:    "non-refundable",
+		Version: 1,
+	}
+)
+
+var allPolicies = []cancellationPolicy{
+	flexible,
+	moderate,
+	strict,
+	nonRefundable,
+}
+
+var policyNotFound = errors.New("no such cancellation policy")
+
+func policyNamed(name string) (cancellationPolicy, error) {
+	for _, policy := range allPolicies {
+		if policy.Name == name {
+			return policy, nil
+		}
+	}
+	return cancellationPolicy{}, policyNotFound
+}
+
+// Tiers as rate plans store them, most notice first, e.g. "5:100,0:50" for
+// 100% up to 5 days before and 50% after that
+type refundTiers []refundTier
+
+// Reads tiers as stored, or as given on the command line
+func parseRefundTiers(s string) (refundTiers, error) {
+	var tiers refundTiers
+	if strings.TrimSpace(s) == "" {
+		return tiers, nil
+	}
+	for _, term := range strings.Split(s, ",") {
+		var tier refundTier
+		_, err := fmt.Sscanf(
+			strings.TrimSpace(term),
+			"%d:%d",
+			&tier.DaysBefore,
+			&tier.Percent,
+		)
+		if err != nil {
+			return nil, invalidPolicy
+		}
+		tiers = append(tiers, tier)
+	}
+	return tiers, nil
+}
+
+func (t *refundTiers) Scan(src interface{}) error {
+	raw, ok := src.([]byte)
+	if !ok {
+		err := errors.New(
+			fmt.Sprintf("can't scan refundTiers from db: %#v", src),
+		)
+		glog.Error(err)
+		return err
+	}
+	tiers, err := parseRefundTiers(string(raw))
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	*t = tiers
+	return nil
+}
+
+func (t refundTiers) Value() (driver.Value, error) {
+	var terms []string
+	for _, tier := range t {
+		terms = append(terms, fmt.Sprintf("%d:%d", tier.DaysBefore, tier.Percent))
+	}
+	return driver.Value(strings.Join(terms, ",")), nil
+}
+
+// Whether two policies have the same tiers
+func (p cancellationPolicy) sameTiers(o cancellationPolicy) bool {
+	if len(p.Tiers) != len(o.Tiers) {
+		return false
+	}
+	for i := range p.Tiers {
+		if p.Tiers[i] != o.Tiers[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Share of the price refunded when cancelling at a moment, 0 to 100
+func (p cancellationPolicy) Percent(checkin time.Time, at time.Time) int {
+	daysBefore := int(math.Floor(checkin.Sub(at).Hours() / 24))
+	for _, tier := range p.Tiers {
+		if daysBefore >= tier.DaysBefore {
+			return tier.Percent
+		}
+	}
+	return 0
+}
+
+// Refunds round down to the cent
+func (p cancellationPolicy) Refund(
+	price amount,
+	checkin time.Time,
+	at time.Time,
+) amount {
+	return price * amount(p.Percent(checkin, at)) / 100
+}
+
+func (p cancellationPolicy) String() string {
+	if len(p.Tiers) == 0 {
+		return p.Name + ": non-refundable"
+	}
+
+	var terms []string
+	for _, tier := range p.Tiers {
+		terms = append(terms, fmt.Sprintf(
+			"%d%% refund up to %d days before check in",
+			tier.Percent,
+			tier.DaysBefore,
+		))
+	}
+	return p.Name + ": " + strings.Join(terms, ", ")
+}
+
+// What was refunded for a cancellation, and under which terms
+const RegisterCancellationSchema = `
+  CREATE TABLE RegisterCancellation (
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    CancelledAt DATETIME NOT NULL,
+    Policy TEXT NOT NULL,
+    PolicyVersion INTEGER NOT NULL,
+    Refund INTEGER NOT NULL
+  )
+`
+
+var registerCancellationMigration = statements(
+	`CREATE TABLE RegisterCancellation (
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    CancelledAt DATETIME NOT NULL,
+    Policy TEXT NOT NULL,
+    PolicyVersion INTEGER NOT NULL,
+    Refund INTEGER NOT NULL
+  )`,
+)
+
+// A row in RegisterCancellation
+type cancellation struct {
+	BookingId     bookingId
+	CancelledAt   time.Time
+	Policy        string
+	PolicyVersion int
+	Refund        amount
+}
+
+var notCancelled = errors.New("booking has not been cancelled")
+
+// What the guest would get back for cancelling at a given moment, which is
+// no more than they've paid
+func (r *Register) Refundable(id bookingId, at time.Time) (amount, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	b, err := lookupBooking(tx, id)
+	if err != nil {
+		return 0, err
+	}
+	refund, _, err := r.refundableTx(tx, b, at)
+	return refund, err
+}
+
+// What goes back to the guest's cards when cancelling at a moment: whatever
+// they've paid beyond what the policy keeps of the quote the booking was made
+// on. Alongside it, the unpaid balance, which is waived
+func (r *Register) refundableTx(
+	tx *sql.Tx,
+	b booking,
+	at time.Time,
+) (amount, amount, error) {
+	if b.Status != confirmed {
+		return 0, 0, nil
+	}
+
+	q, err := r.Pricing.LookupTx(tx, b.Id)
+	if err != nil {
+		return 0, 0, err
+	}
+	paid, err := paidTx(tx, b.Id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	kept := q.Total() - b.Rate.Policy.Refund(q.Total(), b.Checkin.Time(), at)
+	refund := paid - kept
+	if refund < 0 {
+		refund = 0
+	}
+	unpaid := q.Total() - paid
+	if unpaid < 0 {
+		unpaid = 0
+	}
+	return refund, unpaid, nil
+}
+
+// Sum of what's left of a booking's payments
+func paidTx(tx *sql.Tx, id bookingId) (amount, error) {
+	payments, err := paymentsTx(tx, id)
+	if err != nil {
+		return 0, err
+	}
+	var paid amount
+	for _, p := range payments {
+		paid += p.Refundable()
+	}
+	return paid, nil
+}
+
+// Cancel and refund according to the rate's policy
+func (r *Register) Cancel(id bookingId, by actor) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = r.CancelTx(tx, id, by)
+	if err != nil {
+		tx.Rollback()
+		glog.Error(err)
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// Cancels a booking, waiving any unpaid balance, and gives back to the
+// guest's cards what they paid beyond what the policy keeps, newest payment
+// first. Once the gateway has refunded there's no taking it back, so if the
+// caller rolls back the refunds are logged for someone to record by hand -
+// caller is responsible for Commit/Rollback
+func (r *Register) CancelTx(tx *sql.Tx, id bookingId, by actor) error {
+	b, err := lookupBooking(tx, id)
+	if err != nil {
+		return err
+	}
+
+	now := r.Clock.Now()
+	refund, unpaid, err := r.refundableTx(tx, b, now)
+	if err != nil {
+		return err
+	}
+
+	err = r.transitionTx(tx, id, cancelled, by)
+	if err != nil {
+		return err
+	}
+
+	// the balance won't be wanted
+	err = moveScheduledTx(tx, id, scheduled, abandoned)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+      insert into RegisterCancellation
+      (BookingId, CancelledAt, Policy, PolicyVersion, Refund)
+      values ($1, $2, $3, $4, $5)
+    `,
+		id,
+		now,
+		b.Rate.Policy.Name,
+		b.Rate.Policy.Version,
+		refund,
+	)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	if unpaid > 0 {
+		err = r.Ledger.PostTx(tx, guestEntry(b.GuestId, id, -unpaid, refunds, memo(fmt.Sprintf(
+			"%s unpaid balance waived",
+			id,
+		))))
+		if err != nil {
+			return err
+		}
+	}
+	if refund == 0 {
+		return nil
+	}
+
+	err = r.Ledger.RefundTx(tx, b.GuestId, id, refund, memo(fmt.Sprintf(
+		"refund %s under %s policy v%d",
+		id,
+		b.Rate.Policy.Name,
+		b.Rate.Policy.Version,
+	)))
+	if err != nil {
+		return err
+	}
+	payments, err := paymentsTx(tx, id)
+	if err != nil {
+		return err
+	}
+	owed := refund
+	for i := len(payments) - 1; i >= 0 && owed > 0; i-- {
+		a := payments[i].Refundable()
+		if a > owed {
+			a = owed
+		}
+		if a == 0 {
+			continue
+		}
+		_, err := r.Ledger.RefundPaymentTx(
+			tx,
+			payments[i].Id,
+			a,
+			refundMemo(id, fmt.Sprintf("cancelled under %s policy", b.Rate.Policy.Name)),
+		)
+		if err != nil {
+			return err
+		}
+		owed -= a
+	}
+
+	return nil
+}
+
+// Undo a mistaken cancellation, provided nobody has taken the nights since.
+// Any refund is charged back, and any balance waived is owed again
+func (r *Register) Reinstate(id bookingId, by actor) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = r.ReinstateTx(tx, id, by)
+	if err != nil {
+		tx.Rollback()
+		glog.Error(err)
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// Charges the refund back to the card the booking was last paid with. If
+// that card has been forgotten the refund is owed again instead, with the
+// rest of the unpaid balance. If the caller rolls back it should Unwind the
+// payment, which is logged - caller is responsible for Commit/Rollback
+func (r *Register) ReinstateTx(tx *sql.Tx, id bookingId, by actor) error {
+	c, err := lookupCancellation(tx, id)
+	if err != nil {
+		return err
+	}
+
+	err = r.TransitionTx(tx, id, confirmed, by)
+	if err != nil {
+		return err
+	}
+
+	// the balance is wanted again, unless collecting it is what failed
+	err = moveScheduledTx(tx, id, abandoned, scheduled)
+	if err != nil {
+		return err
+	}
+
+	b, err := lookupBooking(tx, id)
+	if err != nil {
+		return err
+	}
+	if c.Refund > 0 {
+		payments, err := paymentsTx(tx, id)
+		if err != nil {
+			return err
+		}
+		var card cardToken
+		for _, p := range payments {
+			if p.Card != "" {
+				card = p.Card
+			}
+		}
+		err = r.chargeBackTx(tx, b, c.Refund, card)
+		if err != nil {
+			return err
+		}
+	}
+
+	q, err := r.Pricing.LookupTx(tx, id)
+	if err != nil {
+		return err
+	}
+	paid, err := paidTx(tx, id)
+	if err != nil {
+		return err
+	}
+	if unpaid := q.Total() - paid; unpaid > 0 {
+		err = r.Ledger.PostTx(tx, guestEntry(b.GuestId, id, unpaid, refunds, memo(fmt.Sprintf(
+			"reinstated %s unpaid balance",
+			id,
+		))))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Takes back a cancellation's refund from the card, unless it's gone
+func (r *Register) chargeBackTx(
+	tx *sql.Tx,
+	b booking,
+	refund amount,
+	card cardToken,
+) error {
+	if card == "" {
+		return nil
+	}
+	_, err := r.Ledger.ChargeTx(
+		tx,
+		b.GuestId,
+		b.Id,
+		refund,
+		card,
+		memo(fmt.Sprintf("%s refund charged back to card", b.Id)),
+	)
+	if err == cardTokenNotFound {
+		glog.Infoln("card for", b.Id, "forgotten, refund owed instead")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return r.Ledger.ReverseRefundTx(tx, b.GuestId, b.Id, refund, memo(fmt.Sprintf(
+		"reinstated %s",
+		b.Id,
+	)))
+}
+
+// The most recent cancellation of a booking
+func (r *Register) Cancellation(id bookingId) (cancellation, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return cancellation{}, err
+	}
+	defer tx.Rollback()
+
+	return lookupCancellation(tx, id)
+}
+
+func lookupCancellation(tx *sql.Tx, id bookingId) (cancellation, error) {
+	var c cancellation
+	err := tx.QueryRow(`
+    select BookingId, CancelledAt, Policy, PolicyVersion, Refund
+    from RegisterCancellation
+    where BookingId = $1
+    order by rowid desc
+    limit 1
+  `, id).Scan(
+		&c.BookingId,
+		&c.CancelledAt,
+		&c.Policy,
+		&c.PolicyVersion,
+		&c.Refund,
+	)
+	if err == sql.ErrNoRows {
+		return cancellation{}, notCancelled
+	}
+	if err != nil {
+		glog.Error(err)
+		return cancellation{}, err
+	}
+
+	c.CancelledAt = c.CancelledAt.UTC()
+	return c, nil
+}
@@ -0,0 +1,318 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestCancellationPolicyRefund(t *testing.T) {
+	custom, err := newCancellationPolicy(
+		"custom",
+		1,
+		refundTier{30, 100},
+		refundTier{7, 50},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkin := date.New(2015, 6, 1).Time()
+	price := amount(99999)
+	var tests = []struct {
+		policy cancellationPolicy
+		at     time.Time
+		refund amount
+	}{
+		{flexible, checkin.Add(-48 * time.Hour), price},
+		{flexible, checkin.Add(-24 * time.Hour), price},
+		{flexible, checkin.Add(-23 * time.Hour), 0},
+		{moderate, checkin.Add(-5 * 24 * time.Hour), price},
+		{moderate, checkin.Add(-4 * 24 * time.Hour), amount(49999)},
+		{moderate, checkin.Add(-time.Minute), amount(49999)},
+		{moderate, checkin.Add(time.Minute), 0},
+		{strict, checkin.Add(-14 * 24 * time.Hour), price},
+		{strict, checkin.Add(-10 * 24 * time.Hour), amount(49999)},
+		{strict, checkin.Add(-6 * 24 * time.Hour), 0},
+		{nonRefundable, checkin.Add(-365 * 24 * time.Hour), 0},
+		{custom, checkin.Add(-30 * 24 * time.Hour), price},
+		{custom, checkin.Add(-29 * 24 * time.Hour), amount(49999)},
+		{custom, checkin.Add(-6 * 24 * time.Hour), 0},
+	}
+
+	for _, tt := range tests {
+		if refund := tt.policy.Refund(price, checkin, tt.at); refund != tt.refund {
+			t.Log(tt.policy, tt.at)
+			t.Error("want", tt.refund)
+			t.Error("got ", refund)
+		}
+	}
+}
+
+func TestNewCancellationPolicy(t *testing.T) {
+	var tests = []struct {
+		name    string
+		version int
+		tiers   []refundTier
+		err     error
+	}{
+		{"ok", 1, []refundTier{{30, 100}, {7, 50}}, nil},
+		{"ok", 2, nil, nil},
+		{"", 1, nil, invalidPolicy},
+		{"no version", 0, nil, invalidPolicy},
+		{"unordered", 1, []refundTier{{7, 50}, {30, 100}}, invalidPolicy},
+		{"repeated", 1, []refundTier{{7, 100}, {7, 50}}, invalidPolicy},
+		{"too much", 1, []refundTier{{7, 150}}, invalidPolicy},
+		{"negative", 1, []refundTier{{-1, 50}}, invalidPolicy},
+	}
+
+	for _, tt := range tests {
+		_, err := newCancellationPolicy(tt.name, tt.version, tt.tiers...)
+		if err != tt.err {
+			t.Log(tt.name, tt.tiers)
+			t.Error("want", tt.err)
+			t.Error("got ", err)
+		}
+	}
+}
+
+// Owes the guest the quote the booking was made on, as a submitted form does
+func testPostQuote(t *testing.T, register *Register, guest guestId, id bookingId) {
+	q, err := register.Pricing.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := register.DB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = register.Ledger.PostQuoteTx(tx, guest, id, q)
+	if err != nil {
+		tx.Rollback()
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRegisterCancelRefund(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var ledger Ledger
+	var register Register
+	gateway := &FakeGateway{}
+	err := inject.Populate(gateway, &calendar, &clock, db, &ledger, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		calendar.Add(date.New(2015, 1, 1).Add(i))
+	}
+
+	guest := guestId(1)
+	id, err := register.Book(
+		date.New(2015, 1, 5),
+		date.New(2015, 1, 7),
+		guest,
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// paid in full
+	testPostQuote(t, &register, guest, id)
+	card := testCard(t, gateway, fakeCardApproved)
+	_, err = ledger.Charge(guest, id, amount(40000), card, memo("bookingId:1 paid by card"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// moderate: half of 2 nights within 5 days of checkin
+	now := time.Date(2015, 1, 2, 12, 0, 0, 0, time.UTC)
+	clock.Set(now)
+	refund, err := register.Refundable(id, now)
+	if err != nil {
+		t.Error(err)
+	}
+	if refund != amount(20000) {
+		t.Error("want", amount(20000))
+		t.Error("got ", refund)
+	}
+
+	// full refund with more notice
+	refund, err = register.Refundable(id, now.Add(-7*24*time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+	if refund != amount(40000) {
+		t.Error("want", amount(40000))
+		t.Error("got ", refund)
+	}
+
+	// Cancellation() -> notCancelled
+	_, err = register.Cancellation(id)
+	if err != notCancelled {
+		t.Error("want", notCancelled)
+		t.Error("got ", err)
+	}
+
+	// Cancel() -> refunded to the card, policy recorded
+	err = register.Cancel(id, actor("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	balance, err := ledger.Balance(guest)
+	if err != nil {
+		t.Error(err)
+	}
+	if balance != 0 {
+		t.Error("want 0")
+		t.Error("got ", balance)
+	}
+	payments, err := ledger.Payments(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].Refunded != amount(20000) {
+		t.Error("want", amount(20000), "refunded")
+		t.Error("got ", payments)
+	}
+
+	c, err := register.Cancellation(id)
+	if err != nil {
+		t.Error(err)
+	}
+	want := cancellation{
+		BookingId:     id,
+		CancelledAt:   now,
+		Policy:        "moderate",
+		PolicyVersion: 1,
+		Refund:        amount(20000),
+	}
+	if !reflect.DeepEqual(want, c) {
+		t.Error("want", want)
+		t.Error("got ", c)
+	}
+
+	// nothing more to refund once cancelled
+	refund, err = register.Refundable(id, now)
+	if err != nil {
+		t.Error(err)
+	}
+	if refund != 0 {
+		t.Error("want 0")
+		t.Error("got ", refund)
+	}
+
+	// Reinstate() -> refund charged back to the card
+	err = register.Reinstate(id, actor("admin"))
+	if err != nil {
+		t.Error(err)
+	}
+	balance, err = ledger.Balance(guest)
+	if err != nil {
+		t.Error(err)
+	}
+	if balance != 0 {
+		t.Error("want 0")
+		t.Error("got ", balance)
+	}
+	payments, _ = ledger.Payments(id)
+	if len(payments) != 2 || payments[1].Amount != amount(20000) || payments[1].Card != card {
+		t.Error("want", amount(20000), "charged to", card)
+		t.Error("got ", payments)
+	}
+	testBooksBalance(t, db)
+}
+
+func TestRegisterCancelDeposit(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var ledger Ledger
+	var rates Rates
+	var register Register
+	gateway := &FakeGateway{}
+	err := inject.Populate(gateway, &calendar, &clock, db, &ledger, &rates, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	calendar.Add(date.New(2015, 1, 5), date.New(2015, 1, 6))
+	now := time.Date(2014, 12, 1, 12, 0, 0, 0, time.UTC)
+	clock.Set(now)
+
+	guest := guestId(1)
+	id, err := register.Book(
+		date.New(2015, 1, 5),
+		date.New(2015, 1, 7),
+		guest,
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the terms change after booking -> cancelled on the terms booked on
+	r, _ := rates.Current(withBunny.Id)
+	r.Policy.Tiers = refundTiers{}
+	_, err = rates.Update(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a 30% deposit paid, so only that can go back
+	testPostQuote(t, &register, guest, id)
+	card := testCard(t, gateway, fakeCardApproved)
+	_, err = ledger.Charge(guest, id, amount(12000), card, memo("bookingId:1 paid by card"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refund, err := register.Refundable(id, now)
+	if refund != amount(12000) || err != nil {
+		t.Error("want", amount(12000))
+		t.Error("got ", refund, err)
+	}
+
+	// Cancel() -> deposit refunded, the rest waived
+	err = register.Cancel(id, actor("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := register.Cancellation(id)
+	if c.Refund != amount(12000) || c.PolicyVersion != 1 {
+		t.Error("want", amount(12000), "under version", 1)
+		t.Error("got ", c.Refund, c.PolicyVersion)
+	}
+	if balance, _ := ledger.Balance(guest); balance != 0 {
+		t.Error("want 0")
+		t.Error("got ", balance)
+	}
+	if payments, _ := ledger.Payments(id); payments[0].Refundable() != 0 {
+		t.Error("want the deposit refunded")
+		t.Error("got ", payments)
+	}
+
+	// Reinstate() with the card forgotten -> all of it owed again
+	gateway.Forget(card)
+	err = register.Reinstate(id, actor("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance, _ := ledger.Balance(guest); balance != amount(40000) {
+		t.Error("want", amount(40000))
+		t.Error("got ", balance)
+	}
+	testBooksBalance(t, db)
+}
@@ -0,0 +1,192 @@
+package booking
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A payment card as entered on the form. Number is the digits alone, Year
+// has four digits. It prints masked to the last four digits, so it can't
+// end up in a log
+type creditCard struct {
+	Brand  cardBrand
+	CVC    string
+	Month  int
+	Number string
+	Year   int
+}
+
+func (c creditCard) String() string {
+	return fmt.Sprintf("%s %s", c.Brand, maskCardNumber(c.Number))
+}
+
+func (c creditCard) GoString() string {
+	return fmt.Sprintf("creditCard{%s}", c)
+}
+
+// Last four digits only
+func maskCardNumber(number string) string {
+	if len(number) < 4 {
+		return "****"
+	}
+	return "**** " + number[len(number)-4:]
+}
+
+// Card network, which decides how long numbers and security codes are
+type cardBrand string
+
+const (
+	visa       = cardBrand("Visa")
+	mastercard = cardBrand("Mastercard")
+	amex       = cardBrand("American Express")
+	discover   = cardBrand("Discover")
+	dinersClub = cardBrand("Diners Club")
+	jcb        = cardBrand("JCB")
+)
+
+// Issuer identification number ranges, both included, compared on the
+// first len(From) digits of a card number
+type iinRange struct {
+	From, To string
+	Brand    cardBrand
+}
+
+// See: https://en.wikipedia.org/wiki/Payment_card_number
+var iinRanges = []iinRange{
+	{"4", "4", visa},
+	{"51", "55", mastercard},
+	{"2221", "2720", mastercard},
+	{"34", "34", amex},
+	{"37", "37", amex},
+	{"6011", "6011", discover},
+	{"644", "649", discover},
+	{"65", "65", discover},
+	{"300", "305", dinersClub},
+	{"36", "36", dinersClub},
+	{"38", "39", dinersClub},
+	{"3528", "3589", jcb},
+}
+
+// Lengths of card number and security code by brand
+var cardRules = map[cardBrand]struct {
+	Lengths []int
+	CVC     int
+}{
+	visa:       {[]int{13, 16, 19}, 3},
+	mastercard: {[]int{16}, 3},
+	amex:       {[]int{15}, 4},
+	discover:   {[]int{16, 19}, 3},
+	dinersClub: {[]int{14, 16, 19}, 3},
+	jcb:        {[]int{16, 17, 18, 19}, 3},
+}
+
+// Field errors, read after the field name, e.g. "CardNumber has a typo"
+var (
+	cardNumberInvalid = errors.New("isn't a card number")
+	cardNumberTypo    = errors.New("has a typo")
+	cardBrandUnknown  = errors.New("isn't a card we accept")
+	cardNumberLength  = errors.New("has the wrong number of digits")
+	cardMonthInvalid  = errors.New("must be 1 to 12")
+	cardYearInvalid   = errors.New("must be a year, e.g. 2027 or 27")
+	cardExpired       = errors.New("has passed")
+	cardCVCInvalid    = errors.New("must be 3 digits, or 4 on American Express")
+)
+
+// Reads a card number, ignoring spaces and dashes, and works out its brand
+func parseCardNumber(s string) (string, cardBrand, error) {
+	number := strings.NewReplacer(" ", "", "-", "").Replace(s)
+	if number == "" || strings.Trim(number, "0123456789") != "" {
+		return "", "", cardNumberInvalid
+	}
+	if !luhn(number) {
+		return "", "", cardNumberTypo
+	}
+
+	brand := brandOf(number)
+	rules, ok := cardRules[brand]
+	if !ok {
+		return "", "", cardBrandUnknown
+	}
+	for _, l := range rules.Lengths {
+		if len(number) == l {
+			return number, brand, nil
+		}
+	}
+	return "", "", cardNumberLength
+}
+
+// Whether the last digit is the right check digit for the rest
+func luhn(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return len(number) > 1 && sum%10 == 0
+}
+
+func brandOf(number string) cardBrand {
+	for _, r := range iinRanges {
+		if len(number) < len(r.From) {
+			continue
+		}
+		prefix := number[:len(r.From)]
+		if prefix >= r.From && prefix <= r.To {
+			return r.Brand
+		}
+	}
+	return ""
+}
+
+func parseCardMonth(s string) (int, error) {
+	month, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || month < 1 || month > 12 {
+		return 0, cardMonthInvalid
+	}
+	return month, nil
+}
+
+// Two digit years are this century
+func parseCardYear(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	year, err := strconv.Atoi(s)
+	if err != nil || year < 0 {
+		return 0, cardYearInvalid
+	}
+	switch len(s) {
+	case 2:
+		return 2000 + year, nil
+	case 4:
+		return year, nil
+	}
+	return 0, cardYearInvalid
+}
+
+// Cards work until the end of their expiry month
+func cardExpiredAt(month, year int, now time.Time) bool {
+	return year < now.Year() ||
+		year == now.Year() && time.Month(month) < now.Month()
+}
+
+func parseCardCVC(s string, brand cardBrand) (string, error) {
+	s = strings.TrimSpace(s)
+	want := 3
+	if rules, ok := cardRules[brand]; ok {
+		want = rules.CVC
+	}
+	if len(s) != want || strings.Trim(s, "0123456789") != "" {
+		return "", cardCVCInvalid
+	}
+	return s, nil
+}
@@ -0,0 +1,140 @@
+package booking
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCardNumber(t *testing.T) {
+	var tests = []struct {
+		s      string
+		number string
+		brand  cardBrand
+		err    error
+	}{
+		{"4242424242424242", "4242424242424242", visa, nil},
+		{"4242 4242 4242 4242", "4242424242424242", visa, nil},
+		{"4222222222222", "4222222222222", visa, nil},
+		{"5555-5555-5555-4444", "5555555555554444", mastercard, nil},
+		{"2223003122003222", "2223003122003222", mastercard, nil},
+		{"378282246310005", "378282246310005", amex, nil},
+		{"6011111111111117", "6011111111111117", discover, nil},
+		{"30569309025904", "30569309025904", dinersClub, nil},
+		{"38520000023237", "38520000023237", dinersClub, nil},
+		{"3530111333300000", "3530111333300000", jcb, nil},
+		{"", "", "", cardNumberInvalid},
+		{"4242x4242", "", "", cardNumberInvalid},
+		{"4242424242424241", "", "", cardNumberTypo},
+		{"1111222233334444", "", "", cardBrandUnknown},
+		{"3782822463100003", "", "", cardNumberLength},
+		{"424242424242424242", "", "", cardNumberLength},
+	}
+	for _, test := range tests {
+		number, brand, err := parseCardNumber(test.s)
+		if number != test.number || brand != test.brand || err != test.err {
+			t.Error(test.s, "want", test.number, test.brand, test.err)
+			t.Error(test.s, "got ", number, brand, err)
+		}
+	}
+}
+
+func TestParseCardExpiry(t *testing.T) {
+	var months = []struct {
+		s     string
+		month int
+		err   error
+	}{
+		{"1", 1, nil},
+		{"09", 9, nil},
+		{"12", 12, nil},
+		{"0", 0, cardMonthInvalid},
+		{"13", 0, cardMonthInvalid},
+		{"jan", 0, cardMonthInvalid},
+	}
+	for _, test := range months {
+		month, err := parseCardMonth(test.s)
+		if month != test.month || err != test.err {
+			t.Error(test.s, "want", test.month, test.err)
+			t.Error(test.s, "got ", month, err)
+		}
+	}
+
+	var years = []struct {
+		s    string
+		year int
+		err  error
+	}{
+		{"27", 2027, nil},
+		{"05", 2005, nil},
+		{"2027", 2027, nil},
+		{"7", 0, cardYearInvalid},
+		{"207", 0, cardYearInvalid},
+		{"-27", 0, cardYearInvalid},
+	}
+	for _, test := range years {
+		year, err := parseCardYear(test.s)
+		if year != test.year || err != test.err {
+			t.Error(test.s, "want", test.year, test.err)
+			t.Error(test.s, "got ", year, err)
+		}
+	}
+
+	now := time.Date(2015, 6, 30, 23, 0, 0, 0, time.UTC)
+	var expiries = []struct {
+		month, year int
+		expired     bool
+	}{
+		{6, 2015, false},
+		{7, 2015, false},
+		{1, 2016, false},
+		{5, 2015, true},
+		{12, 2014, true},
+	}
+	for _, test := range expiries {
+		if got := cardExpiredAt(test.month, test.year, now); got != test.expired {
+			t.Error(test.month, test.year, "want", test.expired)
+			t.Error(test.month, test.year, "got ", got)
+		}
+	}
+}
+
+func TestParseCardCVC(t *testing.T) {
+	var tests = []struct {
+		s     string
+		brand cardBrand
+		cvc   string
+		err   error
+	}{
+		{"123", visa, "123", nil},
+		{"012", mastercard, "012", nil},
+		{"1234", amex, "1234", nil},
+		{"123", amex, "", cardCVCInvalid},
+		{"1234", visa, "", cardCVCInvalid},
+		{"12a", visa, "", cardCVCInvalid},
+	}
+	for _, test := range tests {
+		cvc, err := parseCardCVC(test.s, test.brand)
+		if cvc != test.cvc || err != test.err {
+			t.Error(test.s, test.brand, "want", test.cvc, test.err)
+			t.Error(test.s, test.brand, "got ", cvc, err)
+		}
+	}
+}
+
+func TestCreditCardMasked(t *testing.T) {
+	card := creditCard{Brand: visa, CVC: "321", Month: 12, Number: fakeCardApproved, Year: 2099}
+	want := "Visa **** 4242"
+	if got := card.String(); got != want {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s"} {
+		s := fmt.Sprintf(format, card)
+		if strings.Contains(s, card.Number) || strings.Contains(s, card.CVC) {
+			t.Error(format, "want masked")
+			t.Error(format, "got ", s)
+		}
+	}
+}
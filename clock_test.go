@@ -0,0 +1,32 @@
+package booking
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClock(t *testing.T) {
+	var clock Clock
+
+	// zero value -> system time
+	before := time.Now()
+	if now := clock.Now(); now.Before(before) {
+		t.Error("want after", before)
+		t.Error("got ", now)
+	}
+
+	// Set() -> stopped
+	at := time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)
+	clock.Set(at)
+	if now := clock.Now(); !now.Equal(at) {
+		t.Error("want", at)
+		t.Error("got ", now)
+	}
+
+	// Advance() -> moved
+	clock.Advance(time.Hour)
+	if now := clock.Now(); !now.Equal(at.Add(time.Hour)) {
+		t.Error("want", at.Add(time.Hour))
+		t.Error("got ", now)
+	}
+}
@@ -15,7 +15,33 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+var flagDB = flag.String("db", ":memory:", "sqlite database file")
 var flagHttp = flag.String("http", ":3000", "http port")
+var flagIdempotencyWindow = flag.Duration(
+	"idempotency-window",
+	booking.DefaultIdempotencyWindow,
+	"how long a repeated form submission returns the original booking",
+)
+var flagCurrency = flag.String(
+	"currency",
+	"USD",
+	"ISO 4217 code of the currency rates are set and the books kept in",
+)
+var flagDamageDeposit = flag.String(
+	"damage-deposit",
+	"0",
+	"damage deposit held on the guest's card over each stay, e.g. 250.00",
+)
+var flagDamageHoldDays = flag.Int(
+	"damage-hold-days",
+	booking.DefaultDamageHoldDaysBefore,
+	"days before check in a damage deposit is held",
+)
+var flagDamageReleaseDays = flag.Int(
+	"damage-release-days",
+	booking.DefaultDamageReleaseDaysAfter,
+	"days after check out an unclaimed damage deposit is released",
+)
 
 func main() {
 	flag.Set("stderrthreshold", "ERROR")
@@ -23,18 +49,31 @@ func main() {
 	flag.Parse()
 
 	// Database
-	db, err := sql.Open("sqlite3", ":memory:")
+	db, err := sql.Open("sqlite3", *flagDB)
 	if err != nil {
 		panic(err)
 	}
 	defer db.Close()
 
+	// Every connection to :memory: is a separate database, so share one
+	db.SetMaxOpenConns(1)
+
 	// Domain
 	var calendar booking.Calendar
+	var cards booking.Cards
+	var collector booking.Collector
+	var damage booking.DamageDeposits
 	var formBuilder booking.FormBuilder
+	var gateway booking.FakeGateway
 	var guestbook booking.Guestbook
 	var handler booking.Handler
+	var idempotency booking.Idempotency
+	var invoices booking.Invoices
 	var ledger booking.Ledger
+	var notifier booking.LogNotifier
+	var pricing booking.Pricing
+	var property booking.Property
+	var rates booking.Rates
 	var register booking.Register
 	var schema booking.Schema
 
@@ -42,11 +81,21 @@ func main() {
 	var g inject.Graph
 	err = g.Provide(
 		&inject.Object{Value: &calendar},
+		&inject.Object{Value: &cards},
+		&inject.Object{Value: &collector},
+		&inject.Object{Value: &damage},
 		&inject.Object{Value: db},
 		&inject.Object{Value: &formBuilder},
+		&inject.Object{Value: &gateway},
 		&inject.Object{Value: &guestbook},
 		&inject.Object{Value: &handler},
+		&inject.Object{Value: &idempotency},
+		&inject.Object{Value: &invoices},
 		&inject.Object{Value: &ledger},
+		&inject.Object{Value: &notifier},
+		&inject.Object{Value: &pricing},
+		&inject.Object{Value: &property},
+		&inject.Object{Value: &rates},
 		&inject.Object{Value: &register},
 		&inject.Object{Value: &schema},
 	)
@@ -59,18 +108,119 @@ func main() {
 		os.Exit(1)
 	}
 
-	// Load schema
-	err = schema.Load()
+	idempotency.Window = *flagIdempotencyWindow
+	err = property.SetCurrency(*flagCurrency)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	err = damage.SetAmount(*flagDamageDeposit)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	damage.HoldDaysBefore = *flagDamageHoldDays
+	damage.ReleaseDaysAfter = *flagDamageReleaseDays
+
+	// Load or migrate schema
+	err = schema.Setup()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Seed rates
+	err = rates.Seed()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	// Commands
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "damage":
+			err = booking.DamageCommand(
+				&damage,
+				&register,
+				flag.Args()[1:],
+				os.Stdout,
+			)
+		case "invoices":
+			err = booking.InvoicesCommand(
+				&invoices,
+				&register,
+				flag.Args()[1:],
+				os.Stdout,
+			)
+		case "prices":
+			err = booking.PricesCommand(
+				&pricing,
+				&rates,
+				flag.Args()[1:],
+				os.Stdout,
+			)
+		case "promos":
+			err = booking.PromosCommand(
+				&pricing,
+				&rates,
+				flag.Args()[1:],
+				os.Stdout,
+			)
+		case "refunds":
+			err = booking.RefundsCommand(
+				&ledger,
+				&register,
+				flag.Args()[1:],
+				os.Stdout,
+			)
+		case "rates":
+			err = booking.RatesCommand(&rates, flag.Args()[1:], os.Stdout)
+		case "statements":
+			err = booking.StatementsCommand(&ledger, flag.Args()[1:], os.Stdout)
+		default:
+			err = fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Seed dates
 	today, _ := date.Parse(time.Now())
 	calendar.Add(today)
 	calendar.Add(today.Add(1))
 
+	// The fake gateway's vault starts empty, so give up on what's left to
+	// take from cards it held before a restart. Only the server does this, as
+	// commands run alongside it with vaults of their own
+	_, err = cards.FailLost()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Release abandoned holds
+	go register.ReapHolds(time.Minute, nil)
+
+	// Charge balances as they fall due
+	go collector.Collect(time.Hour, nil)
+
+	// Hold and release damage deposits
+	go damage.Run(time.Hour, nil)
+
+	// Forget cards nothing will charge
+	go cards.Reap(time.Hour, nil)
+
+	// Forget expired idempotency keys
+	go func() {
+		for range time.Tick(time.Hour) {
+			idempotency.ReleaseExpired()
+		}
+	}()
+
 	// Start
 	glog.Infoln("listening on", *flagHttp)
 	glog.Fatal(http.ListenAndServe(*flagHttp, &handler))
@@ -0,0 +1,234 @@
+package booking
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Charges balances as they fall due. A failed charge is retried and the
+// guest told, and once the attempts run out the booking is cancelled under
+// its policy
+type Collector struct {
+	Clock    *Clock    `inject:""`
+	DB       *sql.DB   `inject:""`
+	Ledger   *Ledger   `inject:""`
+	Notifier Notifier  `inject:""`
+	Register *Register `inject:""`
+}
+
+const (
+	// Tries at a balance before cancelling
+	collectionAttempts = 3
+
+	// Wait between tries
+	collectionRetry = 24 * time.Hour
+)
+
+// Who cancels a booking that couldn't be paid for
+const collectorActor = actor("system")
+
+// Tries every balance that's due, returning how many were collected
+func (c *Collector) CollectDue() (int, error) {
+	rows, err := c.DB.Query(
+		scheduledPaymentSelect+`where Status = $1 and NextAttemptAt <= $2
+    order by NextAttemptAt asc`,
+		scheduled,
+		c.Clock.Now().UTC(),
+	)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	var due []scheduledPayment
+	for rows.Next() {
+		s, err := scanScheduledPayment(rows)
+		if err != nil {
+			rows.Close()
+			glog.Error(err)
+			return 0, err
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// one failing doesn't hold up the rest
+	n := 0
+	for _, s := range due {
+		ok, err := c.collect(s)
+		if err != nil {
+			glog.Error("couldn't collect ", s.BookingId, ": ", err)
+			continue
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Charges what's left of a booking, in its own transaction. The guest is
+// told how it went once it's committed
+func (c *Collector) collect(s scheduledPayment) (bool, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	b, err := lookupBooking(tx, s.BookingId)
+	if err != nil {
+		return false, err
+	}
+	if b.Status != confirmed {
+		s.Status = abandoned
+		err = updateScheduledTx(tx, s)
+		if err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+
+	q, err := c.Register.Pricing.LookupTx(tx, b.Id)
+	if err != nil {
+		return false, err
+	}
+	captured, err := capturedTx(tx, b.Id)
+	if err != nil {
+		return false, err
+	}
+	balance := q.Total() - captured
+	if balance <= 0 {
+		s.Status = collected
+		err = updateScheduledTx(tx, s)
+		if err != nil {
+			return false, err
+		}
+		return true, tx.Commit()
+	}
+
+	g, err := (&GuestbookTx{tx}).Lookup(b.GuestId)
+	if err != nil {
+		return false, err
+	}
+
+	p, chargeErr := c.Ledger.ChargeTx(
+		tx,
+		b.GuestId,
+		b.Id,
+		balance,
+		s.Card,
+		memo(fmt.Sprintf("%s balance paid by card", b.Id)),
+	)
+	if chargeErr == nil {
+		s.Status = collected
+		s.PaymentId = p.Id
+		err = updateScheduledTx(tx, s)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			c.Ledger.Unwind(p)
+			return false, err
+		}
+		c.notify(g, fmt.Sprintf("Booking %s: balance paid", b.Code), fmt.Sprintf(
+			"We've charged the balance of %s to your card.",
+			q.Money(balance),
+		))
+		return true, nil
+	}
+
+	s.Attempts++
+	s.Error = chargeErr.Error()
+	if s.Attempts < collectionAttempts {
+		s.NextAttemptAt = c.Clock.Now().Add(collectionRetry).UTC()
+		err = updateScheduledTx(tx, s)
+		if err != nil {
+			return false, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return false, err
+		}
+		c.notify(g, fmt.Sprintf("Booking %s: payment failed", b.Code), fmt.Sprintf(
+			"We couldn't charge the balance of %s to your card: %s. "+
+				"We'll try again on %s. If we still can't, your booking "+
+				"will be cancelled.",
+			q.Money(balance),
+			chargeErr,
+			s.NextAttemptAt.Format("January 2"),
+		))
+		return false, nil
+	}
+
+	// out of attempts
+	s.Status = uncollectable
+	err = updateScheduledTx(tx, s)
+	if err != nil {
+		return false, err
+	}
+	err = c.Register.CancelTx(tx, b.Id, collectorActor)
+	if err != nil {
+		return false, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	c.notify(g, fmt.Sprintf("Booking %s: cancelled", b.Code), fmt.Sprintf(
+		"We couldn't charge the balance of %s to your card: %s. "+
+			"Your booking has been cancelled under the %s policy.",
+		q.Money(balance),
+		chargeErr,
+		b.Rate.Policy.Name,
+	))
+	return false, nil
+}
+
+// Failing to tell the guest doesn't undo anything, it's only logged
+func (c *Collector) notify(to guest, subject string, body string) {
+	err := c.Notifier.Notify(to, subject, body)
+	if err != nil {
+		glog.Error("couldn't notify ", to.Id, ": ", err)
+	}
+}
+
+func updateScheduledTx(tx *sql.Tx, s scheduledPayment) error {
+	_, err := tx.Exec(`
+    update ScheduledPayment
+    set Attempts = $1, Error = $2, NextAttemptAt = $3, PaymentId = $4,
+      Status = $5
+    where BookingId = $6
+  `, s.Attempts, s.Error, s.NextAttemptAt, s.PaymentId, s.Status, s.BookingId)
+	if err != nil {
+		glog.Error(err)
+	}
+	return err
+}
+
+// Collect due balances every interval until stop is closed. Run it in its
+// own goroutine
+func (c *Collector) Collect(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := c.CollectDue()
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				glog.Infoln("collected", n, "balances")
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package booking
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestCollectorCollectDue(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var clock Clock
+	var collector Collector
+	var formBuilder FormBuilder
+	var gateway FakeGateway
+	var notifier LogNotifier
+	var rates Rates
+	var register Register
+	err := inject.Populate(
+		db,
+		&cal,
+		&clock,
+		&collector,
+		&formBuilder,
+		&gateway,
+		&notifier,
+		&rates,
+		&register,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2014, 11, 1, 12, 0, 0, 0, time.UTC))
+	cal.Add(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		date.New(2015, 1, 6),
+	)
+	_, err = rates.Create(
+		"Deposit",
+		"",
+		amount(20000),
+		flexible,
+		paymentSchedule{BalanceDaysBefore: 30, DepositPercent: 30},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Submit() -> deposit now, balance scheduled
+	book := func(checkin, checkout, email string) (bookingId, amount) {
+		vals := validFormValues()
+		vals.Set(fvCheckin, checkin)
+		vals.Set(fvCheckout, checkout)
+		vals.Set(fvEmail, email)
+		vals.Set(fvRate, "3")
+		form := formBuilder.Build()
+		id, ok := form.Submit(postForm(vals))
+		if !ok {
+			t.Fatal(form.Errors)
+		}
+		return id, form.Quote.Total()
+	}
+	paid, paidTotal := book("1/1/2015", "1/3/2015", "a@b")
+	unpaid, unpaidTotal := book("1/5/2015", "1/7/2015", "c@d")
+
+	payments, err := register.Ledger.Payments(paid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].Amount != paidTotal*30/100 {
+		t.Error("want a deposit of", paidTotal*30/100)
+		t.Error("got ", payments)
+	}
+	s, err := register.Ledger.Scheduled(paid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Amount != paidTotal-paidTotal*30/100 || s.DueOn != date.New(2014, 12, 2) {
+		t.Error("want", paidTotal-paidTotal*30/100, date.New(2014, 12, 2))
+		t.Error("got ", s.Amount, s.DueOn)
+	}
+
+	// the card on file for the other booking has since run dry
+	_, err = db.Exec(
+		`update ScheduledPayment set Card = $1 where BookingId = $2`,
+		testCard(t, &gateway, fakeCardInsufficientFunds),
+		unpaid,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var collect = func(want int) {
+		n, err := collector.CollectDue()
+		if err != nil {
+			t.Error(err)
+		}
+		if n != want {
+			t.Error("want", want, "collected")
+			t.Error("got ", n)
+		}
+	}
+	var subjects = func() []string {
+		var list []string
+		for _, n := range notifier.Sent() {
+			list = append(list, n.Subject)
+		}
+		return list
+	}
+
+	// nothing due yet
+	collect(0)
+
+	// CollectDue() -> balance charged
+	clock.Set(time.Date(2014, 12, 2, 0, 0, 0, 0, time.UTC))
+	collect(1)
+	s, _ = register.Ledger.Scheduled(paid)
+	if s.Status != collected || s.PaymentId == 0 {
+		t.Error("want", collected, "with a payment")
+		t.Error("got ", s.Status, s.PaymentId)
+	}
+	b, _ := register.Lookup(paid)
+	if balance, _ := register.Ledger.Balance(b.GuestId); balance != 0 {
+		t.Error("want", 0)
+		t.Error("got ", balance)
+	}
+	collect(0)
+
+	// CollectDue() -> declined, retried a day later, then cancelled
+	clock.Set(time.Date(2014, 12, 6, 0, 0, 0, 0, time.UTC))
+	for attempt := 1; attempt <= collectionAttempts; attempt++ {
+		collect(0)
+		s, _ = register.Ledger.Scheduled(unpaid)
+		if s.Attempts != attempt || s.Error != insufficientFunds.Error() {
+			t.Error("want attempt", attempt, insufficientFunds)
+			t.Error("got ", s.Attempts, s.Error)
+		}
+		collect(0)
+		clock.Advance(collectionRetry)
+	}
+	if s.Status != uncollectable {
+		t.Error("want", uncollectable)
+		t.Error("got ", s.Status)
+	}
+	b, _ = register.Lookup(unpaid)
+	if b.Status != cancelled {
+		t.Error("want", cancelled)
+		t.Error("got ", b.Status)
+	}
+
+	// flexible -> the deposit goes back to the card
+	payments, _ = register.Ledger.Payments(unpaid)
+	if len(payments) != 1 || payments[0].Refunded != unpaidTotal*30/100 {
+		t.Error("want the deposit refunded")
+		t.Error("got ", payments)
+	}
+	if balance, _ := register.Ledger.Balance(b.GuestId); balance != 0 {
+		t.Error("want", 0)
+		t.Error("got ", balance)
+	}
+
+	code := func(id bookingId) string {
+		b, _ := register.Lookup(id)
+		return string(b.Code)
+	}
+	want := []string{
+		"Booking " + code(paid) + ": balance paid",
+		"Booking " + code(unpaid) + ": payment failed",
+		"Booking " + code(unpaid) + ": payment failed",
+		"Booking " + code(unpaid) + ": cancelled",
+	}
+	if got := subjects(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+	testBooksBalance(t, db)
+
+	// a booking cancelled first -> nothing taken
+	clock.Set(time.Date(2014, 11, 1, 12, 0, 0, 0, time.UTC))
+	cal.Add(date.New(2015, 2, 1))
+	gone, _ := book("2/1/2015", "2/2/2015", "e@f")
+	var scheduleIs = func(want scheduleStatus) {
+		s, _ := register.Ledger.Scheduled(gone)
+		if s.Status != want {
+			t.Error("want", want)
+			t.Error("got ", s.Status)
+		}
+	}
+	err = register.Cancel(gone, actor("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduleIs(abandoned)
+
+	// reinstated -> wanted again, until cancelled again
+	err = register.Reinstate(gone, actor("admin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduleIs(scheduled)
+	err = register.Cancel(gone, actor("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduleIs(abandoned)
+	clock.Set(time.Date(2015, 1, 2, 0, 0, 0, 0, time.UTC))
+	collect(0)
+	s, _ = register.Ledger.Scheduled(gone)
+	if s.Status != abandoned {
+		t.Error("want", abandoned)
+		t.Error("got ", s.Status)
+	}
+}
@@ -0,0 +1,72 @@
+package booking
+
+import "html/template"
+
+var templateConfirmation *template.Template
+
+func init() {
+	templateConfirmation = template.Must(
+		template.New("confirmation.html.go").
+			Funcs(formHelpers).
+			Parse(templateConfirmationSrc + templateQuoteSrc),
+	)
+}
+
+const templateConfirmationSrc = `
+<html>
+  <body>
+    <h1>Apartment</h1>
+    <h3>Booking Confirmed!</h3>
+    <p>
+      Your confirmation code is <b>{{.Code}}</b>.
+      Please quote it if you get in touch.
+    </p>
+    <table>
+      <tr>
+        <th align="left">Check in</th>
+        <td>{{pretty .Checkin}}</td>
+      </tr>
+      <tr>
+        <th align="left">Check out</th>
+        <td>{{pretty .Checkout}}</td>
+      </tr>
+      <tr>
+        <th align="left">Rate</th>
+        <td>{{.Rate.Name}}</td>
+      </tr>
+      <tr>
+        <th align="left">Guests</th>
+        <td>{{.Guests}}</td>
+      </tr>
+    </table>
+
+    <h3>Receipt</h3>
+    {{template "quote" .Quote}}
+
+    {{with .Balance}}
+    <p>
+      We've taken a deposit. The balance of {{$.Quote.Money .Amount}} will be charged to
+      your card on {{pretty .DueOn}}.
+    </p>
+    {{end}}
+
+    {{with .Refunds}}
+    <h3>Refunds</h3>
+    <table>
+      {{range .}}
+      <tr>
+        <td>{{.RefundedAt.Format "Jan 2, 2006"}}</td>
+        <td>Refunded to your card</td>
+        <td align="right">{{$.Quote.Money .Amount}}</td>
+      </tr>
+      {{end}}
+    </table>
+    {{end}}
+
+    <form action="/invoice" method="post">
+      <input type="hidden" name="code" value="{{.Code}}" />
+      <input type="submit" value="Invoice" />
+    </form>
+  </body>
+</html>
+`
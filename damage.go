@@ -0,0 +1,466 @@
+package booking
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// Card gateways drop an authorization after about a week, so it's placed
+// shortly before checkin and let go soon after checkout
+const (
+	DefaultDamageHoldDaysBefore   = 1
+	DefaultDamageReleaseDaysAfter = 3
+)
+
+// A damage deposit held on the guest's card over each stay. It's authorized
+// HoldDaysBefore checkin and released ReleaseDaysAfter checkout, unless the
+// host claims some of it first. Amount 0 holds nothing
+type DamageDeposits struct {
+	Clock  *Clock  `inject:""`
+	DB     *sql.DB `inject:""`
+	Ledger *Ledger `inject:""`
+
+	Amount           amount
+	HoldDaysBefore   int
+	ReleaseDaysAfter int
+}
+
+// Reads the amount to hold in the property's currency, e.g. "250.00"
+func (d *DamageDeposits) SetAmount(s string) error {
+	a, err := d.Ledger.Property.ParsePrice(s)
+	if err != nil {
+		return err
+	}
+	d.Amount = a
+	return nil
+}
+
+// Each booking's deposit. The card is kept to authorize when the time comes
+const DamageDepositSchema = `
+  CREATE TABLE DamageDeposit (
+    Amount INTEGER NOT NULL,
+    AuthorizationId TEXT NOT NULL DEFAULT '',
+    BookingId INTEGER PRIMARY KEY NOT NULL REFERENCES Register(Id),
+    Captured INTEGER NOT NULL DEFAULT 0,
+    Card TEXT NOT NULL,
+    ClaimedBy TEXT NOT NULL DEFAULT '',
+    Error TEXT NOT NULL DEFAULT '',
+    Evidence TEXT NOT NULL DEFAULT '',
+    PaymentId INTEGER NOT NULL DEFAULT 0,
+    Reason TEXT NOT NULL DEFAULT '',
+    Status TEXT NOT NULL DEFAULT 'pending',
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0),
+    CONSTRAINT ck_Captured_Within_Amount CHECK (Captured <= Amount)
+  )
+`
+
+var damageDepositMigration = statements(
+	`CREATE TABLE DamageDeposit (
+    Amount INTEGER NOT NULL,
+    AuthorizationId TEXT NOT NULL DEFAULT '',
+    BookingId INTEGER PRIMARY KEY NOT NULL REFERENCES Register(Id),
+    Captured INTEGER NOT NULL DEFAULT 0,
+    Card TEXT NOT NULL,
+    ClaimedBy TEXT NOT NULL DEFAULT '',
+    Error TEXT NOT NULL DEFAULT '',
+    Evidence TEXT NOT NULL DEFAULT '',
+    PaymentId INTEGER NOT NULL DEFAULT 0,
+    Reason TEXT NOT NULL DEFAULT '',
+    Status TEXT NOT NULL DEFAULT 'pending',
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0),
+    CONSTRAINT ck_Captured_Within_Amount CHECK (Captured <= Amount)
+  )`,
+)
+
+// Where a damage deposit is
+type depositStatus string
+
+const (
+	// Not yet authorized
+	depositPending = depositStatus("pending")
+
+	// Authorized on the card
+	depositHeld = depositStatus("held")
+
+	// Let go, or never needed
+	depositReleased = depositStatus("released")
+
+	// Some or all of it taken for a claim, the gateway let go of the rest
+	depositCaptured = depositStatus("partially-captured")
+)
+
+func (s *depositStatus) Scan(src interface{}) error {
+	raw, ok := src.([]byte)
+	if !ok {
+		err := errors.New(
+			fmt.Sprintf("can't scan depositStatus from db: %#v", src),
+		)
+		glog.Error(err)
+		return err
+	}
+	*s = depositStatus(raw)
+	return nil
+}
+
+func (s depositStatus) Value() (driver.Value, error) {
+	return driver.Value(string(s)), nil
+}
+
+// A row in DamageDeposit
+type damageDeposit struct {
+	Amount          amount
+	AuthorizationId gatewayTxId
+	BookingId       bookingId
+	Captured        amount
+	Card            cardToken
+	ClaimedBy       actor
+	Error           string
+	Evidence        string
+	PaymentId       int64
+	Reason          string
+	Status          depositStatus
+}
+
+var (
+	noDamageDeposit  = errors.New("booking has no damage deposit")
+	depositNotHeld   = errors.New("damage deposit isn't held")
+	claimNeedsReason = errors.New("a damage claim needs a reason")
+	claimTooLarge    = errors.New("claim is more than the damage deposit")
+)
+
+// Plans a deposit for a booking, taken from the card it was paid with.
+// Nothing is held when Amount is 0 - caller is responsible for
+// Commit/Rollback
+func (d *DamageDeposits) RecordTx(
+	tx *sql.Tx,
+	id bookingId,
+	card cardToken,
+) error {
+	if d.Amount <= 0 {
+		return nil
+	}
+
+	_, err := tx.Exec(`
+    insert into DamageDeposit (Amount, BookingId, Card)
+    values ($1, $2, $3)
+  `, d.Amount, id, card)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	return nil
+}
+
+const damageDepositSelect = `
+    select Amount, AuthorizationId, BookingId, Captured, Card, ClaimedBy,
+    Error, Evidence, PaymentId, Reason, Status
+    from DamageDeposit
+  `
+
+func scanDamageDeposit(row scanner) (damageDeposit, error) {
+	var dd damageDeposit
+	err := row.Scan(
+		&dd.Amount,
+		&dd.AuthorizationId,
+		&dd.BookingId,
+		&dd.Captured,
+		&dd.Card,
+		&dd.ClaimedBy,
+		&dd.Error,
+		&dd.Evidence,
+		&dd.PaymentId,
+		&dd.Reason,
+		&dd.Status,
+	)
+	return dd, err
+}
+
+func lookupDamageDepositTx(tx *sql.Tx, id bookingId) (damageDeposit, error) {
+	dd, err := scanDamageDeposit(tx.QueryRow(
+		damageDepositSelect+`where BookingId = $1`,
+		id,
+	))
+	if err == sql.ErrNoRows {
+		return damageDeposit{}, noDamageDeposit
+	}
+	if err != nil {
+		glog.Error(err)
+		return damageDeposit{}, err
+	}
+	return dd, nil
+}
+
+func updateDamageDepositTx(tx *sql.Tx, dd damageDeposit) error {
+	_, err := tx.Exec(`
+    update DamageDeposit
+    set AuthorizationId = $1, Captured = $2, ClaimedBy = $3, Error = $4,
+      Evidence = $5, PaymentId = $6, Reason = $7, Status = $8
+    where BookingId = $9
+  `,
+		dd.AuthorizationId,
+		dd.Captured,
+		dd.ClaimedBy,
+		dd.Error,
+		dd.Evidence,
+		dd.PaymentId,
+		dd.Reason,
+		dd.Status,
+		dd.BookingId,
+	)
+	if err != nil {
+		glog.Error(err)
+	}
+	return err
+}
+
+// A booking's deposit
+func (d *DamageDeposits) Lookup(id bookingId) (damageDeposit, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return damageDeposit{}, err
+	}
+	defer tx.Rollback()
+
+	return lookupDamageDepositTx(tx, id)
+}
+
+// Every deposit, by booking
+func (d *DamageDeposits) List() ([]damageDeposit, error) {
+	return d.list(damageDepositSelect + `order by BookingId asc`)
+}
+
+func (d *DamageDeposits) list(query string, args ...interface{}) ([]damageDeposit, error) {
+	rows, err := d.DB.Query(query, args...)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []damageDeposit
+	for rows.Next() {
+		dd, err := scanDamageDeposit(rows)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		list = append(list, dd)
+	}
+	return list, rows.Err()
+}
+
+// Holds deposits coming up and releases those that are done with, returning
+// how many changed. A card that can't be authorized is tried again next time
+// until checkout
+func (d *DamageDeposits) Process() (int, error) {
+	open, err := d.list(
+		damageDepositSelect+`where Status in ($1, $2) order by BookingId asc`,
+		depositPending,
+		depositHeld,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, dd := range open {
+		changed, err := d.process(dd)
+		if err != nil {
+			glog.Error("couldn't process deposit for ", dd.BookingId, ": ", err)
+			continue
+		}
+		if changed {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (d *DamageDeposits) process(dd damageDeposit) (bool, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	b, err := lookupBooking(tx, dd.BookingId)
+	if err != nil {
+		return false, err
+	}
+	today, _ := date.Parse(d.Clock.Now())
+	holdOn := b.Checkin.Add(-d.HoldDaysBefore)
+	releaseOn := b.Checkout.Add(d.ReleaseDaysAfter)
+	over := b.Status == cancelled || b.Status == noShow ||
+		!today.Before(releaseOn)
+
+	switch {
+	case dd.Status == depositHeld && over:
+		err = d.Ledger.Release(dd.AuthorizationId)
+		if err != nil {
+			return false, err
+		}
+		dd.Status = depositReleased
+	case dd.Status == depositPending && (over || !today.Before(b.Checkout)):
+		dd.Status = depositReleased
+	case dd.Status == depositPending && !today.Before(holdOn):
+		auth, err := d.Ledger.Authorize(dd.Card, dd.Amount)
+		if err != nil {
+			dd.Error = err.Error()
+			return false, d.commit(tx, dd)
+		}
+		dd.AuthorizationId = auth
+		dd.Error = ""
+		dd.Status = depositHeld
+	default:
+		return false, nil
+	}
+
+	err = d.commit(tx, dd)
+	if err != nil {
+		return false, err
+	}
+	glog.Infoln("damage deposit", dd.BookingId, dd.Status)
+	return true, nil
+}
+
+func (d *DamageDeposits) commit(tx *sql.Tx, dd damageDeposit) error {
+	err := updateDamageDepositTx(tx, dd)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Takes some of a held deposit for damage, charging it to the guest with
+// the host's reason and a note of the evidence, e.g. where the photos are.
+// One claim per deposit, the rest is let go
+func (d *DamageDeposits) Claim(
+	id bookingId,
+	a amount,
+	reason string,
+	evidence string,
+	by actor,
+) (damageDeposit, error) {
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return damageDeposit{}, claimNeedsReason
+	}
+	if a <= 0 {
+		return damageDeposit{}, invalidAmount
+	}
+
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return damageDeposit{}, err
+	}
+	defer tx.Rollback()
+
+	dd, err := lookupDamageDepositTx(tx, id)
+	if err != nil {
+		return damageDeposit{}, err
+	}
+	if dd.Status != depositHeld {
+		return damageDeposit{}, depositNotHeld
+	}
+	if a > dd.Amount {
+		return damageDeposit{}, claimTooLarge
+	}
+	b, err := lookupBooking(tx, id)
+	if err != nil {
+		return damageDeposit{}, err
+	}
+
+	err = d.Ledger.PostTx(tx, guestEntry(b.GuestId, id, a, damages, memo(
+		fmt.Sprintf("%s damage: %s", id, reason),
+	)))
+	if err != nil {
+		return damageDeposit{}, err
+	}
+	p, err := d.Ledger.CaptureTx(
+		tx,
+		b.GuestId,
+		id,
+		dd.AuthorizationId,
+		a,
+		memo(fmt.Sprintf("%s damage paid from deposit", id)),
+	)
+	if err != nil {
+		return damageDeposit{}, err
+	}
+
+	dd.Captured = a
+	dd.ClaimedBy = by
+	dd.Evidence = evidence
+	dd.PaymentId = p.Id
+	dd.Reason = reason
+	dd.Status = depositCaptured
+	err = d.commit(tx, dd)
+	if err != nil {
+		glog.Error(err)
+		d.Ledger.Unwind(p)
+		return damageDeposit{}, err
+	}
+
+	glog.Infoln(by, "claimed", d.Ledger.Money(a), "of damage deposit for", id)
+	return dd, nil
+}
+
+// Lets go of a deposit early, or gives up on one not yet held
+func (d *DamageDeposits) Release(id bookingId) (damageDeposit, error) {
+	tx, err := d.DB.Begin()
+	if err != nil {
+		return damageDeposit{}, err
+	}
+	defer tx.Rollback()
+
+	dd, err := lookupDamageDepositTx(tx, id)
+	if err != nil {
+		return damageDeposit{}, err
+	}
+	switch dd.Status {
+	case depositHeld:
+		err = d.Ledger.Release(dd.AuthorizationId)
+		if err != nil {
+			return damageDeposit{}, err
+		}
+	case depositPending:
+	default:
+		return damageDeposit{}, depositNotHeld
+	}
+
+	dd.Status = depositReleased
+	err = d.commit(tx, dd)
+	if err != nil {
+		return damageDeposit{}, err
+	}
+	return dd, nil
+}
+
+// Process deposits every interval until stop is closed. Run it in its own
+// goroutine
+func (d *DamageDeposits) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := d.Process()
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				glog.Infoln("processed", n, "damage deposits")
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package booking
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+const damageUsage = `usage:
+  damage list
+  damage claim -code CONFIRMATION -amount PRICE -reason TEXT
+               [-evidence TEXT] [-by NAME]
+  damage release -code CONFIRMATION`
+
+var unknownDamageCommand = errors.New(damageUsage)
+
+// Lists damage deposits, claims against one or lets one go from the command
+// line, writing results to out
+func DamageCommand(
+	d *DamageDeposits,
+	r *Register,
+	args []string,
+	out io.Writer,
+) error {
+	if len(args) == 0 {
+		return unknownDamageCommand
+	}
+
+	flags := flag.NewFlagSet("damage "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	flagCode := flags.String("code", "", "the booking's confirmation code")
+	flagAmount := flags.String("amount", "", "how much to take, e.g. 80.00")
+	flagReason := flags.String("reason", "", "what was damaged, shown to the guest")
+	flagEvidence := flags.String("evidence", "", "where the photos, receipts etc. are")
+	flagBy := flags.String("by", "", "who's claiming")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	default:
+		return unknownDamageCommand
+	case "list":
+		list, err := d.List()
+		if err != nil {
+			return err
+		}
+		for _, dd := range list {
+			b, err := r.Lookup(dd.BookingId)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintln(out, damageSummary(d.Ledger, b, dd))
+		}
+		return nil
+	case "claim":
+		b, err := r.LookupByCode(*flagCode)
+		if err != nil {
+			return err
+		}
+		a, err := d.Ledger.Property.ParsePrice(*flagAmount)
+		if err != nil {
+			return err
+		}
+		dd, err := d.Claim(
+			b.Id,
+			a,
+			*flagReason,
+			*flagEvidence,
+			actor("admin:"+*flagBy),
+		)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, damageSummary(d.Ledger, b, dd))
+		return nil
+	case "release":
+		b, err := r.LookupByCode(*flagCode)
+		if err != nil {
+			return err
+		}
+		dd, err := d.Release(b.Id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, damageSummary(d.Ledger, b, dd))
+		return nil
+	}
+}
+
+func damageSummary(l *Ledger, b booking, dd damageDeposit) string {
+	s := fmt.Sprintf(
+		"%s %s - %s %s %s",
+		b.Code,
+		b.Checkin,
+		b.Checkout,
+		l.Money(dd.Amount),
+		dd.Status,
+	)
+	if dd.Status == depositCaptured {
+		s += fmt.Sprintf(
+			", %s claimed by %s for %s",
+			l.Money(dd.Captured),
+			dd.ClaimedBy,
+			dd.Reason,
+		)
+		if dd.Evidence != "" {
+			s += " (" + dd.Evidence + ")"
+		}
+	}
+	if dd.Error != "" {
+		s += ", last try: " + dd.Error
+	}
+	return s
+}
@@ -0,0 +1,108 @@
+package booking
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestDamageCommand(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var damage DamageDeposits
+	var gateway FakeGateway
+	var register Register
+	err := inject.Populate(db, &calendar, &clock, &damage, &gateway, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	damage.Amount = amount(25000)
+	clock.Set(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+	calendar.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+	var codes []string
+	for _, checkin := range []date.Date{date.New(2015, 1, 1), date.New(2015, 1, 2)} {
+		id, err := register.Book(checkin, checkin.Add(1), guestId(1), withBunny, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx, _ := db.Begin()
+		err = damage.RecordTx(tx, id, testCard(t, &gateway, fakeCardApproved))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+		b, _ := register.Lookup(id)
+		codes = append(codes, string(b.Code))
+	}
+	_, err = damage.Process()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	err = DamageCommand(&damage, &register, nil, &out)
+	if err != unknownDamageCommand {
+		t.Error("want", unknownDamageCommand)
+		t.Error("got ", err)
+	}
+
+	var tests = []struct {
+		args []string
+		err  error
+		want string
+	}{
+		{
+			[]string{"claim", "-code", codes[0], "-amount", "80", "-reason", ""},
+			claimNeedsReason,
+			"",
+		},
+		{
+			[]string{"claim", "-code", codes[1], "-amount", "80", "-reason", "lamp"},
+			depositNotHeld,
+			"",
+		},
+		{
+			[]string{"claim", "-code", codes[0], "-amount", "80", "-reason", "broken lamp", "-evidence", "photos", "-by", "sam"},
+			nil,
+			codes[0] + " 2015-01-01 - 2015-01-02 $250.00 partially-captured, $80.00 claimed by admin:sam for broken lamp (photos)\n",
+		},
+		{
+			[]string{"release", "-code", codes[0]},
+			depositNotHeld,
+			"",
+		},
+		{
+			[]string{"release", "-code", codes[1]},
+			nil,
+			codes[1] + " 2015-01-02 - 2015-01-03 $250.00 released\n",
+		},
+		{
+			[]string{"list"},
+			nil,
+			codes[0] + " 2015-01-01 - 2015-01-02 $250.00 partially-captured, $80.00 claimed by admin:sam for broken lamp (photos)\n" +
+				codes[1] + " 2015-01-02 - 2015-01-03 $250.00 released\n",
+		},
+		{
+			[]string{"bogus"},
+			unknownDamageCommand,
+			"",
+		},
+	}
+	for _, test := range tests {
+		out.Reset()
+		err := DamageCommand(&damage, &register, test.args, &out)
+		if err != test.err {
+			t.Error(test.args, "want", test.err)
+			t.Error(test.args, "got ", err)
+		}
+		if err == nil && out.String() != test.want {
+			t.Error("want", test.want)
+			t.Error("got ", out.String())
+		}
+	}
+}
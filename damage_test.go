@@ -0,0 +1,235 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestDamageDeposits(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var clock Clock
+	var damage DamageDeposits
+	var formBuilder FormBuilder
+	var gateway FakeGateway
+	var register Register
+	err := inject.Populate(
+		db,
+		&cal,
+		&clock,
+		&damage,
+		&formBuilder,
+		&gateway,
+		&register,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	damage.Amount = amount(25000)
+	damage.HoldDaysBefore = DefaultDamageHoldDaysBefore
+	damage.ReleaseDaysAfter = DefaultDamageReleaseDaysAfter
+	clock.Set(time.Date(2014, 12, 1, 12, 0, 0, 0, time.UTC))
+	cal.Add(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		date.New(2015, 1, 6),
+		date.New(2015, 2, 1),
+	)
+
+	book := func(checkin, checkout, email string) bookingId {
+		vals := validFormValues()
+		vals.Set(fvCheckin, checkin)
+		vals.Set(fvCheckout, checkout)
+		vals.Set(fvEmail, email)
+		form := formBuilder.Build()
+		id, ok := form.Submit(postForm(vals))
+		if !ok {
+			t.Fatal(form.Errors)
+		}
+		return id
+	}
+	first := book("1/1/2015", "1/3/2015", "a@b")
+	second := book("1/5/2015", "1/7/2015", "c@d")
+	gone := book("2/1/2015", "2/2/2015", "e@f")
+
+	var process = func(want int) {
+		n, err := damage.Process()
+		if err != nil {
+			t.Error(err)
+		}
+		if n != want {
+			t.Error("want", want, "processed")
+			t.Error("got ", n)
+		}
+	}
+	var status = func(id bookingId, want depositStatus) damageDeposit {
+		dd, err := damage.Lookup(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dd.Status != want {
+			t.Error(id, "want", want)
+			t.Error(id, "got ", dd.Status)
+		}
+		return dd
+	}
+
+	// Submit() -> a deposit waits for each booking
+	dd := status(first, depositPending)
+	if dd.Amount != amount(25000) || dd.Card == "" {
+		t.Error("want", amount(25000), "on the booking's card")
+		t.Error("got ", dd.Amount, dd.Card)
+	}
+	if _, err := damage.Lookup(bookingId(99)); err != noDamageDeposit {
+		t.Error("want", noDamageDeposit)
+		t.Error("got ", err)
+	}
+	process(0)
+
+	// the card for the last booking has since run dry
+	_, err = db.Exec(
+		`update DamageDeposit set Card = $1 where BookingId = $2`,
+		testCard(t, &gateway, fakeCardInsufficientFunds),
+		gone,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Process() -> held the day before checkin
+	clock.Set(time.Date(2014, 12, 31, 0, 0, 0, 0, time.UTC))
+	process(1)
+	dd = status(first, depositHeld)
+	if dd.AuthorizationId == "" {
+		t.Error("want an authorization")
+	}
+	status(second, depositPending)
+
+	// Claim() -> refused until held, and within the deposit
+	var tests = []struct {
+		id     bookingId
+		amount amount
+		reason string
+		err    error
+	}{
+		{bookingId(99), amount(100), "lamp", noDamageDeposit},
+		{second, amount(100), "lamp", depositNotHeld},
+		{first, amount(100), " ", claimNeedsReason},
+		{first, amount(0), "lamp", invalidAmount},
+		{first, amount(25001), "lamp", claimTooLarge},
+	}
+	for _, test := range tests {
+		_, err := damage.Claim(test.id, test.amount, test.reason, "", actor("admin"))
+		if err != test.err {
+			t.Error(test.id, test.amount, "want", test.err)
+			t.Error(test.id, test.amount, "got ", err)
+		}
+	}
+
+	// Claim() -> part captured, charged to the guest and paid from the hold
+	clock.Set(time.Date(2015, 1, 3, 12, 0, 0, 0, time.UTC))
+	dd, err = damage.Claim(
+		first,
+		amount(8000),
+		"broken lamp",
+		"photos in the shared drive",
+		actor("admin:sam"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dd.Status != depositCaptured || dd.Captured != amount(8000) ||
+		dd.ClaimedBy != actor("admin:sam") || dd.PaymentId == 0 {
+		t.Error("want", depositCaptured, amount(8000), "admin:sam")
+		t.Error("got ", dd)
+	}
+	if got := status(first, depositCaptured); got != dd {
+		t.Error("want", dd)
+		t.Error("got ", got)
+	}
+	if released := gateway.transactions[dd.AuthorizationId].Released; released != amount(17000) {
+		t.Error("want the rest of the hold released", amount(17000))
+		t.Error("got ", released)
+	}
+	b, _ := register.Lookup(first)
+	if balance, _ := register.Ledger.Balance(b.GuestId); balance != 0 {
+		t.Error("want", 0)
+		t.Error("got ", balance)
+	}
+	// the claim isn't a payment towards the stay
+	payments, _ := register.Ledger.Payments(first)
+	for _, p := range payments {
+		if p.Id == dd.PaymentId {
+			t.Error("want the stay's payments")
+			t.Error("got ", payments)
+		}
+	}
+	_, err = damage.Claim(first, amount(100), "lamp", "", actor("admin"))
+	if err != depositNotHeld {
+		t.Error("want", depositNotHeld)
+		t.Error("got ", err)
+	}
+	testBooksBalance(t, db)
+
+	// Process() -> held, then let go a few days after checkout
+	clock.Set(time.Date(2015, 1, 4, 0, 0, 0, 0, time.UTC))
+	process(1)
+	dd = status(second, depositHeld)
+	clock.Set(time.Date(2015, 1, 9, 23, 0, 0, 0, time.UTC))
+	process(0)
+	clock.Set(time.Date(2015, 1, 10, 0, 0, 0, 0, time.UTC))
+	process(1)
+	status(second, depositReleased)
+	if err := gateway.Void(dd.AuthorizationId); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+
+	// a card that can't be held is tried again, until the booking's cancelled
+	clock.Set(time.Date(2015, 1, 31, 0, 0, 0, 0, time.UTC))
+	process(0)
+	dd = status(gone, depositPending)
+	if dd.Error != insufficientFunds.Error() {
+		t.Error("want", insufficientFunds)
+		t.Error("got ", dd.Error)
+	}
+	err = register.Cancel(gone, actor("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	process(1)
+	status(gone, depositReleased)
+	if _, err := damage.Release(gone); err != depositNotHeld {
+		t.Error("want", depositNotHeld)
+		t.Error("got ", err)
+	}
+}
+
+func TestDamageDepositsNone(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var damage DamageDeposits
+	var formBuilder FormBuilder
+	var gateway FakeGateway
+	err := inject.Populate(db, &cal, &damage, &formBuilder, &gateway)
+	if err != nil {
+		t.Error(err)
+	}
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+
+	form := formBuilder.Build()
+	id, ok := form.Submit(postForm(validFormValues()))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+	if _, err := damage.Lookup(id); err != noDamageDeposit {
+		t.Error("want", noDamageDeposit)
+		t.Error("got ", err)
+	}
+}
@@ -1,6 +1,9 @@
 package booking
 
-import "database/sql"
+import (
+	"database/sql"
+	"testing"
+)
 
 func testDB() *sql.DB {
 	// connect
@@ -9,6 +12,9 @@ func testDB() *sql.DB {
 		panic(err)
 	}
 
+	// every connection to :memory: is a separate database
+	db.SetMaxOpenConns(1)
+
 	// load schema
 	var s Schema
 	s.DB = db
@@ -17,5 +23,51 @@ func testDB() *sql.DB {
 		panic(err)
 	}
 
+	// withBunny and withoutBunny
+	rates := Rates{DB: db, Property: &Property{}}
+	err = rates.Seed()
+	if err != nil {
+		panic(err)
+	}
+
 	return db
 }
+
+// Rate plans every testDB starts with
+var (
+	withBunny = rate{
+		Active:   true,
+		Amount:   amount(20000),
+		Currency: defaultCurrency,
+		Id:       rateId(1),
+		Name:     "With Bunny",
+		Policy:   moderate,
+		Version:  1,
+	}
+	withoutBunny = rate{
+		Active:   true,
+		Amount:   amount(25000),
+		Currency: defaultCurrency,
+		Id:       rateId(2),
+		Name:     "Without Bunny",
+		Policy:   flexible,
+		Version:  1,
+	}
+)
+
+// Every journal entry's debits equal its credits
+func testBooksBalance(t *testing.T, db *sql.DB) {
+	var unbalanced int
+	err := db.QueryRow(`
+    select count(*) from (
+      select EntryId from JournalLine group by EntryId having sum(Amount) != 0
+    )
+  `).Scan(&unbalanced)
+	if err != nil {
+		t.Error(err)
+	}
+	if unbalanced != 0 {
+		t.Error("want 0 unbalanced entries")
+		t.Error("got ", unbalanced)
+	}
+}
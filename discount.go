@@ -0,0 +1,248 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// Percentage discounts on a rate plan's nightly prices, evaluated in
+// Position order
+const DiscountRuleSchema = `
+  CREATE TABLE DiscountRule (
+    Exclusive BOOLEAN NOT NULL DEFAULT 0,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Kind TEXT NOT NULL,
+    Percent INTEGER NOT NULL,
+    Position INTEGER NOT NULL,
+    RateId INTEGER NOT NULL,
+    Threshold INTEGER NOT NULL,
+    CONSTRAINT ck_Percent_Range CHECK (Percent > 0 AND Percent <= 100)
+  )
+`
+
+var discountRuleMigration = statements(
+	`CREATE TABLE DiscountRule (
+    Exclusive BOOLEAN NOT NULL DEFAULT 0,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Kind TEXT NOT NULL,
+    Percent INTEGER NOT NULL,
+    Position INTEGER NOT NULL,
+    RateId INTEGER NOT NULL,
+    Threshold INTEGER NOT NULL,
+    CONSTRAINT ck_Percent_Range CHECK (Percent > 0 AND Percent <= 100)
+  )`,
+)
+
+// When a discount applies
+type discountKind string
+
+const (
+	// Threshold nights or more
+	lengthOfStay = discountKind("length-of-stay")
+
+	// Checking in less than Threshold days from when the stay is quoted
+	lastMinute = discountKind("last-minute")
+)
+
+// Takes Percent off the nights of a stay. Rules are evaluated in Position
+// order and those that apply stack, except an Exclusive rule only applies
+// when no earlier rule has, and then stops evaluation
+type discountRule struct {
+	Exclusive bool
+	Id        int64
+	Kind      discountKind
+	Percent   int
+	Position  int
+	Rate      rateId
+	Threshold int
+}
+
+var (
+	invalidDiscount  = errors.New("invalid discount rule")
+	discountNotFound = errors.New("discount rule not found")
+)
+
+func (d discountRule) String() string {
+	var when string
+	switch d.Kind {
+	case lengthOfStay:
+		when = fmt.Sprintf("%d+ nights", d.Threshold)
+	case lastMinute:
+		when = fmt.Sprintf("within %d days", d.Threshold)
+	}
+	return fmt.Sprintf("%s: %d%% off", when, d.Percent)
+}
+
+// Whether the rule covers a stay quoted at a moment
+func (d discountRule) Applies(s stay, at time.Time) bool {
+	switch d.Kind {
+	case lengthOfStay:
+		return s.Len() >= d.Threshold
+	case lastMinute:
+		return s.Checkin.Time().Sub(at) < time.Duration(d.Threshold)*date.Day
+	}
+	return false
+}
+
+// Discounts on a subtotal from the rules that apply, rounded to the cent and
+// negative so they can be added to a quote. Stacked rules never take off more
+// than the subtotal between them
+func discountLines(
+	rules []discountRule,
+	s stay,
+	at time.Time,
+	subtotal amount,
+) []quoteLine {
+	var lines []quoteLine
+	var given amount
+	for _, rule := range rules {
+		if !rule.Applies(s, at) {
+			continue
+		}
+		if rule.Exclusive && len(lines) > 0 {
+			continue
+		}
+
+		off := amount(roundDiv(int64(subtotal)*int64(rule.Percent), 100))
+		if off > subtotal-given {
+			off = subtotal - given
+		}
+		if off <= 0 {
+			continue
+		}
+		given += off
+
+		lines = append(lines, quoteLine{
+			Amount:      -off,
+			Description: rule.String(),
+			Kind:        discountLine,
+		})
+
+		if rule.Exclusive {
+			break
+		}
+	}
+	return lines
+}
+
+// Adds a rule after a rate's existing ones, unless it gives a Position
+func (p *Pricing) AddDiscount(d discountRule) (discountRule, error) {
+	if d.Kind != lengthOfStay && d.Kind != lastMinute {
+		return discountRule{}, invalidDiscount
+	}
+	if d.Percent <= 0 || d.Percent > 100 || d.Threshold < 0 {
+		return discountRule{}, invalidDiscount
+	}
+
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return discountRule{}, err
+	}
+	defer tx.Rollback()
+
+	if d.Position == 0 {
+		err = tx.QueryRow(
+			`select coalesce(max(Position), 0) + 1 from DiscountRule
+       where RateId = $1`,
+			d.Rate,
+		).Scan(&d.Position)
+		if err != nil {
+			glog.Error(err)
+			return discountRule{}, err
+		}
+	}
+
+	result, err := tx.Exec(`
+    insert into DiscountRule
+    (Exclusive, Kind, Percent, Position, RateId, Threshold)
+    values ($1, $2, $3, $4, $5, $6)
+  `, d.Exclusive, d.Kind, d.Percent, d.Position, d.Rate, d.Threshold)
+	if err != nil {
+		glog.Error(err)
+		return discountRule{}, err
+	}
+	d.Id, err = result.LastInsertId()
+	if err != nil {
+		glog.Error(err)
+		return discountRule{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return discountRule{}, err
+	}
+
+	glog.Infoln("added discount", d.Id, d, "to", d.Rate)
+	return d, nil
+}
+
+func (p *Pricing) RemoveDiscount(id int64) error {
+	result, err := p.DB.Exec(`delete from DiscountRule where Id = $1`, id)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return discountNotFound
+	}
+
+	glog.Infoln("removed discount", id)
+	return nil
+}
+
+// A rate's rules in evaluation order
+func (p *Pricing) Discounts(rate rateId) ([]discountRule, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return discountsTx(tx, rate)
+}
+
+func discountsTx(tx *sql.Tx, rate rateId) ([]discountRule, error) {
+	rows, err := tx.Query(`
+    select Exclusive, Id, Kind, Percent, Position, RateId, Threshold
+    from DiscountRule
+    where RateId = $1
+    order by Position asc, Id asc
+  `, rate)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []discountRule
+	for rows.Next() {
+		var d discountRule
+		err := rows.Scan(
+			&d.Exclusive,
+			&d.Id,
+			&d.Kind,
+			&d.Percent,
+			&d.Position,
+			&d.Rate,
+			&d.Threshold,
+		)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		rules = append(rules, d)
+	}
+
+	return rules, rows.Err()
+}
@@ -0,0 +1,185 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestDiscountLines(t *testing.T) {
+	weekly := discountRule{Kind: lengthOfStay, Percent: 10, Threshold: 7}
+	monthly := discountRule{Kind: lengthOfStay, Percent: 25, Threshold: 28}
+	lastMin := discountRule{Kind: lastMinute, Percent: 15, Threshold: 3}
+	exclusiveMonthly := monthly
+	exclusiveMonthly.Exclusive = true
+	exclusiveWeekly := weekly
+	exclusiveWeekly.Exclusive = true
+	generousWeekly := discountRule{Kind: lengthOfStay, Percent: 80, Threshold: 7}
+	generousLastMin := discountRule{Kind: lastMinute, Percent: 60, Threshold: 3}
+
+	checkin := date.New(2015, 3, 1)
+	now := checkin.Time().Add(-2 * date.Day)
+	early := checkin.Time().Add(-3 * date.Day)
+	week := stay{checkin, checkin.Add(7)}
+	month := stay{checkin, checkin.Add(28)}
+	subtotal := amount(100000)
+
+	var tests = []struct {
+		rules []discountRule
+		stay  stay
+		at    time.Time
+		want  []amount
+	}{
+		{nil, week, now, nil},
+		{[]discountRule{weekly}, stay{checkin, checkin.Add(6)}, early, nil},
+		{[]discountRule{weekly}, week, early, []amount{-10000}},
+		{[]discountRule{lastMin}, week, early, nil},
+		{[]discountRule{weekly, lastMin}, week, now, []amount{-10000, -15000}},
+
+		// exclusive: most generous first, stops the rest
+		{
+			[]discountRule{exclusiveMonthly, exclusiveWeekly, lastMin},
+			month,
+			now,
+			[]amount{-25000},
+		},
+		{
+			[]discountRule{exclusiveMonthly, exclusiveWeekly, lastMin},
+			week,
+			now,
+			[]amount{-10000},
+		},
+
+		// exclusive after a discount already given is skipped
+		{[]discountRule{lastMin, exclusiveWeekly}, week, now, []amount{-15000}},
+
+		// stacked past the subtotal: no more than all of it
+		{
+			[]discountRule{generousWeekly, generousLastMin, weekly},
+			week,
+			now,
+			[]amount{-80000, -20000},
+		},
+	}
+	for i, test := range tests {
+		var got []amount
+		for _, line := range discountLines(test.rules, test.stay, test.at, subtotal) {
+			if line.Kind != discountLine {
+				t.Error("want", discountLine)
+				t.Error("got ", line.Kind)
+			}
+			got = append(got, line.Amount)
+		}
+		if !reflect.DeepEqual(test.want, got) {
+			t.Error(i, "want", test.want)
+			t.Error(i, "got ", got)
+		}
+	}
+
+	// rounded to the nearest cent: 15% of $9.99 is $1.4985
+	lines := discountLines([]discountRule{lastMin}, week, now, amount(999))
+	if len(lines) != 1 || lines[0].Amount != amount(-150) {
+		t.Error("want", amount(-150))
+		t.Error("got ", lines)
+	}
+}
+
+func TestPricingDiscounts(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var clock Clock
+	var pricing Pricing
+	err := inject.Populate(db, &clock, &pricing)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	// AddDiscount() -> invalidDiscount
+	invalid := []discountRule{
+		{Kind: "bogus", Percent: 10, Rate: withBunny.Id},
+		{Kind: lengthOfStay, Percent: 0, Rate: withBunny.Id},
+		{Kind: lengthOfStay, Percent: 101, Rate: withBunny.Id},
+	}
+	for _, d := range invalid {
+		if _, err := pricing.AddDiscount(d); err != invalidDiscount {
+			t.Error("want", invalidDiscount)
+			t.Error("got ", err)
+		}
+	}
+
+	weekly, err := pricing.AddDiscount(discountRule{
+		Kind:      lengthOfStay,
+		Percent:   10,
+		Rate:      withBunny.Id,
+		Threshold: 7,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lastMin, err := pricing.AddDiscount(discountRule{
+		Kind:      lastMinute,
+		Percent:   15,
+		Rate:      withBunny.Id,
+		Threshold: 3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weekly.Position != 1 || lastMin.Position != 2 {
+		t.Error("want positions 1, 2")
+		t.Error("got ", weekly.Position, lastMin.Position)
+	}
+
+	rules, err := pricing.Discounts(withBunny.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []discountRule{weekly, lastMin}; !reflect.DeepEqual(want, rules) {
+		t.Error("want", want)
+		t.Error("got ", rules)
+	}
+
+	// a week starting tomorrow gets both, as separate lines
+	q, err := pricing.Quote(date.New(2015, 1, 2), date.New(2015, 1, 9), withBunny, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(q.Lines); l != 9 {
+		t.Fatal("want 9 lines, got", l)
+	}
+	want := []quoteLine{
+		{amount(-14000), "7+ nights: 10% off", false, discountLine, date.Date{}},
+		{amount(-21000), "within 3 days: 15% off", false, discountLine, date.Date{}},
+	}
+	if !reflect.DeepEqual(want, q.Lines[7:]) {
+		t.Error("want", want)
+		t.Error("got ", q.Lines[7:])
+	}
+	if total := q.Total(); total != amount(105000) {
+		t.Error("want", amount(105000))
+		t.Error("got ", total)
+	}
+
+	// other rates are unaffected
+	q, err = pricing.Quote(date.New(2015, 1, 2), date.New(2015, 1, 9), withoutBunny, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(q.Lines); l != 7 {
+		t.Error("want", 7)
+		t.Error("got ", l)
+	}
+
+	err = pricing.RemoveDiscount(lastMin.Id)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := pricing.RemoveDiscount(lastMin.Id); err != discountNotFound {
+		t.Error("want", discountNotFound)
+		t.Error("got ", err)
+	}
+}
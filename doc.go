@@ -7,11 +7,15 @@ To make a booking
 
 * Dates must be contiguous
 
+* Nights must not overlap an existing booking
+
 * Guest must be registered
 
 * Checkin must be before Checkout
 
-* Checkout must be at least one day after Checkin
+* Checkout must be at least one night after Checkin
+
+* A stay is its nights: Checkout may be the Checkin of another booking
 
 * Rate must be debited from ledger
 
@@ -0,0 +1,383 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// Fees and taxes added to quotes, evaluated in Position order. A rule with
+// RateId 0 applies to every rate plan
+const FeeRuleSchema = `
+  CREATE TABLE FeeRule (
+    Amount INTEGER NOT NULL DEFAULT 0,
+    AppliesTo TEXT NOT NULL DEFAULT '',
+    Basis TEXT NOT NULL,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Inclusive BOOLEAN NOT NULL DEFAULT 0,
+    Kind TEXT NOT NULL,
+    Name TEXT NOT NULL,
+    Percentage INTEGER NOT NULL DEFAULT 0,
+    Position INTEGER NOT NULL,
+    RateId INTEGER NOT NULL DEFAULT 0
+  )
+`
+
+var feeRuleMigration = statements(
+	`CREATE TABLE FeeRule (
+    Amount INTEGER NOT NULL DEFAULT 0,
+    AppliesTo TEXT NOT NULL DEFAULT '',
+    Basis TEXT NOT NULL,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Inclusive BOOLEAN NOT NULL DEFAULT 0,
+    Kind TEXT NOT NULL,
+    Name TEXT NOT NULL,
+    Percentage INTEGER NOT NULL DEFAULT 0,
+    Position INTEGER NOT NULL,
+    RateId INTEGER NOT NULL DEFAULT 0
+  )`,
+)
+
+// A share in thousandths of a percent, so 8.875% is 8875
+type percentage int64
+
+const wholePercentage = percentage(100000)
+
+func (p percentage) String() string {
+	s := strings.TrimRight(fmt.Sprintf("%d.%03d", p/1000, p%1000), "0")
+	return strings.TrimSuffix(s, ".") + "%"
+}
+
+var invalidPercentage = errors.New("invalid percentage")
+
+// Reads a percentage with up to three decimal places, e.g. "14.75"
+func parsePercentage(s string) (percentage, error) {
+	s = strings.TrimSuffix(strings.TrimSpace(s), "%")
+	parts := strings.Split(s, ".")
+	if len(parts) > 2 || parts[0] == "" {
+		return 0, invalidPercentage
+	}
+
+	whole, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || whole < 0 {
+		return 0, invalidPercentage
+	}
+
+	var thousandths int64
+	if len(parts) == 2 {
+		fraction := parts[1]
+		if fraction == "" || len(fraction) > 3 {
+			return 0, invalidPercentage
+		}
+		fraction += strings.Repeat("0", 3-len(fraction))
+		thousandths, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil || thousandths < 0 {
+			return 0, invalidPercentage
+		}
+	}
+
+	return percentage(whole*1000 + thousandths), nil
+}
+
+// n/d rounded half away from zero, so a cent is never lost one way and
+// found the other
+func roundDiv(n, d int64) int64 {
+	if (n < 0) != (d < 0) {
+		return -((abs64(n) + abs64(d)/2) / abs64(d))
+	}
+	return (abs64(n) + abs64(d)/2) / abs64(d)
+}
+
+func abs64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Share of an amount, rounded half away from zero to the cent
+func (a amount) Percent(p percentage) amount {
+	return amount(roundDiv(int64(a)*int64(p), int64(wholePercentage)))
+}
+
+// What a fee is charged on
+type feeBasis string
+
+const (
+	perStay   = feeBasis("stay")
+	perNight  = feeBasis("night")
+	perGuest  = feeBasis("guest")
+	percentOf = feeBasis("percent")
+)
+
+// Fee rules for every rate plan
+const allRatesId = rateId(0)
+
+// A fee or tax. Flat ones charge Amount per stay, night or guest. Percentage
+// ones charge Percentage of the sum of the quote's lines of the kinds in
+// AppliesTo so far, so a tax on fees goes after them. Inclusive percentages
+// are already in the prices they're taken of - the line says how much of
+// them it is, but adds nothing to the total
+type feeRule struct {
+	Amount     amount
+	AppliesTo  []lineKind
+	Basis      feeBasis
+	Id         int64
+	Inclusive  bool
+	Kind       lineKind
+	Name       string
+	Percentage percentage
+	Position   int
+	Rate       rateId
+}
+
+var (
+	invalidFee  = errors.New("invalid fee rule")
+	feeNotFound = errors.New("fee rule not found")
+)
+
+// How the rule reads with flat amounts in a currency
+func (f feeRule) describe(cur currency) string {
+	switch f.Basis {
+	case percentOf:
+		var kinds []string
+		for _, k := range f.AppliesTo {
+			kinds = append(kinds, string(k))
+		}
+		s := fmt.Sprintf(
+			"%s %s: %s of %s",
+			f.Name,
+			f.Kind,
+			f.Percentage,
+			strings.Join(kinds, ", "),
+		)
+		if f.Inclusive {
+			s += " (included)"
+		}
+		return s
+	default:
+		return fmt.Sprintf(
+			"%s %s: %s per %s",
+			f.Name,
+			f.Kind,
+			money{Amount: f.Amount, Currency: cur},
+			f.Basis,
+		)
+	}
+}
+
+func (f feeRule) valid() bool {
+	if f.Name == "" || (f.Kind != feeLine && f.Kind != taxLine) {
+		return false
+	}
+	switch f.Basis {
+	case perStay, perNight, perGuest:
+		return f.Amount > 0 && !f.Inclusive
+	case percentOf:
+		return f.Percentage > 0 && len(f.AppliesTo) > 0
+	}
+	return false
+}
+
+// Lines the rules add to a quote's lines for a party of guests
+func feeLines(rules []feeRule, lines []quoteLine, guests int) []quoteLine {
+	var nights int
+	for _, line := range lines {
+		if line.Nightly() {
+			nights++
+		}
+	}
+
+	var added []quoteLine
+	for _, rule := range rules {
+		line := quoteLine{
+			Description: rule.Name,
+			Included:    rule.Inclusive,
+			Kind:        rule.Kind,
+		}
+
+		switch rule.Basis {
+		case perStay:
+			line.Amount = rule.Amount
+		case perNight:
+			line.Amount = rule.Amount * amount(nights)
+		case perGuest:
+			line.Amount = rule.Amount * amount(guests)
+		case percentOf:
+			var base amount
+			for _, l := range append(lines, added...) {
+				if l.Included || !l.is(rule.AppliesTo) {
+					continue
+				}
+				base += l.Amount
+			}
+			if rule.Inclusive {
+				// base is net plus tax, so tax is base less base / (1 + rate)
+				net := roundDiv(
+					int64(base)*int64(wholePercentage),
+					int64(wholePercentage+rule.Percentage),
+				)
+				line.Amount = base - amount(net)
+			} else {
+				line.Amount = base.Percent(rule.Percentage)
+			}
+		}
+
+		if line.Amount == 0 {
+			continue
+		}
+		added = append(added, line)
+	}
+	return added
+}
+
+func (l quoteLine) is(kinds []lineKind) bool {
+	for _, k := range kinds {
+		if l.Kind == k {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a rule after the existing ones, unless it gives a Position
+func (p *Pricing) AddFee(f feeRule) (feeRule, error) {
+	if !f.valid() {
+		return feeRule{}, invalidFee
+	}
+
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return feeRule{}, err
+	}
+	defer tx.Rollback()
+
+	if f.Position == 0 {
+		err = tx.QueryRow(
+			`select coalesce(max(Position), 0) + 1 from FeeRule`,
+		).Scan(&f.Position)
+		if err != nil {
+			glog.Error(err)
+			return feeRule{}, err
+		}
+	}
+
+	var appliesTo []string
+	for _, k := range f.AppliesTo {
+		appliesTo = append(appliesTo, string(k))
+	}
+	result, err := tx.Exec(`
+    insert into FeeRule
+    (Amount, AppliesTo, Basis, Inclusive, Kind, Name, Percentage, Position,
+      RateId)
+    values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+  `,
+		f.Amount,
+		strings.Join(appliesTo, ","),
+		f.Basis,
+		f.Inclusive,
+		f.Kind,
+		f.Name,
+		f.Percentage,
+		f.Position,
+		f.Rate,
+	)
+	if err != nil {
+		glog.Error(err)
+		return feeRule{}, err
+	}
+	f.Id, err = result.LastInsertId()
+	if err != nil {
+		glog.Error(err)
+		return feeRule{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return feeRule{}, err
+	}
+
+	glog.Infoln("added fee", f.Id, f.describe(p.Property.Currency()))
+	return f, nil
+}
+
+func (p *Pricing) RemoveFee(id int64) error {
+	result, err := p.DB.Exec(`delete from FeeRule where Id = $1`, id)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return feeNotFound
+	}
+
+	glog.Infoln("removed fee", id)
+	return nil
+}
+
+// Rules for a rate plan, including those for every plan, in evaluation order.
+// allRatesId lists only the rules for every plan
+func (p *Pricing) Fees(rate rateId) ([]feeRule, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return feesTx(tx, rate)
+}
+
+func feesTx(tx *sql.Tx, rate rateId) ([]feeRule, error) {
+	rows, err := tx.Query(`
+    select Amount, AppliesTo, Basis, Id, Inclusive, Kind, Name, Percentage,
+      Position, RateId
+    from FeeRule
+    where RateId in ($1, $2)
+    order by Position asc, Id asc
+  `, allRatesId, rate)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []feeRule
+	for rows.Next() {
+		var f feeRule
+		var appliesTo string
+		err := rows.Scan(
+			&f.Amount,
+			&appliesTo,
+			&f.Basis,
+			&f.Id,
+			&f.Inclusive,
+			&f.Kind,
+			&f.Name,
+			&f.Percentage,
+			&f.Position,
+			&f.Rate,
+		)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		for _, k := range strings.Split(appliesTo, ",") {
+			if k != "" {
+				f.AppliesTo = append(f.AppliesTo, lineKind(k))
+			}
+		}
+		rules = append(rules, f)
+	}
+
+	return rules, rows.Err()
+}
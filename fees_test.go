@@ -0,0 +1,219 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestPercentage(t *testing.T) {
+	var tests = []struct {
+		s   string
+		p   percentage
+		out string
+		err error
+	}{
+		{"10", percentage(10000), "10%", nil},
+		{"14.75", percentage(14750), "14.75%", nil},
+		{"8.875%", percentage(8875), "8.875%", nil},
+		{"0.5", percentage(500), "0.5%", nil},
+		{"", 0, "", invalidPercentage},
+		{"1.2345", 0, "", invalidPercentage},
+		{"-1", 0, "", invalidPercentage},
+		{"1.", 0, "", invalidPercentage},
+	}
+	for _, test := range tests {
+		p, err := parsePercentage(test.s)
+		if p != test.p || err != test.err {
+			t.Error("want", test.p, test.err)
+			t.Error("got ", p, err)
+		}
+		if err == nil && p.String() != test.out {
+			t.Error("want", test.out)
+			t.Error("got ", p.String())
+		}
+	}
+}
+
+func TestAmountPercent(t *testing.T) {
+	var tests = []struct {
+		a    amount
+		p    percentage
+		want amount
+	}{
+		{amount(10000), percentage(14750), amount(1475)},
+		{amount(333), percentage(10000), amount(33)},   // 33.3 down
+		{amount(335), percentage(10000), amount(34)},   // 33.5 half up
+		{amount(-335), percentage(10000), amount(-34)}, // away from zero
+		{amount(1999), percentage(8875), amount(177)},  // 177.41
+	}
+	for _, test := range tests {
+		if got := test.a.Percent(test.p); got != test.want {
+			t.Error("want", test.want)
+			t.Error("got ", got)
+		}
+	}
+}
+
+func TestFeeLines(t *testing.T) {
+	nights := []quoteLine{
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(-4000), Kind: discountLine},
+	}
+	cleaning := feeRule{
+		Amount: amount(7500),
+		Basis:  perStay,
+		Kind:   feeLine,
+		Name:   "Cleaning",
+	}
+	service := feeRule{
+		Amount: amount(1000),
+		Basis:  perNight,
+		Kind:   feeLine,
+		Name:   "Service",
+	}
+	linens := feeRule{
+		Amount: amount(500),
+		Basis:  perGuest,
+		Kind:   feeLine,
+		Name:   "Linens",
+	}
+	city := feeRule{
+		AppliesTo:  []lineKind{nightLine, discountLine},
+		Basis:      percentOf,
+		Kind:       taxLine,
+		Name:       "City tax",
+		Percentage: percentage(5875),
+	}
+	state := feeRule{
+		AppliesTo:  []lineKind{nightLine, discountLine, feeLine},
+		Basis:      percentOf,
+		Kind:       taxLine,
+		Name:       "State tax",
+		Percentage: percentage(6000),
+	}
+	vat := feeRule{
+		AppliesTo:  []lineKind{nightLine},
+		Basis:      percentOf,
+		Inclusive:  true,
+		Kind:       taxLine,
+		Name:       "VAT",
+		Percentage: percentage(20000),
+	}
+
+	var tests = []struct {
+		rules []feeRule
+		want  []amount
+		total amount
+	}{
+		{nil, nil, amount(36000)},
+		{[]feeRule{cleaning, service, linens}, []amount{7500, 2000, 1500}, amount(47000)},
+
+		// 5.875% of 360.00 = 21.15, 6% of 360.00 + 75.00 = 26.10
+		{[]feeRule{city, cleaning, state}, []amount{2115, 7500, 2610}, amount(48225)},
+
+		// 400.00 includes 400.00 - 400.00 / 1.2 = 66.67
+		{[]feeRule{vat}, []amount{6667}, amount(36000)},
+	}
+	for i, test := range tests {
+		lines := feeLines(test.rules, nights, 3)
+		var got []amount
+		for _, line := range lines {
+			got = append(got, line.Amount)
+		}
+		if !reflect.DeepEqual(test.want, got) {
+			t.Error(i, "want", test.want)
+			t.Error(i, "got ", got)
+		}
+		q := quote{Lines: append(append([]quoteLine{}, nights...), lines...)}
+		if total := q.Total(); total != test.total {
+			t.Error(i, "want", test.total)
+			t.Error(i, "got ", total)
+		}
+	}
+}
+
+func TestPricingFees(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var pricing Pricing
+	err := inject.Populate(db, &pricing)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// AddFee() -> invalidFee
+	invalid := []feeRule{
+		{Name: "", Kind: feeLine, Basis: perStay, Amount: 1},
+		{Name: "x", Kind: "bogus", Basis: perStay, Amount: 1},
+		{Name: "x", Kind: feeLine, Basis: perStay},
+		{Name: "x", Kind: feeLine, Basis: perStay, Amount: 1, Inclusive: true},
+		{Name: "x", Kind: taxLine, Basis: percentOf, Percentage: 1},
+	}
+	for _, f := range invalid {
+		if _, err := pricing.AddFee(f); err != invalidFee {
+			t.Error("want", invalidFee)
+			t.Error("got ", err)
+		}
+	}
+
+	cleaning, err := pricing.AddFee(feeRule{
+		Amount: amount(7500),
+		Basis:  perStay,
+		Kind:   feeLine,
+		Name:   "Cleaning",
+		Rate:   withBunny.Id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tax, err := pricing.AddFee(feeRule{
+		AppliesTo:  []lineKind{nightLine, feeLine},
+		Basis:      percentOf,
+		Kind:       taxLine,
+		Name:       "Occupancy tax",
+		Percentage: percentage(10000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rules, err := pricing.Fees(withBunny.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []feeRule{cleaning, tax}; !reflect.DeepEqual(want, rules) {
+		t.Error("want", want)
+		t.Error("got ", rules)
+	}
+	rules, err = pricing.Fees(withoutBunny.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []feeRule{tax}; !reflect.DeepEqual(want, rules) {
+		t.Error("want", want)
+		t.Error("got ", rules)
+	}
+
+	// 2 nights + cleaning, 10% on both
+	q, err := pricing.Quote(date.New(2015, 1, 1), date.New(2015, 1, 3), withBunny, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != amount(52250) {
+		t.Error("want", amount(52250))
+		t.Error("got ", total)
+	}
+
+	err = pricing.RemoveFee(cleaning.Id)
+	if err != nil {
+		t.Error(err)
+	}
+	if err := pricing.RemoveFee(cleaning.Id); err != feeNotFound {
+		t.Error("want", feeNotFound)
+		t.Error("got ", err)
+	}
+}
@@ -2,8 +2,12 @@ package booking
 
 import (
 	"database/sql"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"time"
 
 	"github.com/cmdrkeene/booking/pkg/date"
 	"github.com/golang/glog"
@@ -11,55 +15,89 @@ import (
 
 // Builds Form instances
 type FormBuilder struct {
-	Calendar *Calendar `inject:""`
-	DB       *sql.DB   `inject:""`
-	Ledger   *Ledger   `inject:""`
-	Register *Register `inject:""`
+	Calendar       *Calendar       `inject:""`
+	Clock          *Clock          `inject:""`
+	DamageDeposits *DamageDeposits `inject:""`
+	DB             *sql.DB         `inject:""`
+	Idempotency    *Idempotency    `inject:""`
+	Ledger         *Ledger         `inject:""`
+	Pricing        *Pricing        `inject:""`
+	Rates          *Rates          `inject:""`
+	Register       *Register       `inject:""`
+	Vault          CardVault       `inject:""`
 }
 
+// Each form is issued a fresh idempotency key, kept across re-renders
 func (b *FormBuilder) Build() *Form {
+	key, err := newIdempotencyKey()
+	if err != nil {
+		panic(err)
+	}
+
 	return &Form{
-		calendar: b.Calendar,
-		db:       b.DB,
-		ledger:   b.Ledger,
-		register: b.Register,
+		calendar:       b.Calendar,
+		clock:          b.Clock,
+		damage:         b.DamageDeposits,
+		db:             b.DB,
+		idempotency:    b.Idempotency,
+		ledger:         b.Ledger,
+		pricing:        b.Pricing,
+		rates:          b.Rates,
+		register:       b.Register,
+		vault:          b.Vault,
+		Guests:         "1",
+		IdempotencyKey: string(key),
 	}
 }
 
 // One page booking form
 type Form struct {
 	// Dependencies
-	calendar *Calendar
-	db       *sql.DB
-	ledger   *Ledger
-	register *Register
+	calendar    *Calendar
+	clock       *Clock
+	damage      *DamageDeposits
+	db          *sql.DB
+	idempotency *Idempotency
+	ledger      *Ledger
+	pricing     *Pricing
+	rates       *Rates
+	register    *Register
+	vault       CardVault
 
 	// Errors
 	Errors map[string]string
 
-	// Input
-	CardCVC    string
-	CardMonth  string
-	CardNumber string
-	CardYear   string
-	Checkin    string
-	Checkout   string
-	Email      string
-	Name       string
-	Phone      string
-	Rate       string
+	// Input. The card number and security code are read straight into the
+	// vault, so they're never kept or shown back
+	CardMonth      string
+	CardYear       string
+	Checkin        string
+	Checkout       string
+	Email          string
+	Guests         string
+	HoldToken      string
+	IdempotencyKey string
+	Name           string
+	Phone          string
+	PromoCode      string
+	Rate           string
+
+	// Set by Hold
+	HoldExpires time.Time
+
+	// Set by Estimate and Submit
+	Quote *quote
 
 	// Private, valid fields
-	cardCVC    int
-	cardMonth  int
-	cardNumber int
-	cardYear   int
-	checkin    date.Date
-	checkout   date.Date
-	email      email
-	name       name
-	phone      phoneNumber
-	rate       rate
+	cardToken      cardToken
+	checkin        date.Date
+	checkout       date.Date
+	email          email
+	guests         int
+	idempotencyKey idempotencyKey
+	name           name
+	phone          phoneNumber
+	rate           rate
 }
 
 func (form *Form) AvailableDates() []date.Date {
@@ -70,21 +108,30 @@ func (form *Form) AvailableDates() []date.Date {
 	return dates
 }
 
+// Rate plans on offer
 func (form *Form) Rates() []rate {
-	return allRates
+	rates, err := form.rates.Active()
+	if err != nil {
+		panic(err)
+	}
+	return rates
 }
 
 const (
-	fvCardCVC    = "CardCVC"
-	fvCardMonth  = "CardMonth"
-	fvCardNumber = "CardNumber"
-	fvCardYear   = "CardYear"
-	fvCheckin    = "Checkin"
-	fvCheckout   = "Checkout"
-	fvEmail      = "Email"
-	fvName       = "Name"
-	fvPhone      = "Phone"
-	fvRate       = "Rate"
+	fvCardCVC        = "CardCVC"
+	fvCardMonth      = "CardMonth"
+	fvCardNumber     = "CardNumber"
+	fvCardYear       = "CardYear"
+	fvCheckin        = "Checkin"
+	fvCheckout       = "Checkout"
+	fvEmail          = "Email"
+	fvGuests         = "Guests"
+	fvHoldToken      = "HoldToken"
+	fvIdempotencyKey = "IdempotencyKey"
+	fvName           = "Name"
+	fvPhone          = "Phone"
+	fvPromoCode      = "PromoCode"
+	fvRate           = "Rate"
 )
 
 // Converts http.Request to Form. Caller must check Errors
@@ -92,28 +139,37 @@ func (form *Form) Validate(r *http.Request) bool {
 	form.Errors = make(map[string]string)
 
 	// map request to fields
-	form.CardCVC = r.FormValue(fvCardCVC)
+	cardCVC := r.FormValue(fvCardCVC)
+	cardNumber := r.FormValue(fvCardNumber)
+	forgetCard(r)
 	form.CardMonth = r.FormValue(fvCardMonth)
-	form.CardNumber = r.FormValue(fvCardNumber)
 	form.CardYear = r.FormValue(fvCardYear)
 	form.Checkin = r.FormValue(fvCheckin)
 	form.Checkout = r.FormValue(fvCheckout)
 	form.Email = r.FormValue(fvEmail)
+	form.Guests = r.FormValue(fvGuests)
+	form.HoldToken = r.FormValue(fvHoldToken)
+	form.IdempotencyKey = r.FormValue(fvIdempotencyKey)
+	if form.IdempotencyKey == "" {
+		form.IdempotencyKey = r.Header.Get(IdempotencyHeader)
+	}
 	form.Name = r.FormValue(fvName)
 	form.Phone = r.FormValue(fvPhone)
+	form.PromoCode = normalPromoCode(r.FormValue(fvPromoCode))
 	form.Rate = r.FormValue(fvRate)
 
 	// new validator
 	validator := newValidator()
 
 	// check required
-	validator.Require(fvCardCVC, form.CardCVC)
+	validator.Require(fvCardCVC, cardCVC)
 	validator.Require(fvCardMonth, form.CardMonth)
-	validator.Require(fvCardNumber, form.CardNumber)
+	validator.Require(fvCardNumber, cardNumber)
 	validator.Require(fvCardYear, form.CardYear)
 	validator.Require(fvCheckin, form.Checkin)
 	validator.Require(fvCheckout, form.Checkout)
 	validator.Require(fvEmail, form.Email)
+	validator.Require(fvGuests, form.Guests)
 	validator.Require(fvName, form.Name)
 	validator.Require(fvPhone, form.Phone)
 	validator.Require(fvRate, form.Rate)
@@ -125,16 +181,27 @@ func (form *Form) Validate(r *http.Request) bool {
 	}
 
 	// check data format
-	form.cardCVC = validator.Integer(fvCardCVC, form.CardCVC)
-	form.cardMonth = validator.Integer(fvCardMonth, form.CardMonth)
-	form.cardNumber = validator.Integer(fvCardNumber, form.CardNumber)
-	form.cardYear = validator.Integer(fvCardYear, form.CardYear)
+	var card creditCard
+	card.Number, card.Brand = validator.CardNumber(fvCardNumber, cardNumber)
+	card.Month, card.Year = validator.CardExpiry(
+		fvCardMonth,
+		form.CardMonth,
+		fvCardYear,
+		form.CardYear,
+		form.clock.Now(),
+	)
+	card.CVC = validator.CardCVC(fvCardCVC, cardCVC, card.Brand)
 	form.checkin = validator.Date(fvCheckin, form.Checkin)
 	form.checkout = validator.Date(fvCheckout, form.Checkout)
 	form.email = validator.Email(fvEmail, form.Email)
+	form.guests = validator.Guests(fvGuests, form.Guests)
+	form.idempotencyKey = validator.IdempotencyKey(
+		fvIdempotencyKey,
+		form.IdempotencyKey,
+	)
 	form.name = validator.Name(fvName, form.Name)
 	form.phone = validator.Phone(fvPhone, form.Phone)
-	form.rate = validator.Rate(fvRate, form.Rate)
+	form.rate = validator.Rate(fvRate, form.Rate, form.Rates())
 
 	// do not continue if anything is invalid
 	if len(validator.Errors) > 0 {
@@ -142,6 +209,135 @@ func (form *Form) Validate(r *http.Request) bool {
 		return false
 	}
 
+	// from here on the card is only a token
+	token, err := form.vault.Tokenize(card)
+	if err != nil {
+		glog.Error(err)
+		form.Errors["Card"] = err.Error()
+		return false
+	}
+	form.cardToken = token
+
+	return true
+}
+
+// Drops the card number and security code from a parsed request so nothing
+// handling it later can see them
+func forgetCard(r *http.Request) {
+	for _, values := range []url.Values{r.Form, r.PostForm} {
+		values.Del(fvCardCVC)
+		values.Del(fvCardNumber)
+	}
+}
+
+// How long a guest has to finish the form once they hold dates
+const formHoldDuration = 15 * time.Minute
+
+// Set aside the requested dates while the guest fills in the rest
+func (form *Form) Hold(r *http.Request) bool {
+	form.Errors = make(map[string]string)
+
+	form.Checkin = r.FormValue(fvCheckin)
+	form.Checkout = r.FormValue(fvCheckout)
+
+	validator := newValidator()
+	validator.Require(fvCheckin, form.Checkin)
+	validator.Require(fvCheckout, form.Checkout)
+	if len(validator.Errors) > 0 {
+		form.Errors = validator.Errors
+		return false
+	}
+
+	form.checkin = validator.Date(fvCheckin, form.Checkin)
+	form.checkout = validator.Date(fvCheckout, form.Checkout)
+	if len(validator.Errors) > 0 {
+		form.Errors = validator.Errors
+		return false
+	}
+
+	h, err := form.register.Hold(
+		form.checkin,
+		form.checkout,
+		formHoldDuration,
+		requestHolder(r),
+	)
+	if err != nil {
+		form.Errors["Hold"] = err.Error()
+		return false
+	}
+
+	form.HoldToken = string(h.Token)
+	form.HoldExpires = h.ExpiresAt
+	return true
+}
+
+// Holds are placed by the address the form's posted from
+func requestHolder(r *http.Request) holder {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return holder(r.RemoteAddr)
+	}
+	return holder(host)
+}
+
+// Price the requested dates and rate before the guest commits
+func (form *Form) Estimate(r *http.Request) bool {
+	form.Errors = make(map[string]string)
+
+	form.Checkin = r.FormValue(fvCheckin)
+	form.Checkout = r.FormValue(fvCheckout)
+	form.HoldToken = r.FormValue(fvHoldToken)
+	form.Guests = r.FormValue(fvGuests)
+	form.PromoCode = normalPromoCode(r.FormValue(fvPromoCode))
+	form.Rate = r.FormValue(fvRate)
+
+	validator := newValidator()
+	validator.Require(fvCheckin, form.Checkin)
+	validator.Require(fvCheckout, form.Checkout)
+	validator.Require(fvGuests, form.Guests)
+	validator.Require(fvRate, form.Rate)
+	if len(validator.Errors) > 0 {
+		form.Errors = validator.Errors
+		return false
+	}
+
+	form.checkin = validator.Date(fvCheckin, form.Checkin)
+	form.checkout = validator.Date(fvCheckout, form.Checkout)
+	form.guests = validator.Guests(fvGuests, form.Guests)
+	form.rate = validator.Rate(fvRate, form.Rate, form.Rates())
+	if len(validator.Errors) > 0 {
+		form.Errors = validator.Errors
+		return false
+	}
+
+	var q quote
+	var err error
+	if form.PromoCode != "" {
+		q, err = form.pricing.PromoQuote(
+			form.checkin,
+			form.checkout,
+			form.rate,
+			form.guests,
+			form.PromoCode,
+		)
+		if err != nil {
+			form.Errors[fvPromoCode] = err.Error()
+			return false
+		}
+	} else {
+		q, err = form.pricing.Quote(
+			form.checkin,
+			form.checkout,
+			form.rate,
+			form.guests,
+		)
+		if err != nil {
+			form.Errors["Quote"] = err.Error()
+			return false
+		}
+	}
+
+	form.Quote = &q
 	return true
 }
 
@@ -159,9 +355,30 @@ func (form *Form) Submit(r *http.Request) (bookingId, bool) {
 	}
 	defer tx.Rollback()
 
-	// register guest
+	// a repeat of an earlier submission gets the same booking, uncharged
+	if form.idempotencyKey != "" {
+		bookingId, found, err := form.idempotency.LookupTx(
+			tx,
+			form.idempotencyKey,
+			form.fingerprint(),
+		)
+		if err == idempotencyKeyReused {
+			form.Errors[fvIdempotencyKey] = err.Error()
+			return 0, false
+		}
+		if err != nil {
+			form.Errors["Transaction"] = err.Error()
+			return 0, false
+		}
+		if found {
+			glog.Infoln("repeated submission for", bookingId)
+			return bookingId, true
+		}
+	}
+
+	// register guest, or find them if they've booked before
 	guestbookTx := &GuestbookTx{tx}
-	guestId, err := guestbookTx.Register(
+	guestId, err := guestbookTx.Find(
 		form.name,
 		form.email,
 		form.phone,
@@ -172,39 +389,123 @@ func (form *Form) Submit(r *http.Request) (bookingId, bool) {
 		return 0, false
 	}
 
-	// charge card
-	err = form.ledger.ChargeTx(
-		tx,
-		guestId,
-		form.rate.Amount,
-		form.creditCard(),
-		memo(form.rate.String()),
-	)
+	// book dates before charging so a conflict never reaches the card
+	var bookingId bookingId
+	if form.HoldToken != "" {
+		bookingId, err = form.register.BookHoldTx(
+			tx,
+			holdToken(form.HoldToken),
+			form.checkin,
+			form.checkout,
+			guestId,
+			form.rate,
+			form.guests,
+		)
+	} else {
+		bookingId, err = form.register.BookTx(
+			tx,
+			form.checkin,
+			form.checkout,
+			guestId,
+			form.rate,
+			form.guests,
+		)
+	}
 	if err != nil {
+		form.Errors["Book"] = err.Error()
 		glog.Error(err)
-		form.Errors["Charge"] = err.Error()
+		return 0, false
+	}
+
+	// a promo code is counted in this transaction, so an unused one is
+	// given back if anything below fails
+	if form.PromoCode != "" {
+		_, err = form.pricing.RedeemTx(tx, form.PromoCode, bookingId)
+		if err != nil {
+			glog.Error(err)
+			form.Errors[fvPromoCode] = err.Error()
+			return 0, false
+		}
+	}
 
+	// charge what the booking was quoted
+	q, err := form.pricing.LookupTx(tx, bookingId)
+	if err != nil {
+		glog.Error(err)
+		form.Errors["Quote"] = err.Error()
 		return 0, false
 	}
+	form.Quote = &q
 
-	// book dates
-	bookingId, err := form.register.BookTx(
-		tx,
+	err = form.ledger.PostQuoteTx(tx, guestId, bookingId, q)
+	if err != nil {
+		glog.Error(err)
+		form.Errors["Charge"] = err.Error()
+		return 0, false
+	}
+
+	// a deposit now and the balance later, if the rate takes one
+	deposit, balance, due := form.rate.Schedule.Split(
+		q.Total(),
 		form.checkin,
-		form.checkout,
+		form.clock.Now(),
+	)
+	if balance > 0 {
+		err = form.ledger.ScheduleTx(tx, bookingId, balance, form.cardToken, due)
+		if err != nil {
+			glog.Error(err)
+			form.Errors["Charge"] = err.Error()
+			return 0, false
+		}
+	}
+
+	payment, err := form.ledger.ChargeTx(
+		tx,
 		guestId,
-		form.rate,
+		bookingId,
+		deposit,
+		form.cardToken,
+		memo(fmt.Sprintf("%s paid by card", bookingId)),
 	)
+	if declined(err) {
+		form.Errors[declinedField(err)] = err.Error()
+		return 0, false
+	}
 	if err != nil {
-		form.Errors["Book"] = err.Error()
 		glog.Error(err)
+		form.Errors["Charge"] = err.Error()
+
 		return 0, false
 	}
 
+	// a damage deposit is held on the same card nearer the time
+	err = form.damage.RecordTx(tx, bookingId, form.cardToken)
+	if err != nil {
+		form.ledger.Unwind(payment)
+		form.Errors["Transaction"] = err.Error()
+		return 0, false
+	}
+
+	// remember this submission
+	if form.idempotencyKey != "" {
+		err = form.idempotency.SaveTx(
+			tx,
+			form.idempotencyKey,
+			form.fingerprint(),
+			bookingId,
+		)
+		if err != nil {
+			form.ledger.Unwind(payment)
+			form.Errors["Transaction"] = err.Error()
+			return 0, false
+		}
+	}
+
 	// commit and tell user if it failed
 	err = tx.Commit()
 	if err != nil {
 		glog.Error(err)
+		form.ledger.Unwind(payment)
 		form.Errors["Transaction"] = err.Error()
 		return 0, false
 	}
@@ -212,13 +513,31 @@ func (form *Form) Submit(r *http.Request) (bookingId, bool) {
 	return bookingId, true
 }
 
-func (f *Form) creditCard() creditCard {
-	return creditCard{
-		CVC:    f.cardCVC,
-		Month:  f.cardMonth,
-		Number: f.cardNumber,
-		Year:   f.cardYear,
+// What a submission asked for and who for, as validated, so a repeat can be
+// told from someone else's submission under the same key
+func (form *Form) fingerprint() submissionFingerprint {
+	return fingerprint(
+		form.checkin.Format(date.ISO8601),
+		form.checkout.Format(date.ISO8601),
+		form.email.String(),
+		strconv.Itoa(form.guests),
+		form.name.String(),
+		form.phone.s,
+		form.rate.Id.String(),
+		form.PromoCode,
+		form.HoldToken,
+	)
+}
+
+// The card detail a guest should change for a decline
+func declinedField(err error) string {
+	switch err {
+	case incorrectCVC:
+		return fvCardCVC
+	case expiredCard:
+		return fvCardYear
 	}
+	return fvCardNumber
 }
 
 type validator struct {
@@ -280,11 +599,80 @@ func (val validator) Phone(k, v string) phoneNumber {
 	return p
 }
 
-func (val validator) Rate(k, v string) rate {
-	r, err := newRate(v)
+func (val validator) IdempotencyKey(k, v string) idempotencyKey {
+	key, err := parseIdempotencyKey(v)
+	if err != nil {
+		val.Errors[k] = "invalid"
+		return ""
+	}
+	return key
+}
+
+func (val validator) CardNumber(k, v string) (string, cardBrand) {
+	number, brand, err := parseCardNumber(v)
+	if err != nil {
+		val.Errors[k] = err.Error()
+	}
+	return number, brand
+}
+
+// Month and four digit year of a card that hasn't expired by now
+func (val validator) CardExpiry(
+	monthKey string,
+	month string,
+	yearKey string,
+	year string,
+	now time.Time,
+) (int, int) {
+	m, err := parseCardMonth(month)
+	if err != nil {
+		val.Errors[monthKey] = err.Error()
+	}
+	y, err := parseCardYear(year)
+	if err != nil {
+		val.Errors[yearKey] = err.Error()
+	}
+	if m == 0 || y == 0 || !cardExpiredAt(m, y, now) {
+		return m, y
+	}
+
+	if y < now.Year() {
+		val.Errors[yearKey] = cardExpired.Error()
+	} else {
+		val.Errors[monthKey] = cardExpired.Error()
+	}
+	return 0, 0
+}
+
+// The security code's length depends on the card's brand
+func (val validator) CardCVC(k, v string, brand cardBrand) string {
+	cvc, err := parseCardCVC(v, brand)
 	if err != nil {
+		val.Errors[k] = err.Error()
+	}
+	return cvc
+}
+
+// At least one
+func (val validator) Guests(k, v string) int {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
 		val.Errors[k] = "invalid"
-		return rate{}
+		return 0
+	}
+	return n
+}
+
+// Rates are chosen by id from those offered
+func (val validator) Rate(k, v string, offered []rate) rate {
+	id, err := strconv.ParseInt(v, 10, 64)
+	if err == nil {
+		for _, r := range offered {
+			if r.Id == rateId(id) {
+				return r
+			}
+		}
 	}
-	return r
+	val.Errors[k] = "invalid"
+	return rate{}
 }
@@ -25,7 +25,9 @@ var formHelpers = template.FuncMap{
 
 func init() {
 	templateForm = template.Must(
-		template.New("form.html.go").Funcs(formHelpers).Parse(templateFormSrc),
+		template.New("form.html.go").
+			Funcs(formHelpers).
+			Parse(templateFormSrc + templateQuoteSrc),
 	)
 }
 
@@ -45,6 +47,7 @@ const templateFormSrc = `
     <h1>Apartment</h1>
     <h3>Book your stay</h3>
     <form action="/" method="post">
+      <input type="hidden" name="IdempotencyKey" value="{{.IdempotencyKey}}" />
       <!-- All Errors -->
       {{if .Errors}}
         <ul class="error">
@@ -90,6 +93,24 @@ const templateFormSrc = `
             class="error"
           {{end}}
         />
+
+        <label>Guests</label>
+        <input 
+          type="number" 
+          name="Guests" 
+          min="1" 
+          value="{{.Guests}}"
+          {{with .Errors.Guests}}
+            class="error"
+          {{end}}
+        />
+
+        <input type="hidden" name="HoldToken" value="{{.HoldToken}}" />
+        {{if .HoldToken}}
+          Held for you until {{.HoldExpires.Format "3:04 PM"}}
+        {{else}}
+          <input type="submit" formaction="/hold" value="Hold these dates" />
+        {{end}}
       </fieldset>
 
       <!-- Rate -->
@@ -108,16 +129,39 @@ const templateFormSrc = `
           <input
             name="Rate" 
             type="radio" 
-            value="{{.Name}}" 
-            {{if equals $currentRate .Name}}
+            value="{{printf "%d" .Id}}" 
+            {{if equals $currentRate (printf "%d" .Id)}}
               checked
             {{end}}
             />
-          <b>{{.Amount}}</b>
+          <b>{{.Price}}</b> / night
           {{.Name}}
+          {{with .Description}}<p>{{.}}</p>{{end}}
+          <small>{{.Policy}}</small>
         </div>
         {{end}}
+
+        <label>Promo Code</label>
+        <input
+          type="text"
+          name="PromoCode"
+          value="{{.PromoCode}}"
+          {{with .Errors.PromoCode}}
+            class="error"
+          {{end}}
+        />
+
+        <input type="submit" formaction="/quote" value="Get a quote" />
+      </fieldset>
+
+      <!-- Quote -->
+      {{with .Quote}}
+      <fieldset>
+        <legend>Your Quote</legend>
+        {{template "quote" .}}
       </fieldset>
+      {{end}}
+
       <fieldset>
         <legend>Guest</legend>
         <table>
@@ -173,7 +217,7 @@ const templateFormSrc = `
               <input 
                 type="text" 
                 name="CardNumber" 
-                value="{{.CardNumber}}"
+                autocomplete="cc-number"
                 {{with .Errors.CardNumber}}
                   class="error"
                 {{end}}
@@ -213,7 +257,7 @@ const templateFormSrc = `
                 type="password" 
                 name="CardCVC" 
                 size="4" 
-                value="{{.CardCVC}}"
+                autocomplete="cc-csc"
                 {{with .Errors.CardCVC}}
                   class="error"
                 {{end}}
@@ -1,11 +1,13 @@
 package booking
 
 import (
+	"bytes"
 	"net/http"
 	"net/url"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/cmdrkeene/booking/pkg/date"
 	"github.com/facebookgo/inject"
@@ -16,7 +18,7 @@ func TestForm(t *testing.T) {
 	defer db.Close()
 	var cal Calendar
 	var formBuilder FormBuilder
-	err := inject.Populate(db, &cal, &formBuilder)
+	err := inject.Populate(&FakeGateway{}, db, &cal, &formBuilder)
 	if err != nil {
 		t.Error(err)
 	}
@@ -49,6 +51,7 @@ func TestForm(t *testing.T) {
 		"Checkin":    "required",
 		"Checkout":   "required",
 		"Email":      "required",
+		"Guests":     "required",
 		"Name":       "required",
 		"Phone":      "required",
 		"Rate":       "required",
@@ -67,6 +70,7 @@ func TestForm(t *testing.T) {
 	vals.Set(fvCheckin, "e")
 	vals.Set(fvCheckout, "f")
 	vals.Set(fvEmail, "g")
+	vals.Set(fvGuests, "0")
 	vals.Set(fvName, "h")
 	vals.Set(fvPhone, "i")
 	vals.Set(fvRate, "j")
@@ -81,13 +85,14 @@ func TestForm(t *testing.T) {
 		t.Error("want Validate() to fail")
 	}
 	errors = map[string]string{
-		"CardCVC":    "invalid",
-		"CardMonth":  "invalid",
-		"CardNumber": "invalid",
-		"CardYear":   "invalid",
+		"CardCVC":    cardCVCInvalid.Error(),
+		"CardMonth":  cardMonthInvalid.Error(),
+		"CardNumber": cardNumberInvalid.Error(),
+		"CardYear":   cardYearInvalid.Error(),
 		"Checkin":    "invalid",
 		"Checkout":   "invalid",
 		"Email":      "invalid",
+		"Guests":     "invalid",
 		"Name":       "invalid",
 		"Phone":      "invalid",
 		"Rate":       "invalid",
@@ -101,14 +106,15 @@ func TestForm(t *testing.T) {
 	vals = url.Values{}
 	vals.Set(fvCardCVC, "123")
 	vals.Set(fvCardMonth, "12")
-	vals.Set(fvCardNumber, "1111222233334444")
-	vals.Set(fvCardYear, "2015")
+	vals.Set(fvCardNumber, "4242 4242 4242 4242")
+	vals.Set(fvCardYear, "2099")
 	vals.Set(fvCheckin, "1/2/2015")
 	vals.Set(fvCheckout, "1/3/2015")
 	vals.Set(fvEmail, "a@b")
+	vals.Set(fvGuests, "2")
 	vals.Set(fvName, "a b")
 	vals.Set(fvPhone, "555-123-4567")
-	vals.Set(fvRate, withBunny.Name)
+	vals.Set(fvRate, "1")
 
 	validRequest, _ := http.NewRequest("POST", "/", strings.NewReader(vals.Encode()))
 	validRequest.Header.Set(
@@ -176,3 +182,522 @@ func TestForm(t *testing.T) {
 // 		t.Error(errs)
 // 	}
 // }
+
+func TestFormHold(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var formBuilder FormBuilder
+	err := inject.Populate(&FakeGateway{}, db, &cal, &formBuilder)
+	if err != nil {
+		t.Error(err)
+	}
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+
+	// Hold() -> required
+	form := formBuilder.Build()
+	emptyRequest, _ := http.NewRequest("POST", "/hold", nil)
+	if form.Hold(emptyRequest) {
+		t.Error("want Hold() to fail")
+	}
+	errors := map[string]string{
+		"Checkin":  "required",
+		"Checkout": "required",
+	}
+	if !reflect.DeepEqual(errors, form.Errors) {
+		t.Error("want", errors)
+		t.Error("got ", form.Errors)
+	}
+
+	// Hold() -> ok
+	vals := url.Values{}
+	vals.Set(fvCheckin, "1/1/2015")
+	vals.Set(fvCheckout, "1/3/2015")
+	holdRequest, _ := http.NewRequest("POST", "/hold", strings.NewReader(vals.Encode()))
+	holdRequest.Header.Set(
+		"Content-Type",
+		"application/x-www-form-urlencoded; param=value",
+	)
+	if !form.Hold(holdRequest) {
+		t.Error("want Hold() to succeed")
+		t.Error("got ", form.Errors)
+	}
+	if form.HoldToken == "" {
+		t.Error("want HoldToken")
+	}
+
+	// Hold() -> already held
+	other := formBuilder.Build()
+	holdRequest, _ = http.NewRequest("POST", "/hold", strings.NewReader(vals.Encode()))
+	holdRequest.Header.Set(
+		"Content-Type",
+		"application/x-www-form-urlencoded; param=value",
+	)
+	if other.Hold(holdRequest) {
+		t.Error("want Hold() to fail")
+	}
+	if e := other.Errors["Hold"]; e != heldByAnother.Error() {
+		t.Error("want", heldByAnother.Error())
+		t.Error("got ", e)
+	}
+}
+
+func TestFormEstimate(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var formBuilder FormBuilder
+	err := inject.Populate(&FakeGateway{}, db, &formBuilder)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Estimate() -> required
+	form := formBuilder.Build()
+	emptyRequest, _ := http.NewRequest("POST", "/quote", nil)
+	if form.Estimate(emptyRequest) {
+		t.Error("want Estimate() to fail")
+	}
+	errors := map[string]string{
+		"Checkin":  "required",
+		"Checkout": "required",
+		"Guests":   "required",
+		"Rate":     "required",
+	}
+	if !reflect.DeepEqual(errors, form.Errors) {
+		t.Error("want", errors)
+		t.Error("got ", form.Errors)
+	}
+
+	// Estimate() -> ok
+	if !form.Estimate(postForm(validFormValues())) {
+		t.Fatal(form.Errors)
+	}
+	if total := form.Quote.Total(); total != amount(40000) {
+		t.Error("want", amount(40000))
+		t.Error("got ", total)
+	}
+}
+
+func validFormValues() url.Values {
+	vals := url.Values{}
+	vals.Set(fvCardCVC, "123")
+	vals.Set(fvCardMonth, "12")
+	vals.Set(fvCardNumber, "4242424242424242")
+	vals.Set(fvCardYear, "2099")
+	vals.Set(fvCheckin, "1/1/2015")
+	vals.Set(fvCheckout, "1/3/2015")
+	vals.Set(fvEmail, "a@b")
+	vals.Set(fvGuests, "2")
+	vals.Set(fvName, "a b")
+	vals.Set(fvPhone, "555-123-4567")
+	vals.Set(fvRate, "1")
+	return vals
+}
+
+func postForm(vals url.Values) *http.Request {
+	r, _ := http.NewRequest("POST", "/", strings.NewReader(vals.Encode()))
+	r.Header.Set(
+		"Content-Type",
+		"application/x-www-form-urlencoded; param=value",
+	)
+	return r
+}
+
+func TestFormSubmitIdempotent(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var formBuilder FormBuilder
+	var register Register
+	err := inject.Populate(&FakeGateway{}, db, &cal, &formBuilder, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+
+	// every form gets its own key
+	form := formBuilder.Build()
+	if form.IdempotencyKey == "" {
+		t.Fatal("want IdempotencyKey")
+	}
+	if other := formBuilder.Build(); other.IdempotencyKey == form.IdempotencyKey {
+		t.Error("want distinct keys")
+	}
+
+	vals := validFormValues()
+	vals.Set(fvIdempotencyKey, form.IdempotencyKey)
+	id, ok := form.Submit(postForm(vals))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+
+	// double click -> same booking, no second guest or charge
+	again := formBuilder.Build()
+	repeat, ok := again.Submit(postForm(vals))
+	if !ok {
+		t.Error(again.Errors)
+	}
+	if repeat != id {
+		t.Error("want", id)
+		t.Error("got ", repeat)
+	}
+
+	// key as a header works the same
+	vals.Del(fvIdempotencyKey)
+	r := postForm(vals)
+	r.Header.Set(IdempotencyHeader, form.IdempotencyKey)
+	repeat, ok = formBuilder.Build().Submit(r)
+	if !ok || repeat != id {
+		t.Error("want", id)
+		t.Error("got ", repeat)
+	}
+
+	list, err := register.List()
+	if err != nil {
+		t.Error(err)
+	}
+	if l := len(list); l != 1 {
+		t.Error("want 1")
+		t.Error("got ", l)
+	}
+
+	// nights debited and card payment credited, once
+	var entries int
+	db.QueryRow(`select count(*) from JournalEntry`).Scan(&entries)
+	if entries != 2 {
+		t.Error("want", 2)
+		t.Error("got ", entries)
+	}
+	testBooksBalance(t, db)
+
+	// someone else with the key -> refused, their booking isn't given away
+	stolen := validFormValues()
+	stolen.Set(fvEmail, "someone@example.com")
+	stolen.Set(fvIdempotencyKey, form.IdempotencyKey)
+	thief := formBuilder.Build()
+	if got, ok := thief.Submit(postForm(stolen)); ok || got != 0 {
+		t.Error("want Submit() to fail")
+		t.Error("got ", got)
+	}
+	if thief.Errors[fvIdempotencyKey] != idempotencyKeyReused.Error() {
+		t.Error("want", idempotencyKeyReused)
+		t.Error("got ", thief.Errors)
+	}
+
+	// a new key is a new submission, which fails on the taken dates
+	r = postForm(vals)
+	r.Header.Set(IdempotencyHeader, "another")
+	fresh := formBuilder.Build()
+	if _, ok := fresh.Submit(r); ok {
+		t.Error("want Submit() to fail")
+	}
+}
+
+func TestFormPromoCode(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var clock Clock
+	var formBuilder FormBuilder
+	var pricing Pricing
+	var register Register
+	err := inject.Populate(&FakeGateway{}, db, &cal, &clock, &formBuilder, &pricing, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2014, 12, 1, 12, 0, 0, 0, time.UTC))
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+	cal.Add(date.New(2015, 1, 3), date.New(2015, 1, 4))
+
+	_, err = pricing.CreatePromo(promoCode{
+		Code:     "NEWS10",
+		EndsOn:   date.New(2014, 12, 31),
+		MaxUses:  1,
+		Percent:  10,
+		StartsOn: date.New(2014, 12, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Estimate() -> unknown code
+	vals := validFormValues()
+	vals.Set(fvPromoCode, "bogus")
+	form := formBuilder.Build()
+	if form.Estimate(postForm(vals)) {
+		t.Error("want Estimate() to fail")
+	}
+	if got := form.Errors[fvPromoCode]; got != promoNotFound.Error() {
+		t.Error("want", promoNotFound)
+		t.Error("got ", got)
+	}
+
+	// Estimate() -> discounted, whatever the case
+	vals.Set(fvPromoCode, " news10 ")
+	if !form.Estimate(postForm(vals)) {
+		t.Fatal(form.Errors)
+	}
+	if total := form.Quote.Total(); total != amount(36000) {
+		t.Error("want", amount(36000))
+		t.Error("got ", total)
+	}
+
+	// Submit() -> redeemed and charged the discounted quote
+	form = formBuilder.Build()
+	id, ok := form.Submit(postForm(vals))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+	q, err := pricing.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != amount(36000) {
+		t.Error("want", amount(36000))
+		t.Error("got ", total)
+	}
+
+	// Submit() -> used up, and nothing booked
+	vals.Set(fvCheckin, "1/3/2015")
+	vals.Set(fvCheckout, "1/5/2015")
+	vals.Set(fvEmail, "c@d")
+	form = formBuilder.Build()
+	if _, ok := form.Submit(postForm(vals)); ok {
+		t.Error("want Submit() to fail")
+	}
+	if got := form.Errors[fvPromoCode]; got != promoUsedUp.Error() {
+		t.Error("want", promoUsedUp)
+		t.Error("got ", got)
+	}
+	list, err := register.List()
+	if err != nil {
+		t.Error(err)
+	}
+	if l := len(list); l != 1 {
+		t.Error("want 1")
+		t.Error("got ", l)
+	}
+}
+
+func TestFormPromoCodePerGuest(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var clock Clock
+	var formBuilder FormBuilder
+	var pricing Pricing
+	var register Register
+	err := inject.Populate(&FakeGateway{}, db, &cal, &clock, &formBuilder, &pricing, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2014, 12, 1, 12, 0, 0, 0, time.UTC))
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+	cal.Add(date.New(2015, 1, 3), date.New(2015, 1, 4))
+	cal.Add(date.New(2015, 1, 5), date.New(2015, 1, 6))
+
+	_, err = pricing.CreatePromo(promoCode{
+		Code:            "ONCE",
+		EndsOn:          date.New(2014, 12, 31),
+		MaxUsesPerGuest: 1,
+		Percent:         10,
+		StartsOn:        date.New(2014, 12, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first booking -> redeemed
+	vals := validFormValues()
+	vals.Set(fvPromoCode, "ONCE")
+	form := formBuilder.Build()
+	first, ok := form.Submit(postForm(vals))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+
+	// same email again -> same guest, who's used it
+	vals.Set(fvCheckin, "1/3/2015")
+	vals.Set(fvCheckout, "1/5/2015")
+	form = formBuilder.Build()
+	if _, ok := form.Submit(postForm(vals)); ok {
+		t.Error("want Submit() to fail")
+	}
+	if got := form.Errors[fvPromoCode]; got != promoUsedByGuest.Error() {
+		t.Error("want", promoUsedByGuest)
+		t.Error("got ", form.Errors)
+	}
+
+	// same email without the code -> booked for the same guest
+	vals.Del(fvPromoCode)
+	form = formBuilder.Build()
+	second, ok := form.Submit(postForm(vals))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+	a, err := register.Lookup(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := register.Lookup(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.GuestId != b.GuestId {
+		t.Error("want", a.GuestId)
+		t.Error("got ", b.GuestId)
+	}
+
+	// another guest -> can still use it
+	vals.Set(fvCheckin, "1/5/2015")
+	vals.Set(fvCheckout, "1/7/2015")
+	vals.Set(fvEmail, "c@d")
+	vals.Set(fvPromoCode, "ONCE")
+	form = formBuilder.Build()
+	if _, ok := form.Submit(postForm(vals)); !ok {
+		t.Error(form.Errors)
+	}
+}
+
+func TestFormSubmitDeclined(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var formBuilder FormBuilder
+	var register Register
+	err := inject.Populate(&FakeGateway{}, db, &cal, &formBuilder, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+
+	var tests = []struct {
+		number string
+		field  string
+		err    error
+	}{
+		{"4000000000000002", fvCardNumber, cardDeclined},
+		{"4000000000009995", fvCardNumber, insufficientFunds},
+		{"4000000000000069", fvCardYear, expiredCard},
+		{"4000000000000127", fvCardCVC, incorrectCVC},
+		{"4000000000000119", "Charge", gatewayTimeout},
+	}
+	for _, test := range tests {
+		vals := validFormValues()
+		vals.Set(fvCardNumber, test.number)
+		form := formBuilder.Build()
+		if _, ok := form.Submit(postForm(vals)); ok {
+			t.Error(test.number, "want Submit() to fail")
+		}
+		want := map[string]string{test.field: test.err.Error()}
+		if !reflect.DeepEqual(want, form.Errors) {
+			t.Error(test.number, "want", want)
+			t.Error(test.number, "got ", form.Errors)
+		}
+	}
+
+	// nothing booked or posted
+	list, err := register.List()
+	if err != nil {
+		t.Error(err)
+	}
+	if l := len(list); l != 0 {
+		t.Error("want 0")
+		t.Error("got ", l)
+	}
+	var entries int
+	db.QueryRow(`select count(*) from JournalEntry`).Scan(&entries)
+	if entries != 0 {
+		t.Error("want 0")
+		t.Error("got ", entries)
+	}
+}
+
+func TestFormForgetsCard(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var formBuilder FormBuilder
+	err := inject.Populate(&FakeGateway{}, db, &cal, &formBuilder)
+	if err != nil {
+		t.Error(err)
+	}
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+
+	vals := validFormValues()
+	vals.Set(fvCardNumber, fakeCardDeclined)
+	vals.Set(fvCardCVC, "987")
+	r := postForm(vals)
+	form := formBuilder.Build()
+	if _, ok := form.Submit(r); ok {
+		t.Error("want Submit() to fail")
+	}
+
+	// not in the request
+	for _, key := range []string{fvCardNumber, fvCardCVC} {
+		if v := r.FormValue(key); v != "" {
+			t.Error(key, "want empty")
+			t.Error(key, "got ", v)
+		}
+	}
+
+	// not in the page shown back to the guest
+	var page bytes.Buffer
+	if err := templateForm.Execute(&page, form); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{fakeCardDeclined, "987"} {
+		if strings.Contains(page.String(), s) {
+			t.Error("want the page without", s)
+		}
+	}
+}
+
+func TestFormValidateCard(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var clock Clock
+	var formBuilder FormBuilder
+	err := inject.Populate(&FakeGateway{}, db, &clock, &formBuilder)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2015, 6, 15, 12, 0, 0, 0, time.UTC))
+
+	var tests = []struct {
+		number, month, year, cvc string
+		errors                   map[string]string
+	}{
+		{"4242424242424242", "6", "15", "123", map[string]string{}},
+		{"378282246310005", "12", "2020", "1234", map[string]string{}},
+		{
+			"4242424242424242", "5", "2015", "123",
+			map[string]string{fvCardMonth: cardExpired.Error()},
+		},
+		{
+			"4242424242424242", "12", "14", "123",
+			map[string]string{fvCardYear: cardExpired.Error()},
+		},
+		{
+			"378282246310005", "12", "2020", "123",
+			map[string]string{fvCardCVC: cardCVCInvalid.Error()},
+		},
+		{
+			"4242424242424241", "12", "2020", "123",
+			map[string]string{fvCardNumber: cardNumberTypo.Error()},
+		},
+	}
+	for _, test := range tests {
+		vals := validFormValues()
+		vals.Set(fvCardNumber, test.number)
+		vals.Set(fvCardMonth, test.month)
+		vals.Set(fvCardYear, test.year)
+		vals.Set(fvCardCVC, test.cvc)
+		form := formBuilder.Build()
+		form.Validate(postForm(vals))
+		if !reflect.DeepEqual(test.errors, form.Errors) {
+			t.Error(test.number, "want", test.errors)
+			t.Error(test.number, "got ", form.Errors)
+		}
+	}
+}
@@ -146,6 +146,30 @@ func (tx *GuestbookTx) Register(
 	return guestId(lastId), nil
 }
 
+// The guest registered under an email, or a new one if there's none. A
+// returning guest keeps the details they first registered with
+func (tx *GuestbookTx) Find(
+	name name,
+	email email,
+	phone phoneNumber,
+) (guestId, error) {
+	stmt, err := tx.Prepare(`select Id from Guestbook where Email = $1`)
+	if err != nil {
+		panic(err)
+	}
+
+	var id guestId
+	err = stmt.QueryRow(email).Scan(&id)
+	if err == sql.ErrNoRows {
+		return tx.Register(name, email, phone)
+	}
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	return id, nil
+}
+
 // A guest record
 type guest struct {
 	Email       email
@@ -155,7 +179,7 @@ type guest struct {
 }
 
 // Locator for a guest record
-type guestId uint8
+type guestId int64
 
 func (id *guestId) Scan(src interface{}) error {
 	n, ok := src.(int64)
@@ -221,6 +245,10 @@ func (n name) Equal(s string) bool {
 	return n.s == s
 }
 
+func (n name) String() string {
+	return n.s
+}
+
 // An electronic mail address
 type email struct {
 	s string
@@ -268,6 +296,10 @@ func (e email) Equal(s string) bool {
 	return e.s == s
 }
 
+func (e email) String() string {
+	return e.s
+}
+
 // A telephone number
 type phoneNumber struct {
 	s string
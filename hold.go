@@ -0,0 +1,315 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// Dates set aside for a guest while they fill in the form. Unexpired holds
+// are as good as a booking to everyone but whoever placed them
+const HoldSchema = `
+  CREATE TABLE Hold (
+    Checkin DATETIME NOT NULL,
+    Checkout DATETIME NOT NULL,
+    ExpiresAt DATETIME NOT NULL,
+    HeldSince DATETIME NOT NULL,
+    Holder TEXT NOT NULL DEFAULT '',
+    Token TEXT PRIMARY KEY NOT NULL,
+    CONSTRAINT ck_Ckin_Less_Than_Ckout CHECK (Checkin < Checkout)
+  )
+`
+
+var holdMigration = statements(
+	`CREATE TABLE Hold (
+    Checkin DATETIME NOT NULL,
+    Checkout DATETIME NOT NULL,
+    ExpiresAt DATETIME NOT NULL,
+    Token TEXT PRIMARY KEY NOT NULL,
+    CONSTRAINT ck_Ckin_Less_Than_Ckout CHECK (Checkin < Checkout)
+  )`,
+)
+
+// Holds remember who placed them, and since when they've held the nights
+// through holding them again. Earlier holds are treated as placed when they
+// expire
+var holdHolderMigration = statements(
+	`ALTER TABLE Hold ADD COLUMN HeldSince DATETIME NOT NULL DEFAULT 0`,
+	`UPDATE Hold SET HeldSince = ExpiresAt`,
+	`ALTER TABLE Hold ADD COLUMN Holder TEXT NOT NULL DEFAULT ''`,
+)
+
+// Unguessable claim on a hold
+type holdToken string
+
+func newHoldToken() (holdToken, error) {
+	s, err := randomHex(16)
+	return holdToken(s), err
+}
+
+// Who placed a hold, e.g. the address a form was posted from. Holds by the
+// same holder don't stand in each other's way. Nobody in particular if empty
+type holder string
+
+// A row in Hold
+type hold struct {
+	Checkin   date.Date
+	Checkout  date.Date
+	ExpiresAt time.Time
+	HeldSince time.Time
+	Holder    holder
+	Token     holdToken
+}
+
+const (
+	// Unexpired holds one holder can have at once
+	maxHoldsPerHolder = 3
+
+	// How long a holder can keep nights by holding them again
+	maxHeldFor = time.Hour
+)
+
+var (
+	heldByAnother = errors.New("dates are being booked by someone else")
+	holdExpired   = errors.New("hold has expired")
+	holdMismatch  = errors.New("dates don't match hold")
+	tooManyHolds  = errors.New("too many dates held at once")
+)
+
+// Set aside dates for d, returning the token needed to book them
+func (r *Register) Hold(
+	checkIn date.Date,
+	checkOut date.Date,
+	d time.Duration,
+	by holder,
+) (hold, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return hold{}, err
+	}
+
+	h, err := r.HoldTx(tx, checkIn, checkOut, d, by)
+	if err != nil {
+		tx.Rollback()
+		glog.Error(err)
+		return hold{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return hold{}, err
+	}
+
+	return h, nil
+}
+
+// A holder can have a few holds at once, and holding nights they already
+// hold keeps them no longer than maxHeldFor from when they were first held -
+// caller is responsible for Commit/Rollback
+func (r *Register) HoldTx(
+	tx *sql.Tx,
+	checkIn date.Date,
+	checkOut date.Date,
+	d time.Duration,
+	by holder,
+) (hold, error) {
+	err := r.checkStay(tx, checkIn, checkOut, 0, "", by)
+	if err != nil {
+		return hold{}, err
+	}
+
+	now := r.Clock.Now().UTC()
+	h := hold{
+		Checkin:   checkIn,
+		Checkout:  checkOut,
+		ExpiresAt: now.Add(d),
+		HeldSince: now,
+		Holder:    by,
+	}
+	if by != "" {
+		var n int
+		err := tx.QueryRow(`
+      select count(*) from Hold where Holder = $1 and ExpiresAt > $2
+    `, by, now).Scan(&n)
+		if err != nil {
+			glog.Error(err)
+			return hold{}, err
+		}
+		if n >= maxHoldsPerHolder {
+			return hold{}, tooManyHolds
+		}
+
+		// nights they already hold are held since they were first held
+		err = tx.QueryRow(`
+      select HeldSince from Hold
+      where Holder = $1 and ExpiresAt > $2 and Checkin < $3 and Checkout > $4
+      order by HeldSince asc
+      limit 1
+    `, by, now, checkOut, checkIn).Scan(&h.HeldSince)
+		if err != nil && err != sql.ErrNoRows {
+			glog.Error(err)
+			return hold{}, err
+		}
+		h.HeldSince = h.HeldSince.UTC()
+		if limit := h.HeldSince.Add(maxHeldFor); h.ExpiresAt.After(limit) {
+			h.ExpiresAt = limit
+		}
+	}
+
+	h.Token, err = newHoldToken()
+	if err != nil {
+		return hold{}, err
+	}
+
+	_, err = tx.Exec(`
+      insert into Hold (Checkin, Checkout, ExpiresAt, HeldSince, Holder, Token)
+      values ($1, $2, $3, $4, $5, $6)
+    `,
+		h.Checkin,
+		h.Checkout,
+		h.ExpiresAt,
+		h.HeldSince,
+		h.Holder,
+		h.Token,
+	)
+	if err != nil {
+		glog.Error(err)
+		return hold{}, err
+	}
+
+	glog.Infoln("held", checkIn, "-", checkOut, "until", h.ExpiresAt)
+	return h, nil
+}
+
+// Turn a hold into a booking - caller is responsible for Commit/Rollback
+func (r *Register) BookHoldTx(
+	tx *sql.Tx,
+	token holdToken,
+	checkIn date.Date,
+	checkOut date.Date,
+	guest guestId,
+	rate rate,
+	guests int,
+) (bookingId, error) {
+	var h hold
+	err := tx.QueryRow(`
+    select Checkin, Checkout, ExpiresAt, Holder, Token
+    from Hold
+    where Token = $1
+  `, token).Scan(&h.Checkin, &h.Checkout, &h.ExpiresAt, &h.Holder, &h.Token)
+	if err == sql.ErrNoRows {
+		return 0, holdExpired
+	}
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	if !h.ExpiresAt.After(r.Clock.Now()) {
+		return 0, holdExpired
+	}
+
+	if h.Checkin != checkIn || h.Checkout != checkOut {
+		return 0, holdMismatch
+	}
+
+	err = r.checkStay(tx, checkIn, checkOut, 0, token, h.Holder)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := r.insertBooking(tx, checkIn, checkOut, guest, rate, guests)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(`delete from Hold where Token = $1`, token)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Give up a hold early
+func (r *Register) Release(token holdToken) error {
+	_, err := r.DB.Exec(`delete from Hold where Token = $1`, token)
+	if err != nil {
+		glog.Error(err)
+	}
+	return err
+}
+
+// Delete expired holds, returning how many there were
+func (r *Register) ReleaseExpired() (int, error) {
+	result, err := r.DB.Exec(
+		`delete from Hold where ExpiresAt <= $1`,
+		r.Clock.Now(),
+	)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	return int(n), nil
+}
+
+// Release expired holds every interval until stop is closed. Run it in its
+// own goroutine
+func (r *Register) ReapHolds(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := r.ReleaseExpired()
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				glog.Infoln("released", n, "expired holds")
+			}
+		}
+	}
+}
+
+// True if an unexpired hold covers a night in [checkIn, checkOut), other
+// than the except hold or another placed by the same holder
+func held(
+	tx *sql.Tx,
+	checkIn date.Date,
+	checkOut date.Date,
+	now time.Time,
+	except holdToken,
+	by holder,
+) (bool, error) {
+	var token holdToken
+	err := tx.QueryRow(`
+    select Token
+    from Hold
+    where Checkin < $1 and Checkout > $2 and ExpiresAt > $3 and Token != $4
+    and (Holder = '' or Holder != $5)
+    limit 1
+  `, checkOut, checkIn, now, except, by).Scan(&token)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,333 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestRegisterHold(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, &clock, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		calendar.Add(date.New(2015, 1, 1).Add(i))
+	}
+	now := time.Date(2014, 12, 1, 9, 0, 0, 0, time.UTC)
+	clock.Set(now)
+
+	// Hold() -> unavailable
+	_, err = register.Hold(
+		date.New(2014, 12, 30),
+		date.New(2015, 1, 2),
+		15*time.Minute,
+		holder(""),
+	)
+	if err != unavailable {
+		t.Error("want", unavailable)
+		t.Error("got ", err)
+	}
+
+	// Hold() -> ok
+	h, err := register.Hold(
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		15*time.Minute,
+		holder(""),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.ExpiresAt.Equal(now.Add(15 * time.Minute)) {
+		t.Error("want", now.Add(15*time.Minute))
+		t.Error("got ", h.ExpiresAt)
+	}
+
+	// held nights are unavailable to everyone else
+	_, err = register.Book(
+		date.New(2015, 1, 4),
+		date.New(2015, 1, 6),
+		guestId(2),
+		withBunny,
+		1,
+	)
+	if err != heldByAnother {
+		t.Error("want", heldByAnother)
+		t.Error("got ", err)
+	}
+	_, err = register.Hold(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 3),
+		15*time.Minute,
+		holder(""),
+	)
+	if err != heldByAnother {
+		t.Error("want", heldByAnother)
+		t.Error("got ", err)
+	}
+
+	// BookHoldTx() -> holdMismatch
+	tx, _ := db.Begin()
+	_, err = register.BookHoldTx(
+		tx,
+		h.Token,
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 6),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	tx.Rollback()
+	if err != holdMismatch {
+		t.Error("want", holdMismatch)
+		t.Error("got ", err)
+	}
+
+	// BookHoldTx() -> ok, and the hold is used up
+	tx, _ = db.Begin()
+	_, err = register.BookHoldTx(
+		tx,
+		h.Token,
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Commit()
+
+	tx, _ = db.Begin()
+	_, err = register.BookHoldTx(
+		tx,
+		h.Token,
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	tx.Rollback()
+	if err != holdExpired {
+		t.Error("want", holdExpired)
+		t.Error("got ", err)
+	}
+
+	// an expired hold doesn't block others, even before it's released
+	h, err = register.Hold(
+		date.New(2015, 1, 6),
+		date.New(2015, 1, 8),
+		15*time.Minute,
+		holder(""),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(15 * time.Minute)
+
+	tx, _ = db.Begin()
+	_, err = register.BookHoldTx(
+		tx,
+		h.Token,
+		date.New(2015, 1, 6),
+		date.New(2015, 1, 8),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	tx.Rollback()
+	if err != holdExpired {
+		t.Error("want", holdExpired)
+		t.Error("got ", err)
+	}
+
+	_, err = register.Book(
+		date.New(2015, 1, 7),
+		date.New(2015, 1, 9),
+		guestId(2),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// ReleaseExpired() -> 1
+	n, err := register.ReleaseExpired()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 1 {
+		t.Error("want 1")
+		t.Error("got ", n)
+	}
+
+	// Release() -> nights free again
+	h, err = register.Hold(
+		date.New(2015, 1, 9),
+		date.New(2015, 1, 10),
+		15*time.Minute,
+		holder(""),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = register.Release(h.Token)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = register.Book(
+		date.New(2015, 1, 9),
+		date.New(2015, 1, 10),
+		guestId(3),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegisterHoldByHolder(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, &clock, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		calendar.Add(date.New(2015, 1, 1).Add(i))
+	}
+	now := time.Date(2014, 12, 1, 9, 0, 0, 0, time.UTC)
+	clock.Set(now)
+
+	guest := holder("192.0.2.1")
+	first, err := register.Hold(date.New(2015, 1, 2), date.New(2015, 1, 4), 15*time.Minute, guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold() -> another holder is kept out
+	_, err = register.Hold(date.New(2015, 1, 3), date.New(2015, 1, 5), 15*time.Minute, holder("192.0.2.2"))
+	if err != heldByAnother {
+		t.Error("want", heldByAnother)
+		t.Error("got ", err)
+	}
+
+	// Hold() -> the same holder isn't
+	second, err := register.Hold(date.New(2015, 1, 3), date.New(2015, 1, 5), 15*time.Minute, guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// BookHoldTx() -> their other hold doesn't get in the way
+	tx, _ := db.Begin()
+	_, err = register.BookHoldTx(
+		tx,
+		second.Token,
+		date.New(2015, 1, 3),
+		date.New(2015, 1, 5),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	tx.Rollback()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Hold() -> tooManyHolds
+	_, err = register.Hold(date.New(2015, 1, 6), date.New(2015, 1, 7), 15*time.Minute, guest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = register.Hold(date.New(2015, 1, 8), date.New(2015, 1, 9), 15*time.Minute, guest)
+	if err != tooManyHolds {
+		t.Error("want", tooManyHolds)
+		t.Error("got ", err)
+	}
+	register.Release(first.Token)
+	register.Release(second.Token)
+
+	// holding again -> held no longer than maxHeldFor from the first hold
+	var h hold
+	for i := 0; i < 5; i++ {
+		h, err = register.Hold(date.New(2015, 1, 8), date.New(2015, 1, 10), 15*time.Minute, guest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(14 * time.Minute)
+	}
+	if !h.HeldSince.Equal(now) || !h.ExpiresAt.Equal(now.Add(maxHeldFor)) {
+		t.Error("want", now, now.Add(maxHeldFor))
+		t.Error("got ", h.HeldSince, h.ExpiresAt)
+	}
+}
+
+func TestRegisterReapHolds(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, &clock, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	calendar.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+	clock.Set(time.Date(2014, 12, 1, 9, 0, 0, 0, time.UTC))
+
+	_, err = register.Hold(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 3),
+		10*time.Minute,
+		holder(""),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go register.ReapHolds(time.Millisecond, stop)
+
+	var count = func() int {
+		var n int
+		db.QueryRow(`select count(*) from Hold`).Scan(&n)
+		return n
+	}
+
+	// not yet expired
+	time.Sleep(10 * time.Millisecond)
+	if n := count(); n != 1 {
+		t.Error("want 1")
+		t.Error("got ", n)
+	}
+
+	// expired -> reaped
+	clock.Advance(10 * time.Minute)
+	deadline := time.Now().Add(time.Second)
+	for count() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := count(); n != 0 {
+		t.Error("want 0")
+		t.Error("got ", n)
+	}
+}
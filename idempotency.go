@@ -0,0 +1,181 @@
+package booking
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Remembers which booking a submission made, so repeating it with the same
+// key returns that booking instead of charging and booking again. Keys are
+// picked by clients, so each is kept with a fingerprint of what was
+// submitted and only the same submission gets the booking back
+type Idempotency struct {
+	Clock *Clock  `inject:""`
+	DB    *sql.DB `inject:""`
+
+	// How long a key is remembered, DefaultIdempotencyWindow if zero
+	Window time.Duration
+}
+
+const DefaultIdempotencyWindow = 24 * time.Hour
+
+// HTTP header clients may send instead of the form field
+const IdempotencyHeader = "Idempotency-Key"
+
+const IdempotencySchema = `
+  CREATE TABLE Idempotency (
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    CreatedAt DATETIME NOT NULL,
+    ExpiresAt DATETIME NOT NULL,
+    Fingerprint TEXT NOT NULL DEFAULT '',
+    Key TEXT PRIMARY KEY NOT NULL
+  )
+`
+
+var idempotencyMigration = statements(
+	`CREATE TABLE Idempotency (
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    CreatedAt DATETIME NOT NULL,
+    ExpiresAt DATETIME NOT NULL,
+    Key TEXT PRIMARY KEY NOT NULL
+  )`,
+)
+
+// Keys saved before fingerprints match nothing, so can't be replayed
+var idempotencyFingerprintMigration = statements(
+	`ALTER TABLE Idempotency ADD COLUMN Fingerprint TEXT NOT NULL DEFAULT ''`,
+)
+
+// Client chosen name for one attempt at a submission
+type idempotencyKey string
+
+var (
+	invalidIdempotencyKey = errors.New("invalid idempotency key")
+	idempotencyKeyReused  = errors.New("idempotency key was used for a different submission")
+)
+
+// A hash of what was submitted under a key, so nobody else's submission can
+// claim its booking
+type submissionFingerprint string
+
+// Hashes the fields of a submission in order
+func fingerprint(fields ...string) submissionFingerprint {
+	h := sha256.New()
+	for _, f := range fields {
+		io.WriteString(h, f)
+		h.Write([]byte{0})
+	}
+	return submissionFingerprint(hex.EncodeToString(h.Sum(nil)))
+}
+
+func newIdempotencyKey() (idempotencyKey, error) {
+	s, err := randomHex(16)
+	return idempotencyKey(s), err
+}
+
+// Keys come from clients, so only bound their size
+func parseIdempotencyKey(s string) (idempotencyKey, error) {
+	if len(s) > 255 {
+		return "", invalidIdempotencyKey
+	}
+	return idempotencyKey(s), nil
+}
+
+func (i *Idempotency) window() time.Duration {
+	if i.Window == 0 {
+		return DefaultIdempotencyWindow
+	}
+	return i.Window
+}
+
+// The booking an unexpired key made, if any. A key saved for a different
+// submission is refused rather than giving away its booking
+func (i *Idempotency) LookupTx(
+	tx *sql.Tx,
+	key idempotencyKey,
+	f submissionFingerprint,
+) (bookingId, bool, error) {
+	var id bookingId
+	var saved submissionFingerprint
+	err := tx.QueryRow(`
+    select BookingId, Fingerprint
+    from Idempotency
+    where Key = $1 and ExpiresAt > $2
+  `, key, i.Clock.Now()).Scan(&id, &saved)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		glog.Error(err)
+		return 0, false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(saved), []byte(f)) != 1 {
+		glog.Warningln("idempotency key replayed with a different submission")
+		return 0, false, idempotencyKeyReused
+	}
+	return id, true, nil
+}
+
+// Remember the booking a key made, and what was submitted to make it. An
+// expired key may be reused - caller is responsible for Commit/Rollback
+func (i *Idempotency) SaveTx(
+	tx *sql.Tx,
+	key idempotencyKey,
+	f submissionFingerprint,
+	id bookingId,
+) error {
+	now := i.Clock.Now()
+	_, err := tx.Exec(
+		`delete from Idempotency where Key = $1 and ExpiresAt <= $2`,
+		key,
+		now,
+	)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	_, err = tx.Exec(`
+      insert into Idempotency (BookingId, CreatedAt, ExpiresAt, Fingerprint, Key)
+      values ($1, $2, $3, $4, $5)
+    `,
+		id,
+		now,
+		now.Add(i.window()),
+		f,
+		key,
+	)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// Forget expired keys, returning how many there were
+func (i *Idempotency) ReleaseExpired() (int, error) {
+	result, err := i.DB.Exec(
+		`delete from Idempotency where ExpiresAt <= $1`,
+		i.Clock.Now(),
+	)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	return int(n), nil
+}
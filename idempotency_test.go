@@ -0,0 +1,131 @@
+package booking
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/inject"
+)
+
+func TestIdempotency(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var clock Clock
+	var idempotency Idempotency
+	err := inject.Populate(&clock, db, &idempotency)
+	if err != nil {
+		t.Error(err)
+	}
+	idempotency.Window = time.Hour
+	clock.Set(time.Date(2015, 1, 1, 9, 0, 0, 0, time.UTC))
+
+	submission := fingerprint("2015-01-01", "guest@example.com")
+	var lookup = func(key idempotencyKey) (bookingId, bool) {
+		tx, _ := db.Begin()
+		defer tx.Rollback()
+		id, found, err := idempotency.LookupTx(tx, key, submission)
+		if err != nil {
+			t.Error(err)
+		}
+		return id, found
+	}
+	var save = func(key idempotencyKey, id bookingId) error {
+		tx, _ := db.Begin()
+		err := idempotency.SaveTx(tx, key, submission, id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// LookupTx() -> not found
+	if _, found := lookup("a"); found {
+		t.Error("want not found")
+	}
+
+	// SaveTx(), LookupTx() -> found
+	err = save("a", bookingId(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, found := lookup("a"); !found || id != bookingId(7) {
+		t.Error("want", bookingId(7))
+		t.Error("got ", id)
+	}
+
+	// LookupTx() -> someone else's submission can't have it
+	tx, _ := db.Begin()
+	other := fingerprint("2015-01-01", "someone@example.com")
+	id, found, err := idempotency.LookupTx(tx, "a", other)
+	tx.Rollback()
+	if err != idempotencyKeyReused || found || id != 0 {
+		t.Error("want", idempotencyKeyReused)
+		t.Error("got ", id, found, err)
+	}
+
+	// SaveTx() -> a live key can't be reused
+	if err := save("a", bookingId(8)); err == nil {
+		t.Error("want error")
+	}
+
+	// expired -> forgotten, and reusable
+	clock.Advance(time.Hour)
+	if _, found := lookup("a"); found {
+		t.Error("want not found")
+	}
+	err = save("a", bookingId(8))
+	if err != nil {
+		t.Error(err)
+	}
+	if id, found := lookup("a"); !found || id != bookingId(8) {
+		t.Error("want", bookingId(8))
+		t.Error("got ", id)
+	}
+
+	// ReleaseExpired()
+	err = save("b", bookingId(9))
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Advance(2 * time.Hour)
+	n, err := idempotency.ReleaseExpired()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 2 {
+		t.Error("want 2")
+		t.Error("got ", n)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	a := fingerprint("ab", "c")
+	if a != fingerprint("ab", "c") {
+		t.Error("want the same fingerprint for the same fields")
+	}
+	if a == fingerprint("a", "bc") {
+		t.Error("want fields kept apart")
+	}
+}
+
+func TestParseIdempotencyKey(t *testing.T) {
+	var tests = []struct {
+		input string
+		err   error
+	}{
+		{"", nil},
+		{"abc-123", nil},
+		{strings.Repeat("k", 255), nil},
+		{strings.Repeat("k", 256), invalidIdempotencyKey},
+	}
+
+	for _, tt := range tests {
+		_, err := parseIdempotencyKey(tt.input)
+		if err != tt.err {
+			t.Error("want", tt.err)
+			t.Error("got ", err)
+		}
+	}
+}
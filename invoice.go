@@ -0,0 +1,783 @@
+package booking
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// Invoices for bookings, from what was quoted and what's on the guest's
+// account for them. Once issued an invoice never changes: when a booking
+// does, the last invoice is cancelled by a credit note and a new one issued
+type Invoices struct {
+	Clock   *Clock   `inject:""`
+	DB      *sql.DB  `inject:""`
+	Pricing *Pricing `inject:""`
+}
+
+// Invoices and credit notes share one sequence of numbers with no gaps.
+// Who's billed and for which stay are copied so they read as when issued
+const InvoiceSchema = `
+  CREATE TABLE Invoice (
+    BillTo TEXT NOT NULL,
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    Checkin DATETIME NOT NULL,
+    Checkout DATETIME NOT NULL,
+    Code TEXT NOT NULL,
+    Corrects INTEGER NOT NULL DEFAULT 0,
+    Currency TEXT NOT NULL,
+    IssuedAt DATETIME NOT NULL,
+    Kind TEXT NOT NULL,
+    Number INTEGER PRIMARY KEY NOT NULL,
+    CONSTRAINT ck_Number_Positive CHECK (Number > 0)
+  )
+`
+
+const InvoiceLineSchema = `
+  CREATE TABLE InvoiceLine (
+    Amount INTEGER NOT NULL,
+    Day DATETIME NOT NULL,
+    Description TEXT NOT NULL,
+    Included BOOLEAN NOT NULL DEFAULT 0,
+    InvoiceNumber INTEGER NOT NULL REFERENCES Invoice(Number),
+    Kind TEXT NOT NULL,
+    Position INTEGER NOT NULL,
+    PRIMARY KEY (InvoiceNumber, Position)
+  )
+`
+
+// Issued is issued: the database refuses to change or remove either table
+const InvoiceTriggerSchema = `
+  CREATE TRIGGER InvoiceUpdate BEFORE UPDATE ON Invoice
+  BEGIN SELECT RAISE(ABORT, 'invoices can''t change once issued'); END;
+  CREATE TRIGGER InvoiceDelete BEFORE DELETE ON Invoice
+  BEGIN SELECT RAISE(ABORT, 'invoices can''t change once issued'); END;
+  CREATE TRIGGER InvoiceLineUpdate BEFORE UPDATE ON InvoiceLine
+  BEGIN SELECT RAISE(ABORT, 'invoices can''t change once issued'); END;
+  CREATE TRIGGER InvoiceLineDelete BEFORE DELETE ON InvoiceLine
+  BEGIN SELECT RAISE(ABORT, 'invoices can''t change once issued'); END;
+`
+
+var invoiceMigration = statements(
+	`CREATE TABLE Invoice (
+    BillTo TEXT NOT NULL,
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    Checkin DATETIME NOT NULL,
+    Checkout DATETIME NOT NULL,
+    Code TEXT NOT NULL,
+    Corrects INTEGER NOT NULL DEFAULT 0,
+    Currency TEXT NOT NULL,
+    IssuedAt DATETIME NOT NULL,
+    Kind TEXT NOT NULL,
+    Number INTEGER PRIMARY KEY NOT NULL,
+    CONSTRAINT ck_Number_Positive CHECK (Number > 0)
+  )`,
+	`CREATE TABLE InvoiceLine (
+    Amount INTEGER NOT NULL,
+    Day DATETIME NOT NULL,
+    Description TEXT NOT NULL,
+    Included BOOLEAN NOT NULL DEFAULT 0,
+    InvoiceNumber INTEGER NOT NULL REFERENCES Invoice(Number),
+    Kind TEXT NOT NULL,
+    Position INTEGER NOT NULL,
+    PRIMARY KEY (InvoiceNumber, Position)
+  )`,
+	`CREATE TRIGGER InvoiceUpdate BEFORE UPDATE ON Invoice
+  BEGIN SELECT RAISE(ABORT, 'invoices can''t change once issued'); END`,
+	`CREATE TRIGGER InvoiceDelete BEFORE DELETE ON Invoice
+  BEGIN SELECT RAISE(ABORT, 'invoices can''t change once issued'); END`,
+	`CREATE TRIGGER InvoiceLineUpdate BEFORE UPDATE ON InvoiceLine
+  BEGIN SELECT RAISE(ABORT, 'invoices can''t change once issued'); END`,
+	`CREATE TRIGGER InvoiceLineDelete BEFORE DELETE ON InvoiceLine
+  BEGIN SELECT RAISE(ABORT, 'invoices can''t change once issued'); END`,
+)
+
+// An invoice, or a credit note cancelling one
+type invoiceKind string
+
+const (
+	invoiceKindInvoice = invoiceKind("invoice")
+	invoiceKindCredit  = invoiceKind("credit note")
+)
+
+// Besides the quote's kinds of line, invoices have charges and credits put
+// on the guest's account since, e.g. for damage or a cancellation, and
+// payments, which are negative, and refunds of them
+const (
+	adjustmentLine = lineKind("adjustment")
+	paymentLine    = lineKind("payment")
+)
+
+// One line of an invoice. Day is the night, or when it was posted
+type invoiceLine struct {
+	Amount      amount
+	Day         date.Date
+	Description string
+	Included    bool
+	Kind        lineKind
+}
+
+// A numbered invoice or credit note. A credit note Corrects an invoice,
+// with its charges negated and no payments
+type invoice struct {
+	BillTo    string
+	BookingId bookingId
+	Checkin   date.Date
+	Checkout  date.Date
+	Code      confirmationCode
+	Corrects  int64
+	Currency  currency
+	IssuedAt  time.Time
+	Kind      invoiceKind
+	Lines     []invoiceLine
+	Number    int64
+}
+
+var (
+	invoiceNotFound  = errors.New("invoice not found")
+	invoiceCredited  = errors.New("invoice has already been credited")
+	creditNoteCredit = errors.New("only an invoice can be credited")
+)
+
+// Printed invoice number, e.g. "000042"
+func (i invoice) Reference() string {
+	return fmt.Sprintf("%06d", i.Number)
+}
+
+func (i invoice) Title() string {
+	if i.Kind == invoiceKindCredit {
+		return fmt.Sprintf("Credit note %s", i.Reference())
+	}
+	return fmt.Sprintf("Invoice %s", i.Reference())
+}
+
+// One of the invoice's amounts in its currency
+func (i invoice) Money(a amount) money {
+	return money{Amount: a, Currency: i.Currency}
+}
+
+func (i invoice) lines(keep func(invoiceLine) bool) []invoiceLine {
+	var list []invoiceLine
+	for _, line := range i.Lines {
+		if keep(line) {
+			list = append(list, line)
+		}
+	}
+	return list
+}
+
+// Nights, discounts, fees and adjustments
+func (i invoice) Items() []invoiceLine {
+	return i.lines(func(l invoiceLine) bool {
+		return l.Kind != taxLine && l.Kind != paymentLine
+	})
+}
+
+// Taxes charged, then those included in prices
+func (i invoice) Taxes() []invoiceLine {
+	return append(
+		i.lines(func(l invoiceLine) bool { return l.Kind == taxLine && !l.Included }),
+		i.lines(func(l invoiceLine) bool { return l.Kind == taxLine && l.Included })...,
+	)
+}
+
+func (i invoice) Payments() []invoiceLine {
+	return i.lines(func(l invoiceLine) bool { return l.Kind == paymentLine })
+}
+
+func sumLines(lines []invoiceLine) amount {
+	var sum amount
+	for _, line := range lines {
+		if !line.Included {
+			sum += line.Amount
+		}
+	}
+	return sum
+}
+
+func (i invoice) Subtotal() amount {
+	return sumLines(i.Items())
+}
+
+// Taxes on top of prices
+func (i invoice) Tax() amount {
+	return sumLines(i.Taxes())
+}
+
+func (i invoice) Total() amount {
+	return i.Subtotal() + i.Tax()
+}
+
+// Paid less refunded, when it was issued
+func (i invoice) Paid() amount {
+	return -sumLines(i.Payments())
+}
+
+func (i invoice) BalanceDue() amount {
+	return i.Total() - i.Paid()
+}
+
+// Whether two invoices bill the same things to the same guest
+func (i invoice) same(o invoice) bool {
+	if i.BillTo != o.BillTo || i.Checkin != o.Checkin ||
+		i.Checkout != o.Checkout || i.Currency != o.Currency ||
+		len(i.Lines) != len(o.Lines) {
+		return false
+	}
+	for n := range i.Lines {
+		if i.Lines[n] != o.Lines[n] {
+			return false
+		}
+	}
+	return true
+}
+
+// Issues an invoice for a booking as it stands, or returns the last one if
+// nothing's changed. If something has, the last one is credited first
+func (is *Invoices) Issue(id bookingId) (invoice, error) {
+	tx, err := is.DB.Begin()
+	if err != nil {
+		return invoice{}, err
+	}
+	defer tx.Rollback()
+
+	i, err := is.draftTx(tx, id)
+	if err != nil {
+		return invoice{}, err
+	}
+
+	last, err := lastInvoiceTx(tx, id)
+	switch err {
+	case nil:
+		if last.same(i) {
+			return last, nil
+		}
+		_, err = is.creditTx(tx, last)
+		if err != nil {
+			return invoice{}, err
+		}
+	case invoiceNotFound:
+	default:
+		return invoice{}, err
+	}
+
+	i.Number, err = insertInvoiceTx(tx, i)
+	if err != nil {
+		return invoice{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return invoice{}, err
+	}
+
+	glog.Infoln("issued invoice", i.Number, "for", id)
+	return i, nil
+}
+
+// Cancels an invoice with a credit note for all of it, e.g. to correct it
+// by hand
+func (is *Invoices) Credit(number int64) (invoice, error) {
+	tx, err := is.DB.Begin()
+	if err != nil {
+		return invoice{}, err
+	}
+	defer tx.Rollback()
+
+	i, err := lookupInvoiceTx(tx, number)
+	if err != nil {
+		return invoice{}, err
+	}
+	c, err := is.creditTx(tx, i)
+	if err != nil {
+		return invoice{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return invoice{}, err
+	}
+	return c, nil
+}
+
+// Issues a credit note for an invoice not yet credited - caller is
+// responsible for Commit/Rollback
+func (is *Invoices) creditTx(tx *sql.Tx, i invoice) (invoice, error) {
+	if i.Kind != invoiceKindInvoice {
+		return invoice{}, creditNoteCredit
+	}
+	var n int
+	err := tx.QueryRow(
+		`select count(*) from Invoice where Corrects = $1`,
+		i.Number,
+	).Scan(&n)
+	if err != nil {
+		glog.Error(err)
+		return invoice{}, err
+	}
+	if n > 0 {
+		return invoice{}, invoiceCredited
+	}
+
+	c := i
+	c.Corrects = i.Number
+	c.IssuedAt = is.Clock.Now().UTC()
+	c.Kind = invoiceKindCredit
+	c.Lines = nil
+	for _, line := range i.Lines {
+		if line.Kind == paymentLine {
+			continue
+		}
+		line.Amount = -line.Amount
+		c.Lines = append(c.Lines, line)
+	}
+
+	c.Number, err = insertInvoiceTx(tx, c)
+	if err != nil {
+		return invoice{}, err
+	}
+
+	glog.Infoln("credited invoice", i.Number, "with", c.Number)
+	return c, nil
+}
+
+// What an invoice for a booking would say now: the lines of the quote it's
+// on, then what's been charged or credited to the guest's account for it
+// outside the quote, then payments and refunds
+func (is *Invoices) draftTx(tx *sql.Tx, id bookingId) (invoice, error) {
+	b, err := lookupBooking(tx, id)
+	if err != nil {
+		return invoice{}, err
+	}
+	g, err := (&GuestbookTx{tx}).Lookup(b.GuestId)
+	if err != nil {
+		return invoice{}, err
+	}
+	q, err := is.Pricing.LookupTx(tx, id)
+	if err != nil {
+		return invoice{}, err
+	}
+
+	i := invoice{
+		BillTo:    fmt.Sprintf("%s <%s>", g.Name, g.Email),
+		BookingId: id,
+		Checkin:   b.Checkin,
+		Checkout:  b.Checkout,
+		Code:      b.Code,
+		Currency:  q.Currency,
+		IssuedAt:  is.Clock.Now().UTC(),
+		Kind:      invoiceKindInvoice,
+	}
+	for _, line := range q.Lines {
+		i.Lines = append(i.Lines, invoiceLine{
+			Amount:      line.Amount,
+			Day:         line.Night,
+			Description: line.Description,
+			Included:    line.Included,
+			Kind:        line.Kind,
+		})
+	}
+
+	account, err := accountLinesTx(tx, b)
+	if err != nil {
+		return invoice{}, err
+	}
+	var payments []invoiceLine
+	for _, line := range account {
+		if line.Kind == paymentLine {
+			payments = append(payments, line)
+		} else {
+			i.Lines = append(i.Lines, line)
+		}
+	}
+	i.Lines = append(i.Lines, payments...)
+	return i, nil
+}
+
+// Lines on a guest's account posted for a booking, except those for the
+// price it was quoted at. Entries on the guest's account not linked to any
+// booking are logged rather than guessed at from their memo.
+func accountLinesTx(tx *sql.Tx, b booking) ([]invoiceLine, error) {
+	var unlinked int
+	err := tx.QueryRow(`
+    select count(distinct e.Id)
+    from JournalLine l
+    join JournalEntry e on e.Id = l.EntryId
+    where l.Account = $1 and l.GuestId = $2 and e.BookingId = 0
+  `,
+		receivable,
+		b.GuestId,
+	).Scan(&unlinked)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	if unlinked > 0 {
+		glog.Warningln(
+			"invoice for", b.Id, "leaves off", unlinked,
+			"entries on guest", b.GuestId, "not linked to a booking",
+		)
+	}
+
+	rows, err := tx.Query(`
+    select
+      l.Amount,
+      e.Memo,
+      e.PostedAt,
+      exists (
+        select 1 from JournalLine o
+        where o.EntryId = e.Id and o.Account = $1
+      ),
+      exists (
+        select 1 from JournalLine o
+        where o.EntryId = e.Id and o.Account in ($2, $3)
+      )
+    from JournalLine l
+    join JournalEntry e on e.Id = l.EntryId
+    where l.Account = $4 and l.GuestId = $5 and e.BookingId = $6
+    order by e.Id asc
+  `,
+		clearing,
+		revenue,
+		taxesPayable,
+		receivable,
+		b.GuestId,
+		b.Id,
+	)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []invoiceLine
+	for rows.Next() {
+		var line invoiceLine
+		var m memo
+		var postedAt time.Time
+		var card, priced bool
+		err := rows.Scan(&line.Amount, &m, &postedAt, &card, &priced)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		line.Day, _ = date.Parse(postedAt)
+
+		switch {
+		case card && line.Amount < 0:
+			line.Description = "Paid by card"
+			line.Kind = paymentLine
+		case card:
+			line.Description = "Refunded to card"
+			line.Kind = paymentLine
+		case priced:
+			continue
+		default:
+			line.Description = describeMemo(m, b.Id)
+			line.Kind = adjustmentLine
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+// A memo without the booking it's for, e.g. "bookingId:5 damage: lamp"
+// reads "Damage: lamp"
+func describeMemo(m memo, id bookingId) string {
+	s := strings.Join(strings.Fields(
+		strings.Replace(" "+string(m)+" ", " "+id.String()+" ", " ", 1),
+	), " ")
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// Stores an invoice under the next number - caller is responsible for
+// Commit/Rollback
+func insertInvoiceTx(tx *sql.Tx, i invoice) (int64, error) {
+	var number int64
+	err := tx.QueryRow(
+		`select coalesce(max(Number), 0) + 1 from Invoice`,
+	).Scan(&number)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	_, err = tx.Exec(`
+    insert into Invoice
+    (BillTo, BookingId, Checkin, Checkout, Code, Corrects, Currency, IssuedAt,
+      Kind, Number)
+    values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+  `,
+		i.BillTo,
+		i.BookingId,
+		i.Checkin,
+		i.Checkout,
+		i.Code,
+		i.Corrects,
+		i.Currency,
+		i.IssuedAt,
+		i.Kind,
+		number,
+	)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`
+    insert into InvoiceLine
+    (Amount, Day, Description, Included, InvoiceNumber, Kind, Position)
+    values ($1, $2, $3, $4, $5, $6, $7)
+  `)
+	if err != nil {
+		panic(err)
+	}
+	defer stmt.Close()
+
+	for n, line := range i.Lines {
+		_, err := stmt.Exec(
+			line.Amount,
+			line.Day,
+			line.Description,
+			line.Included,
+			number,
+			line.Kind,
+			n,
+		)
+		if err != nil {
+			glog.Error(err)
+			return 0, err
+		}
+	}
+	return number, nil
+}
+
+const invoiceSelect = `
+    select BillTo, BookingId, Checkin, Checkout, Code, Corrects, Currency,
+    IssuedAt, Kind, Number
+    from Invoice
+  `
+
+func scanInvoice(row scanner) (invoice, error) {
+	var i invoice
+	err := row.Scan(
+		&i.BillTo,
+		&i.BookingId,
+		&i.Checkin,
+		&i.Checkout,
+		&i.Code,
+		&i.Corrects,
+		&i.Currency,
+		&i.IssuedAt,
+		&i.Kind,
+		&i.Number,
+	)
+	i.IssuedAt = i.IssuedAt.UTC()
+	return i, err
+}
+
+func invoiceLinesTx(tx *sql.Tx, number int64) ([]invoiceLine, error) {
+	rows, err := tx.Query(`
+    select Amount, Day, Description, Included, Kind
+    from InvoiceLine
+    where InvoiceNumber = $1
+    order by Position asc
+  `, number)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []invoiceLine
+	for rows.Next() {
+		var line invoiceLine
+		err := rows.Scan(
+			&line.Amount,
+			&line.Day,
+			&line.Description,
+			&line.Included,
+			&line.Kind,
+		)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+	return lines, rows.Err()
+}
+
+func lookupInvoiceTx(tx *sql.Tx, number int64) (invoice, error) {
+	return findInvoiceTx(tx, invoiceSelect+`where Number = $1`, number)
+}
+
+// A booking's latest invoice, unless it's been credited
+func lastInvoiceTx(tx *sql.Tx, id bookingId) (invoice, error) {
+	return findInvoiceTx(tx, invoiceSelect+`
+    where BookingId = $1 and Kind = $2
+      and Number not in (select Corrects from Invoice)
+    order by Number desc
+    limit 1
+  `, id, invoiceKindInvoice)
+}
+
+func findInvoiceTx(
+	tx *sql.Tx,
+	query string,
+	args ...interface{},
+) (invoice, error) {
+	i, err := scanInvoice(tx.QueryRow(query, args...))
+	if err == sql.ErrNoRows {
+		return invoice{}, invoiceNotFound
+	}
+	if err != nil {
+		glog.Error(err)
+		return invoice{}, err
+	}
+	i.Lines, err = invoiceLinesTx(tx, i.Number)
+	if err != nil {
+		return invoice{}, err
+	}
+	return i, nil
+}
+
+// The invoice last issued for a booking, unless it's been credited
+func (is *Invoices) Last(id bookingId) (invoice, error) {
+	tx, err := is.DB.Begin()
+	if err != nil {
+		return invoice{}, err
+	}
+	defer tx.Rollback()
+
+	return lastInvoiceTx(tx, id)
+}
+
+// An invoice or credit note by number
+func (is *Invoices) Lookup(number int64) (invoice, error) {
+	tx, err := is.DB.Begin()
+	if err != nil {
+		return invoice{}, err
+	}
+	defer tx.Rollback()
+
+	return lookupInvoiceTx(tx, number)
+}
+
+// A booking's invoices and credit notes, oldest first
+func (is *Invoices) List(id bookingId) ([]invoice, error) {
+	tx, err := is.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		invoiceSelect+`where BookingId = $1 order by Number asc`,
+		id,
+	)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	var list []invoice
+	for rows.Next() {
+		i, err := scanInvoice(rows)
+		if err != nil {
+			rows.Close()
+			glog.Error(err)
+			return nil, err
+		}
+		list = append(list, i)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for n := range list {
+		list[n].Lines, err = invoiceLinesTx(tx, list[n].Number)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// Whether the line is for a night or was posted on a day, rather than for
+// the stay as a whole
+func (l invoiceLine) Dated() bool {
+	return l.Kind == nightLine || l.Kind == adjustmentLine ||
+		l.Kind == paymentLine
+}
+
+// The invoice as plain text, e.g. for email. Amounts line up on the right
+func (i invoice) Text() string {
+	var rows [][3]string
+	row := func(day, description string, a string) {
+		rows = append(rows, [3]string{day, description, a})
+	}
+	lines := func(list []invoiceLine) {
+		for _, line := range list {
+			day := ""
+			if line.Dated() {
+				day = line.Day.Format(date.Pretty)
+			}
+			if line.Included {
+				row(day, line.Description, "includes "+i.Money(line.Amount).String())
+			} else {
+				row(day, line.Description, i.Money(line.Amount).String())
+			}
+		}
+	}
+	lines(i.Items())
+	row("", "Subtotal", i.Money(i.Subtotal()).String())
+	lines(i.Taxes())
+	row("", "Total", i.Money(i.Total()).String())
+	if i.Kind == invoiceKindInvoice {
+		lines(i.Payments())
+		row("", "Balance due", i.Money(i.BalanceDue()).String())
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n", i.Title())
+	fmt.Fprintf(&b, "Issued %s\n", i.IssuedAt.Format(date.Pretty))
+	if i.Corrects != 0 {
+		fmt.Fprintf(&b, "Cancels invoice %06d\n", i.Corrects)
+	}
+	fmt.Fprintf(&b, "Bill to %s\n", i.BillTo)
+	fmt.Fprintf(
+		&b,
+		"Booking %s, %s to %s\n\n",
+		i.Code,
+		i.Checkin.Format(date.Pretty),
+		i.Checkout.Format(date.Pretty),
+	)
+
+	width := 0
+	for _, r := range rows {
+		if n := utf8.RuneCountInString(r[2]); n > width {
+			width = n
+		}
+	}
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	for _, r := range rows {
+		pad := strings.Repeat(" ", width-utf8.RuneCountInString(r[2]))
+		fmt.Fprintf(w, "%s\t%s\t%s%s\n", r[0], r[1], pad, r[2])
+	}
+	w.Flush()
+	return b.String()
+}
@@ -0,0 +1,86 @@
+package booking
+
+import "html/template"
+
+var templateInvoice *template.Template
+
+func init() {
+	templateInvoice = template.Must(
+		template.New("invoice.html.go").
+			Funcs(formHelpers).
+			Funcs(template.FuncMap{"invoiceLines": invoiceLines}).
+			Parse(templateInvoiceSrc),
+	)
+}
+
+// Some of an invoice's lines, for the "lines" template
+type invoiceSection struct {
+	Invoice invoice
+	Lines   []invoiceLine
+}
+
+func invoiceLines(i invoice, lines []invoiceLine) invoiceSection {
+	return invoiceSection{i, lines}
+}
+
+const templateInvoiceSrc = `
+{{define "lines"}}
+  {{range .Lines}}
+  <tr>
+    <td>{{if .Dated}}{{pretty .Day}}{{end}}</td>
+    <td>{{.Description}}</td>
+    {{if .Included}}
+    <td align="right"><small>includes {{$.Invoice.Money .Amount}}</small></td>
+    {{else}}
+    <td align="right">{{$.Invoice.Money .Amount}}</td>
+    {{end}}
+  </tr>
+  {{end}}
+{{end}}
+<html>
+  <body>
+    <h1>Apartment</h1>
+    <h3>{{.Title}}</h3>
+    <table>
+      <tr>
+        <th align="left">Issued</th>
+        <td>{{.IssuedAt.Format "January 2, 2006"}}</td>
+      </tr>
+      {{if .Corrects}}
+      <tr>
+        <th align="left">Cancels invoice</th>
+        <td>{{printf "%06d" .Corrects}}</td>
+      </tr>
+      {{end}}
+      <tr>
+        <th align="left">Bill to</th>
+        <td>{{.BillTo}}</td>
+      </tr>
+      <tr>
+        <th align="left">Booking</th>
+        <td>{{.Code}}, {{pretty .Checkin}} to {{pretty .Checkout}}</td>
+      </tr>
+    </table>
+
+    <table>
+      {{template "lines" invoiceLines . .Items}}
+      <tr>
+        <th colspan="2" align="left">Subtotal</th>
+        <th align="right">{{.Money .Subtotal}}</th>
+      </tr>
+      {{template "lines" invoiceLines . .Taxes}}
+      <tr>
+        <th colspan="2" align="left">Total</th>
+        <th align="right">{{.Money .Total}}</th>
+      </tr>
+      {{if eq .Kind "invoice"}}
+      {{template "lines" invoiceLines . .Payments}}
+      <tr>
+        <th colspan="2" align="left">Balance due</th>
+        <th align="right">{{.Money .BalanceDue}}</th>
+      </tr>
+      {{end}}
+    </table>
+  </body>
+</html>
+`
@@ -0,0 +1,324 @@
+package booking
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestInvoicesIssue(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var clock Clock
+	var formBuilder FormBuilder
+	var gateway FakeGateway
+	var invoices Invoices
+	var register Register
+	err := inject.Populate(
+		db,
+		&cal,
+		&clock,
+		&formBuilder,
+		&gateway,
+		&invoices,
+		&register,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2014, 12, 1, 12, 0, 0, 0, time.UTC))
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2), date.New(2015, 1, 3))
+
+	form := formBuilder.Build()
+	id, ok := form.Submit(postForm(validFormValues()))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+	total := form.Quote.Total()
+
+	var issue = func(want int64) invoice {
+		i, err := invoices.Issue(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i.Number != want {
+			t.Error("want invoice", want)
+			t.Error("got ", i.Number)
+		}
+		return i
+	}
+
+	// Issue() -> the quote, paid in full
+	first := issue(1)
+	if first.Kind != invoiceKindInvoice || first.BillTo != "a b <a@b>" {
+		t.Error("want an invoice to a b <a@b>")
+		t.Error("got ", first.Kind, first.BillTo)
+	}
+	if first.Total() != total || first.Paid() != total || first.BalanceDue() != 0 {
+		t.Error("want", total, total, 0)
+		t.Error("got ", first.Total(), first.Paid(), first.BalanceDue())
+	}
+	if len(first.Payments()) != 1 || first.Payments()[0].Description != "Paid by card" {
+		t.Error("want one card payment")
+		t.Error("got ", first.Payments())
+	}
+
+	// nothing's changed -> the same invoice
+	issue(1)
+
+	// stays a night longer -> credited and issued afresh
+	b, _ := register.Lookup(id)
+	_, err = register.Modify(id, b.Checkin, date.New(2015, 1, 4), b.Rate, b.Guests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := issue(3)
+	q, _ := register.Pricing.Lookup(id)
+	if second.Total() != q.Total() || second.BalanceDue() != q.Total()-total {
+		t.Error("want", q.Total(), q.Total()-total)
+		t.Error("got ", second.Total(), second.BalanceDue())
+	}
+	credit, err := invoices.Lookup(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credit.Kind != invoiceKindCredit || credit.Corrects != 1 ||
+		credit.Total() != -total || len(credit.Payments()) != 0 {
+		t.Error("want a credit note for", -total, "correcting 1")
+		t.Error("got ", credit.Kind, credit.Total(), credit.Corrects)
+	}
+
+	// cancelled -> the refund shows as an adjustment, but not what's only
+	// posted to the guest, whatever its memo says
+	err = register.Cancel(id, actor("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = register.Ledger.Credit(b.GuestId, amount(500), memo(id.String()+" goodwill"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	third := issue(5)
+	var adjusted bool
+	for _, line := range third.Items() {
+		adjusted = adjusted || line.Kind == adjustmentLine &&
+			strings.HasPrefix(line.Description, "Refund under")
+		if line.Description == "Goodwill" {
+			t.Error("want only the booking's entries")
+			t.Error("got ", line)
+		}
+	}
+	if !adjusted {
+		t.Error("want a refund adjustment")
+		t.Error("got ", third.Lines)
+	}
+
+	list, err := invoices.List(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var numbers []int64
+	for _, i := range list {
+		numbers = append(numbers, i.Number)
+	}
+	if len(numbers) != 5 || numbers[0] != 1 || numbers[4] != 5 {
+		t.Error("want", []int64{1, 2, 3, 4, 5})
+		t.Error("got ", numbers)
+	}
+	if len(list[0].Lines) != len(first.Lines) {
+		t.Error("want", first.Lines)
+		t.Error("got ", list[0].Lines)
+	}
+
+	// issued -> can't change
+	for _, query := range []string{
+		`update Invoice set BillTo = 'someone else'`,
+		`delete from Invoice`,
+		`update InvoiceLine set Amount = 1`,
+		`delete from InvoiceLine`,
+	} {
+		_, err := db.Exec(query)
+		if err == nil || !strings.Contains(err.Error(), "can't change") {
+			t.Error(query, "want refused")
+			t.Error(query, "got ", err)
+		}
+	}
+}
+
+func TestInvoicesIssueCancelled(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var clock Clock
+	var formBuilder FormBuilder
+	var gateway FakeGateway
+	var invoices Invoices
+	var register Register
+	err := inject.Populate(
+		db,
+		&cal,
+		&clock,
+		&formBuilder,
+		&gateway,
+		&invoices,
+		&register,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2014, 12, 1, 12, 0, 0, 0, time.UTC))
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+
+	form := formBuilder.Build()
+	id, ok := form.Submit(postForm(validFormValues()))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+	total := form.Quote.Total()
+
+	// cancelled with plenty of notice -> all of it back on the card
+	err = register.Cancel(id, actor("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := invoices.Issue(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refunded amount
+	for _, line := range i.Payments() {
+		if line.Description == "Refunded to card" {
+			refunded += line.Amount
+		}
+	}
+	if refunded != total {
+		t.Error("want", total, "refunded to card")
+		t.Error("got ", i.Payments())
+	}
+	if i.BalanceDue() != 0 {
+		t.Error("want 0")
+		t.Error("got ", i.BalanceDue(), i.Lines)
+	}
+}
+
+func TestInvoicesCredit(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var formBuilder FormBuilder
+	var gateway FakeGateway
+	var invoices Invoices
+	err := inject.Populate(db, &cal, &formBuilder, &gateway, &invoices)
+	if err != nil {
+		t.Error(err)
+	}
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+	form := formBuilder.Build()
+	id, ok := form.Submit(postForm(validFormValues()))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+	i, err := invoices.Issue(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		number int64
+		err    error
+	}{
+		{i.Number, nil},
+		{i.Number, invoiceCredited},
+		{i.Number + 1, creditNoteCredit},
+		{99, invoiceNotFound},
+	}
+	for _, test := range tests {
+		_, err := invoices.Credit(test.number)
+		if err != test.err {
+			t.Error(test.number, "want", test.err)
+			t.Error(test.number, "got ", err)
+		}
+	}
+
+	// credited by hand -> issued afresh though nothing's changed
+	again, err := invoices.Issue(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Number != 3 || again.Total() != i.Total() {
+		t.Error("want", 3, i.Total())
+		t.Error("got ", again.Number, again.Total())
+	}
+}
+
+func TestInvoiceText(t *testing.T) {
+	i := invoice{
+		BillTo:   "a b <a@b>",
+		Checkin:  date.New(2015, 1, 1),
+		Checkout: date.New(2015, 1, 3),
+		Code:     confirmationCode("ABCD2345"),
+		Currency: defaultCurrency,
+		IssuedAt: time.Date(2014, 12, 1, 12, 0, 0, 0, time.UTC),
+		Kind:     invoiceKindInvoice,
+		Number:   42,
+		Lines: []invoiceLine{
+			{amount(10000), date.New(2015, 1, 1), "Night", false, nightLine},
+			{amount(10000), date.New(2015, 1, 2), "Night", false, nightLine},
+			{amount(1500), date.Date{}, "Cleaning", false, feeLine},
+			{amount(1000), date.Date{}, "Sales tax", false, taxLine},
+			{amount(500), date.Date{}, "VAT", true, taxLine},
+			{amount(-20000), date.New(2014, 12, 1), "Paid by card", false, paymentLine},
+		},
+	}
+	if i.Subtotal() != 21500 || i.Total() != 22500 || i.BalanceDue() != 2500 {
+		t.Error("want", 21500, 22500, 2500)
+		t.Error("got ", i.Subtotal(), i.Total(), i.BalanceDue())
+	}
+
+	text := i.Text()
+	for _, s := range []string{
+		"Invoice 000042",
+		"Bill to a b <a@b>",
+		"Booking ABCD2345, January 1, 2015 to January 3, 2015",
+		"January 2, 2015   Night                $100.00",
+		"VAT           includes $5.00",
+		"December 1, 2014  Paid by card        -$200.00",
+		"Balance due           $25.00",
+	} {
+		if !strings.Contains(text, s) {
+			t.Error("want", s)
+			t.Error("got ", text)
+		}
+	}
+
+	// credit notes don't show payments
+	i.Kind = invoiceKindCredit
+	i.Corrects = 41
+	text = i.Text()
+	if !strings.Contains(text, "Cancels invoice 000041") || strings.Contains(text, "Balance due") {
+		t.Error("want a credit note for 000041 without a balance")
+		t.Error("got ", text)
+	}
+}
+
+func TestDescribeMemo(t *testing.T) {
+	var tests = []struct {
+		m    memo
+		want string
+	}{
+		{"bookingId:5 damage: lamp", "Damage: lamp"},
+		{"refund bookingId:5 under moderate policy v1", "Refund under moderate policy v1"},
+		{"bookingId:5 unpaid balance written off", "Unpaid balance written off"},
+		{"bookingId:55 damage", "BookingId:55 damage"},
+	}
+	for _, test := range tests {
+		if got := describeMemo(test.m, bookingId(5)); got != test.want {
+			t.Error("want", test.want)
+			t.Error("got ", got)
+		}
+	}
+}
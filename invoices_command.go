@@ -0,0 +1,99 @@
+package booking
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+const invoicesUsage = `usage:
+  invoices list -code CONFIRMATION
+  invoices issue -code CONFIRMATION
+  invoices show -number NUMBER [-html]
+  invoices credit -number NUMBER`
+
+var unknownInvoicesCommand = errors.New(invoicesUsage)
+
+// Lists, issues, shows or credits a booking's invoices from the command
+// line, writing results to out
+func InvoicesCommand(
+	is *Invoices,
+	r *Register,
+	args []string,
+	out io.Writer,
+) error {
+	if len(args) == 0 {
+		return unknownInvoicesCommand
+	}
+
+	flags := flag.NewFlagSet("invoices "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	flagCode := flags.String("code", "", "the booking's confirmation code")
+	flagNumber := flags.Int64("number", 0, "the invoice or credit note number")
+	flagHtml := flags.Bool("html", false, "show as html rather than text")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	default:
+		return unknownInvoicesCommand
+	case "list":
+		b, err := r.LookupByCode(*flagCode)
+		if err != nil {
+			return err
+		}
+		list, err := is.List(b.Id)
+		if err != nil {
+			return err
+		}
+		for _, i := range list {
+			fmt.Fprintln(out, invoiceSummary(i))
+		}
+		return nil
+	case "issue":
+		b, err := r.LookupByCode(*flagCode)
+		if err != nil {
+			return err
+		}
+		i, err := is.Issue(b.Id)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, invoiceSummary(i))
+		return nil
+	case "show":
+		i, err := is.Lookup(*flagNumber)
+		if err != nil {
+			return err
+		}
+		if *flagHtml {
+			return templateInvoice.Execute(out, i)
+		}
+		_, err = io.WriteString(out, i.Text())
+		return err
+	case "credit":
+		c, err := is.Credit(*flagNumber)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, invoiceSummary(c))
+		return nil
+	}
+}
+
+func invoiceSummary(i invoice) string {
+	s := fmt.Sprintf(
+		"%s %s %s total %s",
+		i.IssuedAt.Format("2006-01-02 15:04"),
+		i.Title(),
+		i.Code,
+		i.Money(i.Total()),
+	)
+	if i.Kind == invoiceKindCredit {
+		return fmt.Sprintf("%s, cancels invoice %06d", s, i.Corrects)
+	}
+	return fmt.Sprintf("%s, %s due", s, i.Money(i.BalanceDue()))
+}
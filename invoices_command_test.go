@@ -0,0 +1,114 @@
+package booking
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestInvoicesCommand(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cal Calendar
+	var clock Clock
+	var formBuilder FormBuilder
+	var gateway FakeGateway
+	var invoices Invoices
+	var register Register
+	err := inject.Populate(
+		db,
+		&cal,
+		&clock,
+		&formBuilder,
+		&gateway,
+		&invoices,
+		&register,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2014, 12, 1, 12, 0, 0, 0, time.UTC))
+	cal.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+	form := formBuilder.Build()
+	id, ok := form.Submit(postForm(validFormValues()))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+	b, _ := register.Lookup(id)
+	code := string(b.Code)
+
+	var out bytes.Buffer
+	err = InvoicesCommand(&invoices, &register, nil, &out)
+	if err != unknownInvoicesCommand {
+		t.Error("want", unknownInvoicesCommand)
+		t.Error("got ", err)
+	}
+
+	var tests = []struct {
+		args []string
+		err  error
+		want string
+	}{
+		{
+			[]string{"issue", "-code", code},
+			nil,
+			"2014-12-01 12:00 Invoice 000001 " + code + " total $400.00, $0.00 due\n",
+		},
+		{
+			[]string{"credit", "-number", "1"},
+			nil,
+			"2014-12-01 12:00 Credit note 000002 " + code + " total -$400.00, cancels invoice 000001\n",
+		},
+		{
+			[]string{"credit", "-number", "1"},
+			invoiceCredited,
+			"",
+		},
+		{
+			[]string{"list", "-code", code},
+			nil,
+			"2014-12-01 12:00 Invoice 000001 " + code + " total $400.00, $0.00 due\n" +
+				"2014-12-01 12:00 Credit note 000002 " + code + " total -$400.00, cancels invoice 000001\n",
+		},
+		{
+			[]string{"show", "-number", "9"},
+			invoiceNotFound,
+			"",
+		},
+		{
+			[]string{"issue", "-code", "NOPE2345"},
+			bookingNotFound,
+			"",
+		},
+	}
+	for _, test := range tests {
+		out.Reset()
+		err := InvoicesCommand(&invoices, &register, test.args, &out)
+		if err != test.err {
+			t.Error(test.args, "want", test.err)
+			t.Error(test.args, "got ", err)
+		}
+		if got := out.String(); got != test.want {
+			t.Error(test.args, "want", test.want)
+			t.Error(test.args, "got ", got)
+		}
+	}
+
+	// show -> text, or html
+	out.Reset()
+	err = InvoicesCommand(&invoices, &register, []string{"show", "-number", "1"}, &out)
+	if err != nil || !strings.HasPrefix(out.String(), "Invoice 000001\n") {
+		t.Error("want", "Invoice 000001")
+		t.Error("got ", out.String(), err)
+	}
+	out.Reset()
+	err = InvoicesCommand(&invoices, &register, []string{"show", "-number", "2", "-html"}, &out)
+	if err != nil || !strings.Contains(out.String(), "<h3>Credit note 000002</h3>") {
+		t.Error("want", "<h3>Credit note 000002</h3>")
+		t.Error("got ", out.String(), err)
+	}
+}
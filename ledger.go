@@ -2,146 +2,659 @@ package booking
 
 import (
 	"database/sql"
-	"database/sql/driver"
 	"errors"
 	"fmt"
-	"log"
+	"time"
 
+	"github.com/cmdrkeene/booking/pkg/date"
 	"github.com/golang/glog"
 )
 
-// A sum of money stored in 1/100th increments (e.g. cents)
+// A sum of money in a currency's minor units (e.g. cents). Which currency is
+// up to the property, see money
 type amount int64
 
-// Round to nearest cent for simple display
-func (a amount) String() string {
-	return fmt.Sprintf("$%0.2f", float64(a)/100.0)
+var invalidAmount = errors.New("invalid amount")
+
+// Reads a price in the default currency, e.g. "300", "$1,299.95"
+func parseAmount(s string) (amount, error) {
+	return parsePrice(s, defaultCurrency)
+}
+
+// Reads a price in a currency, which can't be negative
+func parsePrice(s string, c currency) (amount, error) {
+	m, err := parseMoney(s, c)
+	if err != nil {
+		return 0, err
+	}
+	if m.Amount < 0 {
+		return 0, invalidAmount
+	}
+	return m.Amount, nil
 }
 
 // A note on a transaction
 type memo string
 
-// A named amount to charge for a booking
-type rate struct {
-	Name   string
-	Amount amount
+// Double-entry books: every entry moves money between accounts, and what
+// guests owe is what's been posted to their receivable
+type Ledger struct {
+	Clock     *Clock         `inject:""`
+	DB        *sql.DB        `inject:""`
+	Gateway   PaymentGateway `inject:""`
+	Guestbook *Guestbook     `inject:""`
+	Property  *Property      `inject:""`
 }
 
-func (r rate) String() string {
-	return fmt.Sprintf("rate: %s (%s)", r.Name, r.Amount.String())
+// An amount on the books, which are kept in the property's currency
+func (l *Ledger) Money(a amount) money {
+	return l.Property.Money(a)
 }
 
-func (r *rate) Scan(src interface{}) error {
-	rawName, ok := src.([]byte)
-	if !ok {
-		err := errors.New(
-			fmt.Sprintf("can't scan rate from db: %#v", src),
-		)
-		glog.Error(err)
+// One posting of a balanced set of lines, and the booking it's for, or 0
+const JournalEntrySchema = `
+  CREATE TABLE JournalEntry (
+    BookingId INTEGER NOT NULL DEFAULT 0,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Memo TEXT NOT NULL,
+    PostedAt DATETIME NOT NULL
+  );
+  CREATE INDEX JournalEntryBooking ON JournalEntry (BookingId);
+`
+
+// Debits are positive, credits negative, so an entry's lines sum to zero and
+// a guest's receivable is what they owe. GuestId is only set on receivables
+const JournalLineSchema = `
+  CREATE TABLE JournalLine (
+    Account TEXT NOT NULL,
+    Amount INTEGER NOT NULL,
+    EntryId INTEGER NOT NULL REFERENCES JournalEntry(Id),
+    GuestId INTEGER NOT NULL DEFAULT 0,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    CONSTRAINT ck_Amount_Not_Zero CHECK (Amount != 0)
+  )
+`
+
+var ledgerMigration = statements(
+	`CREATE TABLE Ledger (
+    Amount INTEGER NOT NULL,
+    GuestId INTEGER NOT NULL REFERENCES Guestbook(Id),
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Memo TEXT NOT NULL,
+    CONSTRAINT ck_Amount_Not_Zero CHECK (Amount != 0)
+  )`,
+)
+
+// Each single-sided Ledger row becomes an entry against the guest's
+// receivable: refunds and reinstatements against refunds, other debits
+// against revenue and other credits, which were card payments, against
+// clearing. Rows weren't dated, so they're posted when migrated
+var journalMigration = statements(
+	`CREATE TABLE JournalEntry (
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Memo TEXT NOT NULL,
+    PostedAt DATETIME NOT NULL
+  )`,
+	`CREATE TABLE JournalLine (
+    Account TEXT NOT NULL,
+    Amount INTEGER NOT NULL,
+    EntryId INTEGER NOT NULL REFERENCES JournalEntry(Id),
+    GuestId INTEGER NOT NULL DEFAULT 0,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    CONSTRAINT ck_Amount_Not_Zero CHECK (Amount != 0)
+  )`,
+	`INSERT INTO JournalEntry (Id, Memo, PostedAt)
+    SELECT Id, Memo, datetime('now') FROM Ledger`,
+	`INSERT INTO JournalLine (Account, Amount, EntryId, GuestId)
+    SELECT 'receivable', Amount, Id, GuestId FROM Ledger`,
+	`INSERT INTO JournalLine (Account, Amount, EntryId, GuestId)
+    SELECT
+      CASE
+        WHEN Memo LIKE 'refund %' OR Memo LIKE 'reinstated %' THEN 'refunds'
+        WHEN Amount > 0 THEN 'revenue'
+        ELSE 'clearing'
+      END,
+      -Amount, Id, 0
+    FROM Ledger`,
+	`DROP TABLE Ledger`,
+)
+
+// Entries are linked to their booking. Earlier payments and refunds take
+// their payment's booking, and anything else the booking its memo mentions,
+// e.g. "refund bookingId:5 under ...", if there is one. Entries mentioning a
+// booking that can't be found are logged
+func journalBookingMigration(tx *sql.Tx) error {
+	err := statements(
+		`ALTER TABLE JournalEntry ADD COLUMN BookingId INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE JournalEntry SET BookingId = (
+        SELECT p.BookingId FROM Payment p WHERE p.EntryId = JournalEntry.Id
+      )
+      WHERE EXISTS (SELECT 1 FROM Payment p WHERE p.EntryId = JournalEntry.Id)`,
+		`UPDATE JournalEntry SET BookingId = (
+        SELECT p.BookingId FROM PaymentRefund r
+        JOIN Payment p ON p.Id = r.PaymentId
+        WHERE r.EntryId = JournalEntry.Id
+      )
+      WHERE EXISTS (
+        SELECT 1 FROM PaymentRefund r WHERE r.EntryId = JournalEntry.Id
+      )`,
+		`UPDATE JournalEntry
+      SET BookingId = CAST(substr(Memo, instr(Memo, 'bookingId:') + 10) AS INTEGER)
+      WHERE BookingId = 0 AND instr(Memo, 'bookingId:') > 0 AND EXISTS (
+        SELECT 1 FROM Register r
+        WHERE r.Id = CAST(substr(Memo, instr(Memo, 'bookingId:') + 10) AS INTEGER)
+      )`,
+		`CREATE INDEX JournalEntryBooking ON JournalEntry (BookingId)`,
+	)(tx)
+	if err != nil {
 		return err
 	}
-	name := string(rawName)
-	for _, element := range allRates {
-		if name == element.Name {
-			r.Amount = element.Amount
-			r.Name = element.Name
-			return nil
-		}
-	}
 
-	err := errors.New("can't find rate for " + name)
-	glog.Error(err)
-	return err
+	return logUnlinked(tx, "journal entries", `
+    select Id from JournalEntry
+    where BookingId = 0 and instr(Memo, 'bookingId:') > 0
+  `)
 }
 
-func (r rate) Value() (driver.Value, error) {
-	return driver.Value(r.Name), nil
+// Where money is
+type account string
+
+const (
+	// What each guest owes, or is owed when negative
+	receivable = account("receivable")
+
+	// Earned from stays, less discounts
+	revenue = account("revenue")
+
+	// Collected for, and owed to, the tax authorities
+	taxesPayable = account("taxes payable")
+
+	// Given back on cancellations
+	refunds = account("refunds")
+
+	// Taken by card, waiting to settle with the payment gateway
+	clearing = account("clearing")
+
+	// Charged for damage found after a stay
+	damages = account("damages")
+)
+
+// A debit, when positive, or credit to an account
+type journalLine struct {
+	Account account
+	Amount  amount
+	GuestId guestId
+}
+
+type journalEntry struct {
+	BookingId bookingId
+	Id        int64
+	Lines     []journalLine
+	Memo      memo
+	PostedAt  time.Time
 }
 
-// What we charge for the place
 var (
-	withBunny = rate{
-		Amount: amount(20000),
-		Name:   "With Bunny",
-	}
-	withoutBunny = rate{
-		Amount: amount(25000),
-		Name:   "Without Bunny",
-	}
-	allRates = []rate{withBunny, withoutBunny}
+	zeroAmount      = errors.New("amount must be non zero")
+	unbalancedEntry = errors.New("journal entry doesn't balance")
 )
 
-// limits "new" rates a predefined list
-func newRate(name string) (rate, error) {
-	for _, r := range allRates {
-		if r.Name == name {
-			return r, nil
+// At least two non-zero lines, debits equal to credits
+func (e journalEntry) Balanced() bool {
+	if len(e.Lines) < 2 {
+		return false
+	}
+	var sum amount
+	for _, line := range e.Lines {
+		if line.Amount == 0 {
+			return false
 		}
+		sum += line.Amount
 	}
-	return rate{}, errors.New("rate not found")
+	return sum == 0
 }
 
-// See: http://www.regular-expressions.info/creditcard.html
-type creditCard struct {
-	CVC    int
-	Month  int
-	Number int
-	Year   int
+// Debits a guest's receivable, or credits it when a is negative, against an
+// account. id is the booking it's for, or 0 if it's for none
+func guestEntry(
+	guest guestId,
+	id bookingId,
+	a amount,
+	against account,
+	memo memo,
+) journalEntry {
+	return journalEntry{
+		BookingId: id,
+		Lines: []journalLine{
+			{Account: receivable, Amount: a, GuestId: guest},
+			{Account: against, Amount: -a},
+		},
+		Memo: memo,
+	}
 }
 
-// Summary of guest accounts
-type Ledger struct {
-	DB        *sql.DB    `inject:""`
-	Guestbook *Guestbook `inject:""`
+// What a guest owes
+func (l *Ledger) Balance(guest guestId) (amount, error) {
+	return l.balance(receivable, guest, nil)
 }
 
-func (l *Ledger) Balance(guestId) (amount, error) {
-	return 0, nil
+// What a guest owed at the end of a day
+func (l *Ledger) BalanceOn(guest guestId, on date.Date) (amount, error) {
+	return l.balance(receivable, guest, &on)
 }
 
-func (l *Ledger) Debit(guestId, amount, memo) error {
-	return nil
+// Sum of an account's lines at the end of a day, every guest's for
+// receivable. Debit balances are positive, credit balances negative
+func (l *Ledger) AccountBalance(a account, on date.Date) (amount, error) {
+	return l.balance(a, 0, &on)
 }
 
-func (l *Ledger) Credit(guestId, amount, memo) error {
-	return nil
+// Lines for a guest, unless guest is 0, posted by the end of a day, unless
+// on is nil
+func (l *Ledger) balance(a account, guest guestId, on *date.Date) (amount, error) {
+	var before interface{}
+	if on != nil {
+		before = on.Add(1)
+	}
+
+	var balance amount
+	err := l.DB.QueryRow(`
+    select coalesce(sum(l.Amount), 0)
+    from JournalLine l
+    join JournalEntry e on e.Id = l.EntryId
+    where l.Account = $1 and ($2 = 0 or l.GuestId = $2)
+    and ($3 is null or e.PostedAt < $3)
+  `, a, guest, before).Scan(&balance)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	return balance, nil
 }
 
-func (l *Ledger) Charge(
+func (l *Ledger) Debit(guest guestId, amount amount, memo memo) error {
+	return l.withTx(func(tx *sql.Tx) error {
+		return l.DebitTx(tx, guest, amount, memo)
+	})
+}
+
+func (l *Ledger) Credit(guest guestId, amount amount, memo memo) error {
+	return l.withTx(func(tx *sql.Tx) error {
+		return l.CreditTx(tx, guest, amount, memo)
+	})
+}
+
+// Record an amount the guest owes, earned as revenue - caller is responsible
+// for Commit/Rollback
+func (l *Ledger) DebitTx(
+	tx *sql.Tx,
+	guest guestId,
+	amount amount,
+	memo memo,
+) error {
+	if amount == 0 {
+		return zeroAmount
+	}
+	return l.PostTx(tx, guestEntry(guest, 0, amount, revenue, memo))
+}
+
+// Record an amount owed to the guest, taken off revenue - caller is
+// responsible for Commit/Rollback
+func (l *Ledger) CreditTx(
+	tx *sql.Tx,
+	guest guestId,
+	amount amount,
+	memo memo,
+) error {
+	if amount == 0 {
+		return zeroAmount
+	}
+	return l.PostTx(tx, guestEntry(guest, 0, -amount, revenue, memo))
+}
+
+// Record an amount given back to the guest for a booking - caller is
+// responsible for Commit/Rollback
+func (l *Ledger) RefundTx(
+	tx *sql.Tx,
+	guest guestId,
+	id bookingId,
+	amount amount,
+	memo memo,
+) error {
+	if amount == 0 {
+		return zeroAmount
+	}
+	return l.PostTx(tx, guestEntry(guest, id, -amount, refunds, memo))
+}
+
+// Take back a refund - caller is responsible for Commit/Rollback
+func (l *Ledger) ReverseRefundTx(
+	tx *sql.Tx,
 	guest guestId,
+	id bookingId,
 	amount amount,
-	card creditCard,
 	memo memo,
 ) error {
+	if amount == 0 {
+		return zeroAmount
+	}
+	return l.PostTx(tx, guestEntry(guest, id, amount, refunds, memo))
+}
+
+// Writes an entry, dated now, unless it doesn't balance - caller is
+// responsible for Commit/Rollback
+func (l *Ledger) PostTx(tx *sql.Tx, e journalEntry) error {
+	_, err := l.post(tx, e)
+	return err
+}
+
+// Returns the entry's id
+func (l *Ledger) post(tx *sql.Tx, e journalEntry) (int64, error) {
+	if !e.Balanced() {
+		return 0, unbalancedEntry
+	}
+
+	result, err := tx.Exec(
+		`insert into JournalEntry (BookingId, Memo, PostedAt) values ($1, $2, $3)`,
+		e.BookingId,
+		e.Memo,
+		l.Clock.Now().UTC(),
+	)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	entryId, err := result.LastInsertId()
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`
+      insert into JournalLine (Account, Amount, EntryId, GuestId)
+      values ($1, $2, $3, $4)
+    `)
+	if err != nil {
+		panic(err)
+	}
+	defer stmt.Close()
+
+	for _, line := range e.Lines {
+		_, err := stmt.Exec(line.Account, line.Amount, entryId, line.GuestId)
+		if err != nil {
+			glog.Error(err)
+			return 0, err
+		}
+	}
+
+	glog.Infoln("posted", e.Memo, e.Lines)
+	return entryId, nil
+}
+
+// Every entry, oldest first
+func (l *Ledger) Journal() ([]journalEntry, error) {
+	rows, err := l.DB.Query(`
+    select e.BookingId, e.Id, e.Memo, e.PostedAt, l.Account, l.Amount, l.GuestId
+    from JournalEntry e
+    join JournalLine l on l.EntryId = e.Id
+    order by e.Id asc, l.Id asc
+  `)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []journalEntry
+	for rows.Next() {
+		var e journalEntry
+		var line journalLine
+		err := rows.Scan(
+			&e.BookingId,
+			&e.Id,
+			&e.Memo,
+			&e.PostedAt,
+			&line.Account,
+			&line.Amount,
+			&line.GuestId,
+		)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		if n := len(entries); n > 0 && entries[n-1].Id == e.Id {
+			entries[n-1].Lines = append(entries[n-1].Lines, line)
+			continue
+		}
+		e.Lines = []journalLine{line}
+		entries = append(entries, e)
+	}
+
+	return entries, rows.Err()
+}
+
+// Wraps fn in a Tx that calls Rollback on err, Commit on ok
+func (l *Ledger) withTx(fn func(*sql.Tx) error) error {
 	tx, err := l.DB.Begin()
 	if err != nil {
 		return err
 	}
 
-	err = l.ChargeTx(tx, guest, amount, card, memo)
+	err = fn(tx)
 	if err != nil {
 		tx.Rollback()
-		glog.Error(err)
 		return err
 	}
 
-	err = tx.Commit()
+	return tx.Commit()
+}
+
+func (l *Ledger) Charge(
+	guest guestId,
+	id bookingId,
+	amount amount,
+	card cardToken,
+	memo memo,
+) (payment, error) {
+	tx, err := l.DB.Begin()
 	if err != nil {
+		return payment{}, err
+	}
+
+	p, err := l.ChargeTx(tx, guest, id, amount, card, memo)
+	if err != nil {
+		tx.Rollback()
 		glog.Error(err)
-		return err
+		return payment{}, err
 	}
 
-	return nil
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		l.Unwind(p)
+		return payment{}, err
+	}
 
+	return p, nil
 }
 
+// Takes the amount for a booking from the card through the gateway and
+// credits the guest with it, against clearing until the gateway settles.
+// Nothing is charged on a zero amount. If the payment can't be recorded it's
+// refunded, but if the caller rolls back it should Unwind the payment -
+// caller is responsible for Commit/Rollback
 func (l *Ledger) ChargeTx(
 	tx *sql.Tx,
 	guest guestId,
+	id bookingId,
 	amount amount,
-	card creditCard,
+	card cardToken,
 	memo memo,
+) (payment, error) {
+	if amount == 0 {
+		return payment{}, nil
+	}
+
+	p := payment{Amount: amount, BookingId: id, Card: card, GuestId: guest}
+	var err error
+	p.AuthorizationId, err = l.Authorize(card, amount)
+	if err != nil {
+		return payment{}, err
+	}
+	p.CaptureId, err = l.Gateway.Capture(p.AuthorizationId, l.Money(amount))
+	if err != nil {
+		glog.Error(err)
+		if err := l.Gateway.Void(p.AuthorizationId); err != nil {
+			glog.Error(err)
+		}
+		return payment{}, err
+	}
+
+	err = l.recordPaymentTx(tx, &p, memo)
+	if err != nil {
+		l.Unwind(p)
+		return payment{}, err
+	}
+
+	glog.Infoln("charged", guest, l.Money(amount), "as", p.CaptureId)
+	return p, nil
+}
+
+// Debits a booking's nights to the guest and posts each other line of its
+// quote on its own, so discounts show on the guest's account. Taxes are
+// owed to the authorities rather than earned, and taxes already in the
+// prices are moved out of revenue - caller is responsible for
+// Commit/Rollback
+func (l *Ledger) PostQuoteTx(
+	tx *sql.Tx,
+	guest guestId,
+	id bookingId,
+	q quote,
+) error {
+	for _, line := range quotePostings(q) {
+		err := l.postQuoteLineTx(tx, guest, id, line, memo(
+			fmt.Sprintf("%s %s", id, line.Description),
+		))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Posts what changed between two quotes for a booking, line by line as
+// PostQuoteTx would, so a change in taxes is owed to the authorities rather
+// than earned - caller is responsible for Commit/Rollback
+func (l *Ledger) PostQuoteChangeTx(
+	tx *sql.Tx,
+	guest guestId,
+	id bookingId,
+	from quote,
+	to quote,
+	m memo,
 ) error {
-	log.Println("charged", guest, amount, "on", card)
+	type key struct {
+		Description string
+		Included    bool
+		Kind        lineKind
+	}
+	keyOf := func(line quoteLine) key {
+		// nights are posted together, however many there are
+		if line.Nightly() {
+			return key{Kind: nightLine}
+		}
+		return key{line.Description, line.Included, line.Kind}
+	}
+
+	var order []key
+	changes := map[key]quoteLine{}
+	change := func(line quoteLine, sign amount) {
+		k := keyOf(line)
+		c, seen := changes[k]
+		if !seen {
+			order = append(order, k)
+			c = line
+			c.Amount = 0
+		}
+		c.Amount += sign * line.Amount
+		changes[k] = c
+	}
+	for _, line := range quotePostings(to) {
+		change(line, 1)
+	}
+	for _, line := range quotePostings(from) {
+		change(line, -1)
+	}
+
+	for _, k := range order {
+		line := changes[k]
+		err := l.postQuoteLineTx(tx, guest, id, line, memo(
+			fmt.Sprintf("%s: %s", m, line.Description),
+		))
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// The lines of a quote as they're posted: its nights as one line, then
+// every other line that comes to something
+func quotePostings(q quote) []quoteLine {
+	var lines []quoteLine
+	nights := 0
+	for _, line := range q.Lines {
+		if line.Nightly() {
+			nights++
+		}
+	}
+	if nights > 0 && q.Subtotal() != 0 {
+		lines = append(lines, quoteLine{
+			Amount:      q.Subtotal(),
+			Description: fmt.Sprintf("%d nights", nights),
+			Kind:        nightLine,
+		})
+	}
+	for _, line := range q.Lines {
+		if line.Nightly() || line.Amount == 0 {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Posts one line of a quote by its kind. A fee in the prices is already
+// revenue, so only an included tax is moved - caller is responsible for
+// Commit/Rollback
+func (l *Ledger) postQuoteLineTx(
+	tx *sql.Tx,
+	guest guestId,
+	id bookingId,
+	line quoteLine,
+	m memo,
+) error {
+	if line.Amount == 0 {
+		return nil
+	}
+
+	var e journalEntry
+	switch {
+	case line.Included && line.Kind == taxLine:
+		e = journalEntry{
+			BookingId: id,
+			Lines: []journalLine{
+				{Account: revenue, Amount: line.Amount},
+				{Account: taxesPayable, Amount: -line.Amount},
+			},
+			Memo: m,
+		}
+	case line.Included:
+		return nil
+	case line.Kind == taxLine:
+		e = guestEntry(guest, id, line.Amount, taxesPayable, m)
+	default:
+		e = guestEntry(guest, id, line.Amount, revenue, m)
+	}
+	return l.PostTx(tx, e)
+}
@@ -1,11 +1,481 @@
 package booking
 
-import "testing"
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
 
-func TestAmount(t *testing.T) {
-	a := amount(100)
-	if s := a.String(); s != "$1.00" {
-		t.Error("want $1.00")
-		t.Error("got ", s)
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestParseAmount(t *testing.T) {
+	var tests = []struct {
+		s   string
+		a   amount
+		err error
+	}{
+		{"300", amount(30000), nil},
+		{"$299.95", amount(29995), nil},
+		{"$1,299.95", amount(129995), nil},
+		{" 0.50 ", amount(50), nil},
+		{"", 0, invalidAmount},
+		{"1.5", 0, invalidAmount},
+		{"-3", 0, invalidAmount},
+		{"1.2.3", 0, invalidAmount},
+		{"ten", 0, invalidAmount},
+	}
+	for _, test := range tests {
+		a, err := parseAmount(test.s)
+		if a != test.a || err != test.err {
+			t.Error("want", test.a, test.err)
+			t.Error("got ", a, err)
+		}
+	}
+}
+
+func TestLedger(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var ledger Ledger
+	err := inject.Populate(&FakeGateway{}, db, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+
+	guest := guestId(1)
+
+	// Balance() -> 0
+	balance, err := ledger.Balance(guest)
+	if err != nil {
+		t.Error(err)
+	}
+	if balance != 0 {
+		t.Error("want 0")
+		t.Error("got ", balance)
+	}
+
+	// Debit() -> zeroAmount
+	err = ledger.Debit(guest, 0, memo("nothing"))
+	if err != zeroAmount {
+		t.Error("want", zeroAmount)
+		t.Error("got ", err)
+	}
+
+	// Debit(), Credit() -> ok
+	err = ledger.Debit(guest, amount(5000), memo("extra night"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = ledger.Credit(guest, amount(1500), memo("goodwill"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = ledger.Debit(guestId(2), amount(9900), memo("other guest"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	balance, err = ledger.Balance(guest)
+	if err != nil {
+		t.Error(err)
+	}
+	if balance != amount(3500) {
+		t.Error("want", amount(3500))
+		t.Error("got ", balance)
+	}
+
+	// PostTx() -> unbalancedEntry
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ledger.PostTx(tx, journalEntry{
+		Lines: []journalLine{
+			{Account: receivable, Amount: amount(100), GuestId: guest},
+			{Account: revenue, Amount: amount(-99)},
+		},
+		Memo: memo("off by a cent"),
+	})
+	tx.Rollback()
+	if err != unbalancedEntry {
+		t.Error("want", unbalancedEntry)
+		t.Error("got ", err)
+	}
+}
+
+func TestJournalEntryBalanced(t *testing.T) {
+	var tests = []struct {
+		lines []journalLine
+		want  bool
+	}{
+		{nil, false},
+		{[]journalLine{{receivable, 100, 1}}, false},
+		{[]journalLine{{receivable, 100, 1}, {revenue, -100, 0}}, true},
+		{[]journalLine{{receivable, 100, 1}, {revenue, -90, 0}}, false},
+		{[]journalLine{{receivable, 0, 1}, {revenue, 0, 0}}, false},
+		{
+			[]journalLine{
+				{receivable, 110, 1},
+				{revenue, -100, 0},
+				{taxesPayable, -10, 0},
+			},
+			true,
+		},
+	}
+	for i, test := range tests {
+		if got := (journalEntry{Lines: test.lines}).Balanced(); got != test.want {
+			t.Error(i, "want", test.want)
+			t.Error(i, "got ", got)
+		}
+	}
+}
+
+func TestLedgerBalanceOn(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var clock Clock
+	var gateway FakeGateway
+	var ledger Ledger
+	err := inject.Populate(&gateway, db, &clock, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+
+	guest := guestId(1)
+	clock.Set(time.Date(2015, 1, 1, 23, 0, 0, 0, time.UTC))
+	err = ledger.Debit(guest, amount(5000), memo("night"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Set(time.Date(2015, 1, 2, 9, 0, 0, 0, time.UTC))
+	_, err = ledger.Charge(
+		guest,
+		bookingId(1),
+		amount(5000),
+		testCard(t, &gateway, fakeCardApproved),
+		memo("paid"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		account account
+		on      date.Date
+		want    amount
+	}{
+		{receivable, date.New(2014, 12, 31), 0},
+		{receivable, date.New(2015, 1, 1), amount(5000)},
+		{receivable, date.New(2015, 1, 2), 0},
+		{revenue, date.New(2015, 1, 2), amount(-5000)},
+		{clearing, date.New(2015, 1, 1), 0},
+		{clearing, date.New(2015, 1, 2), amount(5000)},
+	}
+	for i, test := range tests {
+		got, err := ledger.AccountBalance(test.account, test.on)
+		if err != nil || got != test.want {
+			t.Error(i, "want", test.want)
+			t.Error(i, "got ", got, err)
+		}
+	}
+
+	balance, err := ledger.BalanceOn(guest, date.New(2015, 1, 1))
+	if err != nil || balance != amount(5000) {
+		t.Error("want", amount(5000))
+		t.Error("got ", balance, err)
+	}
+	balance, err = ledger.BalanceOn(guestId(2), date.New(2015, 1, 1))
+	if err != nil || balance != 0 {
+		t.Error("want 0")
+		t.Error("got ", balance, err)
+	}
+}
+
+func TestJournalMigration(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migrate := func(m migration) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+	}
+
+	// single-sided rows from before
+	migrate(ledgerMigration)
+	for _, row := range []struct {
+		Amount amount
+		Memo   memo
+	}{
+		{amount(40000), memo("bookingId:1 2 nights")},
+		{amount(-40000), memo("bookingId:1 paid by card")},
+		{amount(-20000), memo("refund bookingId:1 under moderate policy v1")},
+		{amount(500), memo("late checkout")},
+		{amount(-100), memo("paid by card")},
+		{amount(300), memo("bookingId:9 2 nights")},
+	} {
+		_, err := db.Exec(
+			`insert into Ledger (Amount, GuestId, Memo) values ($1, $2, $3)`,
+			row.Amount,
+			guestId(1),
+			row.Memo,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrate(journalMigration)
+	migrate(paymentMigration)
+	_, err = db.Exec(`CREATE TABLE Register (Id INTEGER PRIMARY KEY)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into Register (Id) values (1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate(refundMigration)
+
+	// a payment knows its booking though its memo doesn't say
+	_, err = db.Exec(`
+    insert into Payment (Amount, AuthorizationId, BookingId, CaptureId, EntryId, GuestId)
+    values (100, 'auth', 1, 'capture', 5, 1)
+  `)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate(journalBookingMigration)
+
+	var ledger Ledger
+	err = inject.Populate(&FakeGateway{}, db, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+
+	journal, err := ledger.Journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		account account
+		booking bookingId
+	}{
+		{revenue, bookingId(1)},
+		{clearing, bookingId(1)},
+		{refunds, bookingId(1)},
+		{revenue, 0},
+		{clearing, bookingId(1)},
+		{revenue, 0},
+	}
+	if l := len(journal); l != len(want) {
+		t.Fatal("want", len(want), "got", l)
+	}
+	for i, e := range journal {
+		if !e.Balanced() || e.Lines[1].Account != want[i].account ||
+			e.BookingId != want[i].booking {
+			t.Error(i, "want balanced against", want[i].account, "for", want[i].booking)
+			t.Error(i, "got ", e)
+		}
+	}
+
+	balance, err := ledger.Balance(guestId(1))
+	if err != nil || balance != amount(-19300) {
+		t.Error("want", amount(-19300))
+		t.Error("got ", balance, err)
+	}
+}
+
+func TestLedgerPostQuote(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var gateway FakeGateway
+	var ledger Ledger
+	err := inject.Populate(&gateway, db, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+
+	guest := guestId(1)
+	q := quote{Lines: []quoteLine{
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(-4000), Description: "weekly", Kind: discountLine},
+		{Amount: amount(5000), Description: "cleaning", Kind: feeLine},
+		{Amount: amount(6000), Description: "VAT", Included: true, Kind: taxLine},
+		{Amount: amount(2000), Description: "resort", Included: true, Kind: feeLine},
+	}}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ledger.PostQuoteTx(tx, guest, bookingId(7), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ledger.ChargeTx(
+		tx,
+		guest,
+		bookingId(7),
+		q.Total(),
+		testCard(t, &gateway, fakeCardApproved),
+		memo("paid"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := ledger.Journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		Memo  memo
+		Lines []journalLine
+	}
+	var entries []entry
+	for _, e := range journal {
+		if !e.Balanced() {
+			t.Error("want balanced")
+			t.Error("got ", e)
+		}
+		entries = append(entries, entry{e.Memo, e.Lines})
+	}
+	want := []entry{
+		{memo("bookingId:7 2 nights"), []journalLine{
+			{receivable, amount(40000), guest},
+			{revenue, amount(-40000), 0},
+		}},
+		{memo("bookingId:7 weekly"), []journalLine{
+			{receivable, amount(-4000), guest},
+			{revenue, amount(4000), 0},
+		}},
+		{memo("bookingId:7 cleaning"), []journalLine{
+			{receivable, amount(5000), guest},
+			{revenue, amount(-5000), 0},
+		}},
+		{memo("bookingId:7 VAT"), []journalLine{
+			{revenue, amount(6000), 0},
+			{taxesPayable, amount(-6000), 0},
+		}},
+		{memo("paid"), []journalLine{
+			{receivable, amount(-41000), guest},
+			{clearing, amount(41000), 0},
+		}},
+	}
+	if !reflect.DeepEqual(want, entries) {
+		t.Error("want", want)
+		t.Error("got ", entries)
+	}
+
+	// paid in full
+	balance, err := ledger.Balance(guest)
+	if err != nil {
+		t.Error(err)
+	}
+	if balance != 0 {
+		t.Error("want 0")
+		t.Error("got ", balance)
+	}
+}
+
+func TestLedgerPostQuoteChange(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var ledger Ledger
+	err := inject.Populate(&FakeGateway{}, db, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+
+	guest := guestId(1)
+	from := quote{Lines: []quoteLine{
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(5000), Description: "cleaning", Kind: feeLine},
+		{Amount: amount(4000), Description: "city tax", Kind: taxLine},
+		{Amount: amount(6000), Description: "VAT", Included: true, Kind: taxLine},
+	}}
+	to := quote{Lines: []quoteLine{
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(20000), Kind: nightLine},
+		{Amount: amount(5000), Description: "cleaning", Kind: feeLine},
+		{Amount: amount(6000), Description: "city tax", Kind: taxLine},
+		{Amount: amount(9000), Description: "VAT", Included: true, Kind: taxLine},
+	}}
+
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ledger.PostQuoteTx(tx, guest, bookingId(7), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ledger.PostQuoteChangeTx(tx, guest, bookingId(7), from, to, memo("modified"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := ledger.Journal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	type entry struct {
+		Memo  memo
+		Lines []journalLine
+	}
+	var entries []entry
+	for _, e := range journal[4:] {
+		entries = append(entries, entry{e.Memo, e.Lines})
+	}
+	want := []entry{
+		{memo("modified: 3 nights"), []journalLine{
+			{receivable, amount(20000), guest},
+			{revenue, amount(-20000), 0},
+		}},
+		{memo("modified: city tax"), []journalLine{
+			{receivable, amount(2000), guest},
+			{taxesPayable, amount(-2000), 0},
+		}},
+		{memo("modified: VAT"), []journalLine{
+			{revenue, amount(3000), 0},
+			{taxesPayable, amount(-3000), 0},
+		}},
+	}
+	if !reflect.DeepEqual(want, entries) {
+		t.Error("want", want)
+		t.Error("got ", entries)
+	}
+
+	// owes the new quote
+	balance, err := ledger.Balance(guest)
+	if err != nil {
+		t.Error(err)
+	}
+	if balance != to.Total() {
+		t.Error("want", to.Total())
+		t.Error("got ", balance)
 	}
 }
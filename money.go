@@ -0,0 +1,279 @@
+package booking
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// An ISO 4217 currency code, e.g. "USD"
+type currency string
+
+// What's needed to write and read a currency: how many digits follow the
+// decimal point and the symbol, if it has a well known one
+type currencyFormat struct {
+	MinorUnits int
+	Symbol     string
+}
+
+// Currencies a property can be priced in
+var currencies = map[currency]currencyFormat{
+	"AUD": {2, "A$"},
+	"BHD": {3, ""},
+	"CAD": {2, "CA$"},
+	"CHF": {2, ""},
+	"EUR": {2, "€"},
+	"GBP": {2, "£"},
+	"JOD": {3, ""},
+	"JPY": {0, "¥"},
+	"KRW": {0, "₩"},
+	"KWD": {3, ""},
+	"MXN": {2, "MX$"},
+	"NZD": {2, "NZ$"},
+	"OMR": {3, ""},
+	"USD": {2, "$"},
+}
+
+// What amounts are in until a property says otherwise
+const defaultCurrency = currency("USD")
+
+var unknownCurrency = errors.New("unknown currency")
+
+// Reads a currency code regardless of case and surrounding space
+func parseCurrency(s string) (currency, error) {
+	c := currency(strings.ToUpper(strings.TrimSpace(s)))
+	if _, ok := currencies[c]; !ok {
+		return "", unknownCurrency
+	}
+	return c, nil
+}
+
+// Digits after the decimal point, e.g. 2 for cents
+func (c currency) MinorUnits() int {
+	return currencies[c].MinorUnits
+}
+
+func (c *currency) Scan(src interface{}) error {
+	raw, ok := src.([]byte)
+	if !ok {
+		err := errors.New(
+			fmt.Sprintf("can't scan currency from db: %#v", src),
+		)
+		glog.Error(err)
+		return err
+	}
+	*c = currency(raw)
+	return nil
+}
+
+func (c currency) Value() (driver.Value, error) {
+	return driver.Value(string(c)), nil
+}
+
+// An amount in a currency's minor units, e.g. 1050 USD is $10.50 and 1050
+// JPY is ¥1,050. Arithmetic refuses to mix currencies rather than convert
+type money struct {
+	Amount   amount
+	Currency currency
+}
+
+var (
+	currencyMismatch = errors.New("amounts are in different currencies")
+	moneyOverflow    = errors.New("amount is too large")
+	invalidShares    = errors.New("shares must be zero or more, and not all zero")
+)
+
+// Exactly, with the symbol or code and thousands separated, e.g.
+// "-$1,234.56", "¥1,235" or "KWD 1.234"
+func (m money) String() string {
+	units := m.Currency.MinorUnits()
+
+	// negate as unsigned so the smallest int64 comes out whole
+	n := uint64(m.Amount)
+	sign := ""
+	if m.Amount < 0 {
+		n = -n
+		sign = "-"
+	}
+	digits := strconv.FormatUint(n, 10)
+	if len(digits) <= units {
+		digits = strings.Repeat("0", units-len(digits)+1) + digits
+	}
+	whole := digits[:len(digits)-units]
+	minor := digits[len(digits)-units:]
+
+	var grouped []byte
+	for i := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped = append(grouped, ',')
+		}
+		grouped = append(grouped, whole[i])
+	}
+	s := string(grouped)
+	if units > 0 {
+		s += "." + minor
+	}
+
+	symbol := currencies[m.Currency].Symbol
+	if symbol == "" {
+		return sign + string(m.Currency) + " " + s
+	}
+	return sign + symbol + s
+}
+
+// Plainly, for other programs to read, e.g. "-1234.56" or "1235"
+func (m money) Decimal() string {
+	units := m.Currency.MinorUnits()
+	n := uint64(m.Amount)
+	sign := ""
+	if m.Amount < 0 {
+		n = -n
+		sign = "-"
+	}
+	digits := strconv.FormatUint(n, 10)
+	if units == 0 {
+		return sign + digits
+	}
+	if len(digits) <= units {
+		digits = strings.Repeat("0", units-len(digits)+1) + digits
+	}
+	return sign + digits[:len(digits)-units] + "." + digits[len(digits)-units:]
+}
+
+// Reads an amount in a currency, e.g. "1,234.56", "-$5" or "KWD 0.250".
+// Separators must fall every three digits, and there are as many digits
+// after the point as the currency has minor units, so nothing is rounded
+func parseMoney(s string, c currency) (money, error) {
+	format, ok := currencies[c]
+	if !ok {
+		return money{}, unknownCurrency
+	}
+
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	if format.Symbol != "" && strings.HasPrefix(s, format.Symbol) {
+		s = strings.TrimPrefix(s, format.Symbol)
+	} else if strings.HasPrefix(s, string(c)) {
+		s = strings.TrimSpace(strings.TrimPrefix(s, string(c)))
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) > 2 || parts[0] == "" {
+		return money{}, invalidAmount
+	}
+	whole := parts[0]
+	if strings.Contains(whole, ",") {
+		groups := strings.Split(whole, ",")
+		if len(groups[0]) < 1 || len(groups[0]) > 3 {
+			return money{}, invalidAmount
+		}
+		for _, g := range groups[1:] {
+			if len(g) != 3 {
+				return money{}, invalidAmount
+			}
+		}
+		whole = strings.Join(groups, "")
+	}
+
+	minor := ""
+	if len(parts) == 2 {
+		minor = parts[1]
+		if len(minor) != format.MinorUnits {
+			return money{}, invalidAmount
+		}
+	} else {
+		minor = strings.Repeat("0", format.MinorUnits)
+	}
+
+	for _, r := range whole + minor {
+		if r < '0' || r > '9' {
+			return money{}, invalidAmount
+		}
+	}
+	n, err := strconv.ParseInt(whole+minor, 10, 64)
+	if err != nil {
+		return money{}, moneyOverflow
+	}
+	if negative {
+		n = -n
+	}
+	return money{Amount: amount(n), Currency: c}, nil
+}
+
+func (m money) Add(o money) (money, error) {
+	if m.Currency != o.Currency {
+		return money{}, currencyMismatch
+	}
+	sum := m.Amount + o.Amount
+	if (o.Amount > 0 && sum < m.Amount) || (o.Amount < 0 && sum > m.Amount) {
+		return money{}, moneyOverflow
+	}
+	return money{Amount: sum, Currency: m.Currency}, nil
+}
+
+func (m money) Sub(o money) (money, error) {
+	if o.Amount == math.MinInt64 {
+		return money{}, moneyOverflow
+	}
+	return m.Add(o.Neg())
+}
+
+func (m money) Neg() money {
+	return money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Splits the money into parts in proportion to shares, e.g. 1, 1, 1 for
+// thirds. What can't be split evenly goes a minor unit at a time to the
+// first parts, so the parts always add up to the whole
+func (m money) Allocate(shares ...int) ([]money, error) {
+	var total int64
+	for _, s := range shares {
+		if s < 0 {
+			return nil, invalidShares
+		}
+		total += int64(s)
+	}
+	if total == 0 {
+		return nil, invalidShares
+	}
+
+	parts := make([]money, len(shares))
+	left := m.Amount
+	for i, s := range shares {
+		share, err := mulDiv(m.Amount, int64(s), total)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = money{Amount: share, Currency: m.Currency}
+		left -= share
+	}
+
+	step := amount(1)
+	if left < 0 {
+		step = -1
+	}
+	for i := 0; left != 0; i++ {
+		if shares[i] == 0 {
+			continue
+		}
+		parts[i].Amount += step
+		left -= step
+	}
+	return parts, nil
+}
+
+// a*n/d truncated towards zero, without overflowing on the way
+func mulDiv(a amount, n int64, d int64) (amount, error) {
+	q, r := int64(a)/d, int64(a)%d
+	whole := q * n
+	if n != 0 && whole/n != q {
+		return 0, moneyOverflow
+	}
+	return amount(whole + r*n/d), nil
+}
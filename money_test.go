@@ -0,0 +1,207 @@
+package booking
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// An amount in the default currency
+func usd(a amount) money {
+	return money{Amount: a, Currency: defaultCurrency}
+}
+
+func TestParseCurrency(t *testing.T) {
+	var tests = []struct {
+		s   string
+		c   currency
+		err error
+	}{
+		{"USD", currency("USD"), nil},
+		{" jpy ", currency("JPY"), nil},
+		{"XYZ", "", unknownCurrency},
+		{"", "", unknownCurrency},
+	}
+	for _, test := range tests {
+		c, err := parseCurrency(test.s)
+		if c != test.c || err != test.err {
+			t.Error("want", test.c, test.err)
+			t.Error("got ", c, err)
+		}
+	}
+	for code, units := range map[currency]int{"JPY": 0, "USD": 2, "KWD": 3} {
+		if got := code.MinorUnits(); got != units {
+			t.Error(code, "want", units)
+			t.Error(code, "got ", got)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	var tests = []struct {
+		m    money
+		want string
+	}{
+		{money{0, "USD"}, "$0.00"},
+		{money{5, "USD"}, "$0.05"},
+		{money{-5, "USD"}, "-$0.05"},
+		{money{123456, "USD"}, "$1,234.56"},
+		{money{-123456789, "USD"}, "-$1,234,567.89"},
+		{money{100000, "USD"}, "$1,000.00"},
+		{money{1235, "JPY"}, "¥1,235"},
+		{money{1234, "KWD"}, "KWD 1.234"},
+		{money{5, "KWD"}, "KWD 0.005"},
+		{money{99, "EUR"}, "€0.99"},
+		{
+			money{math.MaxInt64, "USD"},
+			"$92,233,720,368,547,758.07",
+		},
+		{
+			money{math.MinInt64, "USD"},
+			"-$92,233,720,368,547,758.08",
+		},
+	}
+	for _, test := range tests {
+		if got := test.m.String(); got != test.want {
+			t.Error("want", test.want)
+			t.Error("got ", got)
+		}
+	}
+}
+
+func TestMoneyDecimal(t *testing.T) {
+	var tests = []struct {
+		m    money
+		want string
+	}{
+		{money{0, "USD"}, "0.00"},
+		{money{-5, "USD"}, "-0.05"},
+		{money{123456, "USD"}, "1234.56"},
+		{money{-1235, "JPY"}, "-1235"},
+		{money{5, "KWD"}, "0.005"},
+		{money{math.MinInt64, "USD"}, "-92233720368547758.08"},
+	}
+	for _, test := range tests {
+		if got := test.m.Decimal(); got != test.want {
+			t.Error("want", test.want)
+			t.Error("got ", got)
+		}
+	}
+}
+
+func TestParseMoney(t *testing.T) {
+	var tests = []struct {
+		s   string
+		c   currency
+		m   money
+		err error
+	}{
+		{"1,234.56", "USD", money{123456, "USD"}, nil},
+		{"$1,234.56", "USD", money{123456, "USD"}, nil},
+		{"-$5", "USD", money{-500, "USD"}, nil},
+		{"-1,000,000.00", "USD", money{-100000000, "USD"}, nil},
+		{" 0.50 ", "USD", money{50, "USD"}, nil},
+		{"¥1,235", "JPY", money{1235, "JPY"}, nil},
+		{"KWD 1.234", "KWD", money{1234, "KWD"}, nil},
+		{"0.250", "KWD", money{250, "KWD"}, nil},
+		{"1.5", "USD", money{}, invalidAmount},
+		{"1.234", "USD", money{}, invalidAmount},
+		{"1.00", "JPY", money{}, invalidAmount},
+		{"12,34.56", "USD", money{}, invalidAmount},
+		{"1234,567", "USD", money{}, invalidAmount},
+		{",123", "USD", money{}, invalidAmount},
+		{"€5.00", "USD", money{}, invalidAmount},
+		{"1.2.3", "USD", money{}, invalidAmount},
+		{"", "USD", money{}, invalidAmount},
+		{"-", "USD", money{}, invalidAmount},
+		{"ten", "USD", money{}, invalidAmount},
+		{"92,233,720,368,547,758.08", "USD", money{}, moneyOverflow},
+		{"5", "XYZ", money{}, unknownCurrency},
+	}
+	for _, test := range tests {
+		m, err := parseMoney(test.s, test.c)
+		if m != test.m || err != test.err {
+			t.Error(test.s, "want", test.m, test.err)
+			t.Error(test.s, "got ", m, err)
+		}
+	}
+
+	// String() -> parses back
+	for _, m := range []money{{-123456789, "USD"}, {1235, "JPY"}, {1, "KWD"}} {
+		got, err := parseMoney(m.String(), m.Currency)
+		if got != m || err != nil {
+			t.Error("want", m)
+			t.Error("got ", got, err)
+		}
+	}
+}
+
+func TestMoneyArithmetic(t *testing.T) {
+	sum, err := usd(1050).Add(usd(-2000))
+	if sum != usd(-950) || err != nil {
+		t.Error("want", usd(-950))
+		t.Error("got ", sum, err)
+	}
+	diff, err := usd(1050).Sub(usd(50))
+	if diff != usd(1000) || err != nil {
+		t.Error("want", usd(1000))
+		t.Error("got ", diff, err)
+	}
+
+	var tests = []struct {
+		op  func() (money, error)
+		err error
+	}{
+		{func() (money, error) { return usd(1).Add(money{1, "EUR"}) }, currencyMismatch},
+		{func() (money, error) { return usd(1).Sub(money{1, "JPY"}) }, currencyMismatch},
+		{func() (money, error) { return usd(math.MaxInt64).Add(usd(1)) }, moneyOverflow},
+		{func() (money, error) { return usd(math.MinInt64).Sub(usd(1)) }, moneyOverflow},
+		{func() (money, error) { return usd(0).Sub(usd(math.MinInt64)) }, moneyOverflow},
+	}
+	for i, test := range tests {
+		if _, err := test.op(); err != test.err {
+			t.Error(i, "want", test.err)
+			t.Error(i, "got ", err)
+		}
+	}
+}
+
+func TestMoneyAllocate(t *testing.T) {
+	var tests = []struct {
+		m      money
+		shares []int
+		want   []amount
+		err    error
+	}{
+		{usd(100), []int{1, 1, 1}, []amount{34, 33, 33}, nil},
+		{usd(-100), []int{1, 1, 1}, []amount{-34, -33, -33}, nil},
+		{usd(5), []int{3, 7}, []amount{2, 3}, nil},
+		{usd(1000), []int{0, 1, 1}, []amount{0, 500, 500}, nil},
+		{usd(1), []int{0, 1, 1}, []amount{0, 1, 0}, nil},
+		{money{10, "JPY"}, []int{1, 1, 1}, []amount{4, 3, 3}, nil},
+		{usd(math.MaxInt64), []int{1, 1}, []amount{math.MaxInt64/2 + 1, math.MaxInt64 / 2}, nil},
+		{usd(100), []int{0, 0}, nil, invalidShares},
+		{usd(100), []int{1, -1}, nil, invalidShares},
+		{usd(100), nil, nil, invalidShares},
+	}
+	for _, test := range tests {
+		parts, err := test.m.Allocate(test.shares...)
+		if err != test.err {
+			t.Error(test.m, test.shares, "want", test.err)
+			t.Error(test.m, test.shares, "got ", err)
+			continue
+		}
+		var got []amount
+		for _, p := range parts {
+			if p.Currency != test.m.Currency {
+				t.Error("want", test.m.Currency)
+				t.Error("got ", p.Currency)
+			}
+			got = append(got, p.Amount)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Error(test.m, test.shares, "want", test.want)
+			t.Error(test.m, test.shares, "got ", got)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package booking
+
+import (
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Tells a guest about their booking, by email or however it's set up
+type Notifier interface {
+	Notify(to guest, subject string, body string) error
+}
+
+// What was sent to whom
+type notice struct {
+	Body    string
+	Subject string
+	To      guestId
+}
+
+// A notifier that only logs, for development and tests. It keeps what it's
+// sent. The zero value is ready to use
+type LogNotifier struct {
+	mu   sync.Mutex
+	sent []notice
+}
+
+func (n *LogNotifier) Notify(to guest, subject string, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, notice{Body: body, Subject: subject, To: to.Id})
+	glog.Infoln("notified", to.Id, subject)
+	return nil
+}
+
+// Everything sent so far, oldest first
+func (n *LogNotifier) Sent() []notice {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]notice(nil), n.sent...)
+}
@@ -0,0 +1,32 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLogNotifier(t *testing.T) {
+	var n LogNotifier
+	if sent := n.Sent(); len(sent) != 0 {
+		t.Error("want nothing sent")
+		t.Error("got ", sent)
+	}
+
+	err := n.Notify(guest{Id: guestId(1)}, "Hello", "Welcome")
+	if err != nil {
+		t.Error(err)
+	}
+	err = n.Notify(guest{Id: guestId(2)}, "Bye", "Come again")
+	if err != nil {
+		t.Error(err)
+	}
+
+	want := []notice{
+		{Body: "Welcome", Subject: "Hello", To: guestId(1)},
+		{Body: "Come again", Subject: "Bye", To: guestId(2)},
+	}
+	if got := n.Sent(); !reflect.DeepEqual(want, got) {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+}
@@ -0,0 +1,327 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// Moves money on cards. Authorize holds an amount on a card, Capture takes
+// some or all of it once and releases the rest, Void releases an uncaptured
+// hold and Refund returns some or all of a capture, in the currency it was
+// authorized in. Each returns the gateway's id for what it did
+type PaymentGateway interface {
+	Authorize(card cardToken, m money) (gatewayTxId, error)
+	Capture(auth gatewayTxId, m money) (gatewayTxId, error)
+	Void(auth gatewayTxId) error
+	Refund(capture gatewayTxId, m money) (gatewayTxId, error)
+}
+
+// A payment gateway's reference for an authorization, capture or refund
+type gatewayTxId string
+
+// Reasons a card issuer turns a payment down. The guest can fix these by
+// changing the card details, unlike other gateway errors
+var (
+	cardDeclined      = errors.New("your card was declined")
+	insufficientFunds = errors.New("your card has insufficient funds")
+	expiredCard       = errors.New("your card has expired")
+	incorrectCVC      = errors.New("your card's security code is incorrect")
+)
+
+var (
+	gatewayTimeout  = errors.New("payment gateway timed out")
+	gatewayTxFailed = errors.New("payment gateway can't do that to this transaction")
+)
+
+func declined(err error) bool {
+	switch err {
+	case cardDeclined, insufficientFunds, expiredCard, incorrectCVC:
+		return true
+	}
+	return false
+}
+
+// Card numbers the fake gateway treats specially, after Stripe's test cards.
+// Any other number is approved
+const (
+	fakeCardApproved          = "4242424242424242"
+	fakeCardDeclined          = "4000000000000002"
+	fakeCardInsufficientFunds = "4000000000009995"
+	fakeCardExpired           = "4000000000000069"
+	fakeCardIncorrectCVC      = "4000000000000127"
+	fakeCardTimeout           = "4000000000000119"
+)
+
+// A gateway that moves no money, for development and tests. It's its own
+// vault, so Tokenize cards before charging them, and it drops a card's
+// security code once the card is authorized. Cards behave by number, see
+// fakeCardApproved etc., and ids count up from fake_1 so runs are
+// repeatable. Populate it so its vault has a Clock
+type FakeGateway struct {
+	LocalVault `inject:""`
+
+	mu           sync.Mutex
+	last         int
+	transactions map[gatewayTxId]*fakeTransaction
+}
+
+type fakeTransaction struct {
+	Amount   amount
+	Captured amount
+	Currency currency
+	Parent   gatewayTxId
+	Refunded amount
+	Released amount
+	Voided   bool
+}
+
+func (g *FakeGateway) Authorize(token cardToken, m money) (gatewayTxId, error) {
+	card, err := g.reveal(token)
+	if err != nil {
+		return "", err
+	}
+
+	switch card.Number {
+	case fakeCardDeclined:
+		return "", cardDeclined
+	case fakeCardInsufficientFunds:
+		return "", insufficientFunds
+	case fakeCardExpired:
+		return "", expiredCard
+	case fakeCardIncorrectCVC:
+		return "", incorrectCVC
+	case fakeCardTimeout:
+		return "", gatewayTimeout
+	}
+
+	g.forgetCVC(token)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.record(&fakeTransaction{Amount: m.Amount, Currency: m.Currency}), nil
+}
+
+// Captures at most the authorization, once, releasing whatever's left of it
+func (g *FakeGateway) Capture(auth gatewayTxId, m money) (gatewayTxId, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t, ok := g.transactions[auth]
+	if !ok || t.Parent != "" || t.Voided || t.Captured > 0 || m.Amount > t.Amount {
+		return "", gatewayTxFailed
+	}
+	if m.Currency != t.Currency {
+		return "", currencyMismatch
+	}
+	t.Captured = m.Amount
+	t.Released = t.Amount - m.Amount
+	return g.record(&fakeTransaction{
+		Amount:   m.Amount,
+		Currency: m.Currency,
+		Parent:   auth,
+	}), nil
+}
+
+// Releases an authorization nothing has been captured from
+func (g *FakeGateway) Void(auth gatewayTxId) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t, ok := g.transactions[auth]
+	if !ok || t.Parent != "" || t.Voided || t.Captured > 0 {
+		return gatewayTxFailed
+	}
+	t.Voided = true
+	return nil
+}
+
+// Refunds at most what's left of the capture
+func (g *FakeGateway) Refund(capture gatewayTxId, m money) (gatewayTxId, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	t, ok := g.transactions[capture]
+	if !ok || t.Parent == "" || t.Refunded+m.Amount > t.Amount {
+		return "", gatewayTxFailed
+	}
+	if m.Currency != t.Currency {
+		return "", currencyMismatch
+	}
+	t.Refunded += m.Amount
+	return g.record(&fakeTransaction{
+		Amount:   -m.Amount,
+		Currency: m.Currency,
+		Parent:   capture,
+	}), nil
+}
+
+// Caller must hold mu
+func (g *FakeGateway) record(t *fakeTransaction) gatewayTxId {
+	if g.transactions == nil {
+		g.transactions = make(map[gatewayTxId]*fakeTransaction)
+	}
+	g.last++
+	id := gatewayTxId(fmt.Sprintf("fake_%d", g.last))
+	g.transactions[id] = t
+	glog.Infoln("fake gateway", id, money{Amount: t.Amount, Currency: t.Currency})
+	return id
+}
+
+// Money taken from a guest's card for a booking, and the journal entry it's
+// booked in
+const PaymentSchema = `
+  CREATE TABLE Payment (
+    Amount INTEGER NOT NULL,
+    AuthorizationId TEXT NOT NULL,
+    BookingId INTEGER NOT NULL DEFAULT 0,
+    CaptureId TEXT UNIQUE NOT NULL,
+    Card TEXT NOT NULL DEFAULT '',
+    EntryId INTEGER NOT NULL REFERENCES JournalEntry(Id),
+    GuestId INTEGER NOT NULL,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )
+`
+
+var paymentMigration = statements(
+	`CREATE TABLE Payment (
+    Amount INTEGER NOT NULL,
+    AuthorizationId TEXT NOT NULL,
+    CaptureId TEXT UNIQUE NOT NULL,
+    EntryId INTEGER NOT NULL REFERENCES JournalEntry(Id),
+    GuestId INTEGER NOT NULL,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )`,
+)
+
+// Payments keep the card they were charged to, so a reinstated booking can
+// be charged its refund back. Earlier payments have none
+var paymentCardMigration = statements(
+	`ALTER TABLE Payment ADD COLUMN Card TEXT NOT NULL DEFAULT ''`,
+)
+
+type payment struct {
+	Amount          amount
+	AuthorizationId gatewayTxId
+	BookingId       bookingId
+	CaptureId       gatewayTxId
+	Card            cardToken
+	EntryId         int64
+	GuestId         guestId
+	Id              int64
+}
+
+// Credits the guest with a captured payment and keeps the gateway's ids
+func (l *Ledger) recordPaymentTx(tx *sql.Tx, p *payment, memo memo) error {
+	var err error
+	p.EntryId, err = l.post(tx, guestEntry(p.GuestId, p.BookingId, -p.Amount, clearing, memo))
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(`
+    insert into Payment
+    (Amount, AuthorizationId, BookingId, CaptureId, Card, EntryId, GuestId)
+    values ($1, $2, $3, $4, $5, $6, $7)
+  `,
+		p.Amount,
+		p.AuthorizationId,
+		p.BookingId,
+		p.CaptureId,
+		p.Card,
+		p.EntryId,
+		p.GuestId,
+	)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	p.Id, err = result.LastInsertId()
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// Holds an amount on a card without taking it, to Capture some of or
+// Release later
+func (l *Ledger) Authorize(card cardToken, a amount) (gatewayTxId, error) {
+	if a <= 0 {
+		return "", invalidAmount
+	}
+	auth, err := l.Gateway.Authorize(card, l.Money(a))
+	if err != nil {
+		glog.Error(err)
+		return "", err
+	}
+	glog.Infoln("authorized", l.Money(a), "as", auth)
+	return auth, nil
+}
+
+// Lets go of a hold nothing's been taken from
+func (l *Ledger) Release(auth gatewayTxId) error {
+	err := l.Gateway.Void(auth)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	glog.Infoln("released", auth)
+	return nil
+}
+
+// Takes some or all of a hold for a booking and credits the guest with it,
+// as ChargeTx does. The gateway lets go of whatever's left. If the caller
+// rolls back it should Unwind the payment - caller is responsible for
+// Commit/Rollback
+func (l *Ledger) CaptureTx(
+	tx *sql.Tx,
+	guest guestId,
+	id bookingId,
+	auth gatewayTxId,
+	a amount,
+	memo memo,
+) (payment, error) {
+	if a <= 0 {
+		return payment{}, invalidAmount
+	}
+
+	p := payment{Amount: a, AuthorizationId: auth, BookingId: id, GuestId: guest}
+	var err error
+	p.CaptureId, err = l.Gateway.Capture(auth, l.Money(a))
+	if err != nil {
+		glog.Error(err)
+		return payment{}, err
+	}
+
+	err = l.recordPaymentTx(tx, &p, memo)
+	if err != nil {
+		l.Unwind(p)
+		return payment{}, err
+	}
+
+	glog.Infoln("captured", auth, l.Money(a), "as", p.CaptureId)
+	return p, nil
+}
+
+// Gives back a payment whose transaction didn't commit, so a guest is never
+// charged for what wasn't recorded. Failures are logged for someone to
+// follow up by hand
+func (l *Ledger) Unwind(p payment) {
+	if p.CaptureId == "" {
+		return
+	}
+
+	refund, err := l.Gateway.Refund(p.CaptureId, l.Money(p.Amount))
+	if err != nil {
+		glog.Error("couldn't unwind ", p.CaptureId, ": ", err)
+		return
+	}
+	glog.Infoln("unwound", p.CaptureId, "as", refund)
+}
@@ -0,0 +1,289 @@
+package booking
+
+import (
+	"testing"
+
+	"github.com/facebookgo/inject"
+)
+
+// A card in the fake gateway's vault
+func testCard(t *testing.T, g *FakeGateway, number string) cardToken {
+	token, err := g.Tokenize(creditCard{Number: number})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestFakeGatewayCards(t *testing.T) {
+	var tests = []struct {
+		number string
+		err    error
+	}{
+		{fakeCardApproved, nil},
+		{"5555555555554444", nil},
+		{fakeCardDeclined, cardDeclined},
+		{fakeCardInsufficientFunds, insufficientFunds},
+		{fakeCardExpired, expiredCard},
+		{fakeCardIncorrectCVC, incorrectCVC},
+		{fakeCardTimeout, gatewayTimeout},
+	}
+	var g FakeGateway
+	err := inject.Populate(&g)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, test := range tests {
+		_, err := g.Authorize(testCard(t, &g, test.number), usd(100))
+		if err != test.err {
+			t.Error(test.number, "want", test.err)
+			t.Error(test.number, "got ", err)
+		}
+		if declined(err) != (test.err != nil && test.err != gatewayTimeout) {
+			t.Error(test.number, "want declined", declined(err))
+		}
+	}
+}
+
+func TestFakeGateway(t *testing.T) {
+	var g FakeGateway
+	err := inject.Populate(&g)
+	if err != nil {
+		t.Error(err)
+	}
+	card := testCard(t, &g, fakeCardApproved)
+
+	auth, err := g.Authorize(card, usd(10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Authorize(cardToken("card_unknown"), usd(100)); err != cardTokenNotFound {
+		t.Error("want", cardTokenNotFound)
+		t.Error("got ", err)
+	}
+	if auth != gatewayTxId("fake_1") {
+		t.Error("want", "fake_1")
+		t.Error("got ", auth)
+	}
+
+	// Capture() -> no more than authorized
+	if _, err := g.Capture(auth, usd(10001)); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+	capture, err := g.Capture(auth, usd(10000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Void() -> not once captured
+	if err := g.Void(auth); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+
+	// Refund() -> in parts, up to the capture
+	if _, err := g.Refund(auth, usd(100)); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+	if _, err := g.Refund(capture, usd(6000)); err != nil {
+		t.Error(err)
+	}
+	if _, err := g.Refund(capture, usd(4001)); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+	if _, err := g.Refund(capture, usd(4000)); err != nil {
+		t.Error(err)
+	}
+
+	// Void() -> an uncaptured authorization, once
+	other, err := g.Authorize(card, usd(500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Void(other); err != nil {
+		t.Error(err)
+	}
+	if err := g.Void(other); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+	if _, err := g.Capture(other, usd(500)); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+
+	// Capture(), Refund() -> in the currency authorized
+	euros, err := g.Authorize(card, money{Amount: 500, Currency: "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Capture(euros, usd(500)); err != currencyMismatch {
+		t.Error("want", currencyMismatch)
+		t.Error("got ", err)
+	}
+	capture, err = g.Capture(euros, money{Amount: 500, Currency: "EUR"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Refund(capture, usd(500)); err != currencyMismatch {
+		t.Error("want", currencyMismatch)
+		t.Error("got ", err)
+	}
+}
+
+func TestLedgerCharge(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var gateway FakeGateway
+	var ledger Ledger
+	err := inject.Populate(db, &gateway, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+
+	guest := guestId(1)
+
+	// Charge() -> declined, nothing posted
+	_, err = ledger.Charge(
+		guest,
+		bookingId(1),
+		amount(5000),
+		testCard(t, &gateway, fakeCardInsufficientFunds),
+		memo("paid"),
+	)
+	if err != insufficientFunds {
+		t.Error("want", insufficientFunds)
+		t.Error("got ", err)
+	}
+
+	// Charge() -> captured and recorded
+	p, err := ledger.Charge(
+		guest,
+		bookingId(1),
+		amount(5000),
+		testCard(t, &gateway, fakeCardApproved),
+		memo("paid"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.AuthorizationId != "fake_1" || p.CaptureId != "fake_2" {
+		t.Error("want fake_1, fake_2")
+		t.Error("got ", p.AuthorizationId, p.CaptureId)
+	}
+
+	var id bookingId
+	var captureId gatewayTxId
+	var entryId int64
+	err = db.QueryRow(
+		`select BookingId, CaptureId, EntryId from Payment where Id = $1`,
+		p.Id,
+	).Scan(&id, &captureId, &entryId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != bookingId(1) || captureId != p.CaptureId || entryId != p.EntryId {
+		t.Error("want", bookingId(1), p.CaptureId, p.EntryId)
+		t.Error("got ", id, captureId, entryId)
+	}
+
+	balance, err := ledger.Balance(guest)
+	if err != nil {
+		t.Error(err)
+	}
+	if balance != amount(-5000) {
+		t.Error("want", amount(-5000))
+		t.Error("got ", balance)
+	}
+
+	// Unwind() -> refunded at the gateway
+	ledger.Unwind(p)
+	if _, err := gateway.Refund(p.CaptureId, usd(1)); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+}
+
+func TestLedgerAuthorizeCapture(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var gateway FakeGateway
+	var ledger Ledger
+	err := inject.Populate(db, &gateway, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+	card := testCard(t, &gateway, fakeCardApproved)
+
+	// Authorize() -> declined
+	_, err = ledger.Authorize(
+		testCard(t, &gateway, fakeCardDeclined),
+		amount(25000),
+	)
+	if err != cardDeclined {
+		t.Error("want", cardDeclined)
+		t.Error("got ", err)
+	}
+
+	// Release() -> nothing left to capture
+	auth, err := ledger.Authorize(card, amount(25000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ledger.Release(auth)
+	if err != nil {
+		t.Error(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ledger.CaptureTx(tx, guestId(1), bookingId(1), auth, amount(100), memo("damage"))
+	if err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+
+	// CaptureTx() -> part of a hold, recorded against the booking, and the
+	// rest let go
+	auth, err = ledger.Authorize(card, amount(25000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ledger.CaptureTx(tx, guestId(1), bookingId(1), auth, amount(8000), memo("damage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if released := gateway.transactions[auth].Released; released != amount(17000) {
+		t.Error("want", amount(17000))
+		t.Error("got ", released)
+	}
+	_, err = ledger.CaptureTx(tx, guestId(1), bookingId(1), auth, amount(100), memo("damage"))
+	if err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.AuthorizationId != auth || p.Amount != amount(8000) {
+		t.Error("want", auth, amount(8000))
+		t.Error("got ", p.AuthorizationId, p.Amount)
+	}
+	payments, err := ledger.Payments(bookingId(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].Id != p.Id {
+		t.Error("want", p)
+		t.Error("got ", payments)
+	}
+	if balance, _ := ledger.Balance(guestId(1)); balance != amount(-8000) {
+		t.Error("want", amount(-8000))
+		t.Error("got ", balance)
+	}
+}
@@ -86,6 +86,10 @@ func (d Date) After(u Date) bool {
 	return d.t.After(u.t)
 }
 
+func (d Date) Before(u Date) bool {
+	return d.t.Before(u.t)
+}
+
 func (d Date) DaysApart(u Date) int {
 	duration := d.t.Sub(u.t)
 
@@ -104,6 +108,11 @@ func (d Date) Format(layout string) string {
 	return d.t.Format(layout)
 }
 
+// Midnight UTC at the start of the day
+func (d Date) Time() time.Time {
+	return d.t
+}
+
 func (d *Date) Scan(src interface{}) error {
 	t, ok := src.(time.Time)
 	if !ok {
@@ -0,0 +1,223 @@
+package booking
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+)
+
+const pricesUsage = `usage:
+  prices list
+  prices set -name NAME -rate RATE -from DATE [-to DATE] -amount PRICE
+  prices remove -name NAME -rate RATE
+  prices discounts -rate RATE
+  prices discount -rate RATE -kind KIND -threshold N -percent N
+                  [-exclusive] [-position N]
+  prices undiscount -id ID
+  prices fees [-rate RATE]
+  prices fee -name NAME -kind fee|tax -basis stay|night|guest -amount PRICE
+             [-rate RATE]
+  prices fee -name NAME -kind fee|tax -basis percent -percent PERCENT
+             -of KIND,... [-inclusive] [-rate RATE] [-position N]
+  prices unfee -id ID`
+
+var unknownPricesCommand = errors.New(pricesUsage)
+
+// Manages seasonal prices, discounts, fees and taxes from the command line,
+// writing results to out
+func PricesCommand(
+	p *Pricing,
+	rates *Rates,
+	args []string,
+	out io.Writer,
+) error {
+	if len(args) == 0 {
+		return unknownPricesCommand
+	}
+
+	flags := flag.NewFlagSet("prices "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	flagName := flags.String("name", "", "season name, e.g. New Year")
+	flagRate := flags.String("rate", "", "rate name, e.g. With Bunny")
+	flagFrom := flags.String("from", "", "first night, e.g. 12/30/2015")
+	flagTo := flags.String("to", "", "last night, defaults to -from")
+	flagAmount := flags.String("amount", "", "nightly price, e.g. 300.00")
+	flagKind := flags.String("kind", "", "discount or fee kind")
+	flagThreshold := flags.Int("threshold", 0, "minimum nights, or days ahead")
+	flagPercent := flags.String("percent", "", "e.g. 10 or 14.75")
+	flagBasis := flags.String("basis", "", "what a fee is charged on")
+	flagOf := flags.String("of", "", "line kinds a percentage is taken of")
+	flagInclusive := flags.Bool("inclusive", false, "already in the price")
+	flagExclusive := flags.Bool("exclusive", false, "don't stack")
+	flagPosition := flags.Int("position", 0, "evaluation order, default last")
+	flagId := flags.Int64("id", 0, "discount or fee rule id")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	default:
+		return unknownPricesCommand
+	case "list":
+		seasons, err := p.Seasons()
+		if err != nil {
+			return err
+		}
+		for _, s := range seasons {
+			fmt.Fprintln(out, s)
+		}
+		return nil
+	case "set":
+		s := season{Name: *flagName}
+		s.Rate, err = rates.Named(*flagRate)
+		if err != nil {
+			return err
+		}
+		s.FirstNight, err = date.Parse(*flagFrom)
+		if err != nil {
+			return err
+		}
+		s.LastNight = s.FirstNight
+		if *flagTo != "" {
+			s.LastNight, err = date.Parse(*flagTo)
+			if err != nil {
+				return err
+			}
+		}
+		s.Amount, err = p.Property.ParsePrice(*flagAmount)
+		if err != nil {
+			return err
+		}
+		err = p.SetSeason(s)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, s)
+		return nil
+	case "remove":
+		r, err := rates.Named(*flagRate)
+		if err != nil {
+			return err
+		}
+		return p.RemoveSeason(*flagName, r)
+	case "discounts":
+		r, err := rates.Named(*flagRate)
+		if err != nil {
+			return err
+		}
+		rules, err := p.Discounts(r.Id)
+		if err != nil {
+			return err
+		}
+		for _, d := range rules {
+			fmt.Fprintln(out, discountSummary(d))
+		}
+		return nil
+	case "discount":
+		r, err := rates.Named(*flagRate)
+		if err != nil {
+			return err
+		}
+		percent, err := strconv.Atoi(*flagPercent)
+		if err != nil {
+			return invalidDiscount
+		}
+		d, err := p.AddDiscount(discountRule{
+			Exclusive: *flagExclusive,
+			Kind:      discountKind(*flagKind),
+			Percent:   percent,
+			Position:  *flagPosition,
+			Rate:      r.Id,
+			Threshold: *flagThreshold,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, discountSummary(d))
+		return nil
+	case "undiscount":
+		return p.RemoveDiscount(*flagId)
+	case "fees":
+		id := allRatesId
+		if *flagRate != "" {
+			r, err := rates.Named(*flagRate)
+			if err != nil {
+				return err
+			}
+			id = r.Id
+		}
+		rules, err := p.Fees(id)
+		if err != nil {
+			return err
+		}
+		for _, f := range rules {
+			fmt.Fprintln(out, feeSummary(f, p.Property.Currency()))
+		}
+		return nil
+	case "fee":
+		f := feeRule{
+			Basis:     feeBasis(*flagBasis),
+			Inclusive: *flagInclusive,
+			Kind:      lineKind(*flagKind),
+			Name:      *flagName,
+			Position:  *flagPosition,
+		}
+		if *flagRate != "" {
+			r, err := rates.Named(*flagRate)
+			if err != nil {
+				return err
+			}
+			f.Rate = r.Id
+		}
+		if f.Basis == percentOf {
+			f.Percentage, err = parsePercentage(*flagPercent)
+			if err != nil {
+				return err
+			}
+			for _, k := range strings.Split(*flagOf, ",") {
+				f.AppliesTo = append(f.AppliesTo, lineKind(k))
+			}
+		} else {
+			f.Amount, err = p.Property.ParsePrice(*flagAmount)
+			if err != nil {
+				return err
+			}
+		}
+		f, err = p.AddFee(f)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, feeSummary(f, p.Property.Currency()))
+		return nil
+	case "unfee":
+		return p.RemoveFee(*flagId)
+	}
+}
+
+func discountSummary(d discountRule) string {
+	stacking := "stacks"
+	if d.Exclusive {
+		stacking = "exclusive"
+	}
+	return fmt.Sprintf("%d. #%d %s (%s)", d.Position, d.Id, d, stacking)
+}
+
+func feeSummary(f feeRule, cur currency) string {
+	plans := "all rates"
+	if f.Rate != allRatesId {
+		plans = f.Rate.String()
+	}
+	return fmt.Sprintf(
+		"%d. #%d %s (%s)",
+		f.Position,
+		f.Id,
+		f.describe(cur),
+		plans,
+	)
+}
@@ -0,0 +1,151 @@
+package booking
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestPricesCommand(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var pricing Pricing
+	var rates Rates
+	err := inject.Populate(db, &pricing, &rates)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var out bytes.Buffer
+	err = PricesCommand(&pricing, &rates, nil, &out)
+	if err != unknownPricesCommand {
+		t.Error("want", unknownPricesCommand)
+		t.Error("got ", err)
+	}
+
+	err = PricesCommand(&pricing, &rates, []string{
+		"set",
+		"-name", "New Year",
+		"-rate", "With Bunny",
+		"-from", "12/30/2015",
+		"-to", "1/1/2016",
+		"-amount", "300",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	err = PricesCommand(&pricing, &rates, []string{"list"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "New Year: With Bunny 2015-12-30 - 2016-01-01 at $300.00 a night\n"
+	if got := out.String(); got != want {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+
+	q, err := pricing.Quote(date.New(2015, 12, 31), date.New(2016, 1, 3), withBunny, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != amount(80000) {
+		t.Error("want", amount(80000))
+		t.Error("got ", total)
+	}
+
+	// discounts
+	err = PricesCommand(&pricing, &rates, []string{
+		"discount",
+		"-rate", "With Bunny",
+		"-kind", "length-of-stay",
+		"-threshold", "7",
+		"-percent", "10",
+		"-exclusive",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err = PricesCommand(&pricing, &rates, []string{
+		"discounts",
+		"-rate", "With Bunny",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "1. #1 7+ nights: 10% off (exclusive)\n"
+	if got := out.String(); got != want {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+	err = PricesCommand(&pricing, &rates, []string{"undiscount", "-id", "1"}, &out)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// fees and taxes
+	err = PricesCommand(&pricing, &rates, []string{
+		"fee",
+		"-name", "Cleaning",
+		"-kind", "fee",
+		"-basis", "stay",
+		"-amount", "75",
+		"-rate", "With Bunny",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PricesCommand(&pricing, &rates, []string{
+		"fee",
+		"-name", "City",
+		"-kind", "tax",
+		"-basis", "percent",
+		"-percent", "5.875",
+		"-of", "night,fee",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err = PricesCommand(&pricing, &rates, []string{
+		"fees",
+		"-rate", "With Bunny",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "1. #1 Cleaning fee: $75.00 per stay (rateId:1)\n" +
+		"2. #2 City tax: 5.875% of night, fee (all rates)\n"
+	if got := out.String(); got != want {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+	for _, id := range []string{"1", "2"} {
+		err = PricesCommand(&pricing, &rates, []string{"unfee", "-id", id}, &out)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	err = PricesCommand(&pricing, &rates, []string{
+		"remove",
+		"-name", "New Year",
+		"-rate", "With Bunny",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = PricesCommand(&pricing, &rates, []string{
+		"remove",
+		"-name", "New Year",
+		"-rate", "With Bunny",
+	}, &out)
+	if err != seasonNotFound {
+		t.Error("want", seasonNotFound)
+		t.Error("got ", err)
+	}
+}
@@ -0,0 +1,448 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// Prices stays and keeps the quote each booking was made on, so what a guest
+// agreed to pay doesn't move when rates do
+type Pricing struct {
+	Clock    *Clock    `inject:""`
+	DB       *sql.DB   `inject:""`
+	Property *Property `inject:""`
+}
+
+// Nightly prices for a rate over a named range of nights. A single date is a
+// season whose first and last nights are the same
+const SeasonSchema = `
+  CREATE TABLE Season (
+    Amount INTEGER NOT NULL,
+    FirstNight DATETIME NOT NULL,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    LastNight DATETIME NOT NULL,
+    Name TEXT NOT NULL,
+    RateId INTEGER NOT NULL,
+    UNIQUE (Name, RateId),
+    CONSTRAINT ck_First_Not_After_Last CHECK (FirstNight <= LastNight),
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )
+`
+
+var seasonMigration = statements(
+	`CREATE TABLE Season (
+    Amount INTEGER NOT NULL,
+    FirstNight DATETIME NOT NULL,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    LastNight DATETIME NOT NULL,
+    Name TEXT NOT NULL,
+    Rate TEXT NOT NULL,
+    UNIQUE (Name, Rate),
+    CONSTRAINT ck_First_Not_After_Last CHECK (FirstNight <= LastNight),
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )`,
+)
+
+// What a rate plan costs over a range of nights, both included, whichever
+// version of the plan is booked. Where seasons overlap the shorter one wins,
+// so a date-specific price beats its season
+type season struct {
+	Amount     amount
+	FirstNight date.Date
+	LastNight  date.Date
+	Name       string
+	Rate       rate
+}
+
+var (
+	invalidSeason  = errors.New("season needs a name and a price, and can't end before it starts")
+	seasonNotFound = errors.New("season not found")
+)
+
+func (s season) String() string {
+	return fmt.Sprintf(
+		"%s: %s %s - %s at %s a night",
+		s.Name,
+		s.Rate.Name,
+		s.FirstNight,
+		s.LastNight,
+		money{Amount: s.Amount, Currency: s.Rate.Currency},
+	)
+}
+
+// Adds a season, or replaces the one with the same name and rate
+func (p *Pricing) SetSeason(s season) error {
+	if s.Name == "" || s.Amount <= 0 || s.LastNight.Before(s.FirstNight) {
+		return invalidSeason
+	}
+
+	_, err := p.DB.Exec(`
+    insert or replace into Season (Amount, FirstNight, LastNight, Name, RateId)
+    values ($1, $2, $3, $4, $5)
+  `, s.Amount, s.FirstNight, s.LastNight, s.Name, s.Rate.Id)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	glog.Infoln("set season", s)
+	return nil
+}
+
+func (p *Pricing) RemoveSeason(name string, r rate) error {
+	result, err := p.DB.Exec(
+		`delete from Season where Name = $1 and RateId = $2`,
+		name,
+		r.Id,
+	)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return seasonNotFound
+	}
+
+	glog.Infoln("removed season", name, r)
+	return nil
+}
+
+// Every season, by rate then first night
+func (p *Pricing) Seasons() ([]season, error) {
+	rows, err := p.DB.Query(`
+    select s.Amount, s.FirstNight, s.LastNight, s.Name, ` + rateColumns + `
+    from Season s
+    join RatePlan p on p.Id = s.RateId and` + currentRateVersion + `
+    order by p.Id asc, s.FirstNight asc, s.Name asc
+  `)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var seasons []season
+	for rows.Next() {
+		var s season
+		fields := []interface{}{&s.Amount, &s.FirstNight, &s.LastNight, &s.Name}
+		err := rows.Scan(append(fields, rateFields(&s.Rate)...)...)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		seasons = append(seasons, s)
+	}
+
+	return seasons, rows.Err()
+}
+
+// Lines of every version of every booking's quote
+const QuoteSchema = `
+  CREATE TABLE Quote (
+    Amount INTEGER NOT NULL,
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    Description TEXT NOT NULL,
+    Included BOOLEAN NOT NULL DEFAULT 0,
+    Kind TEXT NOT NULL,
+    Night DATETIME NOT NULL,
+    Position INTEGER NOT NULL,
+    Version INTEGER NOT NULL,
+    PRIMARY KEY (BookingId, Version, Position)
+  )
+`
+
+// Existing bookings are quoted a line per night at what the rates were
+// when quotes were introduced
+var quoteMigration = statements(
+	`CREATE TABLE Quote (
+    Amount INTEGER NOT NULL,
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    Description TEXT NOT NULL,
+    Kind TEXT NOT NULL,
+    Night DATETIME NOT NULL,
+    Position INTEGER NOT NULL,
+    Version INTEGER NOT NULL,
+    PRIMARY KEY (BookingId, Version, Position)
+  )`,
+	`INSERT INTO Quote
+    (Amount, BookingId, Description, Kind, Night, Position, Version)
+    WITH RECURSIVE nights (BookingId, Night, Checkout, Rate, Position, Version)
+    AS (
+      SELECT Id, Checkin, Checkout, Rate, 0, Version FROM Register
+      UNION ALL
+      SELECT BookingId, datetime(Night, '+1 day'), Checkout, Rate,
+        Position + 1, Version
+      FROM nights
+      WHERE datetime(Night, '+1 day') < Checkout
+    )
+    SELECT
+      CASE Rate WHEN 'With Bunny' THEN 20000 ELSE 25000 END,
+      BookingId, Rate, 'night', Night, Position, Version
+    FROM nights`,
+)
+
+// Taxes can be included in the prices they're on
+var quoteIncludedMigration = statements(
+	`ALTER TABLE Quote ADD COLUMN Included BOOLEAN NOT NULL DEFAULT 0`,
+)
+
+// What a quote line is for
+type lineKind string
+
+const (
+	nightLine    = lineKind("night")
+	discountLine = lineKind("discount")
+	feeLine      = lineKind("fee")
+	taxLine      = lineKind("tax")
+)
+
+// One priced item. Night is set on lines for a single night. Included lines
+// are part of other lines' prices, e.g. tax-inclusive taxes, so don't count
+// towards the total
+type quoteLine struct {
+	Amount      amount
+	Description string
+	Included    bool
+	Kind        lineKind
+	Night       date.Date
+}
+
+// Everything a stay costs, itemised, in the property's currency
+type quote struct {
+	Currency currency
+	Lines    []quoteLine
+}
+
+func (l quoteLine) Nightly() bool {
+	return l.Kind == nightLine
+}
+
+// What the nights come to before any discounts
+func (q quote) Subtotal() amount {
+	var subtotal amount
+	for _, line := range q.Lines {
+		if line.Nightly() {
+			subtotal += line.Amount
+		}
+	}
+	return subtotal
+}
+
+func (q quote) Total() amount {
+	var total amount
+	for _, line := range q.Lines {
+		if !line.Included {
+			total += line.Amount
+		}
+	}
+	return total
+}
+
+// One of the quote's amounts, e.g. a line's or the total, in its currency
+func (q quote) Money(a amount) money {
+	return money{Amount: a, Currency: q.Currency}
+}
+
+func (q quote) String() string {
+	return fmt.Sprintf("quote: %d lines (%s)", len(q.Lines), q.Money(q.Total()))
+}
+
+func (p *Pricing) Quote(
+	checkIn date.Date,
+	checkOut date.Date,
+	rate rate,
+	guests int,
+) (quote, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return quote{}, err
+	}
+	defer tx.Rollback()
+
+	return p.QuoteTx(tx, checkIn, checkOut, rate, guests)
+}
+
+// A line per night at that night's seasonal price, or the rate's amount
+// when no season covers it, then a line per discount the rate's rules give,
+// then fees and taxes. Rates set in another currency than the property's
+// can't be quoted
+func (p *Pricing) QuoteTx(
+	tx *sql.Tx,
+	checkIn date.Date,
+	checkOut date.Date,
+	rate rate,
+	guests int,
+) (quote, error) {
+	q, _, err := p.quoteTx(tx, checkIn, checkOut, rate, guests, nil)
+	return q, err
+}
+
+// As QuoteTx, with a promo code's discount after the rules' where the rate
+// and length of stay qualify, also returned on its own. Whether the code can
+// still be used is up to the caller
+func (p *Pricing) quoteTx(
+	tx *sql.Tx,
+	checkIn date.Date,
+	checkOut date.Date,
+	rate rate,
+	guests int,
+	promo *promoCode,
+) (quote, quoteLine, error) {
+	if rate.Currency != p.Property.Currency() {
+		return quote{}, quoteLine{}, currencyMismatch
+	}
+
+	stmt, err := tx.Prepare(`
+    select Amount, Name from Season
+    where RateId = $1 and FirstNight <= $2 and LastNight >= $2
+    order by julianday(LastNight) - julianday(FirstNight) asc, Id desc
+    limit 1
+  `)
+	if err != nil {
+		panic(err)
+	}
+	defer stmt.Close()
+
+	q := quote{Currency: rate.Currency}
+	for _, night := range (stay{checkIn, checkOut}).Nights() {
+		line := quoteLine{
+			Amount:      rate.Amount,
+			Description: rate.Name,
+			Kind:        nightLine,
+			Night:       night,
+		}
+
+		var name string
+		err := stmt.QueryRow(rate.Id, night).Scan(&line.Amount, &name)
+		switch {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			glog.Error(err)
+			return quote{}, quoteLine{}, err
+		default:
+			line.Description = fmt.Sprintf("%s (%s)", rate.Name, name)
+		}
+
+		q.Lines = append(q.Lines, line)
+	}
+
+	rules, err := discountsTx(tx, rate.Id)
+	if err != nil {
+		return quote{}, quoteLine{}, err
+	}
+	q.Lines = append(q.Lines, discountLines(
+		rules,
+		stay{checkIn, checkOut},
+		p.Clock.Now(),
+		q.Subtotal(),
+	)...)
+	var promoLine quoteLine
+	if promo != nil && promo.covers(rate.Id) &&
+		(stay{checkIn, checkOut}).Len() >= promo.MinNights {
+		promoLine = promo.line(q.Lines, q.Currency)
+		q.Lines = append(q.Lines, promoLine)
+	}
+
+	fees, err := feesTx(tx, rate.Id)
+	if err != nil {
+		return quote{}, quoteLine{}, err
+	}
+	q.Lines = append(q.Lines, feeLines(fees, q.Lines, guests)...)
+
+	return q, promoLine, nil
+}
+
+// Keep the quote a version of a booking was made on - caller is responsible
+// for Commit/Rollback
+func (p *Pricing) SaveTx(
+	tx *sql.Tx,
+	id bookingId,
+	version int,
+	q quote,
+) error {
+	stmt, err := tx.Prepare(`
+      insert into Quote
+      (Amount, BookingId, Description, Included, Kind, Night, Position,
+        Version)
+      values ($1, $2, $3, $4, $5, $6, $7, $8)
+    `)
+	if err != nil {
+		panic(err)
+	}
+
+	for i, line := range q.Lines {
+		_, err := stmt.Exec(
+			line.Amount,
+			id,
+			line.Description,
+			line.Included,
+			line.Kind,
+			line.Night,
+			i,
+			version,
+		)
+		if err != nil {
+			glog.Error(err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The quote a booking's current version was made on
+func (p *Pricing) Lookup(id bookingId) (quote, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return quote{}, err
+	}
+	defer tx.Rollback()
+
+	return p.LookupTx(tx, id)
+}
+
+// Quotes are in the currency of the rate they were made on
+func (p *Pricing) LookupTx(tx *sql.Tx, id bookingId) (quote, error) {
+	rows, err := tx.Query(`
+    select q.Amount, q.Description, q.Included, q.Kind, q.Night, p.Currency
+    from Quote q
+    join Register r on r.Id = q.BookingId and r.Version = q.Version
+    join RatePlan p on p.Id = r.RateId and p.Version = r.RateVersion
+    where q.BookingId = $1
+    order by q.Position asc
+  `, id)
+	if err != nil {
+		glog.Error(err)
+		return quote{}, err
+	}
+	defer rows.Close()
+
+	var q quote
+	for rows.Next() {
+		var line quoteLine
+		err := rows.Scan(
+			&line.Amount,
+			&line.Description,
+			&line.Included,
+			&line.Kind,
+			&line.Night,
+			&q.Currency,
+		)
+		if err != nil {
+			glog.Error(err)
+			return quote{}, err
+		}
+		q.Lines = append(q.Lines, line)
+	}
+
+	return q, rows.Err()
+}
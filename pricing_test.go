@@ -0,0 +1,224 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestPricingQuote(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var pricing Pricing
+	err := inject.Populate(db, &pricing)
+	if err != nil {
+		t.Error(err)
+	}
+
+	q, err := pricing.Quote(date.New(2015, 1, 1), date.New(2015, 1, 3), withBunny, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := quote{Currency: defaultCurrency, Lines: []quoteLine{
+		{withBunny.Amount, withBunny.Name, false, nightLine, date.New(2015, 1, 1)},
+		{withBunny.Amount, withBunny.Name, false, nightLine, date.New(2015, 1, 2)},
+	}}
+	if !reflect.DeepEqual(want, q) {
+		t.Error("want", want)
+		t.Error("got ", q)
+	}
+	if total := q.Total(); total != amount(40000) {
+		t.Error("want", amount(40000))
+		t.Error("got ", total)
+	}
+
+	// Quote() -> not once the property has moved to another currency
+	err = pricing.Property.SetCurrency("EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pricing.Quote(date.New(2015, 1, 1), date.New(2015, 1, 3), withBunny, 1)
+	if err != currencyMismatch {
+		t.Error("want", currencyMismatch)
+		t.Error("got ", err)
+	}
+}
+
+func TestPricingKeepsQuotePerVersion(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var pricing Pricing
+	var register Register
+	err := inject.Populate(&FakeGateway{}, db, &calendar, &pricing, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 5; i++ {
+		calendar.Add(date.New(2015, 1, 1).Add(i))
+	}
+
+	id, err := register.Book(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 3),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := pricing.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != amount(40000) {
+		t.Error("want", amount(40000))
+		t.Error("got ", total)
+	}
+
+	// modifying quotes the new version, the old one is kept
+	_, err = register.Modify(
+		id,
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 4),
+		withoutBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err = pricing.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(q.Lines); l != 3 {
+		t.Error("want", 3)
+		t.Error("got ", l)
+	}
+	if total := q.Total(); total != amount(75000) {
+		t.Error("want", amount(75000))
+		t.Error("got ", total)
+	}
+
+	var versions int
+	err = db.QueryRow(
+		`select count(distinct Version) from Quote where BookingId = $1`,
+		id,
+	).Scan(&versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions != 2 {
+		t.Error("want", 2)
+		t.Error("got ", versions)
+	}
+}
+
+func TestPricingSeasons(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var pricing Pricing
+	err := inject.Populate(db, &pricing)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// SetSeason() -> invalidSeason
+	invalid := []season{
+		{Name: "", Amount: 1, Rate: withBunny},
+		{Name: "free", Amount: 0, Rate: withBunny},
+		{
+			Name:       "backwards",
+			Amount:     1,
+			FirstNight: date.New(2015, 2, 2),
+			LastNight:  date.New(2015, 2, 1),
+			Rate:       withBunny,
+		},
+	}
+	for _, s := range invalid {
+		if err := pricing.SetSeason(s); err != invalidSeason {
+			t.Error("want", invalidSeason)
+			t.Error("got ", err)
+		}
+	}
+
+	winter := season{
+		Amount:     amount(15000),
+		FirstNight: date.New(2015, 2, 1),
+		LastNight:  date.New(2015, 2, 28),
+		Name:       "Winter",
+		Rate:       withBunny,
+	}
+	valentines := season{
+		Amount:     amount(35000),
+		FirstNight: date.New(2015, 2, 14),
+		LastNight:  date.New(2015, 2, 14),
+		Name:       "Valentine's Day",
+		Rate:       withBunny,
+	}
+	for _, s := range []season{valentines, winter} {
+		if err := pricing.SetSeason(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seasons, err := pricing.Seasons()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []season{winter, valentines}; !reflect.DeepEqual(want, seasons) {
+		t.Error("want", want)
+		t.Error("got ", seasons)
+	}
+
+	// base, season, date beats season, season, and other rates unaffected
+	q, err := pricing.Quote(date.New(2015, 1, 31), date.New(2015, 2, 16), withBunny, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		line        int
+		amount      amount
+		description string
+	}{
+		{0, withBunny.Amount, "With Bunny"},
+		{1, amount(15000), "With Bunny (Winter)"},
+		{14, amount(35000), "With Bunny (Valentine's Day)"},
+		{15, amount(15000), "With Bunny (Winter)"},
+	}
+	for _, test := range tests {
+		line := q.Lines[test.line]
+		if line.Amount != test.amount || line.Description != test.description {
+			t.Error("want", test.amount, test.description)
+			t.Error("got ", line.Amount, line.Description)
+		}
+	}
+	q, err = pricing.Quote(date.New(2015, 2, 14), date.New(2015, 2, 15), withoutBunny, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != withoutBunny.Amount {
+		t.Error("want", withoutBunny.Amount)
+		t.Error("got ", total)
+	}
+
+	// replacing keeps one season per name and rate
+	winter.Amount = amount(16000)
+	if err := pricing.SetSeason(winter); err != nil {
+		t.Fatal(err)
+	}
+	seasons, _ = pricing.Seasons()
+	if l := len(seasons); l != 2 {
+		t.Error("want", 2)
+		t.Error("got ", l)
+	}
+
+	if err := pricing.RemoveSeason("Summer", withBunny); err != seasonNotFound {
+		t.Error("want", seasonNotFound)
+		t.Error("got ", err)
+	}
+}
@@ -0,0 +1,509 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// Codes handed out to take a percentage or a fixed amount off a stay. Uses
+// counts redemptions so a limit can be checked and taken in one statement
+const PromoSchema = `
+  CREATE TABLE Promo (
+    Amount INTEGER NOT NULL DEFAULT 0,
+    Code TEXT PRIMARY KEY NOT NULL,
+    EndsOn DATETIME NOT NULL,
+    MaxUses INTEGER NOT NULL DEFAULT 0,
+    MaxUsesPerGuest INTEGER NOT NULL DEFAULT 0,
+    MinNights INTEGER NOT NULL DEFAULT 0,
+    Percent INTEGER NOT NULL DEFAULT 0,
+    Rates TEXT NOT NULL DEFAULT '',
+    StartsOn DATETIME NOT NULL,
+    Uses INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT ck_Starts_Not_After_Ends CHECK (StartsOn <= EndsOn),
+    CONSTRAINT ck_Uses_Within_Max CHECK (MaxUses = 0 OR Uses <= MaxUses)
+  )
+`
+
+// Which booking each code was used on, at most one code a booking
+const PromoRedemptionSchema = `
+  CREATE TABLE PromoRedemption (
+    BookingId INTEGER PRIMARY KEY NOT NULL REFERENCES Register(Id),
+    Code TEXT NOT NULL REFERENCES Promo(Code),
+    Discount INTEGER NOT NULL,
+    GuestId INTEGER NOT NULL,
+    RedeemedAt DATETIME NOT NULL
+  )
+`
+
+var promoMigration = statements(
+	`CREATE TABLE Promo (
+    Amount INTEGER NOT NULL DEFAULT 0,
+    Code TEXT PRIMARY KEY NOT NULL,
+    EndsOn DATETIME NOT NULL,
+    MaxUses INTEGER NOT NULL DEFAULT 0,
+    MaxUsesPerGuest INTEGER NOT NULL DEFAULT 0,
+    MinNights INTEGER NOT NULL DEFAULT 0,
+    Percent INTEGER NOT NULL DEFAULT 0,
+    Rates TEXT NOT NULL DEFAULT '',
+    StartsOn DATETIME NOT NULL,
+    Uses INTEGER NOT NULL DEFAULT 0,
+    CONSTRAINT ck_Starts_Not_After_Ends CHECK (StartsOn <= EndsOn),
+    CONSTRAINT ck_Uses_Within_Max CHECK (MaxUses = 0 OR Uses <= MaxUses)
+  )`,
+	`CREATE TABLE PromoRedemption (
+    BookingId INTEGER PRIMARY KEY NOT NULL REFERENCES Register(Id),
+    Code TEXT NOT NULL REFERENCES Promo(Code),
+    Discount INTEGER NOT NULL,
+    GuestId INTEGER NOT NULL,
+    RedeemedAt DATETIME NOT NULL
+  )`,
+)
+
+// Takes Percent, or Amount, off the nights of a stay after discounts, from
+// StartsOn to EndsOn inclusive. No Rates means every rate plan, and a zero
+// limit means no limit
+type promoCode struct {
+	Amount          amount
+	Code            string
+	EndsOn          date.Date
+	MaxUses         int
+	MaxUsesPerGuest int
+	MinNights       int
+	Percent         int
+	Rates           []rateId
+	StartsOn        date.Date
+	Uses            int
+}
+
+var (
+	invalidPromo      = errors.New("invalid promo code")
+	promoExists       = errors.New("promo code already exists")
+	promoNotFound     = errors.New("promo code not found")
+	promoInactive     = errors.New("promo code is not active")
+	promoNotForRate   = errors.New("promo code is not valid for this rate")
+	promoTooShort     = errors.New("stay is too short for this promo code")
+	promoUsedUp       = errors.New("promo code has been used up")
+	promoUsedByGuest  = errors.New("promo code already used")
+	promoCodeAlphabet = regexp.MustCompile(`^[A-Z0-9-]+$`)
+)
+
+// Codes are matched regardless of case and surrounding space
+func normalPromoCode(s string) string {
+	return strings.ToUpper(strings.TrimSpace(s))
+}
+
+// How the code reads on a quote in a currency
+func (c promoCode) describe(cur currency) string {
+	off := money{Amount: c.Amount, Currency: cur}.String()
+	if c.Percent > 0 {
+		off = fmt.Sprintf("%d%%", c.Percent)
+	}
+	return fmt.Sprintf("Promo %s: %s off", c.Code, off)
+}
+
+func (c promoCode) valid() bool {
+	if !promoCodeAlphabet.MatchString(c.Code) {
+		return false
+	}
+	if (c.Percent > 0) == (c.Amount > 0) {
+		return false
+	}
+	if c.Percent < 0 || c.Percent > 100 || c.Amount < 0 {
+		return false
+	}
+	if c.MaxUses < 0 || c.MaxUsesPerGuest < 0 || c.MinNights < 0 {
+		return false
+	}
+	return !c.EndsOn.Before(c.StartsOn)
+}
+
+// Whether the code can be used on a stay at a rate at a moment, usage aside
+func (c promoCode) Check(s stay, r rate, at time.Time) error {
+	if at.Before(c.StartsOn.Time()) || !at.Before(c.EndsOn.Add(1).Time()) {
+		return promoInactive
+	}
+	if !c.covers(r.Id) {
+		return promoNotForRate
+	}
+	if s.Len() < c.MinNights {
+		return promoTooShort
+	}
+	return nil
+}
+
+func (c promoCode) covers(id rateId) bool {
+	if len(c.Rates) == 0 {
+		return true
+	}
+	for _, r := range c.Rates {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// The code's discount on the nights and discounts quoted so far, never more
+// than they come to
+func (c promoCode) line(lines []quoteLine, cur currency) quoteLine {
+	var base amount
+	for _, l := range lines {
+		if !l.Included && l.is([]lineKind{nightLine, discountLine}) {
+			base += l.Amount
+		}
+	}
+
+	off := c.Amount
+	if c.Percent > 0 {
+		off = base * amount(c.Percent) / 100
+	}
+	if off > base {
+		off = base
+	}
+
+	return quoteLine{
+		Amount:      -off,
+		Description: c.describe(cur),
+		Kind:        discountLine,
+	}
+}
+
+// A use of a code
+type promoRedemption struct {
+	BookingId  bookingId
+	Code       string
+	Discount   amount
+	GuestId    guestId
+	RedeemedAt time.Time
+}
+
+func (p *Pricing) CreatePromo(c promoCode) (promoCode, error) {
+	c.Code = normalPromoCode(c.Code)
+	c.Uses = 0
+	if !c.valid() {
+		return promoCode{}, invalidPromo
+	}
+
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return promoCode{}, err
+	}
+	defer tx.Rollback()
+
+	var n int
+	err = tx.QueryRow(
+		`select count(*) from Promo where Code = $1`,
+		c.Code,
+	).Scan(&n)
+	if err != nil {
+		glog.Error(err)
+		return promoCode{}, err
+	}
+	if n > 0 {
+		return promoCode{}, promoExists
+	}
+
+	var rates []string
+	for _, id := range c.Rates {
+		rates = append(rates, strconv.FormatInt(int64(id), 10))
+	}
+	_, err = tx.Exec(`
+    insert into Promo
+    (Amount, Code, EndsOn, MaxUses, MaxUsesPerGuest, MinNights, Percent,
+      Rates, StartsOn)
+    values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+  `,
+		c.Amount,
+		c.Code,
+		c.EndsOn,
+		c.MaxUses,
+		c.MaxUsesPerGuest,
+		c.MinNights,
+		c.Percent,
+		strings.Join(rates, ","),
+		c.StartsOn,
+	)
+	if err != nil {
+		glog.Error(err)
+		return promoCode{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return promoCode{}, err
+	}
+
+	glog.Infoln("created", c.describe(p.Property.Currency()))
+	return c, nil
+}
+
+const promoSelect = `
+  select Amount, Code, EndsOn, MaxUses, MaxUsesPerGuest, MinNights, Percent,
+    Rates, StartsOn, Uses
+  from Promo
+`
+
+func scanPromo(row scanner) (promoCode, error) {
+	var c promoCode
+	var rates string
+	err := row.Scan(
+		&c.Amount,
+		&c.Code,
+		&c.EndsOn,
+		&c.MaxUses,
+		&c.MaxUsesPerGuest,
+		&c.MinNights,
+		&c.Percent,
+		&rates,
+		&c.StartsOn,
+		&c.Uses,
+	)
+	if err != nil {
+		return promoCode{}, err
+	}
+	for _, s := range strings.Split(rates, ",") {
+		if s == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return promoCode{}, err
+		}
+		c.Rates = append(c.Rates, rateId(id))
+	}
+	return c, nil
+}
+
+// Every code with how often it's been used, by when it starts
+func (p *Pricing) Promos() ([]promoCode, error) {
+	rows, err := p.DB.Query(promoSelect + `order by StartsOn asc, Code asc`)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var codes []promoCode
+	for rows.Next() {
+		c, err := scanPromo(rows)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		codes = append(codes, c)
+	}
+
+	return codes, rows.Err()
+}
+
+func promoTx(tx *sql.Tx, code string) (promoCode, error) {
+	c, err := scanPromo(tx.QueryRow(
+		promoSelect+`where Code = $1`,
+		normalPromoCode(code),
+	))
+	if err == sql.ErrNoRows {
+		return promoCode{}, promoNotFound
+	}
+	if err != nil {
+		glog.Error(err)
+	}
+	return c, err
+}
+
+// Each use of a code, oldest first
+func (p *Pricing) PromoUsage(code string) ([]promoRedemption, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = promoTx(tx, code)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+    select BookingId, Code, Discount, GuestId, RedeemedAt
+    from PromoRedemption
+    where Code = $1
+    order by RedeemedAt asc, BookingId asc
+  `, normalPromoCode(code))
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []promoRedemption
+	for rows.Next() {
+		var u promoRedemption
+		err := rows.Scan(
+			&u.BookingId,
+			&u.Code,
+			&u.Discount,
+			&u.GuestId,
+			&u.RedeemedAt,
+		)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+
+	return usage, rows.Err()
+}
+
+// Quotes a stay with a code, checking it could still be used, but not
+// whether the guest has used it up
+func (p *Pricing) PromoQuote(
+	checkIn date.Date,
+	checkOut date.Date,
+	rate rate,
+	guests int,
+	code string,
+) (quote, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return quote{}, err
+	}
+	defer tx.Rollback()
+
+	c, err := promoTx(tx, code)
+	if err != nil {
+		return quote{}, err
+	}
+	err = c.Check(stay{checkIn, checkOut}, rate, p.Clock.Now())
+	if err != nil {
+		return quote{}, err
+	}
+	if c.MaxUses > 0 && c.Uses >= c.MaxUses {
+		return quote{}, promoUsedUp
+	}
+
+	q, _, err := p.quoteTx(tx, checkIn, checkOut, rate, guests, &c)
+	return q, err
+}
+
+// Uses a code on a booking and requotes its current version with it. The
+// use is counted by a single conditional update, so however many bookings
+// race for the last use only one gets it - caller is responsible for
+// Commit/Rollback
+func (p *Pricing) RedeemTx(
+	tx *sql.Tx,
+	code string,
+	id bookingId,
+) (quote, error) {
+	b, err := lookupBooking(tx, id)
+	if err != nil {
+		return quote{}, err
+	}
+
+	c, err := promoTx(tx, code)
+	if err != nil {
+		return quote{}, err
+	}
+	err = c.Check(stay{b.Checkin, b.Checkout}, b.Rate, p.Clock.Now())
+	if err != nil {
+		return quote{}, err
+	}
+
+	if c.MaxUsesPerGuest > 0 {
+		var used int
+		err = tx.QueryRow(
+			`select count(*) from PromoRedemption
+       where Code = $1 and GuestId = $2`,
+			c.Code,
+			b.GuestId,
+		).Scan(&used)
+		if err != nil {
+			glog.Error(err)
+			return quote{}, err
+		}
+		if used >= c.MaxUsesPerGuest {
+			return quote{}, promoUsedByGuest
+		}
+	}
+
+	result, err := tx.Exec(`
+    update Promo set Uses = Uses + 1
+    where Code = $1 and (MaxUses = 0 or Uses < MaxUses)
+  `, c.Code)
+	if err != nil {
+		glog.Error(err)
+		return quote{}, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return quote{}, err
+	}
+	if n == 0 {
+		return quote{}, promoUsedUp
+	}
+
+	q, line, err := p.quoteTx(tx, b.Checkin, b.Checkout, b.Rate, b.Guests, &c)
+	if err != nil {
+		return quote{}, err
+	}
+	discount := -line.Amount
+
+	_, err = tx.Exec(`
+    insert into PromoRedemption
+    (BookingId, Code, Discount, GuestId, RedeemedAt)
+    values ($1, $2, $3, $4, $5)
+  `, id, c.Code, discount, b.GuestId, p.Clock.Now())
+	if err != nil {
+		glog.Error(err)
+		return quote{}, err
+	}
+
+	_, err = tx.Exec(
+		`delete from Quote where BookingId = $1 and Version = $2`,
+		id,
+		b.Version,
+	)
+	if err != nil {
+		glog.Error(err)
+		return quote{}, err
+	}
+	err = p.SaveTx(tx, id, b.Version, q)
+	if err != nil {
+		return quote{}, err
+	}
+
+	glog.Infoln("redeemed", c.Code, "on", id, "for", q.Money(discount))
+	return q, nil
+}
+
+// The code a booking was made with, if any, so changes to it keep the
+// discount where the stay still qualifies
+func redeemedTx(tx *sql.Tx, id bookingId) (*promoCode, error) {
+	var code string
+	err := tx.QueryRow(
+		`select Code from PromoRedemption where BookingId = $1`,
+		id,
+	).Scan(&code)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+
+	c, err := promoTx(tx, code)
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
@@ -0,0 +1,244 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestPromoCheck(t *testing.T) {
+	code := promoCode{
+		Code:      "SPRING",
+		EndsOn:    date.New(2015, 3, 31),
+		MinNights: 2,
+		Percent:   10,
+		Rates:     []rateId{withBunny.Id},
+		StartsOn:  date.New(2015, 3, 1),
+	}
+	checkin := date.New(2015, 4, 10)
+	twoNights := stay{checkin, checkin.Add(2)}
+	during := time.Date(2015, 3, 15, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		stay stay
+		rate rate
+		at   time.Time
+		want error
+	}{
+		{twoNights, withBunny, during, nil},
+		{twoNights, withBunny, date.New(2015, 3, 1).Time(), nil},
+		{twoNights, withBunny, date.New(2015, 3, 31).Time().Add(time.Hour), nil},
+		{twoNights, withBunny, date.New(2015, 4, 1).Time(), promoInactive},
+		{twoNights, withBunny, date.New(2015, 2, 28).Time(), promoInactive},
+		{twoNights, withoutBunny, during, promoNotForRate},
+		{stay{checkin, checkin.Add(1)}, withBunny, during, promoTooShort},
+	}
+	for i, test := range tests {
+		if got := code.Check(test.stay, test.rate, test.at); got != test.want {
+			t.Error(i, "want", test.want)
+			t.Error(i, "got ", got)
+		}
+	}
+}
+
+func TestPromoLine(t *testing.T) {
+	lines := []quoteLine{
+		{Amount: 20000, Kind: nightLine},
+		{Amount: 20000, Kind: nightLine},
+		{Amount: -4000, Kind: discountLine},
+		{Amount: 5000, Kind: feeLine},
+	}
+
+	var tests = []struct {
+		code promoCode
+		want quoteLine
+	}{
+		{
+			promoCode{Code: "TEN", Percent: 10},
+			quoteLine{Amount: -3600, Description: "Promo TEN: 10% off", Kind: discountLine},
+		},
+		{
+			promoCode{Code: "FLAT", Amount: 2500},
+			quoteLine{Amount: -2500, Description: "Promo FLAT: $25.00 off", Kind: discountLine},
+		},
+		{
+			promoCode{Code: "HUGE", Amount: 100000},
+			quoteLine{Amount: -36000, Description: "Promo HUGE: $1,000.00 off", Kind: discountLine},
+		},
+	}
+	for i, test := range tests {
+		if got := test.code.line(lines, defaultCurrency); !reflect.DeepEqual(test.want, got) {
+			t.Error(i, "want", test.want)
+			t.Error(i, "got ", got)
+		}
+	}
+}
+
+func TestPricingPromos(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var pricing Pricing
+	var register Register
+	err := inject.Populate(&FakeGateway{}, db, &calendar, &clock, &pricing, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+	for d := date.New(2015, 2, 1); d.Before(date.New(2015, 2, 20)); d = d.Add(1) {
+		calendar.Add(d)
+	}
+
+	// CreatePromo() -> invalidPromo
+	invalid := []promoCode{
+		{Code: "", Percent: 10},
+		{Code: "NO SPACES", Percent: 10},
+		{Code: "BOTH", Percent: 10, Amount: 100},
+		{Code: "NEITHER"},
+		{Code: "TOOMUCH", Percent: 101},
+		{Code: "BACKWARDS", Percent: 10, StartsOn: date.New(2015, 2, 1), EndsOn: date.New(2015, 1, 1)},
+	}
+	for _, c := range invalid {
+		if _, err := pricing.CreatePromo(c); err != invalidPromo {
+			t.Error("want", invalidPromo)
+			t.Error("got ", err, c)
+		}
+	}
+
+	winter, err := pricing.CreatePromo(promoCode{
+		Code:            "winter-25",
+		EndsOn:          date.New(2015, 1, 31),
+		MaxUses:         2,
+		MaxUsesPerGuest: 1,
+		Amount:          2500,
+		StartsOn:        date.New(2015, 1, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if winter.Code != "WINTER-25" {
+		t.Error("want", "WINTER-25")
+		t.Error("got ", winter.Code)
+	}
+	if _, err := pricing.CreatePromo(winter); err != promoExists {
+		t.Error("want", promoExists)
+		t.Error("got ", err)
+	}
+
+	// PromoQuote() -> the code's line after the nights
+	q, err := pricing.PromoQuote(date.New(2015, 2, 1), date.New(2015, 2, 3), withBunny, 1, "winter-25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != amount(37500) {
+		t.Error("want", amount(37500))
+		t.Error("got ", total)
+	}
+
+	book := func(in, out date.Date, guest guestId) bookingId {
+		id, err := register.Book(in, out, guest, withBunny, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	redeem := func(id bookingId) error {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = pricing.RedeemTx(tx, "Winter-25", id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	}
+
+	// RedeemTx() -> requoted
+	first := book(date.New(2015, 2, 1), date.New(2015, 2, 3), guestId(1))
+	if err := redeem(first); err != nil {
+		t.Fatal(err)
+	}
+	q, err = pricing.Lookup(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != amount(37500) {
+		t.Error("want", amount(37500))
+		t.Error("got ", total)
+	}
+
+	// RedeemTx() -> once per guest
+	again := book(date.New(2015, 2, 5), date.New(2015, 2, 7), guestId(1))
+	if err := redeem(again); err != promoUsedByGuest {
+		t.Error("want", promoUsedByGuest)
+		t.Error("got ", err)
+	}
+
+	// RedeemTx() -> twice in all
+	second := book(date.New(2015, 2, 8), date.New(2015, 2, 10), guestId(2))
+	if err := redeem(second); err != nil {
+		t.Fatal(err)
+	}
+	third := book(date.New(2015, 2, 11), date.New(2015, 2, 13), guestId(3))
+	if err := redeem(third); err != promoUsedUp {
+		t.Error("want", promoUsedUp)
+		t.Error("got ", err)
+	}
+
+	// RedeemTx() -> only while it's on
+	clock.Set(time.Date(2015, 2, 1, 0, 0, 0, 0, time.UTC))
+	if _, err := pricing.PromoQuote(date.New(2015, 2, 14), date.New(2015, 2, 15), withBunny, 1, "WINTER-25"); err != promoInactive {
+		t.Error("want", promoInactive)
+		t.Error("got ", err)
+	}
+
+	// Modify() keeps the discount
+	_, err = register.Modify(first, date.New(2015, 2, 1), date.New(2015, 2, 4), withBunny, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err = pricing.Lookup(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != amount(57500) {
+		t.Error("want", amount(57500))
+		t.Error("got ", total)
+	}
+
+	codes, err := pricing.Promos()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(codes); l != 1 || codes[0].Uses != 2 {
+		t.Error("want 1 code used 2 times")
+		t.Error("got ", codes)
+	}
+
+	usage, err := pricing.PromoUsage("winter-25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range usage {
+		usage[i].RedeemedAt = usage[i].RedeemedAt.UTC()
+	}
+	want := []promoRedemption{
+		{first, "WINTER-25", amount(2500), guestId(1), time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{second, "WINTER-25", amount(2500), guestId(2), time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	if !reflect.DeepEqual(want, usage) {
+		t.Error("want", want)
+		t.Error("got ", usage)
+	}
+
+	if _, err := pricing.PromoUsage("NOPE"); err != promoNotFound {
+		t.Error("want", promoNotFound)
+		t.Error("got ", err)
+	}
+}
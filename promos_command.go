@@ -0,0 +1,149 @@
+package booking
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+)
+
+const promosUsage = `usage:
+  promos list
+  promos create -code CODE -from DATE -to DATE (-percent N | -amount PRICE)
+                [-rates RATE,...] [-min-nights N] [-max-uses N]
+                [-max-uses-per-guest N]
+  promos usage -code CODE`
+
+var unknownPromosCommand = errors.New(promosUsage)
+
+// Manages promo codes from the command line, writing results to out
+func PromosCommand(
+	p *Pricing,
+	rates *Rates,
+	args []string,
+	out io.Writer,
+) error {
+	if len(args) == 0 {
+		return unknownPromosCommand
+	}
+
+	flags := flag.NewFlagSet("promos "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	flagCode := flags.String("code", "", "what guests enter, e.g. SPRING15")
+	flagFrom := flags.String("from", "", "first day it can be used")
+	flagTo := flags.String("to", "", "last day it can be used")
+	flagPercent := flags.Int("percent", 0, "percent off")
+	flagAmount := flags.String("amount", "", "fixed amount off, e.g. 25.00")
+	flagRates := flags.String("rates", "", "rate names, default all")
+	flagMinNights := flags.Int("min-nights", 0, "shortest stay it's good for")
+	flagMaxUses := flags.Int("max-uses", 0, "uses in total, 0 for no limit")
+	flagMaxUsesPerGuest := flags.Int("max-uses-per-guest", 0, "uses by a guest, 0 for no limit")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	default:
+		return unknownPromosCommand
+	case "list":
+		codes, err := p.Promos()
+		if err != nil {
+			return err
+		}
+		for _, c := range codes {
+			fmt.Fprintln(out, promoSummary(c, p.Property.Currency()))
+		}
+		return nil
+	case "create":
+		c := promoCode{
+			Code:            *flagCode,
+			MaxUses:         *flagMaxUses,
+			MaxUsesPerGuest: *flagMaxUsesPerGuest,
+			MinNights:       *flagMinNights,
+			Percent:         *flagPercent,
+		}
+		c.StartsOn, err = date.Parse(*flagFrom)
+		if err != nil {
+			return err
+		}
+		c.EndsOn, err = date.Parse(*flagTo)
+		if err != nil {
+			return err
+		}
+		if *flagAmount != "" {
+			c.Amount, err = p.Property.ParsePrice(*flagAmount)
+			if err != nil {
+				return err
+			}
+		}
+		if *flagRates != "" {
+			for _, name := range strings.Split(*flagRates, ",") {
+				r, err := rates.Named(name)
+				if err != nil {
+					return err
+				}
+				c.Rates = append(c.Rates, r.Id)
+			}
+		}
+		c, err = p.CreatePromo(c)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, promoSummary(c, p.Property.Currency()))
+		return nil
+	case "usage":
+		usage, err := p.PromoUsage(*flagCode)
+		if err != nil {
+			return err
+		}
+		for _, u := range usage {
+			fmt.Fprintf(
+				out,
+				"%s %s %s by %s for %s\n",
+				u.RedeemedAt.Format("2006-01-02 15:04"),
+				u.Code,
+				u.BookingId,
+				u.GuestId,
+				p.Property.Money(u.Discount),
+			)
+		}
+		return nil
+	}
+}
+
+func promoSummary(c promoCode, cur currency) string {
+	plans := "all rates"
+	if len(c.Rates) > 0 {
+		var ids []string
+		for _, id := range c.Rates {
+			ids = append(ids, id.String())
+		}
+		plans = strings.Join(ids, ", ")
+	}
+
+	uses := strconv.Itoa(c.Uses)
+	if c.MaxUses > 0 {
+		uses += fmt.Sprintf("/%d", c.MaxUses)
+	}
+
+	s := fmt.Sprintf(
+		"%s (%s - %s, %s) used %s",
+		c.describe(cur),
+		c.StartsOn,
+		c.EndsOn,
+		plans,
+		uses,
+	)
+	if c.MinNights > 0 {
+		s += fmt.Sprintf(", %d+ nights", c.MinNights)
+	}
+	if c.MaxUsesPerGuest > 0 {
+		s += fmt.Sprintf(", %d per guest", c.MaxUsesPerGuest)
+	}
+	return s
+}
@@ -0,0 +1,80 @@
+package booking
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/facebookgo/inject"
+)
+
+func TestPromosCommand(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var pricing Pricing
+	var rates Rates
+	err := inject.Populate(db, &pricing, &rates)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var out bytes.Buffer
+	err = PromosCommand(&pricing, &rates, nil, &out)
+	if err != unknownPromosCommand {
+		t.Error("want", unknownPromosCommand)
+		t.Error("got ", err)
+	}
+
+	err = PromosCommand(&pricing, &rates, []string{
+		"create",
+		"-code", "news15",
+		"-from", "1/1/2015",
+		"-to", "1/31/2015",
+		"-percent", "15",
+		"-rates", "With Bunny",
+		"-min-nights", "2",
+		"-max-uses", "100",
+		"-max-uses-per-guest", "1",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = PromosCommand(&pricing, &rates, []string{
+		"create",
+		"-code", "BACK",
+		"-from", "2/1/2015",
+		"-to", "2/28/2015",
+		"-amount", "25",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	err = PromosCommand(&pricing, &rates, []string{"list"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Promo NEWS15: 15% off (2015-01-01 - 2015-01-31, rateId:1) used 0/100, 2+ nights, 1 per guest\n" +
+		"Promo BACK: $25.00 off (2015-02-01 - 2015-02-28, all rates) used 0\n"
+	if got := out.String(); got != want {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+
+	out.Reset()
+	err = PromosCommand(&pricing, &rates, []string{"usage", "-code", "news15"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := out.String(); got != "" {
+		t.Error("want nothing")
+		t.Error("got ", got)
+	}
+
+	err = PromosCommand(&pricing, &rates, []string{"usage", "-code", "nope"}, &out)
+	if err != promoNotFound {
+		t.Error("want", promoNotFound)
+		t.Error("got ", err)
+	}
+}
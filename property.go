@@ -0,0 +1,40 @@
+package booking
+
+// The place being let. Its rates are set, and its books kept, in one base
+// currency. The zero value is in the default currency until SetCurrency
+type Property struct {
+	currency currency
+}
+
+// Sets the base currency from its code, e.g. "EUR". Rates already set in
+// another currency can no longer be quoted
+func (p *Property) SetCurrency(code string) error {
+	c, err := parseCurrency(code)
+	if err != nil {
+		return err
+	}
+	p.currency = c
+	return nil
+}
+
+func (p *Property) Currency() currency {
+	if p.currency == "" {
+		return defaultCurrency
+	}
+	return p.currency
+}
+
+// An amount in the base currency
+func (p *Property) Money(a amount) money {
+	return money{Amount: a, Currency: p.Currency()}
+}
+
+// Reads a price in the base currency, e.g. "1,299.95"
+func (p *Property) ParsePrice(s string) (amount, error) {
+	return parsePrice(s, p.Currency())
+}
+
+// Rate plans set so far were in the default currency
+var currencyMigration = statements(
+	`ALTER TABLE RatePlan ADD COLUMN Currency TEXT NOT NULL DEFAULT 'USD'`,
+)
@@ -0,0 +1,49 @@
+package booking
+
+import "testing"
+
+func TestProperty(t *testing.T) {
+	var p Property
+
+	// zero value -> default currency
+	if c := p.Currency(); c != defaultCurrency {
+		t.Error("want", defaultCurrency)
+		t.Error("got ", c)
+	}
+	if m := p.Money(amount(123456)); m.String() != "$1,234.56" {
+		t.Error("want", "$1,234.56")
+		t.Error("got ", m)
+	}
+
+	// SetCurrency() -> only known codes
+	if err := p.SetCurrency("ABC"); err != unknownCurrency {
+		t.Error("want", unknownCurrency)
+		t.Error("got ", err)
+	}
+	if err := p.SetCurrency("jpy"); err != nil {
+		t.Fatal(err)
+	}
+	if m := p.Money(amount(123456)); m.String() != "¥123,456" {
+		t.Error("want", "¥123,456")
+		t.Error("got ", m)
+	}
+
+	// ParsePrice() -> in the currency's minor units, never negative
+	var tests = []struct {
+		s   string
+		a   amount
+		err error
+	}{
+		{"12,000", amount(12000), nil},
+		{"¥500", amount(500), nil},
+		{"500.00", 0, invalidAmount},
+		{"-500", 0, invalidAmount},
+	}
+	for _, test := range tests {
+		a, err := p.ParsePrice(test.s)
+		if a != test.a || err != test.err {
+			t.Error(test.s, "want", test.a, test.err)
+			t.Error(test.s, "got ", a, err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package booking
+
+// Itemised quote shared by the form and the confirmation receipt
+const templateQuoteSrc = `
+{{define "quote"}}
+<table>
+  {{range .Lines}}
+  <tr>
+    <td>{{if .Nightly}}{{pretty .Night}}{{end}}</td>
+    <td>{{.Description}}</td>
+    {{if .Included}}
+    <td align="right"><small>includes {{$.Money .Amount}}</small></td>
+    {{else}}
+    <td align="right">{{$.Money .Amount}}</td>
+    {{end}}
+  </tr>
+  {{end}}
+  <tr>
+    <th colspan="2" align="left">Total</th>
+    <th align="right">{{.Money .Total}}</th>
+  </tr>
+</table>
+{{end}}
+`
@@ -0,0 +1,31 @@
+package booking
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"math/big"
+)
+
+// n random bytes, hex encoded, for tokens and keys that mustn't be guessed
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// n characters picked uniformly from alphabet
+func randomString(n int, alphabet string) (string, error) {
+	max := big.NewInt(int64(len(alphabet)))
+	b := make([]byte, n)
+	for i := range b {
+		j, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[j.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,479 @@
+package booking
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Rate plans on offer. Editing a plan adds a version rather than changing it,
+// so bookings keep the terms they were priced on
+type Rates struct {
+	DB       *sql.DB   `inject:""`
+	Property *Property `inject:""`
+}
+
+// Every version of every rate plan
+const RatePlanSchema = `
+  CREATE TABLE RatePlan (
+    Active BOOLEAN NOT NULL DEFAULT 1,
+    Amount INTEGER NOT NULL,
+    BalanceDaysBefore INTEGER NOT NULL DEFAULT 0,
+    Currency TEXT NOT NULL DEFAULT 'USD',
+    DepositPercent INTEGER NOT NULL DEFAULT 0,
+    Description TEXT NOT NULL DEFAULT '',
+    Id INTEGER NOT NULL,
+    Name TEXT NOT NULL,
+    Policy TEXT NOT NULL,
+    PolicyTiers TEXT NOT NULL DEFAULT '',
+    PolicyVersion INTEGER NOT NULL DEFAULT 1,
+    Version INTEGER NOT NULL,
+    PRIMARY KEY (Id, Version),
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )
+`
+
+// The two rates that used to be built in become plans 1 and 2, and bookings,
+// their history and seasons refer to plans by id rather than by name. Tables
+// are rebuilt new-then-rename so references to Register stay pointed at it
+var ratePlanMigration = statements(
+	`CREATE TABLE RatePlan (
+    Active BOOLEAN NOT NULL DEFAULT 1,
+    Amount INTEGER NOT NULL,
+    Description TEXT NOT NULL DEFAULT '',
+    Id INTEGER NOT NULL,
+    Name TEXT NOT NULL,
+    Policy TEXT NOT NULL,
+    Version INTEGER NOT NULL,
+    PRIMARY KEY (Id, Version),
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )`,
+	`INSERT INTO RatePlan (Amount, Id, Name, Policy, Version) VALUES
+    (20000, 1, 'With Bunny', 'moderate', 1),
+    (25000, 2, 'Without Bunny', 'flexible', 1)`,
+
+	`CREATE TABLE RegisterWithRatePlans (
+    Checkin DATETIME NOT NULL REFERENCES Calendar,
+    Checkout DATETIME NOT NULL,
+    GuestId INTEGER NOT NULL REFERENCES Guestbook(Id),
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    RateId INTEGER NOT NULL,
+    RateVersion INTEGER NOT NULL,
+    Version INTEGER NOT NULL DEFAULT 1,
+    Status TEXT NOT NULL DEFAULT 'confirmed',
+    Code TEXT UNIQUE NOT NULL,
+    FOREIGN KEY (RateId, RateVersion) REFERENCES RatePlan (Id, Version),
+    CONSTRAINT ck_Ckin_Less_Than_Ckout CHECK (Checkin < Checkout)
+  )`,
+	`INSERT INTO RegisterWithRatePlans
+    (Checkin, Checkout, GuestId, Id, RateId, RateVersion, Version, Status, Code)
+    SELECT r.Checkin, r.Checkout, r.GuestId, r.Id, p.Id, p.Version,
+      r.Version, r.Status, r.Code
+    FROM Register r LEFT JOIN RatePlan p ON p.Name = r.Rate`,
+	`DROP TABLE Register`,
+	`ALTER TABLE RegisterWithRatePlans RENAME TO Register`,
+	`CREATE INDEX RegisterCheckin ON Register (Checkin, Id)`,
+	`CREATE INDEX RegisterCheckout ON Register (Checkout, Id)`,
+	`CREATE INDEX RegisterGuest ON Register (GuestId, Checkin)`,
+	`CREATE INDEX RegisterStatus ON Register (Status, Checkin)`,
+
+	`CREATE TABLE RegisterHistoryWithRatePlans (
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    Checkin DATETIME NOT NULL,
+    Checkout DATETIME NOT NULL,
+    RateId INTEGER NOT NULL,
+    RateVersion INTEGER NOT NULL,
+    ReplacedAt DATETIME NOT NULL,
+    Version INTEGER NOT NULL,
+    Status TEXT NOT NULL DEFAULT 'confirmed',
+    PRIMARY KEY (BookingId, Version)
+  )`,
+	`INSERT INTO RegisterHistoryWithRatePlans
+    (BookingId, Checkin, Checkout, RateId, RateVersion, ReplacedAt, Version,
+      Status)
+    SELECT h.BookingId, h.Checkin, h.Checkout, p.Id, p.Version, h.ReplacedAt,
+      h.Version, h.Status
+    FROM RegisterHistory h LEFT JOIN RatePlan p ON p.Name = h.Rate`,
+	`DROP TABLE RegisterHistory`,
+	`ALTER TABLE RegisterHistoryWithRatePlans RENAME TO RegisterHistory`,
+
+	`CREATE TABLE SeasonWithRatePlans (
+    Amount INTEGER NOT NULL,
+    FirstNight DATETIME NOT NULL,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    LastNight DATETIME NOT NULL,
+    Name TEXT NOT NULL,
+    RateId INTEGER NOT NULL,
+    UNIQUE (Name, RateId),
+    CONSTRAINT ck_First_Not_After_Last CHECK (FirstNight <= LastNight),
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )`,
+	`INSERT INTO SeasonWithRatePlans
+    (Amount, FirstNight, Id, LastNight, Name, RateId)
+    SELECT s.Amount, s.FirstNight, s.Id, s.LastNight, s.Name, p.Id
+    FROM Season s LEFT JOIN RatePlan p ON p.Name = s.Rate`,
+	`DROP TABLE Season`,
+	`ALTER TABLE SeasonWithRatePlans RENAME TO Season`,
+)
+
+// Plans kept only the name of a standard policy, so copy in its tiers as
+// they stood, all at version 1
+var policyTiersMigration = statements(
+	`ALTER TABLE RatePlan ADD COLUMN PolicyTiers TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE RatePlan ADD COLUMN PolicyVersion INTEGER NOT NULL DEFAULT 1`,
+	`UPDATE RatePlan SET PolicyTiers = CASE Policy
+      WHEN 'flexible' THEN '1:100'
+      WHEN 'moderate' THEN '5:100,0:50'
+      WHEN 'strict' THEN '14:100,7:50'
+      ELSE ''
+    END`,
+)
+
+// Locator for a rate plan, shared by all its versions
+type rateId int64
+
+func (id *rateId) Scan(src interface{}) error {
+	n, ok := src.(int64)
+	if !ok {
+		err := errors.New(
+			fmt.Sprintf("can't scan rateId from db: %#v", src),
+		)
+		glog.Error(err)
+		return err
+	}
+	*id = rateId(n)
+	return nil
+}
+
+func (id rateId) Value() (driver.Value, error) {
+	return driver.Value(int64(id)), nil
+}
+
+func (id rateId) String() string {
+	return fmt.Sprintf("rateId:%d", id)
+}
+
+// One version of a rate plan: what a night costs, in the currency the
+// property was in when it was set, when it's paid and the terms for
+// cancelling it
+type rate struct {
+	Active      bool
+	Amount      amount
+	Currency    currency
+	Description string
+	Id          rateId
+	Name        string
+	Policy      cancellationPolicy
+	Schedule    paymentSchedule
+	Version     int
+}
+
+// What a night costs
+func (r rate) Price() money {
+	return money{Amount: r.Amount, Currency: r.Currency}
+}
+
+func (r rate) String() string {
+	return fmt.Sprintf("rate: %s (%s)", r.Name, r.Price())
+}
+
+var (
+	invalidRate  = errors.New("rate needs a name and a price")
+	rateInactive = errors.New("rate is no longer offered")
+	rateNameUsed = errors.New("another rate has that name")
+	rateNotFound = errors.New("rate not found")
+)
+
+// Columns of a rate plan joined as p, in the order scanRate expects
+const rateColumns = `p.Active, p.Amount, p.Description, p.Id, p.Name,
+    p.Policy, p.PolicyTiers, p.PolicyVersion, p.BalanceDaysBefore,
+    p.DepositPercent, p.Currency, p.Version`
+
+// Restricts a RatePlan joined as p to the latest version of each plan
+const currentRateVersion = `
+    p.Version = (select max(Version) from RatePlan where Id = p.Id)
+`
+
+func scanRate(row scanner) (rate, error) {
+	var r rate
+	err := row.Scan(rateFields(&r)...)
+	return r, err
+}
+
+func rateFields(r *rate) []interface{} {
+	return []interface{}{
+		&r.Active,
+		&r.Amount,
+		&r.Description,
+		&r.Id,
+		&r.Name,
+		&r.Policy.Name,
+		&r.Policy.Tiers,
+		&r.Policy.Version,
+		&r.Schedule.BalanceDaysBefore,
+		&r.Schedule.DepositPercent,
+		&r.Currency,
+		&r.Version,
+	}
+}
+
+// Adds an active plan at version 1, priced in the property's currency
+func (rs *Rates) Create(
+	name string,
+	description string,
+	price amount,
+	policy cancellationPolicy,
+	schedule paymentSchedule,
+) (rate, error) {
+	tx, err := rs.DB.Begin()
+	if err != nil {
+		return rate{}, err
+	}
+	defer tx.Rollback()
+
+	var id rateId
+	err = tx.QueryRow(
+		`select coalesce(max(Id), 0) + 1 from RatePlan`,
+	).Scan(&id)
+	if err != nil {
+		glog.Error(err)
+		return rate{}, err
+	}
+
+	r := rate{
+		Active:      true,
+		Amount:      price,
+		Currency:    rs.Property.Currency(),
+		Description: description,
+		Id:          id,
+		Name:        name,
+		Policy:      policy,
+		Schedule:    schedule,
+		Version:     1,
+	}
+	err = insertRate(tx, r)
+	if err != nil {
+		return rate{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return rate{}, err
+	}
+
+	glog.Infoln("created", r.Id, r)
+	return r, nil
+}
+
+// Saves r as the next version of its plan, leaving earlier versions for the
+// bookings made on them. Prices are in the property's currency. Deactivate a
+// plan by updating it with Active false
+func (rs *Rates) Update(r rate) (rate, error) {
+	tx, err := rs.DB.Begin()
+	if err != nil {
+		return rate{}, err
+	}
+	defer tx.Rollback()
+
+	current, err := currentRate(tx, r.Id)
+	if err != nil {
+		return rate{}, err
+	}
+
+	r.Currency = rs.Property.Currency()
+	r.Version = current.Version + 1
+
+	// new terms under an old name are a new version of them
+	if r.Policy.Name == current.Policy.Name && !r.Policy.sameTiers(current.Policy) &&
+		r.Policy.Version <= current.Policy.Version {
+		r.Policy.Version = current.Policy.Version + 1
+	}
+	err = insertRate(tx, r)
+	if err != nil {
+		return rate{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return rate{}, err
+	}
+
+	glog.Infoln("updated", r.Id, "to version", r.Version)
+	return r, nil
+}
+
+func insertRate(tx *sql.Tx, r rate) error {
+	if r.Name == "" || r.Amount <= 0 {
+		return invalidRate
+	}
+	if !r.Schedule.Valid() {
+		return invalidSchedule
+	}
+	_, err := newCancellationPolicy(r.Policy.Name, r.Policy.Version, r.Policy.Tiers...)
+	if err != nil {
+		return err
+	}
+
+	// names are how people pick rates, so no two current plans share one
+	var n int
+	err = tx.QueryRow(`
+    select count(*) from RatePlan p
+    where p.Name = $1 and p.Id != $2 and`+currentRateVersion,
+		r.Name,
+		r.Id,
+	).Scan(&n)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	if n > 0 {
+		return rateNameUsed
+	}
+
+	_, err = tx.Exec(`
+      insert into RatePlan
+      (Active, Amount, BalanceDaysBefore, Currency, DepositPercent,
+        Description, Id, Name, Policy, PolicyTiers, PolicyVersion, Version)
+      values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+    `,
+		r.Active,
+		r.Amount,
+		r.Schedule.BalanceDaysBefore,
+		r.Currency,
+		r.Schedule.DepositPercent,
+		r.Description,
+		r.Id,
+		r.Name,
+		r.Policy.Name,
+		r.Policy.Tiers,
+		r.Policy.Version,
+		r.Version,
+	)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// The latest version of a plan
+func (rs *Rates) Current(id rateId) (rate, error) {
+	tx, err := rs.DB.Begin()
+	if err != nil {
+		return rate{}, err
+	}
+	defer tx.Rollback()
+
+	return currentRate(tx, id)
+}
+
+func currentRate(tx *sql.Tx, id rateId) (rate, error) {
+	r, err := scanRate(tx.QueryRow(`
+    select `+rateColumns+`
+    from RatePlan p
+    where p.Id = $1 and`+currentRateVersion,
+		id,
+	))
+	if err == sql.ErrNoRows {
+		return rate{}, rateNotFound
+	}
+	if err != nil {
+		glog.Error(err)
+		return rate{}, err
+	}
+	return r, nil
+}
+
+// The latest version of the plan currently called name
+func (rs *Rates) Named(name string) (rate, error) {
+	r, err := scanRate(rs.DB.QueryRow(`
+    select `+rateColumns+`
+    from RatePlan p
+    where p.Name = $1 and`+currentRateVersion,
+		name,
+	))
+	if err == sql.ErrNoRows {
+		return rate{}, rateNotFound
+	}
+	if err != nil {
+		glog.Error(err)
+		return rate{}, err
+	}
+	return r, nil
+}
+
+// Latest versions of every plan, by id
+func (rs *Rates) List() ([]rate, error) {
+	return rs.list(`select ` + rateColumns + `
+    from RatePlan p
+    where` + currentRateVersion + `
+    order by p.Id asc
+  `)
+}
+
+// Latest versions of the plans on offer, by id
+func (rs *Rates) Active() ([]rate, error) {
+	return rs.list(`select ` + rateColumns + `
+    from RatePlan p
+    where p.Active and` + currentRateVersion + `
+    order by p.Id asc
+  `)
+}
+
+func (rs *Rates) list(query string) ([]rate, error) {
+	rows, err := rs.DB.Query(query)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []rate
+	for rows.Next() {
+		r, err := scanRate(rows)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		list = append(list, r)
+	}
+
+	return list, rows.Err()
+}
+
+// Plans a new database starts out offering
+var startingRates = []rate{
+	{Name: "With Bunny", Amount: amount(20000), Policy: moderate},
+	{Name: "Without Bunny", Amount: amount(25000), Policy: flexible},
+}
+
+// Creates the starting plans if there are none yet
+func (rs *Rates) Seed() error {
+	list, err := rs.List()
+	if err != nil {
+		return err
+	}
+	if len(list) > 0 {
+		return nil
+	}
+
+	for _, r := range startingRates {
+		_, err := rs.Create(
+			r.Name,
+			r.Description,
+			r.Amount,
+			r.Policy,
+			r.Schedule,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package booking
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+const ratesUsage = `usage:
+  rates list
+  rates create -name NAME -amount PRICE -policy POLICY [-tiers TIERS]
+               [-description TEXT] [-deposit PERCENT -balance-days N]
+  rates update -id ID [-name NAME] [-amount PRICE] [-policy POLICY]
+               [-tiers TIERS] [-description TEXT] [-deposit PERCENT]
+               [-balance-days N] [-active=true|false]
+
+POLICY is flexible, moderate, strict or non-refundable, or with TIERS the
+name of your own, e.g. -policy seasonal -tiers 30:100,7:50 refunds 100% up
+to 30 days before check in and 50% up to 7`
+
+var unknownRatesCommand = errors.New(ratesUsage)
+
+// Manages rate plans from the command line, writing results to out
+func RatesCommand(rates *Rates, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return unknownRatesCommand
+	}
+
+	flags := flag.NewFlagSet("rates "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	flagId := flags.Int64("id", 0, "rate plan id")
+	flagName := flags.String("name", "", "rate name, e.g. With Bunny")
+	flagDescription := flags.String("description", "", "shown to guests")
+	flagAmount := flags.String("amount", "", "base nightly price, e.g. 200.00")
+	flagPolicy := flags.String("policy", "", "flexible, moderate, strict or non-refundable, or a name for -tiers")
+	flagTiers := flags.String("tiers", "", "DAYS:PERCENT refunds, most notice first, e.g. 30:100,7:50")
+	flagActive := flags.Bool("active", true, "offered to guests")
+	flagDeposit := flags.Int("deposit", 0, "percent taken at booking, 0 for all of it")
+	flagBalanceDays := flags.Int("balance-days", 0, "days before check in the balance is taken")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	default:
+		return unknownRatesCommand
+	case "list":
+		list, err := rates.List()
+		if err != nil {
+			return err
+		}
+		for _, r := range list {
+			fmt.Fprintln(out, rateSummary(r))
+		}
+		return nil
+	case "create":
+		price, err := rates.Property.ParsePrice(*flagAmount)
+		if err != nil {
+			return err
+		}
+		policy, err := policyFlags(flags, *flagPolicy, *flagTiers)
+		if err != nil {
+			return err
+		}
+		r, err := rates.Create(
+			*flagName,
+			*flagDescription,
+			price,
+			policy,
+			paymentSchedule{
+				BalanceDaysBefore: *flagBalanceDays,
+				DepositPercent:    *flagDeposit,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, rateSummary(r))
+		return nil
+	case "update":
+		r, err := rates.Current(rateId(*flagId))
+		if err != nil {
+			return err
+		}
+
+		// only what was given changes
+		if given(flags, "policy") || given(flags, "tiers") {
+			name := r.Policy.Name
+			if given(flags, "policy") {
+				name = *flagPolicy
+			}
+			r.Policy, err = policyFlags(flags, name, *flagTiers)
+			if err != nil {
+				return err
+			}
+		}
+		var visitErr error
+		flags.Visit(func(f *flag.Flag) {
+			var err error
+			switch f.Name {
+			case "name":
+				r.Name = *flagName
+			case "description":
+				r.Description = *flagDescription
+			case "amount":
+				r.Amount, err = rates.Property.ParsePrice(*flagAmount)
+			case "active":
+				r.Active = *flagActive
+			case "deposit":
+				r.Schedule.DepositPercent = *flagDeposit
+			case "balance-days":
+				r.Schedule.BalanceDaysBefore = *flagBalanceDays
+			}
+			if err != nil && visitErr == nil {
+				visitErr = err
+			}
+		})
+		if visitErr != nil {
+			return visitErr
+		}
+
+		r, err = rates.Update(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, rateSummary(r))
+		return nil
+	}
+}
+
+func given(flags *flag.FlagSet, name string) bool {
+	found := false
+	flags.Visit(func(f *flag.Flag) {
+		found = found || f.Name == name
+	})
+	return found
+}
+
+// A standard policy by name, or one of the given name with the given tiers
+func policyFlags(
+	flags *flag.FlagSet,
+	name string,
+	tiers string,
+) (cancellationPolicy, error) {
+	if !given(flags, "tiers") {
+		return policyNamed(name)
+	}
+	list, err := parseRefundTiers(tiers)
+	if err != nil {
+		return cancellationPolicy{}, err
+	}
+	return newCancellationPolicy(name, 1, list...)
+}
+
+func rateSummary(r rate) string {
+	active := "active"
+	if !r.Active {
+		active = "inactive"
+	}
+	s := fmt.Sprintf(
+		"%s v%d %s %s %s",
+		r.Id,
+		r.Version,
+		active,
+		r,
+		r.Policy.Name,
+	)
+	if r.Schedule != paidInFull {
+		s += ", " + r.Schedule.String()
+	}
+	return s
+}
@@ -0,0 +1,113 @@
+package booking
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/facebookgo/inject"
+)
+
+func TestRatesCommand(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var rates Rates
+	err := inject.Populate(db, &rates)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var out bytes.Buffer
+	err = RatesCommand(&rates, []string{"bogus"}, &out)
+	if err != unknownRatesCommand {
+		t.Error("want", unknownRatesCommand)
+		t.Error("got ", err)
+	}
+
+	err = RatesCommand(&rates, []string{
+		"create",
+		"-name", "Weekly",
+		"-amount", "180",
+		"-policy", "no-such-policy",
+	}, &out)
+	if err != policyNotFound {
+		t.Error("want", policyNotFound)
+		t.Error("got ", err)
+	}
+
+	err = RatesCommand(&rates, []string{
+		"create",
+		"-name", "Weekly",
+		"-amount", "180",
+		"-policy", "strict",
+		"-deposit", "30",
+		"-balance-days", "60",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = RatesCommand(&rates, []string{
+		"update",
+		"-id", "3",
+		"-deposit", "100",
+	}, &out)
+	if err != invalidSchedule {
+		t.Error("want", invalidSchedule)
+		t.Error("got ", err)
+	}
+
+	// only given flags change
+	err = RatesCommand(&rates, []string{
+		"update",
+		"-id", "3",
+		"-active=false",
+	}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// own tiers -> kept with the plan, a new version when they change
+	var tiers = []struct {
+		args    []string
+		err     error
+		version int
+		want    refundTiers
+	}{
+		{[]string{"create", "-name", "Summer", "-amount", "300", "-policy", "seasonal", "-tiers", "30:100,7:50"}, nil, 1, refundTiers{{30, 100}, {7, 50}}},
+		{[]string{"update", "-id", "4", "-tiers", "60:100"}, nil, 2, refundTiers{{60, 100}}},
+		{[]string{"update", "-id", "4", "-amount", "320"}, nil, 2, refundTiers{{60, 100}}},
+		{[]string{"update", "-id", "4", "-tiers", "7:50,30:100"}, invalidPolicy, 2, refundTiers{{60, 100}}},
+		{[]string{"update", "-id", "4", "-tiers", "lots"}, invalidPolicy, 2, refundTiers{{60, 100}}},
+	}
+	for _, test := range tiers {
+		err := RatesCommand(&rates, test.args, &out)
+		if err != test.err {
+			t.Error(test.args, "want", test.err)
+			t.Error(test.args, "got ", err)
+		}
+		r, _ := rates.Current(rateId(4))
+		if r.Policy.Name != "seasonal" || r.Policy.Version != test.version ||
+			!r.Policy.sameTiers(cancellationPolicy{Tiers: test.want}) {
+			t.Error(test.args, "want seasonal", test.version, test.want)
+			t.Error(test.args, "got ", r.Policy)
+		}
+	}
+	err = RatesCommand(&rates, []string{"update", "-id", "4", "-active=false"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out.Reset()
+	err = RatesCommand(&rates, []string{"list"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "rateId:1 v1 active rate: With Bunny ($200.00) moderate\n" +
+		"rateId:2 v1 active rate: Without Bunny ($250.00) flexible\n" +
+		"rateId:3 v2 inactive rate: Weekly ($180.00) strict, 30% deposit, balance 60 days before check in\n" +
+		"rateId:4 v4 inactive rate: Summer ($320.00) seasonal\n"
+	if got := out.String(); got != want {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+}
@@ -0,0 +1,194 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestRates(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var rates Rates
+	var register Register
+	err := inject.Populate(&FakeGateway{}, db, &calendar, &rates, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := 0; i < 5; i++ {
+		calendar.Add(date.New(2015, 1, 1).Add(i))
+	}
+
+	// seeded once
+	err = rates.Seed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := rates.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []rate{withBunny, withoutBunny}; !reflect.DeepEqual(want, list) {
+		t.Error("want", want)
+		t.Error("got ", list)
+	}
+
+	// Create() -> invalidRate, invalidSchedule, rateNameUsed
+	if _, err := rates.Create("", "", amount(100), strict, paidInFull); err != invalidRate {
+		t.Error("want", invalidRate)
+		t.Error("got ", err)
+	}
+	if _, err := rates.Create("Cheap", "", 0, strict, paidInFull); err != invalidRate {
+		t.Error("want", invalidRate)
+		t.Error("got ", err)
+	}
+	_, err = rates.Create("Cheap", "", amount(100), strict, paymentSchedule{
+		BalanceDaysBefore: 30,
+		DepositPercent:    100,
+	})
+	if err != invalidSchedule {
+		t.Error("want", invalidSchedule)
+		t.Error("got ", err)
+	}
+	_, err = rates.Create(withBunny.Name, "", amount(100), strict, paidInFull)
+	if err != rateNameUsed {
+		t.Error("want", rateNameUsed)
+		t.Error("got ", err)
+	}
+
+	weekly, err := rates.Create(
+		"Weekly",
+		"7 nights or more",
+		amount(18000),
+		strict,
+		paymentSchedule{BalanceDaysBefore: 30, DepositPercent: 30},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weekly.Id != rateId(3) || weekly.Version != 1 || !weekly.Active {
+		t.Error("want rateId:3 v1 active")
+		t.Error("got ", weekly.Id, weekly.Version, weekly.Active)
+	}
+
+	id, err := register.Book(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 3),
+		guestId(1),
+		weekly,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// repricing adds a version, the booking keeps the one it was made on
+	repriced := weekly
+	repriced.Amount = amount(19000)
+	repriced, err = rates.Update(repriced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repriced.Version != 2 {
+		t.Error("want", 2)
+		t.Error("got ", repriced.Version)
+	}
+	current, err := rates.Current(weekly.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(repriced, current) {
+		t.Error("want", repriced)
+		t.Error("got ", current)
+	}
+	b, err := register.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(weekly, b.Rate) {
+		t.Error("want", weekly)
+		t.Error("got ", b.Rate)
+	}
+
+	// renaming frees the old name
+	renamed := repriced
+	renamed.Name = "Week Long"
+	renamed, err = rates.Update(renamed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rates.Named("Weekly"); err != rateNotFound {
+		t.Error("want", rateNotFound)
+		t.Error("got ", err)
+	}
+	if r, _ := rates.Named("Week Long"); r.Version != 3 {
+		t.Error("want", 3)
+		t.Error("got ", r.Version)
+	}
+
+	// deactivated plans aren't offered or bookable
+	withdrawn := renamed
+	withdrawn.Active = false
+	withdrawn, err = rates.Update(withdrawn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := rates.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []rate{withBunny, withoutBunny}; !reflect.DeepEqual(want, active) {
+		t.Error("want", want)
+		t.Error("got ", active)
+	}
+	_, err = register.Book(
+		date.New(2015, 1, 3),
+		date.New(2015, 1, 5),
+		guestId(2),
+		withdrawn,
+		1,
+	)
+	if err != rateInactive {
+		t.Error("want", rateInactive)
+		t.Error("got ", err)
+	}
+
+	// but existing bookings can move on the version they have
+	_, err = register.Modify(id, date.New(2015, 1, 2), date.New(2015, 1, 4), weekly, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = register.Modify(id, date.New(2015, 1, 2), date.New(2015, 1, 4), withdrawn, 1)
+	if err != rateInactive {
+		t.Error("want", rateInactive)
+		t.Error("got ", err)
+	}
+
+	if _, err := rates.Current(rateId(99)); err != rateNotFound {
+		t.Error("want", rateNotFound)
+		t.Error("got ", err)
+	}
+
+	// the property moving to another currency, plans are repriced in it
+	err = rates.Property.SetCurrency("EUR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	euros := withBunny
+	euros.Amount = amount(18000)
+	euros, err = rates.Update(euros)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err = rates.Current(withBunny.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Currency != currency("EUR") || current.Price().String() != "€180.00" {
+		t.Error("want", "€180.00")
+		t.Error("got ", current.Price())
+	}
+}
@@ -0,0 +1,388 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Money given back on a card, against the payment it was taken in. A
+// payment can be refunded in parts, up to what was captured
+const PaymentRefundSchema = `
+  CREATE TABLE PaymentRefund (
+    Amount INTEGER NOT NULL,
+    EntryId INTEGER NOT NULL REFERENCES JournalEntry(Id),
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    PaymentId INTEGER NOT NULL REFERENCES Payment(Id),
+    RefundId TEXT UNIQUE NOT NULL,
+    RefundedAt DATETIME NOT NULL,
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )
+`
+
+// Payments are linked to their booking. Nothing else ties earlier ones to
+// a booking but the booking id their memo starts with, e.g. "bookingId:5 paid
+// by card", which is taken if that booking exists. Payments mentioning a
+// booking that can't be found are logged
+func refundMigration(tx *sql.Tx) error {
+	err := statements(
+		`ALTER TABLE Payment ADD COLUMN BookingId INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE Payment SET BookingId = (
+        SELECT r.Id FROM JournalEntry e
+        JOIN Register r ON r.Id = CAST(substr(e.Memo, 11) AS INTEGER)
+        WHERE e.Id = Payment.EntryId AND e.Memo LIKE 'bookingId:%'
+      )
+      WHERE EXISTS (
+        SELECT 1 FROM JournalEntry e
+        JOIN Register r ON r.Id = CAST(substr(e.Memo, 11) AS INTEGER)
+        WHERE e.Id = Payment.EntryId AND e.Memo LIKE 'bookingId:%'
+      )`,
+		`CREATE TABLE PaymentRefund (
+      Amount INTEGER NOT NULL,
+      EntryId INTEGER NOT NULL REFERENCES JournalEntry(Id),
+      Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+      PaymentId INTEGER NOT NULL REFERENCES Payment(Id),
+      RefundId TEXT UNIQUE NOT NULL,
+      RefundedAt DATETIME NOT NULL,
+      CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+    )`,
+	)(tx)
+	if err != nil {
+		return err
+	}
+
+	return logUnlinked(tx, "payments", `
+    select p.Id from Payment p
+    join JournalEntry e on e.Id = p.EntryId
+    where p.BookingId = 0 and e.Memo LIKE 'bookingId:%'
+  `)
+}
+
+// A row in PaymentRefund, with the memo it was posted under
+type paymentRefund struct {
+	Amount     amount
+	EntryId    int64
+	Id         int64
+	Memo       memo
+	PaymentId  int64
+	RefundId   gatewayTxId
+	RefundedAt time.Time
+}
+
+var (
+	paymentNotFound = errors.New("no such payment")
+	overRefund      = errors.New("refund is more than is left of the payment")
+)
+
+func (l *Ledger) RefundPayment(
+	paymentId int64,
+	a amount,
+	memo memo,
+) (paymentRefund, error) {
+	tx, err := l.DB.Begin()
+	if err != nil {
+		return paymentRefund{}, err
+	}
+
+	r, err := l.RefundPaymentTx(tx, paymentId, a, memo)
+	if err != nil {
+		tx.Rollback()
+		glog.Error(err)
+		return paymentRefund{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error("refunded ", r.RefundId, " but couldn't record it: ", err)
+		return paymentRefund{}, err
+	}
+
+	return r, nil
+}
+
+// Gives some or all of what's left of a payment back to the card it was
+// taken from. What the guest is owed on the payment's booking, e.g. after a
+// cancellation, is paid out first and anything more is a concession against refunds, so the guest's
+// balance never goes up. Once the gateway has refunded there's no taking it
+// back, so if the caller rolls back the refund is logged for someone to
+// record by hand - caller is responsible for Commit/Rollback
+func (l *Ledger) RefundPaymentTx(
+	tx *sql.Tx,
+	paymentId int64,
+	a amount,
+	memo memo,
+) (paymentRefund, error) {
+	if a == 0 {
+		return paymentRefund{}, zeroAmount
+	}
+	if a < 0 {
+		return paymentRefund{}, invalidAmount
+	}
+
+	p, err := lookupPaymentTx(tx, paymentId)
+	if err != nil {
+		return paymentRefund{}, err
+	}
+	refunded, err := refundedTx(tx, paymentId)
+	if err != nil {
+		return paymentRefund{}, err
+	}
+	if refunded+a > p.Amount {
+		return paymentRefund{}, overRefund
+	}
+
+	balance, err := bookingReceivableTx(tx, p.GuestId, p.BookingId)
+	if err != nil {
+		return paymentRefund{}, err
+	}
+	owed := -balance
+	paidOut := a
+	if owed < a {
+		paidOut = owed
+	}
+	if paidOut < 0 {
+		paidOut = 0
+	}
+
+	e := journalEntry{
+		BookingId: p.BookingId,
+		Lines:     []journalLine{{Account: clearing, Amount: -a}},
+		Memo:      memo,
+	}
+	if paidOut > 0 {
+		e.Lines = append(e.Lines, journalLine{
+			Account: receivable,
+			Amount:  paidOut,
+			GuestId: p.GuestId,
+		})
+	}
+	if paidOut < a {
+		e.Lines = append(e.Lines, journalLine{
+			Account: refunds,
+			Amount:  a - paidOut,
+		})
+	}
+
+	refundId, err := l.Gateway.Refund(p.CaptureId, l.Money(a))
+	if err != nil {
+		glog.Error(err)
+		return paymentRefund{}, err
+	}
+
+	r := paymentRefund{
+		Amount:     a,
+		Memo:       memo,
+		PaymentId:  paymentId,
+		RefundId:   refundId,
+		RefundedAt: l.Clock.Now().UTC(),
+	}
+	r.EntryId, err = l.post(tx, e)
+	if err != nil {
+		glog.Error("refunded ", refundId, " but couldn't post it: ", err)
+		return paymentRefund{}, err
+	}
+
+	result, err := tx.Exec(`
+    insert into PaymentRefund
+    (Amount, EntryId, PaymentId, RefundId, RefundedAt)
+    values ($1, $2, $3, $4, $5)
+  `, r.Amount, r.EntryId, r.PaymentId, r.RefundId, r.RefundedAt)
+	if err != nil {
+		glog.Error("refunded ", refundId, " but couldn't record it: ", err)
+		return paymentRefund{}, err
+	}
+	r.Id, err = result.LastInsertId()
+	if err != nil {
+		glog.Error(err)
+		return paymentRefund{}, err
+	}
+
+	glog.Infoln("refunded", p.CaptureId, l.Money(a), "as", refundId)
+	return r, nil
+}
+
+// A payment by id, whatever it was taken for
+func (l *Ledger) LookupPayment(id int64) (payment, error) {
+	tx, err := l.DB.Begin()
+	if err != nil {
+		return payment{}, err
+	}
+	defer tx.Rollback()
+
+	return lookupPaymentTx(tx, id)
+}
+
+func lookupPaymentTx(tx *sql.Tx, id int64) (payment, error) {
+	var p payment
+	err := tx.QueryRow(`
+    select Amount, AuthorizationId, BookingId, CaptureId, EntryId, GuestId, Id
+    from Payment
+    where Id = $1
+  `, id).Scan(
+		&p.Amount,
+		&p.AuthorizationId,
+		&p.BookingId,
+		&p.CaptureId,
+		&p.EntryId,
+		&p.GuestId,
+		&p.Id,
+	)
+	if err == sql.ErrNoRows {
+		return payment{}, paymentNotFound
+	}
+	if err != nil {
+		glog.Error(err)
+		return payment{}, err
+	}
+	return p, nil
+}
+
+// Sum of a payment's refunds so far
+func refundedTx(tx *sql.Tx, paymentId int64) (amount, error) {
+	var refunded amount
+	err := tx.QueryRow(
+		`select coalesce(sum(Amount), 0) from PaymentRefund where PaymentId = $1`,
+		paymentId,
+	).Scan(&refunded)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	return refunded, nil
+}
+
+// What a guest owes for one booking, so what they owe for another doesn't
+// hold back a refund of this one's payments
+func bookingReceivableTx(tx *sql.Tx, guest guestId, id bookingId) (amount, error) {
+	var balance amount
+	err := tx.QueryRow(`
+    select coalesce(sum(l.Amount), 0) from JournalLine l
+    join JournalEntry e on e.Id = l.EntryId
+    where l.Account = $1 and l.GuestId = $2 and e.BookingId = $3
+  `, receivable, guest, id).Scan(&balance)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	return balance, nil
+}
+
+// A payment with what's been refunded of it
+type refundablePayment struct {
+	payment
+	Refunded amount
+}
+
+// What's left to refund
+func (p refundablePayment) Refundable() amount {
+	return p.Amount - p.Refunded
+}
+
+// Payments taken for a booking's stay, oldest first. A damage deposit
+// claimed isn't paid towards the stay, so isn't one of them
+func (l *Ledger) Payments(id bookingId) ([]refundablePayment, error) {
+	tx, err := l.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return paymentsTx(tx, id)
+}
+
+func paymentsTx(tx *sql.Tx, id bookingId) ([]refundablePayment, error) {
+	rows, err := tx.Query(`
+    select
+      p.Amount,
+      p.AuthorizationId,
+      p.BookingId,
+      p.CaptureId,
+      p.Card,
+      p.EntryId,
+      p.GuestId,
+      p.Id,
+      coalesce((
+        select sum(r.Amount) from PaymentRefund r where r.PaymentId = p.Id
+      ), 0)
+    from Payment p
+    where p.BookingId = $1
+    and p.Id not in (select PaymentId from DamageDeposit where BookingId = $1)
+    order by p.Id asc
+  `, id)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var payments []refundablePayment
+	for rows.Next() {
+		var p refundablePayment
+		err := rows.Scan(
+			&p.Amount,
+			&p.AuthorizationId,
+			&p.BookingId,
+			&p.CaptureId,
+			&p.Card,
+			&p.EntryId,
+			&p.GuestId,
+			&p.Id,
+			&p.Refunded,
+		)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		payments = append(payments, p)
+	}
+	return payments, rows.Err()
+}
+
+// Refunds of a booking's payments, oldest first
+func (l *Ledger) Refunds(id bookingId) ([]paymentRefund, error) {
+	rows, err := l.DB.Query(`
+    select r.Amount, r.EntryId, r.Id, e.Memo, r.PaymentId, r.RefundId, r.RefundedAt
+    from PaymentRefund r
+    join Payment p on p.Id = r.PaymentId
+    join JournalEntry e on e.Id = r.EntryId
+    where p.BookingId = $1
+    order by r.Id asc
+  `, id)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []paymentRefund
+	for rows.Next() {
+		var r paymentRefund
+		err := rows.Scan(
+			&r.Amount,
+			&r.EntryId,
+			&r.Id,
+			&r.Memo,
+			&r.PaymentId,
+			&r.RefundId,
+			&r.RefundedAt,
+		)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		r.RefundedAt = r.RefundedAt.UTC()
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// Memo for a refund, with the reason when there is one
+func refundMemo(id bookingId, reason string) memo {
+	if reason == "" {
+		return memo(fmt.Sprintf("%s refunded to card", id))
+	}
+	return memo(fmt.Sprintf("%s refunded to card: %s", id, reason))
+}
@@ -0,0 +1,228 @@
+package booking
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestLedgerRefundPayment(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var clock Clock
+	var gateway FakeGateway
+	var ledger Ledger
+	err := inject.Populate(db, &clock, &gateway, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	guest := guestId(1)
+	id := bookingId(1)
+	// another booking still owed for doesn't hold back refunds of this one
+	tx, _ := db.Begin()
+	for _, e := range []journalEntry{
+		guestEntry(guest, id, amount(40000), revenue, memo("bookingId:1 2 nights")),
+		guestEntry(guest, bookingId(2), amount(30000), revenue, memo("bookingId:2 2 nights")),
+	} {
+		err = ledger.PostTx(tx, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tx.Commit()
+	p, err := ledger.Charge(
+		guest,
+		id,
+		amount(40000),
+		testCard(t, &gateway, fakeCardApproved),
+		memo("bookingId:1 paid by card"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		credit  amount // owed to the guest before refunding
+		refund  amount
+		err     error
+		balance amount
+	}{
+		{0, amount(0), zeroAmount, amount(30000)},
+		{0, amount(-100), invalidAmount, amount(30000)},
+		{0, amount(10000), nil, amount(30000)},              // concession
+		{amount(20000), amount(25000), nil, amount(30000)},  // owed, then concession
+		{0, amount(5001), overRefund, amount(30000)},        // 5000 left
+		{0, amount(5000), nil, amount(30000)},               // the rest
+		{0, amount(1), overRefund, amount(30000)},           // nothing left
+		{amount(300), amount(1), overRefund, amount(29700)}, // owed, nothing left
+	}
+	for i, test := range tests {
+		if test.credit > 0 {
+			tx, _ := db.Begin()
+			err := ledger.RefundTx(tx, guest, bookingId(1), test.credit, memo("refund"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx.Commit()
+		}
+		_, err := ledger.RefundPayment(p.Id, test.refund, refundMemo(id, ""))
+		if err != test.err {
+			t.Error(i, "want", test.err)
+			t.Error(i, "got ", err)
+		}
+		balance, _ := ledger.Balance(guest)
+		if balance != test.balance {
+			t.Error(i, "want", test.balance)
+			t.Error(i, "got ", balance)
+		}
+	}
+
+	// RefundPayment() -> no such payment
+	_, err = ledger.RefundPayment(int64(99), amount(1), refundMemo(id, ""))
+	if err != paymentNotFound {
+		t.Error("want", paymentNotFound)
+		t.Error("got ", err)
+	}
+
+	// Refunds() -> each with the gateway's id
+	list, err := ledger.Refunds(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []gatewayTxId{"fake_3", "fake_4", "fake_5"}
+	if len(list) != len(want) {
+		t.Fatal("want", len(want), "got", len(list))
+	}
+	for i, r := range list {
+		if r.RefundId != want[i] || r.PaymentId != p.Id {
+			t.Error("want", want[i], p.Id)
+			t.Error("got ", r.RefundId, r.PaymentId)
+		}
+		if r.Memo != memo("bookingId:1 refunded to card") {
+			t.Error("got ", r.Memo)
+		}
+	}
+
+	// Payments() -> fully refunded
+	payments, err := ledger.Payments(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].Refunded != amount(40000) ||
+		payments[0].Refundable() != 0 {
+		t.Error("want", amount(40000), "refunded")
+		t.Error("got ", payments)
+	}
+
+	// the gateway agrees
+	if _, err := gateway.Refund(p.CaptureId, usd(1)); err != gatewayTxFailed {
+		t.Error("want", gatewayTxFailed)
+		t.Error("got ", err)
+	}
+
+	// clearing settled, concessions and credits against refunds
+	on := date.New(2015, 1, 1)
+	for _, test := range []struct {
+		account account
+		balance amount
+	}{
+		{clearing, amount(0)},
+		{refunds, amount(40300)},
+	} {
+		balance, err := ledger.AccountBalance(test.account, on)
+		if err != nil {
+			t.Error(err)
+		}
+		if balance != test.balance {
+			t.Error(test.account, "want", test.balance)
+			t.Error(test.account, "got ", balance)
+		}
+	}
+	testBooksBalance(t, db)
+}
+
+func TestRefundMigration(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	migrate := func(m migration) {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx.Commit()
+	}
+	migrate(ledgerMigration)
+	migrate(journalMigration)
+	migrate(paymentMigration)
+	_, err = db.Exec(`CREATE TABLE Register (Id INTEGER PRIMARY KEY)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`insert into Register (Id) values (12)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// payments from before, linked to bookings only by memo
+	for i, m := range []memo{
+		"bookingId:12 paid by card",
+		"paid",
+		"bookingId:13 paid by card",
+	} {
+		_, err := db.Exec(
+			`insert into JournalEntry (Id, Memo, PostedAt) values ($1, $2, $3)`,
+			i+1,
+			m,
+			time.Now(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`
+      insert into Payment (Amount, AuthorizationId, CaptureId, EntryId, GuestId)
+      values (100, $1, $2, $3, 1)
+    `, i, i, i+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	migrate(refundMigration)
+	migrate(paymentCardMigration)
+	migrate(damageDepositMigration)
+
+	var ledger Ledger
+	err = inject.Populate(&FakeGateway{}, db, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+	payments, err := ledger.Payments(bookingId(12))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 1 || payments[0].EntryId != 1 {
+		t.Error("want the payment for bookingId:12")
+		t.Error("got ", payments)
+	}
+	payments, err = ledger.Payments(bookingId(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(payments) != 2 || payments[0].EntryId != 2 || payments[1].EntryId != 3 {
+		t.Error("want the others unlinked, as there's no bookingId:13")
+		t.Error("got ", payments)
+	}
+}
@@ -0,0 +1,110 @@
+package booking
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+)
+
+const refundsUsage = `usage:
+  refunds list -code CONFIRMATION
+  refunds create -code CONFIRMATION -payment ID -amount PRICE [-reason TEXT]`
+
+var unknownRefundsCommand = errors.New(refundsUsage)
+
+var paymentNotForBooking = errors.New("payment isn't for that booking")
+
+// Lists a booking's payments and refunds, or refunds a payment, from the
+// command line, writing results to out
+func RefundsCommand(
+	l *Ledger,
+	r *Register,
+	args []string,
+	out io.Writer,
+) error {
+	if len(args) == 0 {
+		return unknownRefundsCommand
+	}
+
+	flags := flag.NewFlagSet("refunds "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	flagCode := flags.String("code", "", "the booking's confirmation code")
+	flagPayment := flags.Int64("payment", 0, "id of the payment to refund")
+	flagAmount := flags.String("amount", "", "how much to refund, e.g. 50.00")
+	flagReason := flags.String("reason", "", "why, kept in the memo")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	default:
+		return unknownRefundsCommand
+	case "list":
+		b, err := r.LookupByCode(*flagCode)
+		if err != nil {
+			return err
+		}
+		payments, err := l.Payments(b.Id)
+		if err != nil {
+			return err
+		}
+		for _, p := range payments {
+			fmt.Fprintf(
+				out,
+				"Payment %d: %s as %s, %s refunded, %s refundable\n",
+				p.Id,
+				l.Money(p.Amount),
+				p.CaptureId,
+				l.Money(p.Refunded),
+				l.Money(p.Refundable()),
+			)
+		}
+		list, err := l.Refunds(b.Id)
+		if err != nil {
+			return err
+		}
+		for _, refund := range list {
+			fmt.Fprintln(out, refundSummary(l, refund))
+		}
+		return nil
+	case "create":
+		b, err := r.LookupByCode(*flagCode)
+		if err != nil {
+			return err
+		}
+		a, err := l.Property.ParsePrice(*flagAmount)
+		if err != nil {
+			return err
+		}
+
+		// only a payment of this booking, for the stay or a damage claim
+		p, err := l.LookupPayment(*flagPayment)
+		if err == paymentNotFound || p.BookingId != b.Id {
+			return paymentNotForBooking
+		}
+		if err != nil {
+			return err
+		}
+
+		refund, err := l.RefundPayment(*flagPayment, a, refundMemo(b.Id, *flagReason))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, refundSummary(l, refund))
+		return nil
+	}
+}
+
+func refundSummary(l *Ledger, r paymentRefund) string {
+	return fmt.Sprintf(
+		"%s Refund %d of payment %d: %s as %s (%s)",
+		r.RefundedAt.Format("2006-01-02 15:04"),
+		r.Id,
+		r.PaymentId,
+		l.Money(r.Amount),
+		r.RefundId,
+		r.Memo,
+	)
+}
@@ -0,0 +1,102 @@
+package booking
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestRefundsCommand(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var gateway FakeGateway
+	var ledger Ledger
+	var register Register
+	err := inject.Populate(db, &calendar, &clock, &gateway, &ledger, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Set(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+	calendar.Add(date.New(2015, 1, 1))
+	id, err := register.Book(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 2),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := register.Lookup(id)
+	p, err := ledger.Charge(
+		guestId(1),
+		id,
+		amount(20000),
+		testCard(t, &gateway, fakeCardApproved),
+		memo("paid"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Id != 1 {
+		t.Fatal("want payment 1, got", p.Id)
+	}
+
+	var out bytes.Buffer
+	err = RefundsCommand(&ledger, &register, nil, &out)
+	if err != unknownRefundsCommand {
+		t.Error("want", unknownRefundsCommand)
+		t.Error("got ", err)
+	}
+
+	var tests = []struct {
+		args []string
+		err  error
+		want string
+	}{
+		{
+			[]string{"create", "-code", string(b.Code), "-payment", "99", "-amount", "1"},
+			paymentNotForBooking,
+			"",
+		},
+		{
+			[]string{"create", "-code", string(b.Code), "-payment", "1", "-amount", "200.01"},
+			overRefund,
+			"",
+		},
+		{
+			[]string{"create", "-code", string(b.Code), "-payment", "1", "-amount", "50", "-reason", "noisy"},
+			nil,
+			"2015-01-01 12:00 Refund 1 of payment 1: $50.00 as fake_3 (bookingId:1 refunded to card: noisy)\n",
+		},
+		{
+			[]string{"list", "-code", string(b.Code)},
+			nil,
+			"Payment 1: $200.00 as fake_2, $50.00 refunded, $150.00 refundable\n" +
+				"2015-01-01 12:00 Refund 1 of payment 1: $50.00 as fake_3 (bookingId:1 refunded to card: noisy)\n",
+		},
+		{
+			[]string{"list", "-code", "NOPE2345"},
+			bookingNotFound,
+			"",
+		},
+	}
+	for _, test := range tests {
+		out.Reset()
+		err := RefundsCommand(&ledger, &register, test.args, &out)
+		if err != test.err {
+			t.Error(test.args, "want", test.err)
+			t.Error(test.args, "got ", err)
+		}
+		if got := out.String(); got != test.want {
+			t.Error(test.args, "want", test.want)
+			t.Error(test.args, "got ", got)
+		}
+	}
+}
@@ -2,8 +2,10 @@ package booking
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/cmdrkeene/booking/pkg/date"
 	"github.com/golang/glog"
@@ -12,40 +14,197 @@ import (
 // Register is a container for booking records
 type Register struct {
 	Calendar *Calendar `inject:""`
+	Clock    *Clock    `inject:""`
 	DB       *sql.DB   `inject:""`
+	Ledger   *Ledger   `inject:""`
+	Pricing  *Pricing  `inject:""`
 }
 
 const RegisterSchema = `
   CREATE TABLE Register (
-    Checkin DATETIME UNIQUE NOT NULL REFERENCES Calendar,
-    Checkout DATETIME UNIQUE NOT NULL REFERENCES Calendar,
+    Checkin DATETIME NOT NULL REFERENCES Calendar,
+    Checkout DATETIME NOT NULL,
     GuestId INTEGER NOT NULL REFERENCES Guestbook(Id),
     Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
-    Rate TEXT NOT NULL,
-    CONSTRAINT ck_Ckin_Less_Than_Ckout CHECK (Checkin <= Checkout)
+    RateId INTEGER NOT NULL,
+    RateVersion INTEGER NOT NULL,
+    Version INTEGER NOT NULL DEFAULT 1,
+    Status TEXT NOT NULL DEFAULT 'confirmed',
+    Code TEXT UNIQUE NOT NULL,
+    Guests INTEGER NOT NULL DEFAULT 1,
+    FOREIGN KEY (RateId, RateVersion) REFERENCES RatePlan (Id, Version),
+    CONSTRAINT ck_Ckin_Less_Than_Ckout CHECK (Checkin < Checkout)
+  )
+`
+
+// Prior versions of each booking, written as it is modified
+const RegisterHistorySchema = `
+  CREATE TABLE RegisterHistory (
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    Checkin DATETIME NOT NULL,
+    Checkout DATETIME NOT NULL,
+    RateId INTEGER NOT NULL,
+    RateVersion INTEGER NOT NULL,
+    ReplacedAt DATETIME NOT NULL,
+    Version INTEGER NOT NULL,
+    Status TEXT NOT NULL DEFAULT 'confirmed',
+    Guests INTEGER NOT NULL DEFAULT 1,
+    PRIMARY KEY (BookingId, Version)
   )
 `
 
+// Stays are nights, so drop UNIQUE on Checkin and Checkout to allow a
+// checkout on the same day as another checkin
+var registerNightsMigration = statements(
+	`ALTER TABLE Register RENAME TO RegisterBeforeNights`,
+	`CREATE TABLE Register (
+    Checkin DATETIME NOT NULL REFERENCES Calendar,
+    Checkout DATETIME NOT NULL,
+    GuestId INTEGER NOT NULL REFERENCES Guestbook(Id),
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Rate TEXT NOT NULL,
+    CONSTRAINT ck_Ckin_Less_Than_Ckout CHECK (Checkin < Checkout)
+  )`,
+	`INSERT INTO Register (Checkin, Checkout, GuestId, Id, Rate)
+    SELECT Checkin, Checkout, GuestId, Id, Rate FROM RegisterBeforeNights`,
+	`DROP TABLE RegisterBeforeNights`,
+)
+
+// Existing bookings get a code of their own before codes become unique
+func registerCodeMigration(tx *sql.Tx) error {
+	_, err := tx.Exec(`ALTER TABLE Register ADD COLUMN Code TEXT`)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`select Id from Register`)
+	if err != nil {
+		return err
+	}
+	var ids []bookingId
+	for rows.Next() {
+		var id bookingId
+		err := rows.Scan(&id)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		code, err := unusedConfirmationCode(tx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(`update Register set Code = $1 where Id = $2`, code, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE UNIQUE INDEX RegisterCode ON Register (Code)`)
+	return err
+}
+
+var registerHistoryMigration = statements(
+	`ALTER TABLE Register ADD COLUMN Version INTEGER NOT NULL DEFAULT 1`,
+	`CREATE TABLE RegisterHistory (
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    Checkin DATETIME NOT NULL,
+    Checkout DATETIME NOT NULL,
+    Rate TEXT NOT NULL,
+    ReplacedAt DATETIME NOT NULL,
+    Version INTEGER NOT NULL,
+    PRIMARY KEY (BookingId, Version)
+  )`,
+)
+
+// Bookings made before guests were counted are for one
+var registerGuestsMigration = statements(
+	`ALTER TABLE Register ADD COLUMN Guests INTEGER NOT NULL DEFAULT 1`,
+	`ALTER TABLE RegisterHistory ADD COLUMN Guests INTEGER NOT NULL DEFAULT 1`,
+)
+
 // Locator for a booking record
-type bookingId uint8
+type bookingId int64
+
+func (id *bookingId) Scan(src interface{}) error {
+	n, ok := src.(int64)
+	if !ok {
+		err := errors.New(
+			fmt.Sprintf("can't scan bookingId from db: %#v", src),
+		)
+		glog.Error(err)
+		return err
+	}
+	*id = bookingId(n)
+	return nil
+}
+
+func (id bookingId) Value() (driver.Value, error) {
+	return driver.Value(int64(id)), nil
+}
 
 func (id bookingId) String() string {
 	return fmt.Sprintf("bookingId:%d", id)
 }
 
+// What a guest quotes back to us. Ids are sequential and easy to guess, codes
+// aren't, and leave out letters and digits that are easily confused
+type confirmationCode string
+
+const (
+	confirmationCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+	confirmationCodeLength   = 8
+)
+
+func newConfirmationCode() (confirmationCode, error) {
+	s, err := randomString(confirmationCodeLength, confirmationCodeAlphabet)
+	return confirmationCode(s), err
+}
+
+// Forgive case, spaces and dashes when a guest types a code in
+func parseConfirmationCode(s string) confirmationCode {
+	s = strings.ToUpper(s)
+	s = strings.NewReplacer(" ", "", "-", "").Replace(s)
+	return confirmationCode(s)
+}
+
 type booking struct {
 	Checkin  date.Date
 	Checkout date.Date
+	Code     confirmationCode
 	GuestId  guestId
+	Guests   int
 	Id       bookingId
 	Rate     rate
+	Status   status
+	Version  int
+}
+
+func (b booking) Stay() stay {
+	return stay{b.Checkin, b.Checkout}
+}
+
+// ConflictError is returned when a stay overlaps the nights of an existing
+// booking
+type ConflictError struct {
+	Booking bookingId
+}
+
+func (e ConflictError) Error() string {
+	return fmt.Sprintf("dates conflict with %s", e.Booking)
 }
 
 var (
 	checkInAfterOut = errors.New("check in can't be after check out")
 	stayTooShort    = errors.New("your stay is too short")
 	unavailable     = errors.New("dates unavailable")
-	minimumStay     = 1 // day
+	bookingNotFound = errors.New("booking not found")
+	noGuests        = errors.New("a stay needs at least one guest")
+	minimumStay     = 1 // night
 )
 
 func (r *Register) Book(
@@ -53,13 +212,14 @@ func (r *Register) Book(
 	checkOut date.Date,
 	guest guestId,
 	rate rate,
+	guests int,
 ) (bookingId, error) {
 	tx, err := r.DB.Begin()
 	if err != nil {
 		return 0, err
 	}
 
-	bookingId, err := r.BookTx(tx, checkIn, checkOut, guest, rate)
+	bookingId, err := r.BookTx(tx, checkIn, checkOut, guest, rate, guests)
 	if err != nil {
 		tx.Rollback()
 		glog.Error(err)
@@ -82,15 +242,121 @@ func (r *Register) BookTx(
 	checkOut date.Date,
 	guest guestId,
 	rate rate,
+	guests int,
 ) (bookingId, error) {
+	err := r.checkStay(tx, checkIn, checkOut, 0, "", "")
+	if err != nil {
+		return 0, err
+	}
+
+	return r.insertBooking(tx, checkIn, checkOut, guest, rate, guests)
+}
+
+// Adds the booking along with the quote it's priced on
+func (r *Register) insertBooking(
+	tx *sql.Tx,
+	checkIn date.Date,
+	checkOut date.Date,
+	guest guestId,
+	rate rate,
+	guests int,
+) (bookingId, error) {
+	if !rate.Active {
+		return 0, rateInactive
+	}
+	if guests < 1 {
+		return 0, noGuests
+	}
+
+	code, err := unusedConfirmationCode(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare(`
+      insert into Register
+      (Checkin, Checkout, Code, GuestId, Guests, RateId, RateVersion, Status)
+      values ($1, $2, $3, $4, $5, $6, $7, $8)
+    `)
+	if err != nil {
+		panic(err)
+	}
+
+	result, err := stmt.Exec(
+		checkIn,
+		checkOut,
+		code,
+		guest,
+		guests,
+		rate.Id,
+		rate.Version,
+		confirmed,
+	)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	lastId, err := result.LastInsertId()
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	id := bookingId(lastId)
+
+	q, err := r.Pricing.QuoteTx(tx, checkIn, checkOut, rate, guests)
+	if err != nil {
+		return 0, err
+	}
+	err = r.Pricing.SaveTx(tx, id, 1, q)
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// Codes are random, so check before using one
+func unusedConfirmationCode(tx *sql.Tx) (confirmationCode, error) {
+	for {
+		code, err := newConfirmationCode()
+		if err != nil {
+			return "", err
+		}
+
+		var n int
+		err = tx.QueryRow(
+			`select count(*) from Register where Code = $1`,
+			code,
+		).Scan(&n)
+		if err != nil {
+			return "", err
+		}
+		if n == 0 {
+			return code, nil
+		}
+	}
+}
+
+// Rules every stay must pass to be booked. Nights already held by the
+// except booking, the hold token or the holder don't count as a conflict, so
+// a booking can be moved over itself and a hold turned into a booking
+func (r *Register) checkStay(
+	tx *sql.Tx,
+	checkIn date.Date,
+	checkOut date.Date,
+	except bookingId,
+	hold holdToken,
+	by holder,
+) error {
 	// check in can't be after check out
 	if checkIn.After(checkOut) {
-		return 0, checkInAfterOut
+		return checkInAfterOut
 	}
 
 	// minimum stay length
-	if checkIn.DaysApart(checkOut) < minimumStay {
-		return 0, stayTooShort
+	if (stay{checkIn, checkOut}).Len() < minimumStay {
+		return stayTooShort
 	}
 
 	// ensure on availablity calendar
@@ -98,62 +364,370 @@ func (r *Register) BookTx(
 	available, err := calendar.Available(checkIn, checkOut)
 	if err != nil {
 		glog.Error(err)
-		return 0, err
+		return err
 	}
 	if !available {
-		return 0, unavailable
+		return unavailable
 	}
 
-	// TODO ensure can't be overbooked
+	// ensure can't be overbooked
+	conflict, found, err := overlapping(tx, checkIn, checkOut, except)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	if found {
+		return ConflictError{conflict}
+	}
+
+	// ensure nobody else is part way through booking
+	isHeld, err := held(tx, checkIn, checkOut, r.Clock.Now(), hold, by)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+	if isHeld {
+		return heldByAnother
+	}
+
+	return nil
+}
+
+// Finds the first booking other than except sharing a night with
+// [checkIn, checkOut). Cancelled bookings have given up their nights
+func overlapping(
+	tx *sql.Tx,
+	checkIn date.Date,
+	checkOut date.Date,
+	except bookingId,
+) (bookingId, bool, error) {
 	stmt, err := tx.Prepare(`
-      insert into Register (Checkin, Checkout, GuestId, Rate)
-      values ($1, $2, $3, $4)
-    `)
+    select Id
+    from Register
+    where Checkin < $1 and Checkout > $2 and Id != $3
+    and Status != $4
+    order by Checkin asc
+    limit 1
+  `)
 	if err != nil {
 		panic(err)
 	}
 
-	result, err := stmt.Exec(checkIn, checkOut, guest, rate)
+	var id bookingId
+	err = stmt.QueryRow(checkOut, checkIn, except, cancelled).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	return id, true, nil
+}
+
+// Bookings in any of the given statuses, or every booking if none are given
+func (r *Register) List(statuses ...status) ([]booking, error) {
+	query := bookingSelect
+	var args []interface{}
+	if len(statuses) > 0 {
+		query += `where r.Status in (`
+		for i, s := range statuses {
+			if i > 0 {
+				query += `, `
+			}
+			query += fmt.Sprintf(`$%d`, i+1)
+			args = append(args, s)
+		}
+		query += `)`
+	}
+	query += ` order by r.Checkin asc`
+
+	stmt, err := r.DB.Prepare(query)
+	if err != nil {
+		panic(err)
+	}
+
+	rows, err := stmt.Query(args...)
 	if err != nil {
 		glog.Error(err)
-		return 0, err
+		return []booking{}, err
 	}
+	defer rows.Close()
 
-	lastId, err := result.LastInsertId()
+	var list []booking
+	for rows.Next() {
+		b, err := scanBooking(rows)
+		if err != nil {
+			glog.Error(err)
+			return []booking{}, err
+		}
+		list = append(list, b)
+	}
+
+	return list, nil
+}
+
+func (r *Register) Lookup(id bookingId) (booking, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return booking{}, err
+	}
+	defer tx.Rollback()
+
+	return lookupBooking(tx, id)
+}
+
+// Find a booking by the code on its confirmation
+func (r *Register) LookupByCode(code string) (booking, error) {
+	stmt, err := r.DB.Prepare(bookingSelect + `where r.Code = $1`)
+	if err != nil {
+		panic(err)
+	}
+
+	b, err := scanBooking(stmt.QueryRow(parseConfirmationCode(code)))
+	if err == sql.ErrNoRows {
+		return booking{}, bookingNotFound
+	}
 	if err != nil {
 		glog.Error(err)
-		return 0, err
+		return booking{}, err
 	}
 
-	return bookingId(lastId), nil
+	return b, nil
 }
 
-func (r *Register) Cancel(id bookingId) error {
-	stmt, err := r.DB.Prepare(`delete from Register where Id=$1`)
+func lookupBooking(tx *sql.Tx, id bookingId) (booking, error) {
+	stmt, err := tx.Prepare(bookingSelect + `where r.Id = $1`)
 	if err != nil {
 		panic(err)
 	}
 
-	_, err = stmt.Exec(id)
+	b, err := scanBooking(stmt.QueryRow(id))
+	if err == sql.ErrNoRows {
+		return booking{}, bookingNotFound
+	}
 	if err != nil {
 		glog.Error(err)
-		return err
+		return booking{}, err
 	}
 
-	return nil
+	return b, nil
+}
+
+// Either *sql.Row or *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Bookings as r with the version of the rate plan each was priced on as p
+const bookingSelect = `
+    select r.Checkin, r.Checkout, r.Code, r.GuestId, r.Guests, r.Id, r.Status,
+    r.Version, ` + rateColumns + `
+    from Register r
+    join RatePlan p on p.Id = r.RateId and p.Version = r.RateVersion
+  `
+
+// Columns must be selected as Checkin, Checkout, Code, GuestId, Guests, Id,
+// Status, Version, then rateColumns
+func scanBooking(row scanner) (booking, error) {
+	var b booking
+	fields := []interface{}{
+		&b.Checkin,
+		&b.Checkout,
+		&b.Code,
+		&b.GuestId,
+		&b.Guests,
+		&b.Id,
+		&b.Status,
+		&b.Version,
+	}
+	err := row.Scan(append(fields, rateFields(&b.Rate)...)...)
+	return b, err
+}
+
+func (r *Register) Modify(
+	id bookingId,
+	checkIn date.Date,
+	checkOut date.Date,
+	rate rate,
+	guests int,
+) (booking, error) {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return booking{}, err
+	}
+
+	b, err := r.ModifyTx(tx, id, checkIn, checkOut, rate, guests)
+	if err != nil {
+		tx.Rollback()
+		glog.Error(err)
+		return booking{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return booking{}, err
+	}
+
+	return b, nil
+}
+
+// Moves, extends or re-rates a booking, keeping its prior version. It is
+// quoted afresh, keeping any promo code it was booked with where the new stay
+// qualifies, and the change from the old quote is posted line by line,
+// debited from or credited to the guest - caller is responsible for
+// Commit/Rollback
+func (r *Register) ModifyTx(
+	tx *sql.Tx,
+	id bookingId,
+	checkIn date.Date,
+	checkOut date.Date,
+	rate rate,
+	guests int,
+) (booking, error) {
+	old, err := lookupBooking(tx, id)
+	if err != nil {
+		return booking{}, err
+	}
+
+	if !old.Status.Modifiable() {
+		return booking{}, transitionError{old.Status, old.Status}
+	}
+
+	// a booking may keep a plan that's since been withdrawn
+	keepsRate := rate.Id == old.Rate.Id && rate.Version == old.Rate.Version
+	if !rate.Active && !keepsRate {
+		return booking{}, rateInactive
+	}
+	if guests < 1 {
+		return booking{}, noGuests
+	}
+
+	err = r.checkStay(tx, checkIn, checkOut, id, "", "")
+	if err != nil {
+		return booking{}, err
+	}
+
+	oldQuote, err := r.Pricing.LookupTx(tx, id)
+	if err != nil {
+		return booking{}, err
+	}
+	promo, err := redeemedTx(tx, id)
+	if err != nil {
+		return booking{}, err
+	}
+	newQuote, _, err := r.Pricing.quoteTx(
+		tx,
+		checkIn,
+		checkOut,
+		rate,
+		guests,
+		promo,
+	)
+	if err != nil {
+		return booking{}, err
+	}
+
+	// keep the version being replaced
+	_, err = tx.Exec(`
+      insert into RegisterHistory
+      (BookingId, Checkin, Checkout, Guests, RateId, RateVersion, ReplacedAt,
+        Status, Version)
+      values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+    `,
+		old.Id,
+		old.Checkin,
+		old.Checkout,
+		old.Guests,
+		old.Rate.Id,
+		old.Rate.Version,
+		r.Clock.Now(),
+		old.Status,
+		old.Version,
+	)
+	if err != nil {
+		glog.Error(err)
+		return booking{}, err
+	}
+
+	modified := booking{
+		Checkin:  checkIn,
+		Checkout: checkOut,
+		Code:     old.Code,
+		GuestId:  old.GuestId,
+		Guests:   guests,
+		Id:       old.Id,
+		Rate:     rate,
+		Status:   old.Status,
+		Version:  old.Version + 1,
+	}
+	_, err = tx.Exec(`
+      update Register
+      set Checkin = $1, Checkout = $2, RateId = $3, RateVersion = $4,
+      Version = $5, Guests = $6
+      where Id = $7
+    `,
+		modified.Checkin,
+		modified.Checkout,
+		modified.Rate.Id,
+		modified.Rate.Version,
+		modified.Version,
+		modified.Guests,
+		modified.Id,
+	)
+	if err != nil {
+		glog.Error(err)
+		return booking{}, err
+	}
+
+	err = r.Pricing.SaveTx(tx, id, modified.Version, newQuote)
+	if err != nil {
+		return booking{}, err
+	}
+
+	// settle the difference, line by line
+	memo := memo(fmt.Sprintf(
+		"modified %s from %s - %s to %s - %s",
+		id,
+		old.Checkin,
+		old.Checkout,
+		checkIn,
+		checkOut,
+	))
+	err = r.Ledger.PostQuoteChangeTx(
+		tx,
+		old.GuestId,
+		id,
+		oldQuote,
+		newQuote,
+		memo,
+	)
+	if err != nil {
+		glog.Error(err)
+		return booking{}, err
+	}
+
+	glog.Infoln("modified", id, "to version", modified.Version)
+	return modified, nil
 }
 
-func (r *Register) List() ([]booking, error) {
+// Prior versions of a booking, oldest first
+func (r *Register) History(id bookingId) ([]booking, error) {
 	stmt, err := r.DB.Prepare(`
-    select Checkin, Checkout, GuestId, Id, Rate
-    from Register
-    order by CheckIn asc
+    select h.Checkin, h.Checkout, r.Code, r.GuestId, h.Guests, h.BookingId,
+    h.Status, h.Version, ` + rateColumns + `
+    from RegisterHistory h
+    join Register r on r.Id = h.BookingId
+    join RatePlan p on p.Id = h.RateId and p.Version = h.RateVersion
+    where h.BookingId = $1
+    order by h.Version asc
   `)
 	if err != nil {
 		panic(err)
 	}
 
-	rows, err := stmt.Query()
+	rows, err := stmt.Query(id)
 	if err != nil {
 		glog.Error(err)
 		return []booking{}, err
@@ -162,31 +736,12 @@ func (r *Register) List() ([]booking, error) {
 
 	var list []booking
 	for rows.Next() {
-		var checkin date.Date
-		var checkout date.Date
-		var guestId guestId
-		var id bookingId
-		var rate rate
-
-		err := rows.Scan(
-			&checkin,
-			&checkout,
-			&guestId,
-			&id,
-			&rate,
-		)
+		b, err := scanBooking(rows)
 		if err != nil {
 			glog.Error(err)
 			return []booking{}, err
 		}
-
-		list = append(list, booking{
-			Checkin:  checkin,
-			Checkout: checkout,
-			GuestId:  guestId,
-			Id:       id,
-			Rate:     rate,
-		})
+		list = append(list, b)
 	}
 
 	return list, nil
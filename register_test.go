@@ -2,6 +2,8 @@ package booking
 
 import (
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/cmdrkeene/booking/pkg/date"
@@ -13,7 +15,7 @@ func TestRegister(t *testing.T) {
 	defer db.Close()
 	var calendar Calendar
 	var register Register
-	err := inject.Populate(&calendar, db, &register)
+	err := inject.Populate(&FakeGateway{}, &calendar, db, &register)
 	if err != nil {
 		t.Error(err)
 	}
@@ -24,6 +26,7 @@ func TestRegister(t *testing.T) {
 		date.New(2015, 1, 2),
 		guestId(123),
 		withBunny,
+		1,
 	)
 	if err != checkInAfterOut {
 		t.Error("want", checkInAfterOut)
@@ -36,6 +39,7 @@ func TestRegister(t *testing.T) {
 		date.New(2015, 1, 2),
 		guestId(123),
 		withBunny,
+		1,
 	)
 	if err != stayTooShort {
 		t.Error("want", stayTooShort)
@@ -48,6 +52,7 @@ func TestRegister(t *testing.T) {
 		date.New(2015, 3, 20),
 		guestId(123),
 		withBunny,
+		1,
 	)
 	if err != unavailable {
 		t.Error("want", unavailable)
@@ -62,11 +67,25 @@ func TestRegister(t *testing.T) {
 		date.New(2015, 1, 5),
 	)
 
+	// book -> noGuests
+	_, err = register.Book(
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		guestId(123),
+		withBunny,
+		0,
+	)
+	if err != noGuests {
+		t.Error("want", noGuests)
+		t.Error("got ", err)
+	}
+
 	id, err := register.Book(
 		date.New(2015, 1, 2),
 		date.New(2015, 1, 5),
 		guestId(123),
 		withBunny,
+		1,
 	)
 	if err != nil {
 		t.Error(err)
@@ -77,13 +96,20 @@ func TestRegister(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
+	if len(list) != 1 || len(list[0].Code) != confirmationCodeLength {
+		t.Fatal("want one booking with a code, got", list)
+	}
 	want := []booking{
 		booking{
 			Checkin:  date.New(2015, 1, 2),
 			Checkout: date.New(2015, 1, 5),
+			Code:     list[0].Code,
 			GuestId:  guestId(123),
+			Guests:   1,
 			Id:       id,
 			Rate:     withBunny,
+			Status:   confirmed,
+			Version:  1,
 		},
 	}
 	if !reflect.DeepEqual(want, list) {
@@ -92,12 +118,12 @@ func TestRegister(t *testing.T) {
 	}
 
 	// cancel
-	err = register.Cancel(id)
+	err = register.Cancel(id, actor("guest"))
 	if err != nil {
 		t.Error(err)
 	}
 
-	list, err = register.List()
+	list, err = register.List(confirmed)
 	if err != nil {
 		t.Error(err)
 	}
@@ -105,4 +131,401 @@ func TestRegister(t *testing.T) {
 		t.Error("want 0")
 		t.Error("got ", l)
 	}
+
+	// cancelled bookings are kept
+	list, err = register.List(cancelled)
+	if err != nil {
+		t.Error(err)
+	}
+	if l := len(list); l != 1 {
+		t.Error("want 1")
+		t.Error("got ", l)
+	}
+}
+
+func TestRegisterOverbooking(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		calendar.Add(date.New(2015, 1, 1).Add(i))
+	}
+
+	id, err := register.Book(
+		date.New(2015, 1, 3),
+		date.New(2015, 1, 6),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		checkin  date.Date
+		checkout date.Date
+		err      error
+	}{
+		{date.New(2015, 1, 3), date.New(2015, 1, 6), ConflictError{id}},
+		{date.New(2015, 1, 1), date.New(2015, 1, 4), ConflictError{id}},
+		{date.New(2015, 1, 5), date.New(2015, 1, 8), ConflictError{id}},
+		{date.New(2015, 1, 4), date.New(2015, 1, 5), ConflictError{id}},
+		{date.New(2015, 1, 1), date.New(2015, 1, 9), ConflictError{id}},
+	}
+	for _, tt := range tests {
+		_, err := register.Book(tt.checkin, tt.checkout, guestId(2), withBunny, 1)
+		if err != tt.err {
+			t.Log(tt.checkin, tt.checkout)
+			t.Error("want", tt.err)
+			t.Error("got ", err)
+		}
+	}
+
+	// leaving the morning the next guest arrives is not a conflict
+	_, err = register.Book(
+		date.New(2015, 1, 6),
+		date.New(2015, 1, 8),
+		guestId(2),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRegisterConcurrentBook(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	start := date.New(2015, 1, 1)
+	for i := 0; i < 30; i++ {
+		calendar.Add(start.Add(i))
+	}
+
+	// every guest wants an overlapping slice of the same month
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			checkin := start.Add(i % 20)
+			checkout := checkin.Add(1 + i%7)
+			register.Book(checkin, checkout, guestId(i), withBunny, 1)
+		}(i)
+	}
+	wg.Wait()
+
+	list, err := register.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 {
+		t.Error("want at least one booking")
+	}
+	for i, a := range list {
+		for _, b := range list[i+1:] {
+			if a.Stay().Overlaps(b.Stay()) {
+				t.Error("overbooked", a, b)
+			}
+		}
+	}
+}
+
+func TestRegisterModify(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var ledger Ledger
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, db, &ledger, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		calendar.Add(date.New(2015, 1, 1).Add(i))
+	}
+
+	guest := guestId(1)
+	id, err := register.Book(
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		guest,
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := register.Book(
+		date.New(2015, 1, 7),
+		date.New(2015, 1, 9),
+		guestId(2),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// modify -> bookingNotFound
+	_, err = register.Modify(
+		bookingId(99),
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		withBunny,
+		1,
+	)
+	if err != bookingNotFound {
+		t.Error("want", bookingNotFound)
+		t.Error("got ", err)
+	}
+
+	// modify -> conflict with another booking
+	_, err = register.Modify(
+		id,
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 8),
+		withBunny,
+		1,
+	)
+	if err != (ConflictError{other}) {
+		t.Error("want", ConflictError{other})
+		t.Error("got ", err)
+	}
+
+	// modify -> unavailable
+	_, err = register.Modify(
+		id,
+		date.New(2014, 12, 31),
+		date.New(2015, 1, 5),
+		withBunny,
+		1,
+	)
+	if err != unavailable {
+		t.Error("want", unavailable)
+		t.Error("got ", err)
+	}
+
+	original, err := register.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var steps = []struct {
+		checkin  date.Date
+		checkout date.Date
+		rate     rate
+		balance  amount
+	}{
+		// shift over its own nights, same price
+		{date.New(2015, 1, 3), date.New(2015, 1, 6), withBunny, 0},
+		// extend by a night
+		{date.New(2015, 1, 3), date.New(2015, 1, 7), withBunny, 20000},
+		// change rate
+		{date.New(2015, 1, 3), date.New(2015, 1, 7), withoutBunny, 40000},
+		// shorten by two nights
+		{date.New(2015, 1, 4), date.New(2015, 1, 6), withoutBunny, -10000},
+	}
+	for i, step := range steps {
+		b, err := register.Modify(id, step.checkin, step.checkout, step.rate, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := booking{
+			Checkin:  step.checkin,
+			Checkout: step.checkout,
+			Code:     original.Code,
+			GuestId:  guest,
+			Guests:   1,
+			Id:       id,
+			Rate:     step.rate,
+			Status:   confirmed,
+			Version:  i + 2,
+		}
+		if !reflect.DeepEqual(want, b) {
+			t.Error("want", want)
+			t.Error("got ", b)
+		}
+
+		balance, err := ledger.Balance(guest)
+		if err != nil {
+			t.Error(err)
+		}
+		if balance != step.balance {
+			t.Error("want", step.balance)
+			t.Error("got ", balance)
+		}
+	}
+	testBooksBalance(t, db)
+
+	found, err := register.Lookup(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if found.Version != 5 {
+		t.Error("want version 5")
+		t.Error("got ", found.Version)
+	}
+
+	// history -> every prior version in order
+	history, err := register.History(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if l := len(history); l != 4 {
+		t.Fatal("want 4, got", l)
+	}
+	first := booking{
+		Checkin:  date.New(2015, 1, 2),
+		Checkout: date.New(2015, 1, 5),
+		Code:     original.Code,
+		GuestId:  guest,
+		Guests:   1,
+		Id:       id,
+		Rate:     withBunny,
+		Status:   confirmed,
+		Version:  1,
+	}
+	if !reflect.DeepEqual(first, history[0]) {
+		t.Error("want", first)
+		t.Error("got ", history[0])
+	}
+	for i, b := range history {
+		if b.Version != i+1 {
+			t.Error("want", i+1)
+			t.Error("got ", b.Version)
+		}
+	}
+}
+
+func TestRegisterLookupByCode(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	calendar.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+
+	id, err := register.Book(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 3),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := register.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := string(b.Code)
+	var tests = []string{
+		code,
+		strings.ToLower(code),
+		" " + code[:4] + "-" + code[4:] + " ",
+	}
+	for _, input := range tests {
+		found, err := register.LookupByCode(input)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if found.Id != id {
+			t.Error("want", id)
+			t.Error("got ", found.Id)
+		}
+	}
+
+	_, err = register.LookupByCode("NOPE2345")
+	if err != bookingNotFound {
+		t.Error("want", bookingNotFound)
+		t.Error("got ", err)
+	}
+}
+
+func TestConfirmationCode(t *testing.T) {
+	seen := make(map[confirmationCode]bool)
+	for i := 0; i < 1000; i++ {
+		code, err := newConfirmationCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != confirmationCodeLength {
+			t.Error("want length", confirmationCodeLength)
+			t.Error("got ", code)
+		}
+		if strings.ContainsAny(string(code), "01IOL") {
+			t.Error("ambiguous character in", code)
+		}
+		if seen[code] {
+			t.Error("repeated", code)
+		}
+		seen[code] = true
+	}
+}
+
+func TestBookingIdIsWide(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	// past where a uint8 would have wrapped
+	_, err := db.Exec(
+		`insert into sqlite_sequence (name, seq) values ('Register', 4294967296)`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calendar Calendar
+	var register Register
+	err = inject.Populate(&FakeGateway{}, &calendar, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	calendar.Add(date.New(2015, 1, 1))
+
+	id, err := register.Book(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 2),
+		guestId(1<<40),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != bookingId(4294967297) {
+		t.Error("want", bookingId(4294967297))
+		t.Error("got ", id)
+	}
+
+	b, err := register.Lookup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Id != id || b.GuestId != guestId(1<<40) {
+		t.Error("want", id, guestId(1<<40))
+		t.Error("got ", b.Id, b.GuestId)
+	}
 }
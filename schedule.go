@@ -0,0 +1,264 @@
+package booking
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// How a rate plan takes payment. With a deposit, DepositPercent of the total
+// is charged at booking and the balance BalanceDaysBefore days ahead of
+// checkin. The zero value takes everything at booking
+type paymentSchedule struct {
+	BalanceDaysBefore int
+	DepositPercent    int
+}
+
+var paidInFull = paymentSchedule{}
+
+var invalidSchedule = errors.New("deposit must be 1 to 99 percent, with the balance due 0 or more days before check in")
+
+func (s paymentSchedule) Valid() bool {
+	if s == paidInFull {
+		return true
+	}
+	return s.DepositPercent > 0 && s.DepositPercent < 100 &&
+		s.BalanceDaysBefore >= 0
+}
+
+// Splits a total into what's charged when booking at a moment and what's
+// left, due on a day. Bookings made once the balance would have been due are
+// paid in full. Deposits round down to the cent
+func (s paymentSchedule) Split(
+	total amount,
+	checkin date.Date,
+	at time.Time,
+) (deposit amount, balance amount, due date.Date) {
+	today, _ := date.Parse(at)
+	due = checkin.Add(-s.BalanceDaysBefore)
+	if s == paidInFull || !today.Before(due) || total <= 0 {
+		return total, 0, date.Date{}
+	}
+	deposit = total * amount(s.DepositPercent) / 100
+	return deposit, total - deposit, due
+}
+
+func (s paymentSchedule) String() string {
+	if s == paidInFull {
+		return "paid in full at booking"
+	}
+	return fmt.Sprintf(
+		"%d%% deposit, balance %d days before check in",
+		s.DepositPercent,
+		s.BalanceDaysBefore,
+	)
+}
+
+// Rate plans keep their schedule, and each booking on a deposit has the
+// balance to take, with the card to take it from
+var scheduleMigration = statements(
+	`ALTER TABLE RatePlan ADD COLUMN BalanceDaysBefore INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE RatePlan ADD COLUMN DepositPercent INTEGER NOT NULL DEFAULT 0`,
+	`CREATE TABLE ScheduledPayment (
+    Amount INTEGER NOT NULL,
+    Attempts INTEGER NOT NULL DEFAULT 0,
+    BookingId INTEGER UNIQUE NOT NULL REFERENCES Register(Id),
+    Card TEXT NOT NULL,
+    DueOn DATETIME NOT NULL,
+    Error TEXT NOT NULL DEFAULT '',
+    NextAttemptAt DATETIME NOT NULL,
+    PaymentId INTEGER NOT NULL DEFAULT 0,
+    Status TEXT NOT NULL DEFAULT 'scheduled',
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )`,
+	`CREATE INDEX ScheduledPaymentDue ON ScheduledPayment (Status, NextAttemptAt)`,
+)
+
+// A balance to charge to a booking's card. Amount is what was planned, but
+// what's charged is whatever's left of the quote by then. PaymentId is set
+// once paid
+const ScheduledPaymentSchema = `
+  CREATE TABLE ScheduledPayment (
+    Amount INTEGER NOT NULL,
+    Attempts INTEGER NOT NULL DEFAULT 0,
+    BookingId INTEGER UNIQUE NOT NULL REFERENCES Register(Id),
+    Card TEXT NOT NULL,
+    DueOn DATETIME NOT NULL,
+    Error TEXT NOT NULL DEFAULT '',
+    NextAttemptAt DATETIME NOT NULL,
+    PaymentId INTEGER NOT NULL DEFAULT 0,
+    Status TEXT NOT NULL DEFAULT 'scheduled',
+    CONSTRAINT ck_Amount_Positive CHECK (Amount > 0)
+  )
+`
+
+const ScheduledPaymentIndexSchema = `
+  CREATE INDEX ScheduledPaymentDue ON ScheduledPayment (Status, NextAttemptAt)
+`
+
+// Where a scheduled payment is
+type scheduleStatus string
+
+const (
+	// Waiting to fall due, or for another attempt
+	scheduled = scheduleStatus("scheduled")
+
+	// Charged, or nothing was left to charge
+	collected = scheduleStatus("collected")
+
+	// Gave up, and cancelled the booking. Or the card was lost, and the
+	// booking's left for someone to follow up
+	uncollectable = scheduleStatus("uncollectable")
+
+	// The booking was cancelled some other way first
+	abandoned = scheduleStatus("abandoned")
+)
+
+// A row in ScheduledPayment
+type scheduledPayment struct {
+	Amount        amount
+	Attempts      int
+	BookingId     bookingId
+	Card          cardToken
+	DueOn         date.Date
+	Error         string
+	NextAttemptAt time.Time
+	PaymentId     int64
+	Status        scheduleStatus
+}
+
+func (s *scheduleStatus) Scan(src interface{}) error {
+	raw, ok := src.([]byte)
+	if !ok {
+		err := errors.New(
+			fmt.Sprintf("can't scan scheduleStatus from db: %#v", src),
+		)
+		glog.Error(err)
+		return err
+	}
+	*s = scheduleStatus(raw)
+	return nil
+}
+
+func (s scheduleStatus) Value() (driver.Value, error) {
+	return driver.Value(string(s)), nil
+}
+
+var notScheduled = errors.New("booking has no scheduled payment")
+
+// Plans to charge the balance of a booking to a card on a day, first trying
+// at the start of it - caller is responsible for Commit/Rollback
+func (l *Ledger) ScheduleTx(
+	tx *sql.Tx,
+	id bookingId,
+	a amount,
+	card cardToken,
+	due date.Date,
+) error {
+	if a <= 0 {
+		return invalidAmount
+	}
+
+	_, err := tx.Exec(`
+    insert into ScheduledPayment
+    (Amount, BookingId, Card, DueOn, NextAttemptAt)
+    values ($1, $2, $3, $4, $5)
+  `, a, id, card, due, due.Time())
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	glog.Infoln("scheduled", id, l.Money(a), "on", due)
+	return nil
+}
+
+// The balance planned for a booking
+func (l *Ledger) Scheduled(id bookingId) (scheduledPayment, error) {
+	tx, err := l.DB.Begin()
+	if err != nil {
+		return scheduledPayment{}, err
+	}
+	defer tx.Rollback()
+
+	return lookupScheduledTx(tx, id)
+}
+
+const scheduledPaymentSelect = `
+    select Amount, Attempts, BookingId, Card, DueOn, Error, NextAttemptAt,
+    PaymentId, Status
+    from ScheduledPayment
+  `
+
+func scanScheduledPayment(row scanner) (scheduledPayment, error) {
+	var s scheduledPayment
+	err := row.Scan(
+		&s.Amount,
+		&s.Attempts,
+		&s.BookingId,
+		&s.Card,
+		&s.DueOn,
+		&s.Error,
+		&s.NextAttemptAt,
+		&s.PaymentId,
+		&s.Status,
+	)
+	s.NextAttemptAt = s.NextAttemptAt.UTC()
+	return s, err
+}
+
+func lookupScheduledTx(tx *sql.Tx, id bookingId) (scheduledPayment, error) {
+	s, err := scanScheduledPayment(tx.QueryRow(
+		scheduledPaymentSelect+`where BookingId = $1`,
+		id,
+	))
+	if err == sql.ErrNoRows {
+		return scheduledPayment{}, notScheduled
+	}
+	if err != nil {
+		glog.Error(err)
+		return scheduledPayment{}, err
+	}
+	return s, nil
+}
+
+// Moves a booking's scheduled payment along if it's where it's expected to be,
+// e.g. from scheduled to abandoned - caller is responsible for Commit/Rollback
+func moveScheduledTx(
+	tx *sql.Tx,
+	id bookingId,
+	from scheduleStatus,
+	to scheduleStatus,
+) error {
+	_, err := tx.Exec(
+		`update ScheduledPayment set Status = $1 where BookingId = $2 and Status = $3`,
+		to,
+		id,
+		from,
+	)
+	if err != nil {
+		glog.Error(err)
+	}
+	return err
+}
+
+// Sum of what's been captured for a booking's stay, refunds aside. A damage
+// deposit claimed isn't paid towards the stay
+func capturedTx(tx *sql.Tx, id bookingId) (amount, error) {
+	var captured amount
+	err := tx.QueryRow(`
+    select coalesce(sum(Amount), 0) from Payment
+    where BookingId = $1
+    and Id not in (select PaymentId from DamageDeposit where BookingId = $1)
+  `, id).Scan(&captured)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	return captured, nil
+}
@@ -0,0 +1,64 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+)
+
+func TestPaymentScheduleSplit(t *testing.T) {
+	deposit30 := paymentSchedule{BalanceDaysBefore: 30, DepositPercent: 30}
+	checkin := date.New(2015, 3, 1)
+	early := time.Date(2015, 1, 1, 9, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		schedule paymentSchedule
+		total    amount
+		at       time.Time
+		deposit  amount
+		balance  amount
+		due      date.Date
+	}{
+		// paid in full -> all now
+		{paidInFull, amount(40000), early, amount(40000), 0, date.Date{}},
+		// well ahead -> deposit now, balance 30 days before
+		{deposit30, amount(40000), early, amount(12000), amount(28000), date.New(2015, 1, 30)},
+		// deposits round down
+		{deposit30, amount(33333), early, amount(9999), amount(23334), date.New(2015, 1, 30)},
+		// the day before the balance is due -> still a deposit
+		{deposit30, amount(40000), time.Date(2015, 1, 29, 23, 0, 0, 0, time.UTC), amount(12000), amount(28000), date.New(2015, 1, 30)},
+		// on or after -> all now
+		{deposit30, amount(40000), time.Date(2015, 1, 30, 0, 0, 0, 0, time.UTC), amount(40000), 0, date.Date{}},
+		{deposit30, amount(40000), time.Date(2015, 2, 20, 0, 0, 0, 0, time.UTC), amount(40000), 0, date.Date{}},
+		// nothing to pay
+		{deposit30, amount(0), early, 0, 0, date.Date{}},
+	}
+	for i, test := range tests {
+		deposit, balance, due := test.schedule.Split(test.total, checkin, test.at)
+		if deposit != test.deposit || balance != test.balance || due != test.due {
+			t.Error(i, "want", test.deposit, test.balance, test.due)
+			t.Error(i, "got ", deposit, balance, due)
+		}
+	}
+}
+
+func TestPaymentScheduleValid(t *testing.T) {
+	var tests = []struct {
+		schedule paymentSchedule
+		valid    bool
+	}{
+		{paidInFull, true},
+		{paymentSchedule{BalanceDaysBefore: 30, DepositPercent: 30}, true},
+		{paymentSchedule{BalanceDaysBefore: 0, DepositPercent: 50}, true},
+		{paymentSchedule{BalanceDaysBefore: 30, DepositPercent: 0}, false},
+		{paymentSchedule{BalanceDaysBefore: 30, DepositPercent: 100}, false},
+		{paymentSchedule{BalanceDaysBefore: -1, DepositPercent: 30}, false},
+	}
+	for _, test := range tests {
+		if got := test.schedule.Valid(); got != test.valid {
+			t.Error(test.schedule, "want", test.valid)
+			t.Error(test.schedule, "got ", got)
+		}
+	}
+}
@@ -1,6 +1,11 @@
 package booking
 
-import "database/sql"
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/golang/glog"
+)
 
 // Schema is the aggregate of all table create statements, constraints, etc.
 // Per-object constants, e.g. CalendarSchema live in their respective files
@@ -8,17 +13,192 @@ type Schema struct {
 	DB *sql.DB `inject:""`
 }
 
+// One step in upgrading a database, run inside its own transaction
+type migration func(tx *sql.Tx) error
+
+// A migration that runs each query in order
+func statements(queries ...string) migration {
+	return func(tx *sql.Tx) error {
+		for _, query := range queries {
+			_, err := tx.Exec(query)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Logs the ids of rows a migration couldn't link to their booking, for
+// someone to place by hand
+func logUnlinked(tx *sql.Tx, what string, query string) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		err := rows.Scan(&id)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > 0 {
+		glog.Warningln(len(ids), what, "name a booking that doesn't exist:", ids)
+	}
+	return rows.Err()
+}
+
+// Migrations upgrade a database created by an earlier Schema. Append only -
+// a database at version n has run migrations[:n]. Like the create statements
+// each migration lives next to the object it changes
+var migrations = []migration{
+	registerNightsMigration,
+	registerHistoryMigration,
+	ledgerMigration,
+	registerStatusMigration,
+	registerCancellationMigration,
+	holdMigration,
+	idempotencyMigration,
+	registerCodeMigration,
+	registerIndexMigration,
+	quoteMigration,
+	seasonMigration,
+	ratePlanMigration,
+	discountRuleMigration,
+	registerGuestsMigration,
+	quoteIncludedMigration,
+	feeRuleMigration,
+	promoMigration,
+	journalMigration,
+	paymentMigration,
+	refundMigration,
+	scheduleMigration,
+	damageDepositMigration,
+	currencyMigration,
+	invoiceMigration,
+	policyTiersMigration,
+	idempotencyFingerprintMigration,
+	journalBookingMigration,
+	paymentCardMigration,
+	holdHolderMigration,
+}
+
+// Creates every table in an empty database at the latest version
 func (s *Schema) Load() error {
 	queries := []string{
 		CalendarSchema,
+		DamageDepositSchema,
+		DiscountRuleSchema,
+		FeeRuleSchema,
 		GuestbookSchema,
+		HoldSchema,
+		IdempotencySchema,
+		InvoiceSchema,
+		InvoiceLineSchema,
+		InvoiceTriggerSchema,
+		JournalEntrySchema,
+		JournalLineSchema,
+		PaymentSchema,
+		PaymentRefundSchema,
+		PromoSchema,
+		PromoRedemptionSchema,
+		QuoteSchema,
+		RatePlanSchema,
 		RegisterSchema,
+		RegisterIndexSchema,
+		RegisterCancellationSchema,
+		RegisterHistorySchema,
+		RegisterStatusLogSchema,
+		ScheduledPaymentSchema,
+		ScheduledPaymentIndexSchema,
+		SeasonSchema,
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+
 	for _, query := range queries {
-		_, err := s.DB.Exec(query)
+		_, err := tx.Exec(query)
 		if err != nil {
 			return err
 		}
 	}
+
+	err = setSchemaVersion(tx, len(migrations))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Loads an empty database, or migrates one created by an earlier Schema
+func (s *Schema) Setup() error {
+	var tables int
+	err := s.DB.QueryRow(
+		`select count(*) from sqlite_master where type = 'table'`,
+	).Scan(&tables)
+	if err != nil {
+		return err
+	}
+
+	if tables == 0 {
+		return s.Load()
+	}
+	return s.Migrate()
+}
+
+// Runs any migrations an existing database hasn't seen, each in its own
+// transaction so a failure leaves it at the last good version
+func (s *Schema) Migrate() error {
+	var version int
+	err := s.DB.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(migrations); version++ {
+		err := s.migrate(version + 1)
+		if err != nil {
+			glog.Error(err)
+			return err
+		}
+		glog.Infoln("migrated schema to version", version+1)
+	}
+
 	return nil
 }
+
+func (s *Schema) migrate(version int) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = migrations[version-1](tx)
+	if err != nil {
+		return err
+	}
+
+	err = setSchemaVersion(tx, version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PRAGMA doesn't take bind parameters
+func setSchemaVersion(tx *sql.Tx, version int) error {
+	_, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version))
+	return err
+}
@@ -0,0 +1,204 @@
+package booking
+
+import (
+	"database/sql"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+// Tables as first deployed, before any migrations
+var schemaVersion0 = []string{
+	`CREATE TABLE Calendar (
+    Date DATETIME UNIQUE NOT NULL
+  )`,
+	`CREATE TABLE Guestbook (
+    Email TEXT UNIQUE NOT NULL,
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Name TEXT NOT NULL,
+    PhoneNumber TEXT NOT NULL
+  )`,
+	`CREATE TABLE Register (
+    Checkin DATETIME UNIQUE NOT NULL REFERENCES Calendar,
+    Checkout DATETIME UNIQUE NOT NULL REFERENCES Calendar,
+    GuestId INTEGER NOT NULL REFERENCES Guestbook(Id),
+    Id INTEGER PRIMARY KEY AUTOINCREMENT NOT NULL,
+    Rate TEXT NOT NULL,
+    CONSTRAINT ck_Ckin_Less_Than_Ckout CHECK (Checkin <= Checkout)
+  )`,
+}
+
+func testDBVersion0() *sql.DB {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		panic(err)
+	}
+	db.SetMaxOpenConns(1)
+
+	for _, query := range schemaVersion0 {
+		_, err := db.Exec(query)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return db
+}
+
+// Table name -> sorted column names
+func schemaColumns(db *sql.DB) map[string][]string {
+	rows, err := db.Query(`
+    select name from sqlite_master
+    where type = 'table' and name != 'sqlite_sequence'
+  `)
+	if err != nil {
+		panic(err)
+	}
+	var tables []string
+	for rows.Next() {
+		var table string
+		rows.Scan(&table)
+		tables = append(tables, table)
+	}
+	rows.Close()
+
+	columns := make(map[string][]string)
+	for _, table := range tables {
+		rows, err := db.Query(`PRAGMA table_info(` + table + `)`)
+		if err != nil {
+			panic(err)
+		}
+		for rows.Next() {
+			var cid int
+			var name string
+			var kind string
+			var notNull bool
+			var dflt interface{}
+			var pk int
+			rows.Scan(&cid, &name, &kind, &notNull, &dflt, &pk)
+			columns[table] = append(columns[table], name)
+		}
+		rows.Close()
+		sort.Strings(columns[table])
+	}
+	return columns
+}
+
+func TestSchemaMigrate(t *testing.T) {
+	db := testDBVersion0()
+	defer db.Close()
+
+	// a booking made before migrating
+	_, err := db.Exec(
+		`insert into Register (Checkin, Checkout, GuestId, Rate)
+     values ($1, $2, $3, $4)`,
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 4),
+		guestId(1),
+		withBunny.Name,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calendar Calendar
+	var pricing Pricing
+	var register Register
+	var schema Schema
+	err = inject.Populate(&FakeGateway{}, db, &calendar, &pricing, &register, &schema)
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = schema.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// migrating again is a no-op
+	err = schema.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same tables and columns as a fresh database
+	fresh := testDB()
+	defer fresh.Close()
+	if want, got := schemaColumns(fresh), schemaColumns(db); !reflect.DeepEqual(want, got) {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+
+	// existing booking survived
+	list, err := register.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(list); l != 1 {
+		t.Fatal("want 1, got", l)
+	}
+	if len(list[0].Code) != confirmationCodeLength {
+		t.Error("want a confirmation code")
+		t.Error("got ", list[0].Code)
+	}
+	if !reflect.DeepEqual(list[0].Rate, withBunny) {
+		t.Error("want", withBunny)
+		t.Error("got ", list[0].Rate)
+	}
+	if list[0].Checkout != date.New(2015, 1, 4) {
+		t.Error("want", date.New(2015, 1, 4))
+		t.Error("got ", list[0].Checkout)
+	}
+
+	// existing booking was quoted at its rate
+	q, err := pricing.Lookup(list[0].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := q.Total(); total != amount(40000) {
+		t.Error("want", amount(40000))
+		t.Error("got ", total)
+	}
+
+	// same day turnover on the old booking's checkout
+	calendar.Add(date.New(2015, 1, 4), date.New(2015, 1, 5))
+	_, err = register.Book(
+		date.New(2015, 1, 4),
+		date.New(2015, 1, 6),
+		guestId(2),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchemaSetup(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	schema := Schema{DB: db}
+
+	// empty -> loaded, then already current
+	for i := 0; i < 2; i++ {
+		err = schema.Setup()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var version int
+	db.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if version != len(migrations) {
+		t.Error("want", len(migrations))
+		t.Error("got ", version)
+	}
+}
@@ -0,0 +1,264 @@
+package booking
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// Lets Search filter and page through the Register without a table scan
+const RegisterIndexSchema = `
+  CREATE INDEX RegisterCheckin ON Register (Checkin, Id);
+  CREATE INDEX RegisterCheckout ON Register (Checkout, Id);
+  CREATE INDEX RegisterGuest ON Register (GuestId, Checkin);
+  CREATE INDEX RegisterStatus ON Register (Status, Checkin)
+`
+
+var registerIndexMigration = statements(
+	`CREATE INDEX RegisterCheckin ON Register (Checkin, Id)`,
+	`CREATE INDEX RegisterCheckout ON Register (Checkout, Id)`,
+	`CREATE INDEX RegisterGuest ON Register (GuestId, Checkin)`,
+	`CREATE INDEX RegisterStatus ON Register (Status, Checkin)`,
+)
+
+// Which bookings Search returns. Zero fields don't filter
+type searchFilter struct {
+	Guest    guestId
+	Rate     rateId
+	Statuses []status
+
+	// Bookings with a night in [From, To)
+	From date.Date
+	To   date.Date
+
+	// Bookings arriving or leaving on a day
+	ArrivingOn  date.Date
+	DepartingOn date.Date
+}
+
+// Order of Search results. Ties are broken by Id
+type searchOrder string
+
+const (
+	byCheckin      = searchOrder("checkin")
+	byCheckinDesc  = searchOrder("-checkin")
+	byCheckout     = searchOrder("checkout")
+	byCheckoutDesc = searchOrder("-checkout")
+	byId           = searchOrder("id")
+	byIdDesc       = searchOrder("-id")
+)
+
+func (o searchOrder) column() string {
+	return strings.TrimPrefix(string(o), "-")
+}
+
+func (o searchOrder) desc() bool {
+	return strings.HasPrefix(string(o), "-")
+}
+
+// One page of bookings, the total matching the filter, and the cursor for
+// the next page, empty on the last
+type searchResult struct {
+	Bookings []booking
+	Next     string
+	Total    int
+}
+
+const defaultSearchLimit = 50
+
+var (
+	invalidCursor = errors.New("invalid cursor")
+	invalidOrder  = errors.New("invalid sort order")
+)
+
+// A page of bookings matching filter. Pass "" as the cursor for the first
+// page, then each result's Next. Limit defaults to 50
+func (r *Register) Search(
+	filter searchFilter,
+	order searchOrder,
+	cursor string,
+	limit int,
+) (searchResult, error) {
+	if order == "" {
+		order = byCheckin
+	}
+	var column string
+	switch order.column() {
+	case "checkin":
+		column = "r.Checkin"
+	case "checkout":
+		column = "r.Checkout"
+	case "id":
+		column = "r.Id"
+	default:
+		return searchResult{}, invalidOrder
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+
+	// filter
+	var where []string
+	var args []interface{}
+	var arg = func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if filter.Guest != 0 {
+		where = append(where, "r.GuestId = "+arg(filter.Guest))
+	}
+	if filter.Rate != 0 {
+		where = append(where, "r.RateId = "+arg(filter.Rate))
+	}
+	if len(filter.Statuses) > 0 {
+		var in []string
+		for _, s := range filter.Statuses {
+			in = append(in, arg(s))
+		}
+		where = append(where, "r.Status in ("+strings.Join(in, ", ")+")")
+	}
+	if filter.From != (date.Date{}) {
+		where = append(where, "r.Checkout > "+arg(filter.From))
+	}
+	if filter.To != (date.Date{}) {
+		where = append(where, "r.Checkin < "+arg(filter.To))
+	}
+	if filter.ArrivingOn != (date.Date{}) {
+		where = append(where, "r.Checkin = "+arg(filter.ArrivingOn))
+	}
+	if filter.DepartingOn != (date.Date{}) {
+		where = append(where, "r.Checkout = "+arg(filter.DepartingOn))
+	}
+
+	// total ignores the cursor
+	var total int
+	err := r.DB.QueryRow(
+		`select count(*) from Register r`+whereClause(where),
+		args...,
+	).Scan(&total)
+	if err != nil {
+		glog.Error(err)
+		return searchResult{}, err
+	}
+
+	// resume after the last row of the previous page
+	if cursor != "" {
+		after, afterId, err := decodeCursor(cursor, order)
+		if err != nil {
+			return searchResult{}, err
+		}
+		op := ">"
+		if order.desc() {
+			op = "<"
+		}
+		if column == "r.Id" {
+			where = append(where, "r.Id "+op+" "+arg(afterId))
+		} else {
+			where = append(where, fmt.Sprintf(
+				"(%s %s %s or (%s = %s and r.Id %s %s))",
+				column, op, arg(after),
+				column, arg(after), op, arg(afterId),
+			))
+		}
+	}
+
+	direction := "asc"
+	if order.desc() {
+		direction = "desc"
+	}
+	query := bookingSelect + whereClause(where)
+	if column == "r.Id" {
+		query += fmt.Sprintf(" order by r.Id %s", direction)
+	} else {
+		query += fmt.Sprintf(
+			" order by %s %s, r.Id %s",
+			column,
+			direction,
+			direction,
+		)
+	}
+	// one extra tells us if there's another page
+	query += " limit " + arg(limit+1)
+
+	rows, err := r.DB.Query(query, args...)
+	if err != nil {
+		glog.Error(err)
+		return searchResult{}, err
+	}
+	defer rows.Close()
+
+	var list []booking
+	for rows.Next() {
+		b, err := scanBooking(rows)
+		if err != nil {
+			glog.Error(err)
+			return searchResult{}, err
+		}
+		list = append(list, b)
+	}
+	err = rows.Err()
+	if err != nil {
+		glog.Error(err)
+		return searchResult{}, err
+	}
+
+	result := searchResult{Bookings: list, Total: total}
+	if len(list) > limit {
+		result.Bookings = list[:limit]
+		result.Next = encodeCursor(order, list[limit-1])
+	}
+	return result, nil
+}
+
+func whereClause(where []string) string {
+	if len(where) == 0 {
+		return ""
+	}
+	return " where " + strings.Join(where, " and ")
+}
+
+// Cursors name the order they were made for, the last row's sort value and
+// its Id
+func encodeCursor(order searchOrder, last booking) string {
+	var value string
+	switch order.column() {
+	case "checkin":
+		value = last.Checkin.String()
+	case "checkout":
+		value = last.Checkout.String()
+	}
+	s := fmt.Sprintf("%s|%s|%d", order, value, last.Id)
+	return base64.URLEncoding.EncodeToString([]byte(s))
+}
+
+func decodeCursor(cursor string, order searchOrder) (date.Date, bookingId, error) {
+	b, err := base64.URLEncoding.DecodeString(cursor)
+	if err != nil {
+		return date.Date{}, 0, invalidCursor
+	}
+
+	parts := strings.Split(string(b), "|")
+	if len(parts) != 3 || searchOrder(parts[0]) != order {
+		return date.Date{}, 0, invalidCursor
+	}
+
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return date.Date{}, 0, invalidCursor
+	}
+
+	if order.column() == "id" {
+		return date.Date{}, bookingId(id), nil
+	}
+
+	d, err := date.Parse(parts[1])
+	if err != nil {
+		return date.Date{}, 0, invalidCursor
+	}
+	return d, bookingId(id), nil
+}
@@ -0,0 +1,162 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestRegisterSearch(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	start := date.New(2015, 1, 1)
+	for i := 0; i < 40; i++ {
+		calendar.Add(start.Add(i))
+	}
+
+	// ids 1-6, two bookings arriving on Jan 10 after a cancellation
+	var bookings = []struct {
+		checkin int
+		nights  int
+		guest   guestId
+		rate    rate
+		cancel  bool
+	}{
+		{0, 3, guestId(1), withBunny, false},
+		{3, 2, guestId(2), withoutBunny, false},
+		{9, 4, guestId(1), withBunny, true},
+		{9, 2, guestId(3), withBunny, false},
+		{11, 5, guestId(2), withoutBunny, false},
+		{20, 1, guestId(1), withoutBunny, false},
+	}
+	var ids []bookingId
+	for _, b := range bookings {
+		id, err := register.Book(
+			start.Add(b.checkin),
+			start.Add(b.checkin+b.nights),
+			b.guest,
+			b.rate,
+			1,
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b.cancel {
+			register.Cancel(id, actor("guest"))
+		}
+		ids = append(ids, id)
+	}
+
+	var filterTests = []struct {
+		filter searchFilter
+		ids    []bookingId
+	}{
+		{searchFilter{}, []bookingId{ids[0], ids[1], ids[2], ids[3], ids[4], ids[5]}},
+		{searchFilter{Guest: guestId(1)}, []bookingId{ids[0], ids[2], ids[5]}},
+		{searchFilter{Rate: withoutBunny.Id}, []bookingId{ids[1], ids[4], ids[5]}},
+		{searchFilter{Statuses: []status{cancelled}}, []bookingId{ids[2]}},
+		{
+			searchFilter{Statuses: []status{confirmed}, Guest: guestId(1)},
+			[]bookingId{ids[0], ids[5]},
+		},
+		// nights Jan 3 - Jan 4 only
+		{searchFilter{From: start.Add(2), To: start.Add(4)}, []bookingId{ids[0], ids[1]}},
+		// everything from Jan 12 on
+		{searchFilter{From: start.Add(11)}, []bookingId{ids[2], ids[4], ids[5]}},
+		{searchFilter{ArrivingOn: start.Add(9)}, []bookingId{ids[2], ids[3]}},
+		{searchFilter{DepartingOn: start.Add(3)}, []bookingId{ids[0]}},
+		{searchFilter{Guest: guestId(99)}, nil},
+	}
+	for _, tt := range filterTests {
+		result, err := register.Search(tt.filter, byCheckin, "", 0)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		var got []bookingId
+		for _, b := range result.Bookings {
+			got = append(got, b.Id)
+		}
+		if !reflect.DeepEqual(tt.ids, got) {
+			t.Log(tt.filter)
+			t.Error("want", tt.ids)
+			t.Error("got ", got)
+		}
+		if result.Total != len(tt.ids) {
+			t.Error("want total", len(tt.ids))
+			t.Error("got ", result.Total)
+		}
+		if result.Next != "" {
+			t.Error("want last page")
+		}
+	}
+
+	// every order, two at a time
+	var orderTests = []struct {
+		order searchOrder
+		ids   []bookingId
+	}{
+		{byCheckin, []bookingId{ids[0], ids[1], ids[2], ids[3], ids[4], ids[5]}},
+		{byCheckinDesc, []bookingId{ids[5], ids[4], ids[3], ids[2], ids[1], ids[0]}},
+		{byCheckout, []bookingId{ids[0], ids[1], ids[3], ids[2], ids[4], ids[5]}},
+		{byCheckoutDesc, []bookingId{ids[5], ids[4], ids[2], ids[3], ids[1], ids[0]}},
+		{byId, []bookingId{ids[0], ids[1], ids[2], ids[3], ids[4], ids[5]}},
+		{byIdDesc, []bookingId{ids[5], ids[4], ids[3], ids[2], ids[1], ids[0]}},
+	}
+	for _, tt := range orderTests {
+		var got []bookingId
+		cursor := ""
+		for pages := 0; pages < 10; pages++ {
+			result, err := register.Search(searchFilter{}, tt.order, cursor, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Total != 6 {
+				t.Error("want total 6")
+				t.Error("got ", result.Total)
+			}
+			for _, b := range result.Bookings {
+				got = append(got, b.Id)
+			}
+			cursor = result.Next
+			if cursor == "" {
+				break
+			}
+		}
+		if !reflect.DeepEqual(tt.ids, got) {
+			t.Log(tt.order)
+			t.Error("want", tt.ids)
+			t.Error("got ", got)
+		}
+	}
+
+	// a cursor only works with the order it came from
+	result, err := register.Search(searchFilter{}, byCheckin, "", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = register.Search(searchFilter{}, byCheckout, result.Next, 2)
+	if err != invalidCursor {
+		t.Error("want", invalidCursor)
+		t.Error("got ", err)
+	}
+	_, err = register.Search(searchFilter{}, byCheckin, "garbage!", 2)
+	if err != invalidCursor {
+		t.Error("want", invalidCursor)
+		t.Error("got ", err)
+	}
+	_, err = register.Search(searchFilter{}, searchOrder("rate"), "", 2)
+	if err != invalidOrder {
+		t.Error("want", invalidOrder)
+		t.Error("got ", err)
+	}
+}
@@ -0,0 +1,259 @@
+package booking
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/golang/glog"
+)
+
+// What a movement on a guest's account was, from what it was posted against
+type movementKind string
+
+const (
+	// For a stay, its taxes or damage
+	chargeMovement = movementKind("charge")
+
+	// Taken by card
+	paymentMovement = movementKind("payment")
+
+	// Given back to a card
+	refundMovement = movementKind("refund")
+
+	// Anything else, e.g. a credit for a shorter stay or a cancellation
+	adjustmentMovement = movementKind("adjustment")
+)
+
+// One line posted to a guest's receivable, and what they owed after it
+type movement struct {
+	Amount   amount
+	Balance  amount
+	EntryId  int64
+	Kind     movementKind
+	Memo     memo
+	PostedAt time.Time
+}
+
+// A guest's account over a range of days: what they owed at the start, what
+// moved and what they owed at the end
+type statement struct {
+	Closing   amount
+	Currency  currency
+	From      date.Date
+	Guest     guest
+	Movements []movement
+	Opening   amount
+	To        date.Date
+}
+
+var invalidStatementRange = errors.New("statement must end on or after it starts")
+
+// A guest's statement for the days from and to, both included
+func (l *Ledger) Statement(
+	id guestId,
+	from date.Date,
+	to date.Date,
+) (statement, error) {
+	if to.Before(from) {
+		return statement{}, invalidStatementRange
+	}
+	g, err := l.Guestbook.Lookup(id)
+	if err != nil {
+		return statement{}, err
+	}
+
+	s := statement{
+		Currency: l.Property.Currency(),
+		From:     from,
+		Guest:    g,
+		To:       to,
+	}
+	s.Opening, err = l.BalanceOn(id, from.Add(-1))
+	if err != nil {
+		return statement{}, err
+	}
+	s.Movements, err = l.movements(id, from, to, s.Opening)
+	if err != nil {
+		return statement{}, err
+	}
+	s.Closing, err = l.BalanceOn(id, to)
+	if err != nil {
+		return statement{}, err
+	}
+	return s, nil
+}
+
+// A guest's receivable lines posted from the start of one day to the end of
+// another, with the balance after each from opening
+func (l *Ledger) movements(
+	id guestId,
+	from date.Date,
+	to date.Date,
+	opening amount,
+) ([]movement, error) {
+	rows, err := l.DB.Query(`
+    select
+      l.Amount,
+      e.Id,
+      e.Memo,
+      e.PostedAt,
+      exists (
+        select 1 from JournalLine o
+        where o.EntryId = e.Id and o.Account = $1
+      ),
+      exists (
+        select 1 from JournalLine o
+        where o.EntryId = e.Id and o.Account in ($2, $3, $4)
+      )
+    from JournalLine l
+    join JournalEntry e on e.Id = l.EntryId
+    where l.Account = $5 and l.GuestId = $6
+      and e.PostedAt >= $7 and e.PostedAt < $8
+    order by e.PostedAt asc, e.Id asc
+  `,
+		clearing,
+		revenue,
+		taxesPayable,
+		damages,
+		receivable,
+		id,
+		from,
+		to.Add(1),
+	)
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []movement
+	balance := opening
+	for rows.Next() {
+		var m movement
+		var card, charged bool
+		err := rows.Scan(&m.Amount, &m.EntryId, &m.Memo, &m.PostedAt, &card, &charged)
+		if err != nil {
+			glog.Error(err)
+			return nil, err
+		}
+		m.PostedAt = m.PostedAt.UTC()
+
+		switch {
+		case card && m.Amount < 0:
+			m.Kind = paymentMovement
+		case card:
+			m.Kind = refundMovement
+		case charged && m.Amount > 0:
+			m.Kind = chargeMovement
+		default:
+			m.Kind = adjustmentMovement
+		}
+		balance += m.Amount
+		m.Balance = balance
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// One of the statement's amounts in its currency
+func (s statement) Money(a amount) money {
+	return money{Amount: a, Currency: s.Currency}
+}
+
+const statementTimeFormat = "2006-01-02 15:04:05"
+
+// As a spreadsheet: the opening balance, each movement and the closing
+// balance, one to a row. Amounts are plain decimals in the statement's
+// currency
+func (s statement) WriteCSV(w io.Writer) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"Date", "Entry", "Kind", "Memo", "Amount", "Balance"})
+	out.Write([]string{
+		s.From.Format(date.ISO8601),
+		"",
+		"opening",
+		"Opening balance",
+		"",
+		s.Money(s.Opening).Decimal(),
+	})
+	for _, m := range s.Movements {
+		out.Write([]string{
+			m.PostedAt.Format(statementTimeFormat),
+			fmt.Sprint(m.EntryId),
+			string(m.Kind),
+			string(m.Memo),
+			s.Money(m.Amount).Decimal(),
+			s.Money(m.Balance).Decimal(),
+		})
+	}
+	out.Write([]string{
+		s.To.Format(date.ISO8601),
+		"",
+		"closing",
+		"Closing balance",
+		"",
+		s.Money(s.Closing).Decimal(),
+	})
+	out.Flush()
+	return out.Error()
+}
+
+type statementGuestJSON struct {
+	Email string `json:"email"`
+	Id    int64  `json:"id"`
+	Name  string `json:"name"`
+}
+
+type movementJSON struct {
+	Amount   string `json:"amount"`
+	Balance  string `json:"balance"`
+	Entry    int64  `json:"entry"`
+	Kind     string `json:"kind"`
+	Memo     string `json:"memo"`
+	PostedAt string `json:"postedAt"`
+}
+
+type statementJSON struct {
+	Closing   string             `json:"closing"`
+	Currency  string             `json:"currency"`
+	From      string             `json:"from"`
+	Guest     statementGuestJSON `json:"guest"`
+	Movements []movementJSON     `json:"movements"`
+	Opening   string             `json:"opening"`
+	To        string             `json:"to"`
+}
+
+// As a JSON object. Amounts are decimal strings so nothing's lost to floats
+func (s statement) WriteJSON(w io.Writer) error {
+	v := statementJSON{
+		Closing:  s.Money(s.Closing).Decimal(),
+		Currency: string(s.Currency),
+		From:     s.From.Format(date.ISO8601),
+		Guest: statementGuestJSON{
+			Email: s.Guest.Email.String(),
+			Id:    int64(s.Guest.Id),
+			Name:  s.Guest.Name.String(),
+		},
+		Movements: []movementJSON{},
+		Opening:   s.Money(s.Opening).Decimal(),
+		To:        s.To.Format(date.ISO8601),
+	}
+	for _, m := range s.Movements {
+		v.Movements = append(v.Movements, movementJSON{
+			Amount:   s.Money(m.Amount).Decimal(),
+			Balance:  s.Money(m.Balance).Decimal(),
+			Entry:    m.EntryId,
+			Kind:     string(m.Kind),
+			Memo:     string(m.Memo),
+			PostedAt: m.PostedAt.Format(time.RFC3339),
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,217 @@
+package booking
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+// A guest who stays, pays by card, is credited some for their trouble and
+// has it refunded to the card, a day at a time from January 1, 2015
+func testStatementGuest(t *testing.T, clock *Clock, l *Ledger, g *FakeGateway) guestId {
+	n, _ := newName("a b")
+	e, _ := newEmail("a@b")
+	p, _ := newPhoneNumber("555-123-4567")
+	id, err := l.Guestbook.Register(n, e, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Set(time.Date(2015, 1, 1, 12, 0, 0, 0, time.UTC))
+	err = l.Debit(id, amount(40000), memo("bookingId:1 stay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(date.Day)
+	charged, err := l.Charge(id, bookingId(1), amount(40000), testCard(t, g, fakeCardApproved), memo("bookingId:1 paid by card"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(date.Day)
+	err = l.Credit(id, amount(5000), memo("bookingId:1 goodwill"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(date.Day)
+	_, err = l.RefundPayment(charged.Id, amount(5000), refundMemo(bookingId(1), "noisy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestLedgerStatement(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var clock Clock
+	var gateway FakeGateway
+	var ledger Ledger
+	err := inject.Populate(db, &clock, &gateway, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+	id := testStatementGuest(t, &clock, &ledger, &gateway)
+
+	var tests = []struct {
+		from, to date.Date
+		opening  amount
+		kinds    []movementKind
+		balances []amount
+		closing  amount
+	}{
+		{
+			date.New(2015, 1, 1), date.New(2015, 1, 4),
+			0,
+			[]movementKind{chargeMovement, paymentMovement, adjustmentMovement, refundMovement},
+			[]amount{40000, 0, -5000, 0},
+			0,
+		},
+		{
+			date.New(2015, 1, 2), date.New(2015, 1, 3),
+			40000,
+			[]movementKind{paymentMovement, adjustmentMovement},
+			[]amount{0, -5000},
+			-5000,
+		},
+		{
+			date.New(2015, 2, 1), date.New(2015, 2, 1),
+			0,
+			nil,
+			nil,
+			0,
+		},
+	}
+	for _, test := range tests {
+		s, err := ledger.Statement(id, test.from, test.to)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var kinds []movementKind
+		var balances []amount
+		for _, m := range s.Movements {
+			kinds = append(kinds, m.Kind)
+			balances = append(balances, m.Balance)
+		}
+		if s.Opening != test.opening || s.Closing != test.closing ||
+			!equalKinds(kinds, test.kinds) || !equalAmounts(balances, test.balances) {
+			t.Error(test.from, test.to, "want", test.opening, test.kinds, test.balances, test.closing)
+			t.Error(test.from, test.to, "got ", s.Opening, kinds, balances, s.Closing)
+		}
+	}
+
+	_, err = ledger.Statement(id, date.New(2015, 1, 2), date.New(2015, 1, 1))
+	if err != invalidStatementRange {
+		t.Error("want", invalidStatementRange)
+		t.Error("got ", err)
+	}
+	_, err = ledger.Statement(guestId(99), date.New(2015, 1, 1), date.New(2015, 1, 1))
+	if err != guestNotFound {
+		t.Error("want", guestNotFound)
+		t.Error("got ", err)
+	}
+}
+
+func equalKinds(a, b []movementKind) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func equalAmounts(a, b []amount) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStatementWrite(t *testing.T) {
+	s := statement{
+		Closing:  amount(5000),
+		Currency: defaultCurrency,
+		From:     date.New(2015, 1, 2),
+		Guest:    guest{Id: guestId(1)},
+		Movements: []movement{
+			{
+				Amount:   amount(-40000),
+				Balance:  amount(0),
+				EntryId:  2,
+				Kind:     paymentMovement,
+				Memo:     memo("bookingId:1 paid by card"),
+				PostedAt: time.Date(2015, 1, 2, 12, 0, 0, 0, time.UTC),
+			},
+			{
+				Amount:   amount(5000),
+				Balance:  amount(5000),
+				EntryId:  3,
+				Kind:     refundMovement,
+				Memo:     memo("bookingId:1 refunded to card: noisy, sorry"),
+				PostedAt: time.Date(2015, 1, 3, 12, 0, 0, 0, time.UTC),
+			},
+		},
+		Opening: amount(40000),
+		To:      date.New(2015, 1, 3),
+	}
+
+	var out bytes.Buffer
+	err := s.WriteCSV(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Join([]string{
+		"Date,Entry,Kind,Memo,Amount,Balance",
+		"2015-01-02,,opening,Opening balance,,400.00",
+		"2015-01-02 12:00:00,2,payment,bookingId:1 paid by card,-400.00,0.00",
+		`2015-01-03 12:00:00,3,refund,"bookingId:1 refunded to card: noisy, sorry",50.00,50.00`,
+		"2015-01-03,,closing,Closing balance,,50.00",
+		"",
+	}, "\n")
+	if got := out.String(); got != want {
+		t.Error("want", want)
+		t.Error("got ", got)
+	}
+
+	out.Reset()
+	err = s.WriteJSON(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range []string{
+		`"closing": "50.00"`,
+		`"currency": "USD"`,
+		`"from": "2015-01-02"`,
+		`"id": 1`,
+		`"opening": "400.00"`,
+		`"amount": "-400.00"`,
+		`"kind": "refund"`,
+		`"postedAt": "2015-01-03T12:00:00Z"`,
+	} {
+		if !strings.Contains(out.String(), w) {
+			t.Error("want", w)
+			t.Error("got ", out.String())
+		}
+	}
+
+	// no movements -> an empty list, not null
+	s.Movements = nil
+	out.Reset()
+	s.WriteJSON(&out)
+	if !strings.Contains(out.String(), `"movements": []`) {
+		t.Error("want", `"movements": []`)
+		t.Error("got ", out.String())
+	}
+}
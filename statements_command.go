@@ -0,0 +1,61 @@
+package booking
+
+import (
+	"errors"
+	"flag"
+	"io"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+)
+
+const statementsUsage = `usage:
+  statements csv -guest ID -from DATE [-to DATE]
+  statements json -guest ID -from DATE [-to DATE]`
+
+var unknownStatementsCommand = errors.New(statementsUsage)
+
+// Writes a guest's statement from the command line to out as CSV or JSON.
+// It runs to today unless told otherwise
+func StatementsCommand(l *Ledger, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return unknownStatementsCommand
+	}
+
+	flags := flag.NewFlagSet("statements "+args[0], flag.ContinueOnError)
+	flags.SetOutput(out)
+	flagGuest := flags.Int64("guest", 0, "the guest's id")
+	flagFrom := flags.String("from", "", "first day, e.g. 2015-01-01")
+	flagTo := flags.String("to", "", "last day, e.g. 2015-01-31")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	var write func(statement, io.Writer) error
+	switch args[0] {
+	default:
+		return unknownStatementsCommand
+	case "csv":
+		write = statement.WriteCSV
+	case "json":
+		write = statement.WriteJSON
+	}
+
+	from, err := date.Parse(*flagFrom)
+	if err != nil {
+		return err
+	}
+	to, _ := date.Parse(l.Clock.Now().UTC())
+	if *flagTo != "" {
+		to, err = date.Parse(*flagTo)
+		if err != nil {
+			return err
+		}
+	}
+
+	s, err := l.Statement(guestId(*flagGuest), from, to)
+	if err != nil {
+		return err
+	}
+	return write(s, out)
+}
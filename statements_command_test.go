@@ -0,0 +1,83 @@
+package booking
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestStatementsCommand(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var clock Clock
+	var gateway FakeGateway
+	var ledger Ledger
+	err := inject.Populate(db, &clock, &gateway, &ledger)
+	if err != nil {
+		t.Error(err)
+	}
+	id := testStatementGuest(t, &clock, &ledger, &gateway)
+	guest := fmt.Sprint(int64(id))
+
+	var out bytes.Buffer
+	err = StatementsCommand(&ledger, nil, &out)
+	if err != unknownStatementsCommand {
+		t.Error("want", unknownStatementsCommand)
+		t.Error("got ", err)
+	}
+
+	var tests = []struct {
+		args []string
+		err  error
+		want []string
+	}{
+		{
+			[]string{"csv", "-guest", guest, "-from", "2015-01-02", "-to", "2015-01-03"},
+			nil,
+			[]string{
+				"2015-01-02,,opening,Opening balance,,400.00\n",
+				",payment,bookingId:1 paid by card,-400.00,0.00\n",
+				"2015-01-03,,closing,Closing balance,,-50.00\n",
+			},
+		},
+		{
+			// runs to today
+			[]string{"json", "-guest", guest, "-from", "1/1/2015"},
+			nil,
+			[]string{`"to": "2015-01-04"`, `"closing": "0.00"`, `"kind": "refund"`},
+		},
+		{
+			[]string{"csv", "-guest", guest, "-from", "someday"},
+			date.ParseError,
+			nil,
+		},
+		{
+			[]string{"csv", "-guest", "99", "-from", "2015-01-01"},
+			guestNotFound,
+			nil,
+		},
+		{
+			[]string{"xml", "-guest", guest, "-from", "2015-01-01"},
+			unknownStatementsCommand,
+			nil,
+		},
+	}
+	for _, test := range tests {
+		out.Reset()
+		err := StatementsCommand(&ledger, test.args, &out)
+		if err != test.err {
+			t.Error(test.args, "want", test.err)
+			t.Error(test.args, "got ", err)
+		}
+		for _, s := range test.want {
+			if !strings.Contains(out.String(), s) {
+				t.Error(test.args, "want", s)
+				t.Error(test.args, "got ", out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Where a booking is in its lifecycle
+type status string
+
+const (
+	confirmed = status("confirmed")
+	checkedIn = status("checked-in")
+	completed = status("completed")
+	noShow    = status("no-show")
+	cancelled = status("cancelled")
+)
+
+// Allowed moves from each status. Cancelled back to confirmed is a
+// reinstatement and only allowed while the nights are still free
+var transitions = map[status][]status{
+	confirmed: []status{checkedIn, noShow, cancelled},
+	checkedIn: []status{completed},
+	cancelled: []status{confirmed},
+}
+
+func (s status) CanBecome(to status) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Dates and rate may only change before the guest has left or given up
+func (s status) Modifiable() bool {
+	return s == confirmed || s == checkedIn
+}
+
+// Who made a change, e.g. "guest", "admin:brandon" or "system"
+type actor string
+
+type transitionError struct {
+	From status
+	To   status
+}
+
+var cancelWithCancel = errors.New("bookings are cancelled with Cancel")
+
+func (e transitionError) Error() string {
+	if e.From == e.To {
+		return fmt.Sprintf("can't change a %s booking", e.From)
+	}
+	return fmt.Sprintf("can't go from %s to %s", e.From, e.To)
+}
+
+// Every change of status, with when and by whom
+const RegisterStatusLogSchema = `
+  CREATE TABLE RegisterStatusLog (
+    Actor TEXT NOT NULL,
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    ChangedAt DATETIME NOT NULL,
+    FromStatus TEXT NOT NULL,
+    ToStatus TEXT NOT NULL
+  )
+`
+
+var registerStatusMigration = statements(
+	`ALTER TABLE Register ADD COLUMN Status TEXT NOT NULL DEFAULT 'confirmed'`,
+	`ALTER TABLE RegisterHistory
+    ADD COLUMN Status TEXT NOT NULL DEFAULT 'confirmed'`,
+	`CREATE TABLE RegisterStatusLog (
+    Actor TEXT NOT NULL,
+    BookingId INTEGER NOT NULL REFERENCES Register(Id),
+    ChangedAt DATETIME NOT NULL,
+    FromStatus TEXT NOT NULL,
+    ToStatus TEXT NOT NULL
+  )`,
+)
+
+// A row in RegisterStatusLog
+type statusChange struct {
+	Actor     actor
+	BookingId bookingId
+	ChangedAt time.Time
+	From      status
+	To        status
+}
+
+// Checks a booking in or out, or marks it a no-show. Cancelling refunds and
+// records why, so goes through Cancel instead
+func (r *Register) Transition(id bookingId, to status, by actor) error {
+	tx, err := r.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	err = r.TransitionTx(tx, id, to, by)
+	if err != nil {
+		tx.Rollback()
+		glog.Error(err)
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	return nil
+}
+
+// Move a booking to a new status, other than cancelled, and log it - caller
+// is responsible for Commit/Rollback
+func (r *Register) TransitionTx(
+	tx *sql.Tx,
+	id bookingId,
+	to status,
+	by actor,
+) error {
+	if to == cancelled {
+		return cancelWithCancel
+	}
+	return r.transitionTx(tx, id, to, by)
+}
+
+// Moves a booking to any status it can become, including cancelled for
+// CancelTx - caller is responsible for Commit/Rollback
+func (r *Register) transitionTx(
+	tx *sql.Tx,
+	id bookingId,
+	to status,
+	by actor,
+) error {
+	b, err := lookupBooking(tx, id)
+	if err != nil {
+		return err
+	}
+
+	if !b.Status.CanBecome(to) {
+		return transitionError{b.Status, to}
+	}
+
+	// a cancelled booking gave up its nights, so take them back
+	if b.Status == cancelled {
+		err = r.checkStay(tx, b.Checkin, b.Checkout, id, "", "")
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`update Register set Status = $1 where Id = $2`, to, id)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	_, err = tx.Exec(`
+      insert into RegisterStatusLog
+      (Actor, BookingId, ChangedAt, FromStatus, ToStatus)
+      values ($1, $2, $3, $4, $5)
+    `,
+		by,
+		id,
+		r.Clock.Now(),
+		b.Status,
+		to,
+	)
+	if err != nil {
+		glog.Error(err)
+		return err
+	}
+
+	glog.Infoln(by, "moved", id, "from", b.Status, "to", to)
+	return nil
+}
+
+// Status changes of a booking, oldest first
+func (r *Register) StatusLog(id bookingId) ([]statusChange, error) {
+	rows, err := r.DB.Query(`
+    select Actor, BookingId, ChangedAt, FromStatus, ToStatus
+    from RegisterStatusLog
+    where BookingId = $1
+    order by rowid asc
+  `, id)
+	if err != nil {
+		glog.Error(err)
+		return []statusChange{}, err
+	}
+	defer rows.Close()
+
+	var list []statusChange
+	for rows.Next() {
+		var c statusChange
+		err := rows.Scan(&c.Actor, &c.BookingId, &c.ChangedAt, &c.From, &c.To)
+		if err != nil {
+			glog.Error(err)
+			return []statusChange{}, err
+		}
+		c.ChangedAt = c.ChangedAt.UTC()
+		list = append(list, c)
+	}
+
+	return list, nil
+}
@@ -0,0 +1,198 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestStatusCanBecome(t *testing.T) {
+	var tests = []struct {
+		from status
+		to   status
+		ok   bool
+	}{
+		{confirmed, checkedIn, true},
+		{confirmed, noShow, true},
+		{confirmed, cancelled, true},
+		{confirmed, completed, false},
+		{checkedIn, completed, true},
+		{checkedIn, cancelled, false},
+		{cancelled, confirmed, true},
+		{cancelled, checkedIn, false},
+		{completed, cancelled, false},
+		{noShow, confirmed, false},
+	}
+
+	for _, tt := range tests {
+		if ok := tt.from.CanBecome(tt.to); ok != tt.ok {
+			t.Log(tt.from, "->", tt.to)
+			t.Error("want", tt.ok)
+			t.Error("got ", ok)
+		}
+	}
+}
+
+func TestRegisterLifecycle(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var clock Clock
+	var register Register
+	err := inject.Populate(&FakeGateway{}, &calendar, &clock, db, &register)
+	if err != nil {
+		t.Error(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		calendar.Add(date.New(2015, 1, 1).Add(i))
+	}
+	now := time.Date(2014, 12, 1, 9, 0, 0, 0, time.UTC)
+	clock.Set(now)
+
+	id, err := register.Book(
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 5),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancel frees the nights for someone else
+	err = register.Cancel(id, actor("guest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := register.Book(
+		date.New(2015, 1, 4),
+		date.New(2015, 1, 6),
+		guestId(2),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// cancelled -> can't be modified
+	_, err = register.Modify(
+		id,
+		date.New(2015, 1, 2),
+		date.New(2015, 1, 3),
+		withBunny,
+		1,
+	)
+	if err != (transitionError{cancelled, cancelled}) {
+		t.Error("want", transitionError{cancelled, cancelled})
+		t.Error("got ", err)
+	}
+
+	// reinstate -> nights taken
+	err = register.Reinstate(id, actor("admin"))
+	if err != (ConflictError{other}) {
+		t.Error("want", ConflictError{other})
+		t.Error("got ", err)
+	}
+
+	// reinstate -> ok once they're free again
+	clock.Advance(time.Hour)
+	err = register.Cancel(other, actor("guest"))
+	if err != nil {
+		t.Error(err)
+	}
+	clock.Advance(time.Hour)
+	err = register.Reinstate(id, actor("admin"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// cancelling has to go through Cancel
+	err = register.Transition(id, cancelled, actor("admin"))
+	if err != cancelWithCancel {
+		t.Error("want", cancelWithCancel)
+		t.Error("got ", err)
+	}
+
+	// confirmed -> completed is not allowed
+	err = register.Transition(id, completed, actor("admin"))
+	if err != (transitionError{confirmed, completed}) {
+		t.Error("want", transitionError{confirmed, completed})
+		t.Error("got ", err)
+	}
+
+	// check in, complete
+	clock.Advance(time.Hour)
+	err = register.Transition(id, checkedIn, actor("admin"))
+	if err != nil {
+		t.Error(err)
+	}
+	err = register.Transition(id, completed, actor("system"))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// unknown booking
+	err = register.Cancel(bookingId(99), actor("guest"))
+	if err != bookingNotFound {
+		t.Error("want", bookingNotFound)
+		t.Error("got ", err)
+	}
+
+	// lookup and list by status
+	found, err := register.Lookup(id)
+	if err != nil {
+		t.Error(err)
+	}
+	if found.Status != completed {
+		t.Error("want", completed)
+		t.Error("got ", found.Status)
+	}
+
+	var listTests = []struct {
+		statuses []status
+		ids      []bookingId
+	}{
+		{nil, []bookingId{id, other}},
+		{[]status{completed}, []bookingId{id}},
+		{[]status{cancelled}, []bookingId{other}},
+		{[]status{cancelled, completed}, []bookingId{id, other}},
+		{[]status{confirmed}, nil},
+	}
+	for _, tt := range listTests {
+		list, err := register.List(tt.statuses...)
+		if err != nil {
+			t.Error(err)
+		}
+		var ids []bookingId
+		for _, b := range list {
+			ids = append(ids, b.Id)
+		}
+		if !reflect.DeepEqual(tt.ids, ids) {
+			t.Log(tt.statuses)
+			t.Error("want", tt.ids)
+			t.Error("got ", ids)
+		}
+	}
+
+	// every change logged with time and actor
+	changes, err := register.StatusLog(id)
+	if err != nil {
+		t.Error(err)
+	}
+	want := []statusChange{
+		{actor("guest"), id, now, confirmed, cancelled},
+		{actor("admin"), id, now.Add(2 * time.Hour), cancelled, confirmed},
+		{actor("admin"), id, now.Add(3 * time.Hour), confirmed, checkedIn},
+		{actor("system"), id, now.Add(3 * time.Hour), checkedIn, completed},
+	}
+	if !reflect.DeepEqual(want, changes) {
+		t.Error("want", want)
+		t.Error("got ", changes)
+	}
+}
@@ -0,0 +1,33 @@
+package booking
+
+import "github.com/cmdrkeene/booking/pkg/date"
+
+// A stay is the half-open set of nights [Checkin, Checkout) - the guest
+// sleeps over every night but leaves on the morning of Checkout
+type stay struct {
+	Checkin  date.Date
+	Checkout date.Date
+}
+
+// Number of nights, zero if Checkout isn't after Checkin
+func (s stay) Len() int {
+	if !s.Checkout.After(s.Checkin) {
+		return 0
+	}
+	return s.Checkin.DaysApart(s.Checkout)
+}
+
+// Each night of the stay in order, named by the date the guest arrives
+func (s stay) Nights() []date.Date {
+	var nights []date.Date
+	for i := 0; i < s.Len(); i++ {
+		nights = append(nights, s.Checkin.Add(i))
+	}
+	return nights
+}
+
+// True if both stays share at least one night. Checking out the day
+// another checks in is not an overlap
+func (s stay) Overlaps(o stay) bool {
+	return s.Checkin.Before(o.Checkout) && o.Checkin.Before(s.Checkout)
+}
@@ -0,0 +1,69 @@
+package booking
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+)
+
+func TestStayNights(t *testing.T) {
+	var tests = []struct {
+		stay   stay
+		nights []date.Date
+	}{
+		{stay{date.New(2015, 1, 1), date.New(2015, 1, 1)}, nil},
+		{stay{date.New(2015, 1, 2), date.New(2015, 1, 1)}, nil},
+		{
+			stay{date.New(2015, 1, 1), date.New(2015, 1, 2)},
+			[]date.Date{date.New(2015, 1, 1)},
+		},
+		{
+			stay{date.New(2015, 1, 30), date.New(2015, 2, 2)},
+			[]date.Date{
+				date.New(2015, 1, 30),
+				date.New(2015, 1, 31),
+				date.New(2015, 2, 1),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		nights := tt.stay.Nights()
+		if !reflect.DeepEqual(tt.nights, nights) {
+			t.Error("want", tt.nights)
+			t.Error("got ", nights)
+		}
+		if n := tt.stay.Len(); n != len(tt.nights) {
+			t.Error("want", len(tt.nights))
+			t.Error("got ", n)
+		}
+	}
+}
+
+func TestStayOverlaps(t *testing.T) {
+	a := stay{date.New(2015, 1, 3), date.New(2015, 1, 6)}
+	var tests = []struct {
+		b  stay
+		ok bool
+	}{
+		{stay{date.New(2015, 1, 1), date.New(2015, 1, 3)}, false},
+		{stay{date.New(2015, 1, 1), date.New(2015, 1, 4)}, true},
+		{stay{date.New(2015, 1, 4), date.New(2015, 1, 5)}, true},
+		{stay{date.New(2015, 1, 5), date.New(2015, 1, 9)}, true},
+		{stay{date.New(2015, 1, 6), date.New(2015, 1, 9)}, false},
+	}
+
+	for _, tt := range tests {
+		if ok := a.Overlaps(tt.b); ok != tt.ok {
+			t.Log(a, tt.b)
+			t.Error("want", tt.ok)
+			t.Error("got ", ok)
+		}
+		if ok := tt.b.Overlaps(a); ok != tt.ok {
+			t.Log(tt.b, a)
+			t.Error("want", tt.ok)
+			t.Error("got ", ok)
+		}
+	}
+}
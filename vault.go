@@ -0,0 +1,279 @@
+package booking
+
+import (
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Stands in for a card, so only the vault and the gateway ever see its
+// number
+type cardToken string
+
+// Keeps cards and hands out tokens for them. Cards are kept until they're
+// forgotten, so TokenizedBefore lists them for Cards to clear out, and Has
+// finds those a vault has lost
+type CardVault interface {
+	Tokenize(card creditCard) (cardToken, error)
+	TokenizedBefore(t time.Time) ([]cardToken, error)
+	Has(token cardToken) (bool, error)
+	Forget(token cardToken) error
+}
+
+var cardTokenNotFound = errors.New("card not found in vault")
+
+// A vault in memory, for development and tests. Cards don't survive a
+// restart, so balances and deposits still to be taken from them are lost
+// with them, see Cards.FailLost. Clock dates each card
+type LocalVault struct {
+	Clock *Clock `inject:""`
+
+	mu          sync.Mutex
+	cards       map[cardToken]creditCard
+	tokenizedAt map[cardToken]time.Time
+}
+
+func (v *LocalVault) Tokenize(card creditCard) (cardToken, error) {
+	s, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	token := cardToken("card_" + s)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.cards == nil {
+		v.cards = make(map[cardToken]creditCard)
+		v.tokenizedAt = make(map[cardToken]time.Time)
+	}
+	v.cards[token] = card
+	v.tokenizedAt[token] = v.Clock.Now()
+	return token, nil
+}
+
+// Tokens for cards kept since before t
+func (v *LocalVault) TokenizedBefore(t time.Time) ([]cardToken, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var tokens []cardToken
+	for token, at := range v.tokenizedAt {
+		if at.Before(t) {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens, nil
+}
+
+// Whether the card behind a token is still kept
+func (v *LocalVault) Has(token cardToken) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	_, ok := v.cards[token]
+	return ok, nil
+}
+
+// Drops a card, so its token can't be charged again
+func (v *LocalVault) Forget(token cardToken) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.cards[token]; !ok {
+		return cardTokenNotFound
+	}
+	delete(v.cards, token)
+	delete(v.tokenizedAt, token)
+	return nil
+}
+
+// Drops a card's security code once it's been checked. Issuers only want it
+// when the card is first used, and it mustn't be kept after that
+func (v *LocalVault) forgetCVC(token cardToken) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	card, ok := v.cards[token]
+	if !ok {
+		return
+	}
+	card.CVC = ""
+	v.cards[token] = card
+}
+
+// The card behind a token, for a gateway to charge
+func (v *LocalVault) reveal(token cardToken) (creditCard, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	card, ok := v.cards[token]
+	if !ok {
+		return creditCard{}, cardTokenNotFound
+	}
+	return card, nil
+}
+
+// Forgets cards once nothing is going to charge them: no balance is
+// scheduled to them and no damage deposit is to be held on them. A balance
+// abandoned by a cancellation keeps its card, as the booking may be
+// reinstated
+type Cards struct {
+	Clock *Clock    `inject:""`
+	DB    *sql.DB   `inject:""`
+	Vault CardVault `inject:""`
+
+	// How long a new card is kept before it must be used, DefaultCardGrace if
+	// zero. Covers a form being submitted
+	Grace time.Duration
+}
+
+const DefaultCardGrace = time.Hour
+
+func (c *Cards) grace() time.Duration {
+	if c.Grace == 0 {
+		return DefaultCardGrace
+	}
+	return c.Grace
+}
+
+// Forget cards nothing will charge, returning how many there were
+func (c *Cards) ForgetUnused() (int, error) {
+	tokens, err := c.Vault.TokenizedBefore(c.Clock.Now().Add(-c.grace()))
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+
+	stmt, err := c.DB.Prepare(`
+    select
+      exists (
+        select 1 from ScheduledPayment where Card = $1 and Status in ($2, $3)
+      ) or exists (
+        select 1 from DamageDeposit where Card = $1 and Status in ($4, $5)
+      )
+  `)
+	if err != nil {
+		panic(err)
+	}
+	defer stmt.Close()
+
+	n := 0
+	for _, token := range tokens {
+		var used bool
+		err := stmt.QueryRow(
+			token,
+			scheduled,
+			abandoned,
+			depositPending,
+			depositHeld,
+		).Scan(&used)
+		if err != nil {
+			glog.Error(err)
+			return n, err
+		}
+		if used {
+			continue
+		}
+		err = c.Vault.Forget(token)
+		if err != nil {
+			glog.Error(err)
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Gives up on balances and damage deposits whose card the vault no longer
+// has, e.g. a LocalVault after a restart, as nothing can take them. Each is
+// logged for someone to ask the guest for another card. Returns how many
+// there were
+func (c *Cards) FailLost() (int, error) {
+	tx, err := c.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+    select BookingId, Card from ScheduledPayment where Status in ($1, $2)
+    union all
+    select BookingId, Card from DamageDeposit where Status = $3
+  `, scheduled, abandoned, depositPending)
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	lost := make(map[cardToken][]bookingId)
+	for rows.Next() {
+		var id bookingId
+		var token cardToken
+		err := rows.Scan(&id, &token)
+		if err != nil {
+			rows.Close()
+			glog.Error(err)
+			return 0, err
+		}
+		lost[token] = append(lost[token], id)
+	}
+	rows.Close()
+
+	n := 0
+	for token, ids := range lost {
+		has, err := c.Vault.Has(token)
+		if err != nil {
+			glog.Error(err)
+			return 0, err
+		}
+		if has {
+			continue
+		}
+
+		_, err = tx.Exec(`
+      update ScheduledPayment set Status = $1, Error = $2
+      where Card = $3 and Status in ($4, $5)
+    `, uncollectable, cardTokenNotFound.Error(), token, scheduled, abandoned)
+		if err != nil {
+			glog.Error(err)
+			return 0, err
+		}
+		_, err = tx.Exec(`
+      update DamageDeposit set Status = $1, Error = $2
+      where Card = $3 and Status = $4
+    `, depositReleased, cardTokenNotFound.Error(), token, depositPending)
+		if err != nil {
+			glog.Error(err)
+			return 0, err
+		}
+
+		glog.Error("card lost for bookings ", ids, ", ask for another")
+		n += len(ids)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		glog.Error(err)
+		return 0, err
+	}
+	return n, nil
+}
+
+// Forget unused cards every interval until stop is closed. Run it in its own
+// goroutine
+func (c *Cards) Reap(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			n, err := c.ForgetUnused()
+			if err != nil {
+				continue
+			}
+			if n > 0 {
+				glog.Infoln("forgot", n, "unused cards")
+			}
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"github.com/facebookgo/inject"
+)
+
+func TestLocalVault(t *testing.T) {
+	var clock Clock
+	v := LocalVault{Clock: &clock}
+	clock.Set(time.Date(2015, 1, 1, 9, 0, 0, 0, time.UTC))
+	card := creditCard{Brand: visa, CVC: "123", Month: 12, Number: fakeCardApproved, Year: 2099}
+
+	token, err := v.Tokenize(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := v.Tokenize(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token == other {
+		t.Error("want a new token each time")
+		t.Error("got ", token, other)
+	}
+
+	got, err := v.reveal(token)
+	if err != nil {
+		t.Error(err)
+	}
+	if got != card {
+		t.Error("want", card.Number)
+		t.Error("got ", got.Number)
+	}
+
+	if _, err := v.reveal(cardToken("card_unknown")); err != cardTokenNotFound {
+		t.Error("want", cardTokenNotFound)
+		t.Error("got ", err)
+	}
+
+	// TokenizedBefore() -> cards kept since before then
+	clock.Advance(time.Hour)
+	later, err := v.Tokenize(card)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := v.TokenizedBefore(time.Date(2015, 1, 1, 10, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(tokens) != 2 {
+		t.Error("want", token, other)
+		t.Error("got ", tokens)
+	}
+	for _, got := range tokens {
+		if got == later {
+			t.Error("want", later, "left out")
+		}
+	}
+
+	// Forget() -> gone, once
+	if err := v.Forget(token); err != nil {
+		t.Error(err)
+	}
+	if _, err := v.reveal(token); err != cardTokenNotFound {
+		t.Error("want", cardTokenNotFound)
+		t.Error("got ", err)
+	}
+	if err := v.Forget(token); err != cardTokenNotFound {
+		t.Error("want", cardTokenNotFound)
+		t.Error("got ", err)
+	}
+}
+
+func TestFakeGatewayForgetsCVC(t *testing.T) {
+	var g FakeGateway
+	err := inject.Populate(&g)
+	if err != nil {
+		t.Error(err)
+	}
+	token, err := g.Tokenize(creditCard{CVC: "123", Number: fakeCardApproved})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card, _ := g.reveal(token); card.CVC != "123" {
+		t.Fatal("want a CVC until authorized")
+	}
+
+	_, err = g.Authorize(token, usd(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, err := g.reveal(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.CVC != "" || card.Number != fakeCardApproved {
+		t.Error("want the number without the CVC")
+		t.Error("got ", card.Number, card.CVC)
+	}
+
+	// still good for the balance and deposit
+	if _, err := g.Authorize(token, usd(100)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCardsForgetUnused(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cards Cards
+	var clock Clock
+	var gateway FakeGateway
+	err := inject.Populate(db, &cards, &clock, &gateway)
+	if err != nil {
+		t.Error(err)
+	}
+	start := time.Date(2015, 1, 1, 9, 0, 0, 0, time.UTC)
+	clock.Set(start)
+
+	token := func() cardToken {
+		return testCard(t, &gateway, fakeCardApproved)
+	}
+	var (
+		balanceDue  = token()
+		balancePaid = token()
+		abandonedOn = token()
+		depositDue  = token()
+		depositDone = token()
+		paidInFull  = token()
+	)
+	for i, row := range []struct {
+		card   cardToken
+		status scheduleStatus
+	}{
+		{balanceDue, scheduled},
+		{balancePaid, collected},
+		{abandonedOn, abandoned},
+	} {
+		_, err := db.Exec(`
+      insert into ScheduledPayment
+      (Amount, BookingId, Card, DueOn, NextAttemptAt, Status)
+      values (100, $1, $2, $3, $3, $4)
+    `, i+1, row.card, start, row.status)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, row := range []struct {
+		card   cardToken
+		status depositStatus
+	}{
+		{depositDue, depositPending},
+		{depositDone, depositReleased},
+	} {
+		_, err := db.Exec(`
+      insert into DamageDeposit (Amount, BookingId, Card, Status)
+      values (100, $1, $2, $3)
+    `, i+1, row.card, row.status)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ForgetUnused() -> new cards kept while their form is submitted
+	n, err := cards.ForgetUnused()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 0 {
+		t.Error("want 0")
+		t.Error("got ", n)
+	}
+
+	// ForgetUnused() -> cards nothing will charge
+	clock.Advance(DefaultCardGrace + time.Minute)
+	n, err = cards.ForgetUnused()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 3 {
+		t.Error("want 3")
+		t.Error("got ", n)
+	}
+	for _, tt := range []struct {
+		card cardToken
+		kept bool
+	}{
+		{balanceDue, true},
+		{balancePaid, false},
+		{abandonedOn, true},
+		{depositDue, true},
+		{depositDone, false},
+		{paidInFull, false},
+	} {
+		_, err := gateway.reveal(tt.card)
+		if kept := err == nil; kept != tt.kept {
+			t.Error(tt.card, "want kept", tt.kept)
+			t.Error(tt.card, "got ", kept)
+		}
+	}
+}
+
+func TestCardsFailLost(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var cards Cards
+	var gateway FakeGateway
+	err := inject.Populate(db, &cards, &gateway)
+	if err != nil {
+		t.Error(err)
+	}
+	kept := testCard(t, &gateway, fakeCardApproved)
+	lost := cardToken("card_lost")
+
+	now := time.Date(2015, 1, 1, 9, 0, 0, 0, time.UTC)
+	for i, card := range []cardToken{kept, lost} {
+		_, err := db.Exec(`
+      insert into ScheduledPayment
+      (Amount, BookingId, Card, DueOn, NextAttemptAt)
+      values (100, $1, $2, $3, $3)
+    `, i+1, card, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = db.Exec(`
+      insert into DamageDeposit (Amount, BookingId, Card) values (100, $1, $2)
+    `, i+1, card)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// FailLost() -> the lost card's balance and deposit given up on
+	n, err := cards.FailLost()
+	if err != nil {
+		t.Error(err)
+	}
+	if n != 2 {
+		t.Error("want 2")
+		t.Error("got ", n)
+	}
+	for i, want := range []struct {
+		balance scheduleStatus
+		deposit depositStatus
+	}{
+		{scheduled, depositPending},
+		{uncollectable, depositReleased},
+	} {
+		var balance scheduleStatus
+		var deposit depositStatus
+		db.QueryRow(
+			`select Status from ScheduledPayment where BookingId = $1`,
+			i+1,
+		).Scan(&balance)
+		db.QueryRow(
+			`select Status from DamageDeposit where BookingId = $1`,
+			i+1,
+		).Scan(&deposit)
+		if balance != want.balance || deposit != want.deposit {
+			t.Error(i, "want", want.balance, want.deposit)
+			t.Error(i, "got ", balance, deposit)
+		}
+	}
+}
@@ -3,8 +3,9 @@ package booking
 import (
 	"bytes"
 	"html/template"
-
+	"io"
 	"net/http"
+	"net/url"
 
 	"github.com/golang/glog"
 )
@@ -12,17 +13,150 @@ import (
 // Handle HTTP interaction with Form
 type Handler struct {
 	FormBuilder *FormBuilder `inject:""`
+	Invoices    *Invoices    `inject:""`
+	Register    *Register    `inject:""`
 }
 
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", h.index)
 	mux.HandleFunc("/confirmation", h.confirmation)
+	mux.HandleFunc("/hold", h.hold)
+	mux.HandleFunc("/invoice", h.invoice)
+	mux.HandleFunc("/quote", h.quote)
 	mux.ServeHTTP(w, r)
 }
 
 func (h *Handler) confirmation(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte("Booking Confirmed!"))
+	b, err := h.Register.LookupByCode(r.FormValue("code"))
+	if err == bookingNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q, err := h.Register.Pricing.Lookup(b.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	refunds, err := h.Register.Ledger.Refunds(b.Id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var balance *scheduledPayment
+	s, err := h.Register.Ledger.Scheduled(b.Id)
+	switch err {
+	case nil:
+		if s.Status == scheduled {
+			balance = &s
+		}
+	case notScheduled:
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	render(w, templateConfirmation, receipt{b, q, refunds, balance})
+}
+
+// A booking, what was charged for it, what's still to pay and what's been
+// given back
+type receipt struct {
+	booking
+	Quote   quote
+	Refunds []paymentRefund
+	Balance *scheduledPayment
+}
+
+func (h *Handler) hold(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(
+			w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	form := h.FormBuilder.Build()
+	form.Hold(r)
+	render(w, templateForm, form)
+}
+
+// The booking's last invoice as html or, with format=text, plain text.
+// Posting brings it up to date first, issuing a new one if the booking's
+// changed
+func (h *Handler) invoice(w http.ResponseWriter, r *http.Request) {
+	b, err := h.Register.LookupByCode(r.FormValue("code"))
+	if err == bookingNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method == "POST" {
+		_, err := h.Invoices.Issue(b.Id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(
+			w,
+			r,
+			"/invoice?code="+url.QueryEscape(string(b.Code)),
+			http.StatusSeeOther,
+		)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(
+			w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	i, err := h.Invoices.Last(b.Id)
+	if err == invoiceNotFound {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, i.Text())
+		return
+	}
+	render(w, templateInvoice, i)
+}
+
+func (h *Handler) quote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(
+			w,
+			http.StatusText(http.StatusMethodNotAllowed),
+			http.StatusMethodNotAllowed,
+		)
+		return
+	}
+
+	form := h.FormBuilder.Build()
+	form.Estimate(r)
+	render(w, templateForm, form)
 }
 
 func (h *Handler) index(w http.ResponseWriter, r *http.Request) {
@@ -32,12 +166,22 @@ func (h *Handler) index(w http.ResponseWriter, r *http.Request) {
 	case "GET":
 		render(w, templateForm, form)
 	case "POST":
-		_, ok := form.Submit(r)
+		id, ok := form.Submit(r)
 		if !ok {
 			render(w, templateForm, form)
 			return
 		}
-		http.Redirect(w, r, "/confirmation", http.StatusSeeOther)
+		b, err := h.Register.Lookup(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(
+			w,
+			r,
+			"/confirmation?code="+url.QueryEscape(string(b.Code)),
+			http.StatusSeeOther,
+		)
 	default:
 		http.Error(
 			w,
@@ -1,5 +1,177 @@
 package booking
 
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/cmdrkeene/booking/pkg/date"
+	"github.com/facebookgo/inject"
+)
+
+func TestHandlerConfirmation(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var gateway FakeGateway
+	var handler Handler
+	var register Register
+	err := inject.Populate(&gateway, db, &calendar, &handler, &register)
+	if err != nil {
+		t.Error(err)
+	}
+	calendar.Add(date.New(2015, 1, 1))
+	id, err := register.Book(
+		date.New(2015, 1, 1),
+		date.New(2015, 1, 2),
+		guestId(1),
+		withBunny,
+		1,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := register.Lookup(id)
+
+	// unknown code -> 404
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/confirmation?code=NOPE2345", nil)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error("want", http.StatusNotFound)
+		t.Error("got ", w.Code)
+	}
+
+	// known code -> shows it with the dates
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/confirmation?code="+string(b.Code), nil)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Error("want", http.StatusOK)
+		t.Error("got ", w.Code)
+	}
+	body := w.Body.String()
+	// with a receipt
+	want := []string{string(b.Code), "January 1, 2015", "Receipt", "$200.00"}
+	for _, s := range want {
+		if !strings.Contains(body, s) {
+			t.Error("want", s)
+			t.Error("got ", body)
+		}
+	}
+	if strings.Contains(body, "Refunds") {
+		t.Error("want no refunds")
+	}
+
+	// refunded -> shows the refund
+	p, err := register.Ledger.Charge(
+		guestId(1),
+		id,
+		amount(20000),
+		testCard(t, &gateway, fakeCardApproved),
+		memo("paid"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = register.Ledger.RefundPayment(p.Id, amount(7500), refundMemo(id, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	body = w.Body.String()
+	for _, s := range []string{"Refunds", "Refunded to your card", "$75.00"} {
+		if !strings.Contains(body, s) {
+			t.Error("want", s)
+			t.Error("got ", body)
+		}
+	}
+}
+
+func TestHandlerInvoice(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	var calendar Calendar
+	var gateway FakeGateway
+	var handler Handler
+	err := inject.Populate(&gateway, db, &calendar, &handler)
+	if err != nil {
+		t.Error(err)
+	}
+	calendar.Add(date.New(2015, 1, 1), date.New(2015, 1, 2))
+	form := handler.FormBuilder.Build()
+	id, ok := form.Submit(postForm(validFormValues()))
+	if !ok {
+		t.Fatal(form.Errors)
+	}
+	b, _ := handler.Register.Lookup(id)
+
+	// unknown code -> 404
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/invoice?code=NOPE2345", nil)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error("want", http.StatusNotFound)
+		t.Error("got ", w.Code)
+	}
+
+	// nothing issued yet -> 404, and viewing doesn't issue one
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/invoice?code="+string(b.Code), nil)
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Error("want", http.StatusNotFound)
+		t.Error("got ", w.Code)
+	}
+
+	// POST -> issued, then shown
+	w = httptest.NewRecorder()
+	r = postForm(url.Values{"code": {string(b.Code)}})
+	r.URL.Path = "/invoice"
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Error("want", http.StatusSeeOther)
+		t.Error("got ", w.Code)
+	}
+	if got := w.Header().Get("Location"); got != "/invoice?code="+string(b.Code) {
+		t.Error("want", "/invoice?code="+string(b.Code))
+		t.Error("got ", got)
+	}
+
+	// GET -> the one issued, as html or text
+	for _, test := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"<h3>Invoice 000001</h3>", "a b &lt;a@b&gt;", "Balance due"}},
+		{"&format=text", []string{"Invoice 000001\n", "Bill to a b <a@b>", "Paid by card"}},
+	} {
+		w = httptest.NewRecorder()
+		r, _ = http.NewRequest("GET", "/invoice?code="+string(b.Code)+test.query, nil)
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Error("want", http.StatusOK)
+			t.Error("got ", w.Code)
+		}
+		body := w.Body.String()
+		for _, s := range test.want {
+			if !strings.Contains(body, s) {
+				t.Error("want", s)
+				t.Error("got ", body)
+			}
+		}
+	}
+	var issued int
+	db.QueryRow(`select count(*) from Invoice`).Scan(&issued)
+	if issued != 1 {
+		t.Error("want", 1)
+		t.Error("got ", issued)
+	}
+}
+
 // func xTestHandler(t *testing.T) {
 // 	db := testDB()
 // 	defer db.Close()